@@ -15,23 +15,202 @@
         }
         return "";
     }
+    var waitingForRefresh = null;
+    function refreshSession(retry) {
+        // The refresh token travels in an HttpOnly cookie, and the new app
+        // token comes back in the auth cookie. Without a session to refresh
+        // the user has to log in again. Requests refused while a refresh is
+        // under way wait for it rather than spending the same token again.
+        if (waitingForRefresh) {
+            waitingForRefresh.push(retry);
+            return;
+        }
+        waitingForRefresh = [retry];
+        $.ajax({
+            type: 'POST',
+            url: '/v1/auth/refresh',
+            success: function() {
+                var waiting = waitingForRefresh;
+                waitingForRefresh = null;
+                $.each(waiting, function(i, callback) {
+                    callback();
+                });
+            },
+            error: function() {
+                window.location.href = '/login';
+            },
+        });
+    }
+    function apiRequest(options) {
+        // App tokens are short lived, so a request refused as unauthorized
+        // is retried once with a refreshed token
+        var send = function(canRetry) {
+            var request = $.extend({}, options, {
+                headers: $.extend({}, options.headers, {'Authorization': getCookie('auth')}),
+                error: function(xhr, ajaxOptions, thrownError) {
+                    if (xhr.status == 401 && canRetry) {
+                        refreshSession(function() { send(false); });
+                    } else if (options.error) {
+                        options.error(xhr, ajaxOptions, thrownError);
+                    }
+                },
+            });
+            $.ajax(request);
+        };
+        send(true);
+    }
     function clearTextAreas() {
-        $('#authority').val('')
         $('#commonName').val('')
         $('#owner').val('')
         $('#validityStart').val('')
         $('#validityEnd').val('')
+        $('#csr').val('')
     }
    function emptyInputs() {
+        // With a CSR the common name comes from the CSR itself, and a
+        // profile with a default validity fills in the dates
         var vals = [$('#authority').val(),
-                    $('#commonName').val(),
-                    $('#owner').val(),
-                    $('#validityStart').val(),
-                    $('#validityEnd').val()]
+                    $('#csr').val() || $('#commonName').val(),
+                    $('#owner').val()];
+        if (!$('#profile option:selected').data('defaultValidity')) {
+            vals.push($('#validityEnd').val());
+        }
         return jQuery.grep(vals, function(n) {
             return n == '';
         }).length > 0;
     }
+    function describeAuthority() {
+        var selected = $('#authority option:selected');
+        var text = selected.data('description') || '';
+        if (selected.data('maxValidity')) {
+            text += ' Certificates cannot be valid past ' + selected.data('maxValidity') + '.';
+        }
+        if (selected.data('csrOnly')) {
+            text += ' This authority only signs CSRs; paste one below.';
+        }
+        $('#authority-description').text(text);
+    }
+    function loadAuthorities() {
+        apiRequest({
+            type: 'GET',
+            url: '/v1/authorities',
+            dataType: 'json',
+            success: function(data) {
+                var select = $('#authority');
+                select.empty();
+                if (data.items.length == 0) {
+                    select.append($('<option>', {value: '', text: 'No authorities available to your group'}));
+                    return;
+                }
+                select.append($('<option>', {value: '', text: 'Select an authority'}));
+                $.each(data.items, function(i, authority) {
+                    var option = $('<option>', {value: authority.name, text: authority.name});
+                    option.data('description', authority.description);
+                    option.data('maxValidity', authority.maxValidity);
+                    option.data('csrOnly', authority.csrOnly);
+                    select.append(option);
+                });
+                describeAuthority();
+            },
+            error: function(xhr, ajaxOptions, thrownError) {
+                $('#authority').html($('<option>', {value: '', text: 'Unable to load authorities'}));
+                console.log(xhr.responseText);
+            },
+        });
+    }
+    function errorMessage(text) {
+        // Errors come back as JSON, with a message per invalid field and an
+        // id to quote when asking for help
+        try {
+            var body = JSON.parse(text);
+            var lines = [body.message];
+            $.each(body.fields || {}, function(field, problem) {
+                lines.push(field + ' ' + problem);
+            });
+            if (body.request_id) {
+                lines.push('(request id ' + body.request_id + ')');
+            }
+            return lines.join('\n');
+        } catch (e) {
+            return text;
+        }
+    }
+    function describeProfile() {
+        var selected = $('#profile option:selected');
+        var text = selected.data('description') || '';
+        if (selected.data('defaultValidity')) {
+            text += ' Valid for ' + selected.data('defaultValidity') + ' unless you pick dates.';
+        }
+        if (selected.data('maxValidity')) {
+            text += ' At most ' + selected.data('maxValidity') + '.';
+        }
+        $('#profile-description').text(text);
+    }
+    function loadProfiles() {
+        apiRequest({
+            type: 'GET',
+            url: '/v1/profiles',
+            dataType: 'json',
+            success: function(data) {
+                var select = $('#profile');
+                select.empty();
+                $.each(data.items, function(i, profile) {
+                    var option = $('<option>', {value: profile.name, text: profile.name});
+                    option.data('description', profile.description);
+                    option.data('defaultValidity', profile.defaultValidity);
+                    option.data('maxValidity', profile.maxValidity);
+                    select.append(option);
+                });
+                select.val(data['default']);
+                describeProfile();
+            },
+            error: function(xhr, ajaxOptions, thrownError) {
+                $('#profile').html($('<option>', {value: '', text: 'Default profile'}));
+                console.log(xhr.responseText);
+            },
+        });
+    }
+    function loadDestinations() {
+        apiRequest({
+            type: 'GET',
+            url: '/v1/destinations',
+            dataType: 'json',
+            success: function(data) {
+                var select = $('#destinations');
+                select.empty();
+                $.each(data.items, function(i, destination) {
+                    select.append($('<option>', {value: destination.label,
+                                                 text: destination.label + ' - ' + destination.description}));
+                });
+            },
+            error: function(xhr, ajaxOptions, thrownError) {
+                console.log(xhr.responseText);
+            },
+        });
+    }
+    function makeDestinationPanel(statuses) {
+        if (!statuses || statuses.length == 0) {
+            return;
+        }
+        var panel = $("<div>",
+                      {class: 'panel panel-default'});
+        panel.appendTo($('#certificate-data'));
+        var panelHead = $("<div>",
+                          {class: "panel-heading"});
+        panelHead.appendTo(panel);
+        $("<h3>",
+          {class: 'panel-title',
+           text: 'Destinations'}).appendTo(panelHead);
+        var list = $("<ul>",
+                     {class: 'list-group'});
+        list.appendTo(panel);
+        $.each(statuses, function(i, destination) {
+            $("<li>",
+              {class: destination.status == 'uploaded' ? 'list-group-item list-group-item-success'
+                                                        : 'list-group-item list-group-item-danger',
+               text: destination.label + ': ' + destination.status}).appendTo(list);
+        });
+    }
     function makeCertPanels(dict) {
         var div = $('#certificate-data');
         div.empty();
@@ -69,6 +248,10 @@
                  {text: dict.pubcert});
     pubCertPre.appendTo(pubCertBody);
 
+        if (!dict.privatekey) {
+        makeDestinationPanel(dict.destinations);
+        return;
+    }
         var privKeyPanel = $("<div>",
                              {class: 'panel panel-default'});
         privKeyPanel.appendTo(div);
@@ -85,14 +268,90 @@
     var privKeyPre = $("<pre>",
                  {text: dict.privatekey});
     privKeyPre.appendTo(privKeyBody);
+    makeDestinationPanel(dict.destinations);
+    }
+    function saveBlob(blob, filename) {
+        var link = document.createElement('a');
+        link.href = URL.createObjectURL(blob);
+        link.download = filename;
+        document.body.appendChild(link);
+        link.click();
+        document.body.removeChild(link);
+        URL.revokeObjectURL(link.href);
+    }
+    // A retry of the same request reuses its Idempotency-Key so that the
+    // service hands back the certificate it already issued
+    var pendingRequest = null;
+    function idempotencyKey(data, format) {
+        var body = JSON.stringify(data) + format;
+        if (pendingRequest == null || pendingRequest.body != body) {
+            pendingRequest = {body: body,
+                              key: Date.now().toString(36) + '-' + Math.random().toString(36).slice(2)};
+        }
+        return pendingRequest.key;
+    }
+    function requestBundle(url, data, format, retried) {
+        // jQuery cannot hand back binary responses, so use XHR directly
+        var xhr = new XMLHttpRequest();
+        xhr.open('POST', url + '?format=' + encodeURIComponent(format));
+        xhr.setRequestHeader('Authorization', getCookie('auth'));
+        xhr.setRequestHeader('Content-Type', 'application/json');
+        xhr.setRequestHeader('X-Bundle-Password', $('#bundlePassword').val());
+        xhr.setRequestHeader('Idempotency-Key', idempotencyKey(data, format));
+        xhr.responseType = 'blob';
+        xhr.onload = function() {
+            if (xhr.status == 401 && !retried) {
+                refreshSession(function() { requestBundle(url, data, format, true); });
+                return;
+            }
+            if (xhr.status != 200) {
+                var reader = new FileReader();
+                reader.onload = function() {
+                    alert(errorMessage(reader.result));
+                };
+                reader.readAsText(xhr.response);
+                return;
+            }
+            var disposition = xhr.getResponseHeader('Content-Disposition') || '';
+            var match = /filename="([^"]+)"/.exec(disposition);
+            saveBlob(xhr.response, match ? match[1] : 'certificate');
+            $('#certificate-data').html($("<div>",
+                                          {class: 'alert alert-success',
+                                           text: 'Certificate issued and downloaded.'}));
+            pendingRequest = null;
+            clearTextAreas();
+        };
+        xhr.send(JSON.stringify(data));
+    }
+    function togglePassword() {
+        var format = $('#bundleFormat').val();
+        $('#bundlePasswordGroup').toggle(format == 'pkcs12' || format == 'jks');
+    }
+    function logout() {
+        $.ajax({
+            type: 'POST',
+            url: '/v1/auth/logout',
+            headers: {'Authorization': getCookie('auth')},
+            complete: function() {
+                window.location.href = '/login';
+            },
+        });
     }
     $(document).ready(function() {
+    $('#logout').click(logout);
+    loadAuthorities();
+    loadProfiles();
+    loadDestinations();
+    $('#authority').change(describeAuthority);
+    $('#profile').change(describeProfile);
+    $('#bundleFormat').change(togglePassword);
+    togglePassword();
     $('#clear').click( function() {
         clearCertPanels()
     });
     $('#submit').click( function(event) {
         if ( emptyInputs() ) {
-            alert('This form requires Authority, CommonName (you), Owner (email), StartDate, EndDate and RBAC Group!');
+            alert('This form requires Authority, CommonName (you), Owner (email), and EndDate unless the profile has a default validity!');
         } else {
         var data = {};
         var verb = 'POST';
@@ -102,19 +361,29 @@
         data['owner']         = $('#owner').val();
         data['validityStart'] = $('#validityStart').val();
         data['validityEnd']   = $('#validityEnd').val();
-        var result = $.ajax({
+        data['destinations']  = $('#destinations').val() || [];
+        data['csr']           = $('#csr').val();
+        data['profile']       = $('#profile').val();
+        data['keyType']       = $('#keyType').val();
+        var format = $('#bundleFormat').val();
+        if (format != 'json') {
+            requestBundle(url, data, format);
+            return;
+        }
+        apiRequest({
             type: verb,
             url: url,
             dataType: 'json',
             data: JSON.stringify(data),
-            headers: {'Authorization': getCookie('auth')},
+            headers: {'Idempotency-Key': idempotencyKey(data, format)},
             success: function(data) {
+            pendingRequest = null;
             makeCertPanels(data);
             clearTextAreas();
             },
             error: function(xhr, ajaxOptions, thrownError) { 
             console.log(xhr.responseText);
-            alert(xhr.responseText);
+            alert(errorMessage(xhr.responseText));
             },
             contentType: 'application/json',
         });
@@ -0,0 +1,193 @@
+(function( $ ) {
+    'use strict';
+    var REVOKE_REASONS = ['unspecified',
+                          'keyCompromise',
+                          'affiliationChanged',
+                          'superseded',
+                          'cessationOfOperation',
+                          'privilegeWithdrawn'];
+    var BUNDLE_FORMATS = ['pem-zip', 'pkcs12', 'jks', 'json'];
+    function getCookie(cname) {
+        var name = cname + "=";
+        var decodedCookie = decodeURIComponent(document.cookie);
+        var ca = decodedCookie.split(';');
+        for(var i = 0; i <ca.length; i++) {
+            var c = ca[i];
+            while (c.charAt(0) == ' ') {
+                c = c.substring(1);
+            }
+            if (c.indexOf(name) == 0) {
+                return c.substring(name.length, c.length);
+            }
+        }
+        return "";
+    }
+    function showAlert(kind, text) {
+        $('#certs-alert').html($("<div>",
+                                 {class: 'alert alert-' + kind,
+                                  text: text}));
+    }
+    function errorMessage(text) {
+        try {
+            var body = JSON.parse(text);
+            return body.message + (body.request_id ? ' (request id ' + body.request_id + ')' : '');
+        } catch (e) {
+            return text;
+        }
+    }
+    function rowClass(status) {
+        switch (status) {
+            case 'expired':
+            case 'revoked':
+                return 'danger';
+            case 'expiring':
+                return 'warning';
+            case 'inactive':
+                return 'active';
+        }
+        return '';
+    }
+    function revokeCert(cert) {
+        var reason = prompt('Revoke certificate ' + cert.id + ' (' + cert.commonName + ')?\n' +
+                            'Reason, one of: ' + REVOKE_REASONS.join(', '),
+                            'unspecified');
+        if (reason === null) {
+            return;
+        }
+        $.ajax({
+            type: 'POST',
+            url: '/v1/certs/' + cert.id + '/revoke',
+            dataType: 'json',
+            data: JSON.stringify({reason: reason}),
+            headers: {'Authorization': getCookie('auth')},
+            contentType: 'application/json',
+            success: function(data) {
+                showAlert('success', 'Certificate ' + cert.id + ' revoked.');
+                loadCerts();
+            },
+            error: function(xhr, ajaxOptions, thrownError) {
+                showAlert('danger', errorMessage(xhr.responseText));
+            },
+        });
+    }
+    function saveBlob(blob, filename) {
+        var link = document.createElement('a');
+        link.href = URL.createObjectURL(blob);
+        link.download = filename;
+        document.body.appendChild(link);
+        link.click();
+        document.body.removeChild(link);
+        URL.revokeObjectURL(link.href);
+    }
+    function downloadCert(cert) {
+        var format = prompt('Download certificate ' + cert.id + ' (' + cert.commonName + ') as:\n' +
+                            BUNDLE_FORMATS.join(', '),
+                            'pem-zip');
+        if (format === null) {
+            return;
+        }
+        var password = '';
+        if (format == 'pkcs12' || format == 'jks') {
+            password = prompt('Password for the ' + format + ' file (at least 6 characters):');
+            if (password === null) {
+                return;
+            }
+        }
+        // jQuery cannot hand back binary responses, so use XHR directly
+        var xhr = new XMLHttpRequest();
+        xhr.open('GET', '/v1/certs/' + cert.id + '/bundle?format=' + encodeURIComponent(format));
+        xhr.setRequestHeader('Authorization', getCookie('auth'));
+        xhr.setRequestHeader('X-Bundle-Password', password);
+        xhr.responseType = 'blob';
+        xhr.onload = function() {
+            if (xhr.status != 200) {
+                var reader = new FileReader();
+                reader.onload = function() {
+                    showAlert('danger', errorMessage(reader.result));
+                };
+                reader.readAsText(xhr.response);
+                return;
+            }
+            var disposition = xhr.getResponseHeader('Content-Disposition') || '';
+            var match = /filename="([^"]+)"/.exec(disposition);
+            saveBlob(xhr.response, match ? match[1] : 'certificate');
+        };
+        xhr.send();
+    }
+    function makeCertRow(cert) {
+        var row = $("<tr>",
+                    {class: rowClass(cert.status)});
+        $("<td>", {text: cert.id}).appendTo(row);
+        $("<td>", {text: cert.commonName}).appendTo(row);
+        $("<td>", {text: cert.authority}).appendTo(row);
+        $("<td>", {text: cert.notBefore}).appendTo(row);
+        $("<td>", {text: cert.notAfter}).appendTo(row);
+        $("<td>", {text: cert.status}).appendTo(row);
+        $("<td>").append($("<code>",
+                           {text: cert.digest.substring(0, 16),
+                            title: cert.digest})).appendTo(row);
+        var actions = $("<td>");
+        actions.appendTo(row);
+        if (cert.status != 'revoked' && cert.status != 'inactive') {
+            var download = $("<button>",
+                             {class: 'btn btn-xs btn-default',
+                              type: 'button',
+                              text: 'Download'});
+            download.click(function() {
+                downloadCert(cert);
+            });
+            download.appendTo(actions);
+            actions.append(' ');
+            var revoke = $("<button>",
+                           {class: 'btn btn-xs btn-danger',
+                            type: 'button',
+                            text: 'Revoke'});
+            revoke.click(function() {
+                revokeCert(cert);
+            });
+            revoke.appendTo(actions);
+        }
+        return row;
+    }
+    function loadCerts() {
+        $.ajax({
+            type: 'GET',
+            url: '/v1/certs',
+            dataType: 'json',
+            headers: {'Authorization': getCookie('auth')},
+            success: function(data) {
+                var body = $('#certs');
+                body.empty();
+                $('#owner').text(data.owner);
+                if (data.items.length == 0) {
+                    body.append($("<tr>").append($("<td>",
+                                                   {colspan: 8,
+                                                    text: 'You have no certificates yet.'})));
+                }
+                $.each(data.items, function(i, cert) {
+                    body.append(makeCertRow(cert));
+                });
+                if (data.truncated) {
+                    showAlert('info', 'Showing the first ' + data.items.length + ' of ' + data.total + ' certificates.');
+                }
+            },
+            error: function(xhr, ajaxOptions, thrownError) {
+                showAlert('danger', errorMessage(xhr.responseText));
+            },
+        });
+    }
+    function logout() {
+        $.ajax({
+            type: 'POST',
+            url: '/v1/auth/logout',
+            headers: {'Authorization': getCookie('auth')},
+            complete: function() {
+                window.location.href = '/login';
+            },
+        });
+    }
+    $(document).ready(function() {
+        loadCerts();
+        $('#logout').click(logout);
+    });
+})( jQuery );
@@ -0,0 +1,99 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "net/http"
+)
+
+// RequestIdHeader carries the id of a request. A caller may send its own id
+// to correlate our logs with its own; otherwise one is generated. Either way
+// it is echoed in the response and in any error body.
+const RequestIdHeader = "X-Request-Id"
+
+// maxRequestIdLength bounds the ids accepted from callers
+const maxRequestIdLength = 64
+
+// Error codes used in APIError bodies. Clients should branch on these rather
+// than on messages, which are meant for people.
+const (
+    CodeBadRequest           = "bad_request"
+    CodeMalformedBody        = "malformed_body"
+    CodeInvalidFields        = "invalid_fields"
+    CodeUnauthorized         = "unauthorized"
+    CodeAuthenticationFailed = "authentication_failed"
+    CodeForbidden            = "forbidden"
+    CodePolicyViolation      = "policy_violation"
+    CodeNotFound             = "not_found"
+    CodeConflict             = "conflict"
+    CodeGone                 = "gone"
+    CodeIdempotencyKeyReused = "idempotency_key_reused"
+    CodeLemurError           = "lemur_error"
+    CodeIdpError             = "idp_error"
+    CodeVerificationFailed   = "verification_failed"
+    CodeInternal             = "internal_error"
+)
+
+// APIError is the body of every error response. Fields maps invalid request
+// fields to what is wrong with them.
+type APIError struct {
+    Code      string            `json:"code"`
+    Message   string            `json:"message"`
+    Fields    map[string]string `json:"fields,omitempty"`
+    RequestId string            `json:"request_id"`
+}
+
+type requestIdKey struct{}
+
+// RequestID decorates a handler so that every request has an id, taken from
+// the X-Request-Id header if the caller sent a usable one
+func RequestID(inner http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get(RequestIdHeader)
+        if len(id) > maxRequestIdLength || !ValidIdempotencyKey(id) {
+            id = newRequestId()
+        }
+        w.Header().Set(RequestIdHeader, id)
+        inner.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id)))
+    })
+}
+
+// RequestIdFrom returns the id RequestID gave a request, or "" if none
+func RequestIdFrom(r *http.Request) string {
+    id, _ := r.Context().Value(requestIdKey{}).(string)
+    return id
+}
+
+func newRequestId() string {
+    id := make([]byte, 16)
+    if _, err := rand.Read(id); err != nil {
+        Logs.Errorf("Unable to generate request id: %+v", err)
+    }
+    return hex.EncodeToString(id)
+}
+
+// writeError answers a request with an APIError
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, format string, args ...interface{}) {
+    writeAPIError(w, status, &APIError{Code: code,
+                                       Message: fmt.Sprintf(format, args...),
+                                       RequestId: RequestIdFrom(r)})
+}
+
+// writeFieldErrors answers a 400 naming each invalid request field, so that
+// clients can show the messages next to the fields
+func writeFieldErrors(w http.ResponseWriter, r *http.Request, message string, fields map[string]string) {
+    writeAPIError(w, http.StatusBadRequest, &APIError{Code: CodeInvalidFields,
+                                                      Message: message,
+                                                      Fields: fields,
+                                                      RequestId: RequestIdFrom(r)})
+}
+
+func writeAPIError(w http.ResponseWriter, status int, body *APIError) {
+    output, _ := json.Marshal(body)
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    w.Write(output)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestRequestID(t *testing.T) {
+    var seen string
+    handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        seen = RequestIdFrom(r)
+    }))
+    recorder := httptest.NewRecorder()
+    handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/ping", nil))
+    if seen == "" || recorder.Header().Get(RequestIdHeader) != seen {
+        t.Errorf("Requests without an id should get one, echoed in the response!")
+    }
+    for id, keep := range map[string]bool{"client-1234": true,
+                                          "bad id\n": false,
+                                          strings.Repeat("a", maxRequestIdLength + 1): false} {
+        request := httptest.NewRequest("GET", "/v1/ping", nil)
+        request.Header.Set(RequestIdHeader, id)
+        handler.ServeHTTP(httptest.NewRecorder(), request)
+        if (seen == id) != keep {
+            t.Errorf("Request id %q kept should be %v!", id, keep)
+        }
+    }
+}
+
+// postCert sends a certificate request to CreateCertHandler and decodes the
+// error it answers with
+func postCert(t *testing.T, body string) (int, APIError) {
+    token, err := secretKey.MakeToken("first.last@example.com", "TestOrg")
+    if err != nil {
+        t.Fatal(err)
+    }
+    request := httptest.NewRequest("POST", "/v1/certs", strings.NewReader(body))
+    request.Header.Set("Authorization", token.(map[string]string)["token"])
+    recorder := httptest.NewRecorder()
+    RequestID(http.HandlerFunc(CreateCertHandler)).ServeHTTP(recorder, request)
+    var apiErr APIError
+    if err := json.Unmarshal(recorder.Body.Bytes(), &apiErr); err != nil {
+        t.Fatalf("Error responses should be JSON, got %q", recorder.Body.String())
+    }
+    if apiErr.RequestId == "" || apiErr.RequestId != recorder.Header().Get(RequestIdHeader) {
+        t.Errorf("Error responses should carry the request id!")
+    }
+    return recorder.Code, apiErr
+}
+
+func TestCreateCertErrors(t *testing.T) {
+    oldSecret, oldFlags, oldClient := secretKey, Flags, LemurClient
+    defer func() { secretKey, Flags, LemurClient = oldSecret, oldFlags, oldClient }()
+    secretKey = NewTokenSecret()
+    Flags = &flagOptArgs{Config: &InstanceConfig{}}
+    // Nothing here should get as far as Lemur
+    LemurClient = nil
+
+    status, apiErr := postCert(t, "{\"authority\": ")
+    if status != http.StatusBadRequest || apiErr.Code != CodeMalformedBody {
+        t.Errorf("A malformed body should be a 400 %s, got %d %s", CodeMalformedBody, status, apiErr.Code)
+    }
+    status, apiErr = postCert(t, "{\"validityEnd\": \"someday\"}")
+    if status != http.StatusBadRequest || apiErr.Code != CodeInvalidFields {
+        t.Fatalf("Missing fields should be a 400 %s, got %d %s", CodeInvalidFields, status, apiErr.Code)
+    }
+    for _, field := range []string{"authority", "commonName", "owner", "validityEnd"} {
+        if apiErr.Fields[field] == "" {
+            t.Errorf("Field %s should be reported as invalid: %+v", field, apiErr.Fields)
+        }
+    }
+
+    // Owners may revoke, so only admins may name someone else
+    status, apiErr = postCert(t, "{\"owner\": \"someone.else@example.com\"}")
+    if status != http.StatusBadRequest || apiErr.Fields["owner"] == "" {
+        t.Errorf("Non-admins should not name another owner, got %d %+v", status, apiErr.Fields)
+    }
+    _, apiErr = postCert(t, "{\"owner\": \"First.Last@example.com\"}")
+    if apiErr.Fields["owner"] != "" {
+        t.Errorf("Users should name themselves as owner, got %+v", apiErr.Fields)
+    }
+    Flags.Config.AdminGroups = []string{"TestOrg"}
+    _, apiErr = postCert(t, "{\"owner\": \"someone.else@example.com\"}")
+    if apiErr.Fields["owner"] != "" {
+        t.Errorf("Admins should be able to name another owner, got %+v", apiErr.Fields)
+    }
+}
@@ -3,46 +3,423 @@ package main
 import (
     "crypto/rand"
     "sync"
-    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "strings"
     "time"
     "github.com/dgrijalva/jwt-go"
     "fmt"
     "errors"
 )
 
-var once    sync.Once
+// TokenKeysEnv holds the token signing keys as comma separated kid=key
+// pairs, keys base64 encoded, the first of which signs. It takes precedence
+// over tokens.key_file, which lets replicas share keys from a secret store.
+const TokenKeysEnv = "LEMUR_CLIENT_TOKEN_KEYS"
+
+// DefaultRetainedTokenKeys is how many retired keys are kept to verify
+// tokens signed before a rotation
+const DefaultRetainedTokenKeys = 2
+
+// DefaultTokenIssuer is the iss and aud of app tokens unless tokens.issuer
+// and tokens.audience say otherwise
+const DefaultTokenIssuer = "lemur-client"
+
+// Default lifetimes. App tokens are short lived; a browser keeps working by
+// exchanging its refresh token for a new one, for as long as the session
+// is neither idle nor too old.
+const (
+    DefaultTokenLifetime          = "15m"
+    DefaultSessionIdleTimeout     = "2h"
+    DefaultSessionAbsoluteTimeout = "12h"
+)
+
+// tokenClockSkew is how far another replica's clock may be ahead of ours
+// and still have its tokens accepted straight away
+const tokenClockSkew = time.Minute
+
+var ErrTokenKeysReadOnly = errors.New("Token keys come from " + TokenKeysEnv + " and cannot be rotated here")
+
+// TokenConfig is the tokens section of config.yaml
+type TokenConfig struct {
+    KeyFile    string `yaml:"key_file"`
+    RetainKeys int    `yaml:"retain_keys"`
+    Algorithm  string `yaml:"algorithm"`
+    Issuer     string `yaml:"issuer"`
+    Audience   string `yaml:"audience"`
+    RevocationFile string `yaml:"revocation_file"`
+    Lifetime        string `yaml:"lifetime"`
+    SessionFile     string `yaml:"session_file"`
+    IdleTimeout     string `yaml:"idle_timeout"`
+    AbsoluteTimeout string `yaml:"absolute_timeout"`
+}
+
+// durations parses the token and session lifetimes, falling back to the
+// defaults for any that are unset
+// Returns the token lifetime, the idle and absolute session timeouts and an
+// error
+func (c *TokenConfig) durations() (time.Duration, time.Duration, time.Duration, error) {
+    values := []struct {
+        name, value, fallback string
+    }{
+        {"lifetime", c.Lifetime, DefaultTokenLifetime},
+        {"idle_timeout", c.IdleTimeout, DefaultSessionIdleTimeout},
+        {"absolute_timeout", c.AbsoluteTimeout, DefaultSessionAbsoluteTimeout},
+    }
+    parsed := []time.Duration{}
+    for _, v := range values {
+        if v.value == "" {
+            v.value = v.fallback
+        }
+        duration, err := time.ParseDuration(v.value)
+        if err != nil || duration <= 0 {
+            return 0, 0, 0, fmt.Errorf("Lemur-client config: tokens.%s '%s' is not a positive duration", v.name, v.value)
+        }
+        parsed = append(parsed, duration)
+    }
+    lifetime, idle, absolute := parsed[0], parsed[1], parsed[2]
+    if lifetime > idle {
+        return 0, 0, 0, errors.New("Lemur-client config: tokens.lifetime must not be longer than tokens.idle_timeout")
+    }
+    if idle > absolute {
+        return 0, 0, 0, errors.New("Lemur-client config: tokens.idle_timeout must not be longer than tokens.absolute_timeout")
+    }
+    return lifetime, idle, absolute, nil
+}
+
+// authSecret is the set of keys app tokens are signed and verified with.
+// The first key signs; the rest only verify, so tokens issued before a
+// rotation stay valid. Keys loaded from a file are re-read whenever the file
+// changes, so a rotation on one replica reaches the others.
 type authSecret struct {
-    Value   string
+    mu        sync.RWMutex
+    file      *watchedFile
+    readOnly  bool
+    retain    int
+    algorithm string
+    issuer    string
+    audience  string
+    keys      []*signingKey
+    lifetime  time.Duration
+    revocations *TokenRevocations
+    sessions    *TokenSessions
 }
 
+// NewTokenSecret creates a secret holding a single random key, kept only in
+// memory. Tokens it signs do not survive a restart.
 func NewTokenSecret() *authSecret {
-    key := make([]byte, 64)
-    _, err := rand.Read(key)
+    key, err := newSigningKey(DefaultTokenAlgorithm)
     if err != nil {
         Logs.Errorf("Unable to create secret key for application! What?")
         panic(err)
     }
-    secret := &authSecret{}
-    once.Do(func() {
-        secret.Value = base64.StdEncoding.EncodeToString([]byte(key))
-    })
-    return secret
+    lifetime, idle, absolute, _ := (&TokenConfig{}).durations()
+    revocations, _ := NewTokenRevocations("")
+    sessions, _ := NewTokenSessions("", idle, absolute)
+    return &authSecret{retain: DefaultRetainedTokenKeys,
+                       algorithm: DefaultTokenAlgorithm,
+                       issuer: DefaultTokenIssuer,
+                       audience: DefaultTokenIssuer,
+                       keys: []*signingKey{key},
+                       lifetime: lifetime,
+                       revocations: revocations,
+                       sessions: sessions}
 }
 
-func (a *authSecret) MakeToken(userName string, rbac string, lenMinutes ...int) (interface{}, error) {
+// LoadTokenSecret sets up the token keys from LEMUR_CLIENT_TOKEN_KEYS or
+// tokens.key_file. A key file that does not exist yet is created with a
+// fresh key. Without either the keys are only kept in memory.
+// Takes a TokenConfig pointer
+// Returns an authSecret pointer and an error
+func LoadTokenSecret(config *TokenConfig) (*authSecret, error) {
+    secret := NewTokenSecret()
+    if config.RetainKeys > 0 {
+        secret.retain = config.RetainKeys
+    }
+    if config.Algorithm != "" {
+        if !knownTokenAlgorithm(config.Algorithm) {
+            return nil, fmt.Errorf("Lemur-client config: tokens.algorithm must be one of %s", strings.Join(TokenAlgorithms, ", "))
+        }
+        secret.algorithm = config.Algorithm
+    }
+    if config.Issuer != "" {
+        secret.issuer = config.Issuer
+    }
+    if config.Audience != "" {
+        secret.audience = config.Audience
+    }
+    if config.RevocationFile != "" {
+        revocations, err := NewTokenRevocations(config.RevocationFile)
+        if err != nil {
+            return nil, err
+        }
+        secret.revocations = revocations
+    }
+    lifetime, idle, absolute, err := config.durations()
+    if err != nil {
+        return nil, err
+    }
+    sessions, err := NewTokenSessions(config.SessionFile, idle, absolute)
+    if err != nil {
+        return nil, err
+    }
+    secret.lifetime, secret.sessions = lifetime, sessions
+    if env := os.Getenv(TokenKeysEnv); env != "" {
+        keys, err := parseTokenKeys(env)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %v", TokenKeysEnv, err)
+        }
+        secret.readOnly, secret.keys = true, keys
+        return secret, nil
+    }
+    if config.KeyFile == "" {
+        Logs.Warningf("No tokens.key_file configured. Tokens will not survive a restart or work across replicas.")
+        if secret.algorithm != DefaultTokenAlgorithm {
+            key, err := newSigningKey(secret.algorithm)
+            if err != nil {
+                return nil, err
+            }
+            secret.keys = []*signingKey{key}
+        }
+        return secret, nil
+    }
+    secret.file = &watchedFile{path: config.KeyFile}
+    if err := secret.create(); err != nil {
+        return nil, err
+    }
+    secret.mu.Lock()
+    defer secret.mu.Unlock()
+    if err := secret.reload(true); err != nil {
+        return nil, err
+    }
+    return secret, nil
+}
+
+// create writes a key file holding one fresh key, unless the file already
+// exists. Replicas starting together on a shared volume race here, so the
+// file is written aside and linked into place, which only one can win.
+func (a *authSecret) create() error {
+    path := a.file.path
+    if _, err := os.Stat(path); err == nil {
+        return nil
+    }
+    key, err := newSigningKey(a.algorithm)
+    if err != nil {
+        return err
+    }
+    data, _ := json.MarshalIndent(map[string][]*signingKey{"keys": {key}}, "", "  ")
+    tmp := path + "." + key.Id + ".tmp"
+    if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+        return fmt.Errorf("Unable to write tokens.key_file: %v", err)
+    }
+    defer os.Remove(tmp)
+    if err := os.Link(tmp, path); os.IsExist(err) {
+        return nil
+    } else if err != nil {
+        return fmt.Errorf("Unable to create tokens.key_file: %v", err)
+    }
+    Logs.Infof("Created %s token key %s in %s", key.Algorithm, key.Id, path)
+    return nil
+}
+
+// reload re-reads the key file if it changed since it was last read, or
+// regardless when forced. The caller must hold the write lock.
+func (a *authSecret) reload(force bool) error {
+    if a.file == nil {
+        return nil
+    }
+    if !force {
+        changed, err := a.file.Changed()
+        if err != nil {
+            return fmt.Errorf("Unable to read tokens.key_file: %v", err)
+        } else if !changed {
+            return nil
+        }
+    }
+    data, err := a.file.Read()
+    if err != nil {
+        return fmt.Errorf("Unable to read tokens.key_file: %v", err)
+    }
+    var file struct {
+        Keys []*signingKey `json:"keys"`
+    }
+    if err := json.Unmarshal(data, &file); err != nil {
+        return fmt.Errorf("Unable to parse tokens.key_file: %v", err)
+    }
+    if err := loadTokenKeys(file.Keys); err != nil {
+        return fmt.Errorf("tokens.key_file: %v", err)
+    }
+    a.keys = file.Keys
+    return nil
+}
+
+// refresh picks up changes to the key file, keeping the keys already loaded
+// if it cannot be read
+func (a *authSecret) refresh(force bool) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    if err := a.reload(force); err != nil {
+        Logs.Errorf("%+v", err)
+    }
+}
+
+// save writes the keys to the key file
+func (a *authSecret) save() error {
+    data, err := json.MarshalIndent(map[string][]*signingKey{"keys": a.keys}, "", "  ")
+    if err != nil {
+        return err
+    }
+    return a.file.Write(data, a.keys[0].Id)
+}
+
+// Rotate makes a fresh key, of the configured algorithm, the signing key.
+// The previous keys keep verifying tokens, up to tokens.retain_keys of them.
+// Called on an authSecret pointer
+// Returns the new key id and an error
+func (a *authSecret) Rotate() (string, error) {
+    if a.readOnly {
+        return "", ErrTokenKeysReadOnly
+    }
+    key, err := newSigningKey(a.algorithm)
+    if err != nil {
+        return "", err
+    }
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    // Another replica may have rotated since we last looked
+    if err := a.reload(true); err != nil {
+        return "", err
+    }
+    keys := append([]*signingKey{key}, a.keys...)
+    if len(keys) > a.retain + 1 {
+        keys = keys[:a.retain + 1]
+    }
+    previous := a.keys
+    a.keys = keys
+    if a.file != nil {
+        if err := a.save(); err != nil {
+            a.keys = previous
+            return "", fmt.Errorf("Unable to write tokens.key_file: %v", err)
+        }
+    }
+    return key.Id, nil
+}
+
+// KeyIds lists the ids of the keys tokens are verified with, the signing
+// key first
+func (a *authSecret) KeyIds() []string {
+    a.mu.RLock()
+    defer a.mu.RUnlock()
+    ids := []string{}
+    for _, key := range a.keys {
+        ids = append(ids, key.Id)
+    }
+    return ids
+}
 
-    minutes := 60
+// JWKS returns the public keys tokens may be verified with as a JSON Web
+// Key Set. HS256 keys are secret and left out.
+func (a *authSecret) JWKS() map[string]interface{} {
+    a.refresh(false)
+    a.mu.RLock()
+    defer a.mu.RUnlock()
+    keys := []map[string]interface{}{}
+    for _, key := range a.keys {
+        if jwk := key.JWK(); jwk != nil {
+            keys = append(keys, jwk)
+        }
+    }
+    return map[string]interface{}{"keys": keys}
+}
+
+// signingKey returns the key new tokens are signed with
+func (a *authSecret) signingKey() *signingKey {
+    a.refresh(false)
+    a.mu.RLock()
+    defer a.mu.RUnlock()
+    return a.keys[0]
+}
+
+// verificationKey finds the key with the given id. Changes to the key file
+// are picked up first, so keys retired elsewhere stop verifying; an unknown
+// id forces a re-read in case another replica has just rotated.
+func (a *authSecret) verificationKey(id string) (*signingKey, bool) {
+    for attempt := 0; attempt < 2; attempt++ {
+        a.refresh(attempt > 0)
+        a.mu.RLock()
+        for _, key := range a.keys {
+            if key.Id == id {
+                a.mu.RUnlock()
+                return key, true
+            }
+        }
+        a.mu.RUnlock()
+    }
+    return nil, false
+}
+
+// keyFunc gives jwt-go the key named by a token's kid header, as long as
+// the token was signed with that key's algorithm
+func (a *authSecret) keyFunc(token *jwt.Token) (interface{}, error) {
+    id, _ := token.Header["kid"].(string)
+    key, ok := a.verificationKey(id)
+    if !ok {
+        return nil, fmt.Errorf("Unknown token key '%s'", id)
+    }
+    if token.Method.Alg() != key.Algorithm {
+        return nil, fmt.Errorf("Unexpected signing method: %+v", token.Header["alg"])
+    }
+    return key.verifyKey(), nil
+}
+
+// parse checks a token's signature. Its claims are checked separately so
+// that clock skew can be allowed for.
+func (a *authSecret) parse(tokenString string) (*jwt.Token, error) {
+    parser := &jwt.Parser{ValidMethods: TokenAlgorithms, SkipClaimsValidation: true}
+    return parser.Parse(tokenString, a.keyFunc)
+}
+
+// checkClaims makes sure a token is ours, meant for us and current
+func (a *authSecret) checkClaims(claims jwt.MapClaims, now time.Time) error {
+    if !claims.VerifyIssuer(a.issuer, true) {
+        return errors.New("Token has the wrong issuer")
+    }
+    if !claims.VerifyAudience(a.audience, true) {
+        return errors.New("Token has the wrong audience")
+    }
+    if !claims.VerifyExpiresAt(now.Unix(), true) {
+        return errors.New("Expired token")
+    }
+    if !claims.VerifyNotBefore(now.Add(tokenClockSkew).Unix(), true) {
+        return errors.New("Token is not valid yet")
+    }
+    if _, ok := claims["jti"].(string); !ok {
+        return errors.New("Token has no jti")
+    }
+    return nil
+}
+
+func newTokenId() string {
+    id := make([]byte, 16)
+    if _, err := rand.Read(id); err != nil {
+        Logs.Errorf("Unable to generate token id: %+v", err)
+    }
+    return hex.EncodeToString(id)
+}
+
+// MakeToken signs an app token for a user. Besides username and rbac it
+// carries the registered iss, aud, sub, iat, nbf, exp and jti claims, so
+// other services can verify it against /.well-known/jwks.json. It lasts for
+// tokens.lifetime unless lenMinutes says otherwise, and cannot be refreshed.
+func (a *authSecret) MakeToken(userName string, rbac string, lenMinutes ...int) (interface{}, error) {
+    expires := time.Now().Add(a.lifetime)
     if len(lenMinutes) > 0 {
-        minutes = lenMinutes[0]
+        expires = time.Now().Add(time.Minute * time.Duration(lenMinutes[0]))
     }
-    token := jwt.NewWithClaims(jwt.GetSigningMethod("HS256"), jwt.MapClaims{
-        "username": userName,
-        "rbac": rbac,
-        "exp": time.Now().Add(time.Minute * time.Duration(minutes)),
-    })
-    tokenString, err := token.SignedString([]byte(a.Value))
+    tokenString, err := a.signToken(userName, rbac, "", expires)
     if err != nil {
-        Logs.Errorf("Unable to create application authentication token!")
         return "", err
     }
     data := map[string]string {
@@ -51,32 +428,138 @@ func (a *authSecret) MakeToken(userName string, rbac string, lenMinutes ...int)
     return data, nil
 }
 
+// signToken signs an app token that expires at expires. Tokens issued under
+// a session carry its id as the sid claim and stop being accepted once the
+// session ends.
+func (a *authSecret) signToken(userName, rbac, sessionId string, expires time.Time) (string, error) {
+    now := time.Now()
+    claims := jwt.MapClaims{
+        "iss": a.issuer,
+        "aud": a.audience,
+        "sub": userName,
+        "iat": now.Unix(),
+        "nbf": now.Unix(),
+        "exp": expires.Unix(),
+        "jti": newTokenId(),
+        "username": userName,
+        "rbac": rbac,
+    }
+    if sessionId != "" {
+        claims["sid"] = sessionId
+    }
+    key := a.signingKey()
+    token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+    token.Header["kid"] = key.Id
+    tokenString, err := token.SignedString(key.signKey())
+    if err != nil {
+        Logs.Errorf("Unable to create application authentication token!")
+        return "", err
+    }
+    return tokenString, nil
+}
+
+// sessionTokens signs an app token under a session, lasting tokens.lifetime
+// but no longer than the session itself
+func (a *authSecret) sessionTokens(id string, session tokenSession, refreshToken string) (map[string]string, error) {
+    expires := time.Now().Add(a.lifetime)
+    if ends := session.Ends(a.sessions.idle, a.sessions.absolute); ends.Before(expires) {
+        expires = ends
+    }
+    tokenString, err := a.signToken(session.Username, session.Rbac, id, expires)
+    if err != nil {
+        return nil, err
+    }
+    return map[string]string{"token": tokenString, "refresh_token": refreshToken}, nil
+}
+
+// StartSession logs a user in, returning an app token and the refresh token
+// that exchanges for the next one
+// Returns a map with "token" and "refresh_token" and an error
+func (a *authSecret) StartSession(userName string, rbac string) (map[string]string, error) {
+    id, refreshToken, err := a.sessions.Start(userName, rbac)
+    if err != nil {
+        return nil, err
+    }
+    now := time.Now().UTC()
+    return a.sessionTokens(id, tokenSession{Username: userName, Rbac: rbac, Created: now, Refreshed: now}, refreshToken)
+}
+
+// RefreshSession exchanges a refresh token for a new app token and the next
+// refresh token, keeping the session alive
+// Returns a map with "token" and "refresh_token" and an error
+func (a *authSecret) RefreshSession(refreshToken string) (map[string]string, error) {
+    id, session, next, err := a.sessions.Refresh(refreshToken)
+    if err != nil {
+        return nil, err
+    }
+    return a.sessionTokens(id, session, next)
+}
+
+// EndSession ends the session a refresh token belongs to, if it is still
+// open and the token is one it handed out, e.g. on logout
+func (a *authSecret) EndSession(refreshToken string) error {
+    return a.sessions.Logout(refreshToken)
+}
+
 func (a *authSecret) ValidateToken(tokenString string) (interface{}, error) {
-    token, _ := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-        if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-            return nil, fmt.Errorf("Unexpected signing method: %+v", token.Header["alg"])
-        }
-        return []byte(a.Value), nil
-    })
+    token, err := a.parse(tokenString)
+    if err != nil || !token.Valid {
+        return nil, errors.New("Invalid token")
+    }
     claims, ok := token.Claims.(jwt.MapClaims)
-    if !ok || !token.Valid {
-        return nil, errors.New("Expired token")
-    } else {
-        expiry, _ := time.Parse(time.RFC3339, claims["exp"].(string))
-        if expiry.Before(time.Now()) {
-            return nil, errors.New("Expired token")
-        }
-        return token, nil
+    if !ok {
+        return nil, errors.New("Invalid token")
+    }
+    if err := a.checkClaims(claims, time.Now()); err != nil {
+        return nil, err
+    }
+    jti, _ := claims["jti"].(string)
+    username, _ := claims["username"].(string)
+    iat, _ := claims["iat"].(float64)
+    if a.revocations.Revoked(jti, username, time.Unix(int64(iat), 0)) {
+        return nil, errors.New("Revoked token")
+    }
+    if sid, ok := claims["sid"].(string); ok && !a.sessions.Active(sid) {
+        return nil, errors.New("Session has ended")
+    }
+    return token, nil
+}
+
+// Revoke stops a valid token being accepted, e.g. on logout, and ends the
+// session it was issued under
+func (a *authSecret) Revoke(tokenString string) error {
+    token, err := a.ValidateToken(tokenString)
+    if err != nil {
+        return err
+    }
+    claims := token.(*jwt.Token).Claims.(jwt.MapClaims)
+    exp, _ := claims["exp"].(float64)
+    if err := a.revocations.RevokeToken(claims["jti"].(string), time.Unix(int64(exp), 0)); err != nil {
+        return err
+    }
+    if sid, ok := claims["sid"].(string); ok {
+        return a.sessions.End(sid)
     }
+    return nil
+}
+
+// RevokeUser stops every token issued to username so far being accepted
+// and ends their sessions, so they cannot be refreshed either
+// Returns the time from which the user's tokens are accepted again and an
+// error
+func (a *authSecret) RevokeUser(username string) (time.Time, error) {
+    revoked, err := a.revocations.RevokeUser(username)
+    if err != nil {
+        return revoked, err
+    }
+    return revoked, a.sessions.EndUser(username)
 }
 
 func (a *authSecret) GetClaims(tokenString string) (jwt.MapClaims) {
-    token, _ := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-        if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-            return nil, fmt.Errorf("Unexpected signing method: %+v", token.Header["alg"])
-        }
-        return []byte(a.Value), nil
-    })
+    token, _ := a.parse(tokenString)
+    if token == nil {
+        return jwt.MapClaims{}
+    }
     claims, _ := token.Claims.(jwt.MapClaims)
     return claims
 }
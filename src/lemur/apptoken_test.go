@@ -1,20 +1,103 @@
 package main
 
 import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/base64"
+    "math/big"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
     "testing"
     "reflect"
+    "github.com/dgrijalva/jwt-go"
 )
 
 func TestNewTokenSecret(t *testing.T) {
     // This should create a new secret with no errors
     secret := NewTokenSecret()
-    if secret.Value == "" {
-        t.Errorf("App secret should not be empty!")
+    if len(secret.KeyIds()) != 1 {
+        t.Errorf("App secret should have one key!")
     }
-    // We should only be able to have one secret
+    // Each secret gets its own key
     secret2 := NewTokenSecret()
-    if secret2.Value != "" {
-        t.Errorf("Should not be able to create two app secrets!")
+    token, _ := secret.MakeToken("testUser", "testrbac")
+    if _, err := secret2.ValidateToken(token.(map[string]string)["token"]); err == nil {
+        t.Errorf("Tokens should not validate against another secret!")
+    }
+}
+
+func TestTokenKeyRotation(t *testing.T) {
+    dir, err := ioutil.TempDir("", "tokenkeys")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    config := &TokenConfig{KeyFile: filepath.Join(dir, "keys.json"), RetainKeys: 1}
+    secret, err := LoadTokenSecret(config)
+    if err != nil {
+        t.Fatalf("A missing key file should be created: %v", err)
+    }
+    // A second replica sharing the key file
+    replica, err := LoadTokenSecret(config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    token, _ := secret.MakeToken("testUser", "testrbac")
+    first := token.(map[string]string)["token"]
+    if _, err := replica.ValidateToken(first); err != nil {
+        t.Errorf("Replicas sharing a key file should accept each other's tokens: %v", err)
+    }
+    kid, err := secret.Rotate()
+    if err != nil {
+        t.Fatal(err)
+    }
+    token, _ = secret.MakeToken("testUser", "testrbac")
+    second := token.(map[string]string)["token"]
+    if _, err := replica.ValidateToken(second); err != nil {
+        t.Errorf("Replicas should pick up a rotated key: %v", err)
+    }
+    if _, err := replica.ValidateToken(first); err != nil {
+        t.Errorf("Tokens signed before a rotation should still validate: %v", err)
+    }
+    if ids := replica.KeyIds(); ids[0] != kid {
+        t.Errorf("The rotated key should sign, got %v", ids)
+    }
+    if _, err := replica.Rotate(); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := secret.ValidateToken(first); err == nil {
+        t.Errorf("Tokens signed with a retired key should not validate!")
+    }
+    if _, err := secret.ValidateToken(second); err != nil {
+        t.Errorf("Tokens signed with a retained key should validate: %v", err)
+    }
+}
+
+func TestTokenKeysEnv(t *testing.T) {
+    defer os.Unsetenv(TokenKeysEnv)
+    key := base64.StdEncoding.EncodeToString(make([]byte, minTokenKeyLength))
+    os.Setenv(TokenKeysEnv, "new=" + key + ",old=" + key)
+    secret, err := LoadTokenSecret(&TokenConfig{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if ids := secret.KeyIds(); len(ids) != 2 || ids[0] != "new" {
+        t.Errorf("The first key in %s should sign, got %v", TokenKeysEnv, ids)
+    }
+    if _, err := secret.Rotate(); err != ErrTokenKeysReadOnly {
+        t.Errorf("Keys from the environment should not rotate!")
+    }
+    for _, bad := range []string{"nokid", "short=c2hvcnQ=", "a=" + key + ",a=" + key} {
+        os.Setenv(TokenKeysEnv, bad)
+        if _, err := LoadTokenSecret(&TokenConfig{}); err == nil {
+            t.Errorf("%s=%s should be refused!", TokenKeysEnv, bad)
+        }
     }
 }
 
@@ -48,3 +131,125 @@ func TestValidateToken(t *testing.T) {
         t.Errorf("Expired tokens should not validate!")
     }
 }
+
+func TestTokenAlgorithms(t *testing.T) {
+    for _, algorithm := range TokenAlgorithms {
+        secret, err := LoadTokenSecret(&TokenConfig{Algorithm: algorithm})
+        if err != nil {
+            t.Fatal(err)
+        }
+        token, _ := secret.MakeToken("testUser", "testrbac")
+        tokenString := token.(map[string]string)["token"]
+        if _, err := secret.ValidateToken(tokenString); err != nil {
+            t.Errorf("%s tokens should validate: %v", algorithm, err)
+        }
+        keys := secret.JWKS()["keys"].([]map[string]interface{})
+        if algorithm == TokenAlgHS256 {
+            if len(keys) != 0 {
+                t.Errorf("HMAC keys should not be published!")
+            }
+            continue
+        }
+        if len(keys) != 1 || keys[0]["kid"] != secret.KeyIds()[0] || keys[0]["alg"] != algorithm {
+            t.Fatalf("The %s key should be published, got %v", algorithm, keys)
+        }
+        // Verify the way another service would, from the JWKS alone
+        parsed, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+            return jwkPublicKey(t, keys[0]), nil
+        })
+        if err != nil || !parsed.Valid {
+            t.Errorf("%s tokens should verify against the JWKS: %v", algorithm, err)
+        }
+    }
+    if _, err := LoadTokenSecret(&TokenConfig{Algorithm: "none"}); err == nil {
+        t.Errorf("Unknown algorithms should be refused!")
+    }
+}
+
+// jwkPublicKey turns a published JWK back into a public key
+func jwkPublicKey(t *testing.T, jwk map[string]interface{}) interface{} {
+    decode := func(name string) *big.Int {
+        bytes, err := base64.RawURLEncoding.DecodeString(jwk[name].(string))
+        if err != nil {
+            t.Fatal(err)
+        }
+        return new(big.Int).SetBytes(bytes)
+    }
+    if jwk["kty"] == "RSA" {
+        return &rsa.PublicKey{N: decode("n"), E: int(decode("e").Int64())}
+    }
+    return &ecdsa.PublicKey{Curve: elliptic.P256(), X: decode("x"), Y: decode("y")}
+}
+
+func TestTokenClaims(t *testing.T) {
+    secret := NewTokenSecret()
+    token, _ := secret.MakeToken("testUser", "testrbac")
+    claims := secret.GetClaims(token.(map[string]string)["token"])
+    for _, claim := range []string{"iss", "aud", "sub", "iat", "nbf", "exp", "jti", "username", "rbac"} {
+        if _, ok := claims[claim]; !ok {
+            t.Errorf("Tokens should carry the %s claim!", claim)
+        }
+    }
+    if claims["sub"] != "testUser" || claims["iss"] != DefaultTokenIssuer {
+        t.Errorf("Unexpected claims %v", claims)
+    }
+    other, _ := secret.MakeToken("testUser", "testrbac")
+    if secret.GetClaims(other.(map[string]string)["token"])["jti"] == claims["jti"] {
+        t.Errorf("Every token should get its own jti!")
+    }
+    // The same keys, but expecting tokens for another audience
+    elsewhere := &authSecret{issuer: secret.issuer, audience: "another-service", keys: secret.keys}
+    if _, err := elsewhere.ValidateToken(token.(map[string]string)["token"]); err == nil {
+        t.Errorf("Tokens for another audience should not validate!")
+    }
+    // An HS256 token signed with the public key of an ES256 key
+    forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+    forged.Header["kid"] = secret.KeyIds()[0]
+    public, _ := x509.MarshalPKIXPublicKey(secret.keys[0].verifyKey())
+    forgedString, _ := forged.SignedString(public)
+    if _, err := secret.ValidateToken(forgedString); err == nil {
+        t.Errorf("Tokens should only validate with their key's algorithm!")
+    }
+}
+
+// adminRequest sends a request through the admin router with token, if any,
+// in the Authorization header
+func adminRequest(method, path string, body io.Reader, token string) *httptest.ResponseRecorder {
+    request := httptest.NewRequest(method, path, body)
+    if token != "" {
+        request.Header.Set("Authorization", token)
+    }
+    recorder := httptest.NewRecorder()
+    NewAdminRouter().ServeHTTP(recorder, request)
+    return recorder
+}
+
+// adminTokens sets up admin_groups and returns a token for a member and
+// for someone else
+func adminTokens() (string, string) {
+    Flags = &flagOptArgs{Config: &InstanceConfig{AdminGroups: []string{"SecurityAdmins"}}}
+    admin, _ := secretKey.MakeToken("admin@example.com", "SecurityAdmins")
+    user, _ := secretKey.MakeToken("first.last@example.com", "TestOrg")
+    return admin.(map[string]string)["token"], user.(map[string]string)["token"]
+}
+
+func TestRotateTokenKeyAuth(t *testing.T) {
+    oldSecret, oldFlags := secretKey, Flags
+    defer func() { secretKey, Flags = oldSecret, oldFlags }()
+    secretKey = NewTokenSecret()
+    admin, user := adminTokens()
+    keys := secretKey.KeyIds()
+
+    if recorder := adminRequest("POST", "/token-keys/rotate", nil, ""); recorder.Code != http.StatusUnauthorized {
+        t.Errorf("Rotating keys without a token should be refused, got %d", recorder.Code)
+    }
+    if recorder := adminRequest("POST", "/token-keys/rotate", nil, user); recorder.Code != http.StatusForbidden {
+        t.Errorf("Rotating keys should be refused outside admin_groups, got %d", recorder.Code)
+    }
+    if !reflect.DeepEqual(secretKey.KeyIds(), keys) {
+        t.Errorf("Refused rotations should not change the keys!")
+    }
+    if recorder := adminRequest("POST", "/token-keys/rotate", nil, admin); recorder.Code != http.StatusOK {
+        t.Errorf("Admins should be able to rotate keys, got %d", recorder.Code)
+    }
+}
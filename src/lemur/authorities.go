@@ -0,0 +1,144 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "time"
+)
+
+// listCache holds the result of an expensive Lemur listing for ttl. If a
+// refresh fails, the stale value is served rather than an error.
+type listCache struct {
+    mu      sync.Mutex
+    ttl     time.Duration
+    fetched time.Time
+    value   interface{}
+}
+
+func newListCache(ttl time.Duration) *listCache {
+    return &listCache{ttl: ttl}
+}
+
+// Get returns the cached value, calling fetch to refresh it when it is older
+// than the ttl
+func (c *listCache) Get(fetch func() (interface{}, error)) (interface{}, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.value != nil && time.Since(c.fetched) < c.ttl {
+        return c.value, nil
+    }
+    value, err := fetch()
+    if err != nil {
+        if c.value != nil {
+            Logs.Warningf("Serving cached Lemur data from %s, refresh failed: %+v", c.fetched, err)
+            return c.value, nil
+        }
+        return nil, err
+    }
+    c.value = value
+    c.fetched = time.Now()
+    return value, nil
+}
+
+// AuthorityOption is what the UI and API show for an authority a user may
+// pick. MaxValidity is the expiry of the authority's own certificate, past
+// which nothing it issues can be valid. CSROnly authorities will not issue
+// a certificate without a CSR.
+type AuthorityOption struct {
+    Name        string `json:"name"`
+    Description string `json:"description"`
+    MaxValidity string `json:"maxValidity,omitempty"`
+    CSROnly     bool   `json:"csrOnly,omitempty"`
+}
+
+// ListAuthorities fetches every authority from Lemur
+// Called on a LemurRequester pointer
+// Returns a slice of Authority and an error
+func (l *LemurRequester) ListAuthorities() ([]Authority, error) {
+    var authorities []Authority
+    for page := 1; ; page++ {
+        address := fmt.Sprintf("%s?count=%d&page=%d", l.address(AuthorityUri), l.pageSize, page)
+        var list AuthorityList
+        if err := l.doJSON("GET", address, nil, &list); err != nil {
+            return nil, err
+        }
+        authorities = append(authorities, list.Items...)
+        if len(list.Items) < l.pageSize || len(authorities) >= list.Total || len(authorities) >= l.maxResults {
+            return authorities, nil
+        }
+    }
+}
+
+// CachedAuthorities returns every authority, from cache when fresh enough
+func (l *LemurRequester) CachedAuthorities() ([]Authority, error) {
+    value, err := l.authorities.Get(func() (interface{}, error) {
+        return l.ListAuthorities()
+    })
+    if err != nil {
+        return nil, err
+    }
+    return value.([]Authority), nil
+}
+
+// AuthoritiesForGroup returns the active authorities an RBAC group may issue
+// from: those with a Lemur role named after the group, plus any listed in
+// lemur.shared_authorities
+// Called on a LemurRequester pointer
+// Takes an RBAC group name
+// Returns a slice of Authority and an error
+func (l *LemurRequester) AuthoritiesForGroup(group string) ([]Authority, error) {
+    authorities, err := l.CachedAuthorities()
+    if err != nil {
+        return nil, err
+    }
+    var allowed []Authority
+    for _, authority := range authorities {
+        if authority.Active && l.groupMayUse(group, &authority) {
+            allowed = append(allowed, authority)
+        }
+    }
+    return allowed, nil
+}
+
+// AuthorityForGroup finds a single authority by name, returning nil if the
+// group may not use it or it does not exist
+func (l *LemurRequester) AuthorityForGroup(group, name string) (*Authority, error) {
+    authorities, err := l.AuthoritiesForGroup(group)
+    if err != nil {
+        return nil, err
+    }
+    for i := range authorities {
+        if authorities[i].Name == name {
+            return &authorities[i], nil
+        }
+    }
+    return nil, nil
+}
+
+func (l *LemurRequester) groupMayUse(group string, authority *Authority) bool {
+    for _, shared := range l.sharedAuthorities {
+        if shared == authority.Name {
+            return true
+        }
+    }
+    if group == "" {
+        return false
+    }
+    for _, role := range authority.Roles {
+        if role.Name == group {
+            return true
+        }
+    }
+    return false
+}
+
+// Option converts an Authority to the AuthorityOption shown to users
+func (a *Authority) Option() AuthorityOption {
+    option := AuthorityOption{Name: a.Name, Description: a.Description}
+    if a.AuthorityCertificate != nil {
+        if notAfter, err := parseLemurTime(a.AuthorityCertificate.NotAfter); err == nil {
+            option.MaxValidity = notAfter.Format("2006-01-02")
+        }
+    }
+    return option
+}
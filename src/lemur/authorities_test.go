@@ -0,0 +1,79 @@
+package main
+
+import (
+    "errors"
+    "net/http"
+    "testing"
+    "time"
+)
+
+func TestListCache(t *testing.T) {
+    cache := newListCache(time.Minute)
+    fetches := 0
+    fetch := func() (interface{}, error) {
+        fetches++
+        return fetches, nil
+    }
+    broken := func() (interface{}, error) {
+        return nil, errors.New("Lemur is down")
+    }
+    if _, err := cache.Get(broken); err == nil {
+        t.Errorf("A failed first fetch should be an error!")
+    }
+    cache.Get(fetch)
+    if value, _ := cache.Get(fetch); value != 1 || fetches != 1 {
+        t.Errorf("A fresh value should be served from cache, got %v after %d fetches", value, fetches)
+    }
+    cache.fetched = time.Now().Add(-2 * time.Minute)
+    if value, _ := cache.Get(fetch); value != 2 {
+        t.Errorf("An expired value should be fetched again, got %v", value)
+    }
+    cache.fetched = time.Now().Add(-2 * time.Minute)
+    if value, err := cache.Get(broken); err != nil || value != 2 {
+        t.Errorf("A failed refresh should serve the stale value, got %v %v", value, err)
+    }
+}
+
+func TestAuthoritiesForGroup(t *testing.T) {
+    fake, lemur := newTestLemur(t)
+    defer fake.Close()
+    fake.AddAuthority("TeamACA", "TeamA")
+    fake.AddAuthority("SharedCA")
+    lemur.sharedAuthorities = []string{"SharedCA"}
+
+    names := func(group string) []string {
+        authorities, err := lemur.AuthoritiesForGroup(group)
+        if err != nil {
+            t.Fatal(err)
+        }
+        var names []string
+        for _, authority := range authorities {
+            names = append(names, authority.Name)
+        }
+        return names
+    }
+    if got := names("TeamA"); len(got) != 2 || got[0] != "TeamACA" || got[1] != "SharedCA" {
+        t.Errorf("TeamA should get its own and the shared authority, got %v", got)
+    }
+    // Three authorities take two pages
+    listed := fake.Requests("GET", AuthorityUri)
+    if got := names("TeamB"); len(got) != 1 || got[0] != "SharedCA" {
+        t.Errorf("Other groups should only get the shared authority, got %v", got)
+    }
+    if authority, _ := lemur.AuthorityForGroup("TeamB", "TeamACA"); authority != nil {
+        t.Errorf("Authorities of other groups should not be found!")
+    }
+    if authority, _ := lemur.AuthorityForGroup("TeamA", "TeamACA"); authority == nil || authority.Option().MaxValidity == "" {
+        t.Errorf("An authority's option should carry its certificate's expiry!")
+    }
+    if listed != 2 || fake.Requests("GET", AuthorityUri) != listed {
+        t.Errorf("Authorities should be listed once and cached, got %d requests", fake.Requests("GET", AuthorityUri))
+    }
+
+    // Lemur failing after the cache expires still serves the old list
+    lemur.authorities.fetched = time.Now().Add(-time.Hour)
+    fake.FailNext("GET", AuthorityUri, http.StatusBadRequest, 1)
+    if got := names("TeamA"); len(got) != 2 {
+        t.Errorf("A failed refresh should keep the cached authorities, got %v", got)
+    }
+}
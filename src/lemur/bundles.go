@@ -0,0 +1,294 @@
+package main
+
+import (
+    "archive/zip"
+    "bytes"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rsa"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/asn1"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+)
+
+const (
+    BundleJSON   = "json"
+    BundlePKCS12 = "pkcs12"
+    BundleJKS    = "jks"
+    BundlePEMZip = "pem-zip"
+
+    // BundlePasswordHeader carries the password for pkcs12 and jks bundles.
+    // A header rather than a query parameter keeps it out of access logs.
+    BundlePasswordHeader    = "X-Bundle-Password"
+    MinBundlePasswordLength = 6
+)
+
+var (
+    oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+    oidECPublicKey   = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+    oidNamedCurves   = map[elliptic.Curve]asn1.ObjectIdentifier{
+        elliptic.P224(): {1, 3, 132, 0, 33},
+        elliptic.P256(): {1, 2, 840, 10045, 3, 1, 7},
+        elliptic.P384(): {1, 3, 132, 0, 34},
+        elliptic.P521(): {1, 3, 132, 0, 35},
+    }
+)
+
+// certBundle is a certificate, chain and key packaged for download. json
+// bundles have no filename and are returned inline.
+type certBundle struct {
+    ContentType string
+    Filename    string
+    Data        []byte
+}
+
+// zipFile is one file in a zip bundle; private keys get mode 0600
+type zipFile struct {
+    Name string
+    Data []byte
+    Mode os.FileMode
+}
+
+type pkcs8 struct {
+    Version    int
+    Algorithm  pkix.AlgorithmIdentifier
+    PrivateKey []byte
+}
+
+// bundleOptions reads the requested bundle format and password from a
+// request, defaulting to json. Errors are meant to be shown to the caller.
+func bundleOptions(r *http.Request) (string, string, error) {
+    format := strings.ToLower(r.URL.Query().Get("format"))
+    password := r.Header.Get(BundlePasswordHeader)
+    switch format {
+    case "":
+        return BundleJSON, "", nil
+    case BundleJSON, BundlePEMZip:
+        return format, "", nil
+    case BundlePKCS12, BundleJKS:
+        if len(password) < MinBundlePasswordLength {
+            return "", "", fmt.Errorf("%s bundles need a password of at least %d characters in the %s header",
+                                      format, MinBundlePasswordLength, BundlePasswordHeader)
+        }
+        return format, password, nil
+    }
+    return "", "", fmt.Errorf("Unknown format '%s', expected one of %s, %s, %s or %s",
+                              format, BundleJSON, BundlePKCS12, BundleJKS, BundlePEMZip)
+}
+
+// Bundle packages a certificate, chain and key in the requested format
+// Called on a certChainPubKey pointer
+// Takes the format, a name for the files and keystore entries, and the
+// password for pkcs12 and jks bundles
+// Returns a certBundle pointer and an error
+func (c *certChainPubKey) Bundle(format, name, password string) (*certBundle, error) {
+    base := sanitizeFilename(name)
+    if base == "" {
+        base = "certificate"
+    }
+    if format == BundleJSON {
+        data, err := json.Marshal(c)
+        if err != nil {
+            return nil, err
+        }
+        return &certBundle{ContentType: "application/json", Data: data}, nil
+    }
+    if format == BundlePEMZip {
+        files := []zipFile{{"cert.pem", []byte(pemText(c.PublicCertificate)), 0644},
+                           {"chain.pem", []byte(pemText(c.Chain)), 0644},
+                           {"fullchain.pem", []byte(pemText(c.PublicCertificate) + pemText(c.Chain)), 0644}}
+        if c.PrivateKey != "" {
+            files = append(files, zipFile{"key.pem", []byte(pemText(c.PrivateKey)), 0600})
+        }
+        data, err := zipFiles(files...)
+        if err != nil {
+            return nil, err
+        }
+        return &certBundle{ContentType: "application/zip", Filename: base + ".zip", Data: data}, nil
+    }
+
+    if c.PrivateKey == "" {
+        return nil, ErrNoPrivateKey
+    }
+    leaves, err := parseCertificates(c.PublicCertificate)
+    if err != nil {
+        return nil, err
+    }
+    if len(leaves) == 0 {
+        return nil, errors.New("No certificate to bundle")
+    }
+    chain, err := parseCertificates(c.Chain)
+    if err != nil {
+        return nil, err
+    }
+    key, err := pkcs8Key(c.PrivateKey)
+    if err != nil {
+        return nil, err
+    }
+    switch format {
+    case BundlePKCS12:
+        data, err := EncodePKCS12(key, leaves[0], chain, name, password)
+        if err != nil {
+            return nil, err
+        }
+        return &certBundle{ContentType: "application/x-pkcs12", Filename: base + ".p12", Data: data}, nil
+    case BundleJKS:
+        keystore, truststore, err := EncodeJKS(key, leaves[0], chain, strings.ToLower(base), password)
+        if err != nil {
+            return nil, err
+        }
+        data, err := zipFiles(zipFile{"keystore.jks", keystore, 0600},
+                              zipFile{"truststore.jks", truststore, 0644})
+        if err != nil {
+            return nil, err
+        }
+        return &certBundle{ContentType: "application/zip", Filename: base + "-jks.zip", Data: data}, nil
+    }
+    return nil, fmt.Errorf("Unknown bundle format '%s'", format)
+}
+
+// Write sends the bundle, as a download if it has a filename
+func (b *certBundle) Write(w http.ResponseWriter) {
+    w.Header().Set("Content-Type", b.ContentType)
+    if b.Filename != "" {
+        w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", b.Filename))
+    }
+    w.Header().Set("Cache-Control", "no-store")
+    w.Write(b.Data)
+}
+
+// pemText makes sure PEM data ends in a newline so files can be concatenated
+func pemText(s string) string {
+    s = strings.TrimSpace(s)
+    if s == "" {
+        return ""
+    }
+    return s + "\n"
+}
+
+// sanitizeFilename turns a common name into something safe to use as a file
+// name or keystore alias; a leading wildcard becomes "wildcard"
+func sanitizeFilename(name string) string {
+    name = strings.Replace(name, "*", "wildcard", -1)
+    return strings.Trim(strings.Map(func(r rune) rune {
+        switch {
+        case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+            return r
+        }
+        return '_'
+    }, name), "._")
+}
+
+func zipFiles(files ...zipFile) ([]byte, error) {
+    var buf bytes.Buffer
+    archive := zip.NewWriter(&buf)
+    for _, f := range files {
+        header := &zip.FileHeader{Name: f.Name, Method: zip.Deflate}
+        header.SetModTime(time.Now())
+        header.SetMode(f.Mode)
+        file, err := archive.CreateHeader(header)
+        if err != nil {
+            return nil, err
+        }
+        if _, err := file.Write(f.Data); err != nil {
+            return nil, err
+        }
+    }
+    if err := archive.Close(); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+// parseCertificates decodes every CERTIFICATE block in PEM data
+func parseCertificates(pemData string) ([]*x509.Certificate, error) {
+    var certs []*x509.Certificate
+    rest := []byte(pemData)
+    for {
+        var block *pem.Block
+        block, rest = pem.Decode(rest)
+        if block == nil {
+            break
+        }
+        if block.Type != "CERTIFICATE" {
+            continue
+        }
+        cert, err := x509.ParseCertificate(block.Bytes)
+        if err != nil {
+            return nil, err
+        }
+        certs = append(certs, cert)
+    }
+    if len(certs) == 0 && strings.TrimSpace(pemData) != "" {
+        return nil, errors.New("No certificates found in PEM data")
+    }
+    return certs, nil
+}
+
+// pkcs8Key returns the private key in PEM data as PKCS#8 DER, converting
+// from the PKCS#1 and SEC 1 forms Lemur may hand back. Go 1.7 has no
+// x509.MarshalPKCS8PrivateKey, so the wrapping is done here.
+func pkcs8Key(pemData string) ([]byte, error) {
+    block, _ := pem.Decode([]byte(pemData))
+    if block == nil {
+        return nil, errors.New("No private key found in PEM data")
+    }
+    switch block.Type {
+    case "PRIVATE KEY":
+        if _, err := x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+            return nil, err
+        }
+        return block.Bytes, nil
+    case "RSA PRIVATE KEY":
+        key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+        if err != nil {
+            return nil, err
+        }
+        return marshalPKCS8(key)
+    case "EC PRIVATE KEY":
+        key, err := x509.ParseECPrivateKey(block.Bytes)
+        if err != nil {
+            return nil, err
+        }
+        return marshalPKCS8(key)
+    }
+    return nil, fmt.Errorf("Unsupported private key type '%s'", block.Type)
+}
+
+func marshalPKCS8(key interface{}) ([]byte, error) {
+    switch key := key.(type) {
+    case *rsa.PrivateKey:
+        return asn1.Marshal(pkcs8{
+            Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption,
+                                                Parameters: asn1.RawValue{FullBytes: []byte{asn1.TagNull, 0}}},
+            PrivateKey: x509.MarshalPKCS1PrivateKey(key),
+        })
+    case *ecdsa.PrivateKey:
+        curve, ok := oidNamedCurves[key.Curve]
+        if !ok {
+            return nil, errors.New("Unsupported elliptic curve")
+        }
+        params, err := asn1.Marshal(curve)
+        if err != nil {
+            return nil, err
+        }
+        ecKey, err := x509.MarshalECPrivateKey(key)
+        if err != nil {
+            return nil, err
+        }
+        return asn1.Marshal(pkcs8{
+            Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidECPublicKey,
+                                                Parameters: asn1.RawValue{FullBytes: params}},
+            PrivateKey: ecKey,
+        })
+    }
+    return nil, fmt.Errorf("Unsupported private key type %T", key)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+    "archive/zip"
+    "bytes"
+    "crypto/cipher"
+    "crypto/des"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/asn1"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/pem"
+    "io"
+    "io/ioutil"
+    "math/big"
+    "net/http"
+    "testing"
+    "time"
+)
+
+// testChainCertKey issues a throwaway self-signed EC certificate
+func testChainCertKey(t *testing.T) *certChainPubKey {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{SerialNumber: big.NewInt(1),
+                                  Subject: pkix.Name{CommonName: "first.last"},
+                                  NotBefore: time.Now(),
+                                  NotAfter: time.Now().Add(time.Hour)}
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ecKey, _ := x509.MarshalECPrivateKey(key)
+    body := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+    return &certChainPubKey{PublicCertificate: body,
+                            Chain: body,
+                            PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecKey}))}
+}
+
+func TestPKCS12KDF(t *testing.T) {
+    // Test vectors from Bouncy Castle's PKCS12 tests
+    salt, _ := hex.DecodeString("0A58CF64530D823F")
+    key := pkcs12KDF(bmpString("smeg"), salt, 1, 1, 24)
+    if hex.EncodeToString(key) != "8aaae6297b6cb04642ab5b077851284eb7128f1a2a7fbca3" {
+        t.Errorf("pkcs12KDF key derivation does not match the test vector, got %x", key)
+    }
+    iv := pkcs12KDF(bmpString("smeg"), salt, 1, 2, 8)
+    if hex.EncodeToString(iv) != "79993dfe048d3b76" {
+        t.Errorf("pkcs12KDF IV derivation does not match the test vector, got %x", iv)
+    }
+}
+
+func TestBundleOptions(t *testing.T) {
+    request, _ := http.NewRequest("GET", "/v1/certs/1/bundle?format=pkcs12", nil)
+    if _, _, err := bundleOptions(request); err == nil {
+        t.Errorf("pkcs12 bundles should require a password!")
+    }
+    request.Header.Set(BundlePasswordHeader, "changeit")
+    if format, password, err := bundleOptions(request); err != nil || format != BundlePKCS12 || password != "changeit" {
+        t.Errorf("Expected pkcs12 with a password, got %s %s %v", format, password, err)
+    }
+    request, _ = http.NewRequest("GET", "/v1/certs/1/bundle?format=tar", nil)
+    if _, _, err := bundleOptions(request); err == nil {
+        t.Errorf("Unknown formats should be rejected!")
+    }
+    request, _ = http.NewRequest("GET", "/v1/certs/1/bundle", nil)
+    if format, _, err := bundleOptions(request); err != nil || format != BundleJSON {
+        t.Errorf("The default format should be json, got %s %v", format, err)
+    }
+}
+
+func TestPEMZipBundle(t *testing.T) {
+    bundle, err := testChainCertKey(t).Bundle(BundlePEMZip, "*.example.com", "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if bundle.Filename != "wildcard.example.com.zip" || bundle.ContentType != "application/zip" {
+        t.Errorf("Unexpected bundle name or type: %s %s", bundle.Filename, bundle.ContentType)
+    }
+    archive, err := zip.NewReader(bytes.NewReader(bundle.Data), int64(len(bundle.Data)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    files := map[string]int{}
+    for _, file := range archive.File {
+        reader, _ := file.Open()
+        data, _ := ioutil.ReadAll(reader)
+        reader.Close()
+        files[file.Name] = bytes.Count(data, []byte("-----BEGIN"))
+    }
+    if files["cert.pem"] != 1 || files["chain.pem"] != 1 || files["fullchain.pem"] != 2 || files["key.pem"] != 1 {
+        t.Errorf("PEM zip should hold cert, chain, fullchain and key, got %v", files)
+    }
+}
+
+func TestPKCS12Bundle(t *testing.T) {
+    chainCertKey := testChainCertKey(t)
+    bundle, err := chainCertKey.Bundle(BundlePKCS12, "first.last", "changeit")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if bundle.Filename != "first.last.p12" || bundle.ContentType != "application/x-pkcs12" {
+        t.Errorf("Unexpected bundle name or type: %s %s", bundle.Filename, bundle.ContentType)
+    }
+    // "changeit" as a NUL terminated BMPString
+    password := []byte("\x00c\x00h\x00a\x00n\x00g\x00e\x00i\x00t\x00\x00")
+    var pfx pfxPdu
+    if rest, err := asn1.Unmarshal(bundle.Data, &pfx); err != nil || len(rest) > 0 {
+        t.Fatalf("The bundle should be a single PFX: %v", err)
+    }
+    if pfx.Version != 3 || !pfx.AuthSafe.ContentType.Equal(oidData) {
+        t.Fatalf("Expected a version 3 PFX holding data, got %d %v", pfx.Version, pfx.AuthSafe.ContentType)
+    }
+    var authenticatedSafe []byte
+    if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafe); err != nil {
+        t.Fatal(err)
+    }
+    mac := hmac.New(sha1.New, pkcs12KDF(password, pfx.MacData.MacSalt, pfx.MacData.Iterations, 3, 20))
+    mac.Write(authenticatedSafe)
+    if !pfx.MacData.Mac.Algorithm.Algorithm.Equal(oidSHA1) || !hmac.Equal(mac.Sum(nil), pfx.MacData.Mac.Digest) {
+        t.Errorf("The PFX MAC should check out with the password!")
+    }
+    wrong := hmac.New(sha1.New, pkcs12KDF([]byte("\x00x\x00\x00"), pfx.MacData.MacSalt, pfx.MacData.Iterations, 3, 20))
+    wrong.Write(authenticatedSafe)
+    if hmac.Equal(wrong.Sum(nil), pfx.MacData.Mac.Digest) {
+        t.Errorf("The PFX MAC should not check out with the wrong password!")
+    }
+
+    var contents []contentInfo
+    if _, err := asn1.Unmarshal(authenticatedSafe, &contents); err != nil || len(contents) != 2 {
+        t.Fatalf("Expected a key and a certificate ContentInfo, got %d: %v", len(contents), err)
+    }
+    // The shrouded key decrypts to the key we bundled
+    var keyData []byte
+    var keyBags []safeBag
+    if _, err := asn1.Unmarshal(contents[0].Content.Bytes, &keyData); err != nil || !contents[0].ContentType.Equal(oidData) {
+        t.Fatalf("The key should come as data: %v", err)
+    }
+    if _, err := asn1.Unmarshal(keyData, &keyBags); err != nil || len(keyBags) != 1 || !keyBags[0].Id.Equal(oidPKCS8ShroudedKeyBag) {
+        t.Fatalf("Expected one shrouded key bag: %v", err)
+    }
+    var shrouded encryptedPrivateKeyInfo
+    if _, err := asn1.Unmarshal(keyBags[0].Value.Bytes, &shrouded); err != nil {
+        t.Fatal(err)
+    }
+    key, err := x509.ParsePKCS8PrivateKey(pbeDecrypt(t, shrouded.AlgorithmIdentifier, shrouded.EncryptedData, password))
+    if err != nil {
+        t.Fatalf("The shrouded key should decrypt to a PKCS#8 key: %v", err)
+    }
+    block, _ := pem.Decode([]byte(chainCertKey.PrivateKey))
+    original, _ := x509.ParseECPrivateKey(block.Bytes)
+    if ecKey, ok := key.(*ecdsa.PrivateKey); !ok || ecKey.D.Cmp(original.D) != 0 {
+        t.Errorf("The shrouded key should be the bundled key!")
+    }
+
+    // Then the leaf and chain in order, the leaf tied to the key
+    var encrypted encryptedData
+    var certBags []safeBag
+    if !contents[1].ContentType.Equal(oidEncryptedData) {
+        t.Fatalf("Certificates should be encrypted, got %v", contents[1].ContentType)
+    }
+    if _, err := asn1.Unmarshal(contents[1].Content.Bytes, &encrypted); err != nil {
+        t.Fatal(err)
+    }
+    info := encrypted.EncryptedContentInfo
+    if _, err := asn1.Unmarshal(pbeDecrypt(t, info.ContentEncryptionAlgorithm, info.EncryptedContent, password), &certBags); err != nil {
+        t.Fatal(err)
+    }
+    leaf, _ := pem.Decode([]byte(chainCertKey.PublicCertificate))
+    chain, _ := pem.Decode([]byte(chainCertKey.Chain))
+    expected := [][]byte{leaf.Bytes, chain.Bytes}
+    if len(certBags) != len(expected) {
+        t.Fatalf("Expected the leaf and chain, got %d certificates", len(certBags))
+    }
+    for i, bag := range certBags {
+        var cert certBag
+        if _, err := asn1.Unmarshal(bag.Value.Bytes, &cert); err != nil || !bag.Id.Equal(oidCertBag) ||
+           !cert.Id.Equal(oidX509Certificate) || !bytes.Equal(cert.Data, expected[i]) {
+            t.Errorf("Certificate %d should be the bundled one: %v", i, err)
+        }
+    }
+    if len(keyBags[0].Attributes) == 0 || len(certBags[0].Attributes) != len(keyBags[0].Attributes) ||
+       !bytes.Equal(keyBags[0].Attributes[0].Value.FullBytes, certBags[0].Attributes[0].Value.FullBytes) {
+        t.Errorf("The key and leaf should share their attributes!")
+    }
+}
+
+// pbeDecrypt undoes pbeWithSHAAnd3-KeyTripleDES-CBC and its padding
+func pbeDecrypt(t *testing.T, algorithm pkix.AlgorithmIdentifier, data, password []byte) []byte {
+    var params pbeParams
+    if !algorithm.Algorithm.Equal(oidPBEWithSHAAnd3KeyTDES) {
+        t.Fatalf("Expected pbeWithSHAAnd3-KeyTripleDES-CBC, got %v", algorithm.Algorithm)
+    }
+    if _, err := asn1.Unmarshal(algorithm.Parameters.FullBytes, &params); err != nil {
+        t.Fatal(err)
+    }
+    block, err := des.NewTripleDESCipher(pkcs12KDF(password, params.Salt, params.Iterations, 1, 24))
+    if err != nil || len(data) == 0 || len(data) % block.BlockSize() != 0 {
+        t.Fatalf("Encrypted data should be whole 3DES blocks: %v", err)
+    }
+    plain := make([]byte, len(data))
+    cipher.NewCBCDecrypter(block, pkcs12KDF(password, params.Salt, params.Iterations, 2, 8)).CryptBlocks(plain, data)
+    padding := int(plain[len(plain) - 1])
+    if padding < 1 || padding > block.BlockSize() || !bytes.Equal(plain[len(plain) - padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+        t.Fatalf("Decrypted data should end in PKCS#7 padding!")
+    }
+    return plain[:len(plain) - padding]
+}
+
+// knownJKS is a keystore holding one EC key under alias first.last with
+// password changeit. It was written from the JDK's JavaKeyStore and
+// KeyProtector sources rather than with jks.go, protecting the key with the
+// salt 00 01 .. 13 and dating the entry 1500000000000 ms.
+const knownJKS = 
+    "/u3+7QAAAAIAAAABAAAAAQAKZmlyc3QubGFzdAAAAV0+95gAAAAAyDCBxTAOBgor" +
+    "BgEEASoCEQEBBQAEgbIAAQIDBAUGBwgJCgsMDQ4PEBESEzA7wuJtcJfWlbuOjM4J" +
+    "UZVee6q4nTS1UG5/7ze9ZJYwhd7HarscIfPW0Q/y29em/K/xuN+L4wj2sQ2vF/gh" +
+    "gmQ/h2RH+HnxWLWa3UH/Z0h0b8UWvCOAUcSDJ6JGsNd7Msz+BR3f6X8nlZc72hG8" +
+    "nz1UeXEZXcKzRsnhCzo75AhfEEVVigrYfnlEL7MaRbk1W7NJCpkNRoZHt+CT//dT" +
+    "AAAAAQAFWC41MDkAAAFyMIIBbjCCARSgAwIBAgIBATAKBggqhkjOPQQDAjAVMRMw" +
+    "EQYDVQQDDApmaXJzdC5sYXN0MCAXDTI2MTAxODA0MzgwNVoYDzIxMjYwOTI0MDQz" +
+    "ODA1WjAVMRMwEQYDVQQDDApmaXJzdC5sYXN0MFkwEwYHKoZIzj0CAQYIKoZIzj0D" +
+    "AQcDQgAEk8jg5gSFPJH2jlpp/exxXOOwkMjA76p1w1GZ8RhfP4XahoU+JVWR4YzS" +
+    "qIy7sLSMQHMNy84F3z3RBUWU5Z8IbqNTMFEwHQYDVR0OBBYEFACWu/Jv02Os64av" +
+    "jxPpl3AoBIFFMB8GA1UdIwQYMBaAFACWu/Jv02Os64avjxPpl3AoBIFFMA8GA1Ud" +
+    "EwEB/wQFMAMBAf8wCgYIKoZIzj0EAwIDSAAwRQIhAKvJjxYtcB5SniS3qrFM9KkV" +
+    "MUQg/ZTLH9NfLzQUeqTCAiAp63GvLpzmxN9v8AKFfmJBz1vIb5WmjVjXVRuKhzcl" +
+    "++Rgz/2F39MddpwJkM4iwQgcW2yZ"
+
+// jksEntry is a keystore entry as read back by readJKS
+type jksEntry struct {
+    alias   string
+    created int64
+    key     []byte
+    chain   [][]byte
+}
+
+// readJKS parses a keystore the way keytool does, checking its integrity
+// digest and unprotecting private keys with the UTF-16 password
+func readJKS(t *testing.T, store, password []byte) []jksEntry {
+    if len(store) < 12 + sha1.Size {
+        t.Fatalf("A keystore of %d bytes is too short!", len(store))
+    }
+    body := store[:len(store) - sha1.Size]
+    digest := sha1.New()
+    digest.Write(password)
+    digest.Write([]byte("Mighty Aphrodite"))
+    digest.Write(body)
+    if !bytes.Equal(digest.Sum(nil), store[len(body):]) {
+        t.Fatalf("Keystore integrity digest does not match!")
+    }
+    reader := bytes.NewReader(body)
+    var header struct {
+        Magic, Version, Count uint32
+    }
+    binary.Read(reader, binary.BigEndian, &header)
+    if header.Magic != 0xFEEDFEED || header.Version != 2 {
+        t.Fatalf("Keystore should start with the JKS magic and version 2, got %x %d", header.Magic, header.Version)
+    }
+    readBytes := func(size int) []byte {
+        data := make([]byte, size)
+        if _, err := io.ReadFull(reader, data); err != nil {
+            t.Fatalf("Keystore is truncated: %v", err)
+        }
+        return data
+    }
+    readUTF := func() string {
+        var size uint16
+        binary.Read(reader, binary.BigEndian, &size)
+        return string(readBytes(int(size)))
+    }
+    readCert := func() []byte {
+        var size uint32
+        if certType := readUTF(); certType != "X.509" {
+            t.Fatalf("Expected an X.509 certificate, got %q", certType)
+        }
+        binary.Read(reader, binary.BigEndian, &size)
+        return readBytes(int(size))
+    }
+    var entries []jksEntry
+    for i := uint32(0); i < header.Count; i++ {
+        var tag, size, chainLength uint32
+        var entry jksEntry
+        binary.Read(reader, binary.BigEndian, &tag)
+        entry.alias = readUTF()
+        binary.Read(reader, binary.BigEndian, &entry.created)
+        switch tag {
+        case 1:
+            binary.Read(reader, binary.BigEndian, &size)
+            entry.key = unprotectJKSKey(t, readBytes(int(size)), password)
+            binary.Read(reader, binary.BigEndian, &chainLength)
+            for j := uint32(0); j < chainLength; j++ {
+                entry.chain = append(entry.chain, readCert())
+            }
+        case 2:
+            entry.chain = [][]byte{readCert()}
+        default:
+            t.Fatalf("Unknown keystore entry type %d", tag)
+        }
+        entries = append(entries, entry)
+    }
+    if reader.Len() != 0 {
+        t.Errorf("Keystore has %d bytes left after its entries!", reader.Len())
+    }
+    return entries
+}
+
+// unprotectJKSKey undoes Sun's KeyProtector and checks the key's checksum
+func unprotectJKSKey(t *testing.T, protected, password []byte) []byte {
+    var info encryptedPrivateKeyInfo
+    if _, err := asn1.Unmarshal(protected, &info); err != nil {
+        t.Fatal(err)
+    }
+    if !info.AlgorithmIdentifier.Algorithm.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}) {
+        t.Fatalf("Keys should be protected with Sun's KeyProtector, got %v", info.AlgorithmIdentifier.Algorithm)
+    }
+    if len(info.EncryptedData) < 2 * sha1.Size {
+        t.Fatalf("Protected key is too short!")
+    }
+    salt := info.EncryptedData[:sha1.Size]
+    encrypted := info.EncryptedData[sha1.Size:len(info.EncryptedData) - sha1.Size]
+    plain := make([]byte, len(encrypted))
+    digest := salt
+    for i := range encrypted {
+        if i % sha1.Size == 0 {
+            hash := sha1.New()
+            hash.Write(password)
+            hash.Write(digest)
+            digest = hash.Sum(nil)
+        }
+        plain[i] = encrypted[i] ^ digest[i % sha1.Size]
+    }
+    checksum := sha1.New()
+    checksum.Write(password)
+    checksum.Write(plain)
+    if !bytes.Equal(checksum.Sum(nil), info.EncryptedData[len(info.EncryptedData) - sha1.Size:]) {
+        t.Fatalf("Protected key checksum does not match!")
+    }
+    return plain
+}
+
+func TestJKSKeystore(t *testing.T) {
+    // "changeit" in UTF-16, as Java hashes it
+    password := []byte("\x00c\x00h\x00a\x00n\x00g\x00e\x00i\x00t")
+    known, _ := base64.StdEncoding.DecodeString(knownJKS)
+    entries := readJKS(t, known, password)
+    if len(entries) != 1 || entries[0].alias != "first.last" || entries[0].created != 1500000000000 || len(entries[0].chain) != 1 {
+        t.Fatalf("The known keystore should hold first.last's key and certificate, got %+v", entries)
+    }
+    if _, err := x509.ParsePKCS8PrivateKey(entries[0].key); err != nil {
+        t.Fatalf("The known keystore's key should be PKCS#8: %v", err)
+    }
+    cert, err := x509.ParseCertificate(entries[0].chain[0])
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Given the same key, salt and date ours comes out byte for byte the same
+    salt := make([]byte, sha1.Size)
+    for i := range salt {
+        salt[i] = byte(i)
+    }
+    protectedKey, err := jksProtectKeyWithSalt(entries[0].key, "changeit", salt)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var keystore jksWriter
+    keystore.PrivateKey("first.last", protectedKey, []*x509.Certificate{cert}, time.Unix(1500000000, 0))
+    if !bytes.Equal(keystore.Bytes("changeit"), known) {
+        t.Errorf("Keystore should match the known one!")
+    }
+
+    // EncodeJKS puts the key and whole chain in the keystore, and the CA
+    // certificates alone in the truststore
+    chainCertKey := testChainCertKey(t)
+    key, err := pkcs8Key(chainCertKey.PrivateKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    certs, _ := parseCertificates(chainCertKey.PublicCertificate)
+    keystoreData, truststoreData, err := EncodeJKS(key, certs[0], certs, "first.last", "changeit")
+    if err != nil {
+        t.Fatal(err)
+    }
+    entries = readJKS(t, keystoreData, password)
+    if len(entries) != 1 || entries[0].alias != "first.last" || !bytes.Equal(entries[0].key, key) ||
+       len(entries[0].chain) != 2 || !bytes.Equal(entries[0].chain[0], certs[0].Raw) {
+        t.Errorf("The keystore should hold the key and its chain under the alias, got %+v", entries)
+    }
+    entries = readJKS(t, truststoreData, password)
+    if len(entries) != 1 || entries[0].key != nil || entries[0].alias != "first.last-0" || !bytes.Equal(entries[0].chain[0], certs[0].Raw) {
+        t.Errorf("The truststore should hold the chain as trusted certificates, got %+v", entries)
+    }
+}
@@ -1,52 +1,32 @@
 package main
 
 import (
-    "gopkg.in/yaml.v2"
+    "crypto/x509"
     "crypto/sha256"
     "encoding/base64"
-    "time"
-    "strings"
     "net/http"
-    "encoding/json"
-    "bytes"
-    "io/ioutil"
-    "os"
-    "fmt"
-    "errors"
-    "sync"
-)
-
-const (
-    LemurUserEnv      = "LEMUR_USER"
-    LemurPasswordEnv  = "LEMUR_PASS"
-    LemurUrl          = "https://lemur.example.com"
-    LemurApiVersion   = "/api/1"
-    AuthorityUri      = "/authorities"
-    DestinationsUri   = "/destinations"
-    CertificatesUri   = "/certificates"
-    AuthorizeUri      = "/auth/login"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
 )
 
-type authToken struct {
-    Token string `json:"token"`
-}
-
-type LemurRequester struct {
-    Token     string
-    Client    *http.Client
-}
-
-type Authority struct {
-    Name  string
-    Id    int
-}
-
 type certJsonRequest struct {
     Authority           string                                `yaml:"authority"           json:"authority"`
     CommonName          string                                `yaml:"commonName"          json:"commonName"`
     Email               string                                `yaml:"owner"               json:"owner"`
     StartDate           string                                `yaml:"validityStart"       json:"validityStart"`
     EndDate             string                                `yaml:"validityEnd"         json:"validityEnd"`
+    Destinations        []string                              `yaml:"destinations"        json:"destinations"`
+    CSR                 string                                `yaml:"csr"                 json:"csr"`
+    Profile             string                                `yaml:"profile"             json:"profile"`
+    KeyType             string                                `yaml:"keyType"             json:"keyType"`
+}
+
+// lemurRef refers to an existing Lemur object by id
+type lemurRef struct {
+    Id                  int                                   `yaml:"id"                  json:"id"`
 }
 
 type certManifest struct {
@@ -63,235 +43,236 @@ type certManifest struct {
     OrganizationalUnit  string                                `yaml:"organizationalUnit"  json:"organizationalUnit"`
     Active              bool                                  `yaml:"active"              json:"active"`
     Extensions          map[string]map[string]map[string]bool `yaml:"extensions"          json:"extensions"`
-    Once                sync.Once                             `yaml:"-"                   json:"-"`
+    Destinations        []lemurRef                            `yaml:"destinations,omitempty" json:"destinations,omitempty"`
+    CSR                 string                                `yaml:"csr,omitempty"       json:"csr,omitempty"`
+    KeyType             string                                `yaml:"keyType,omitempty"   json:"keyType,omitempty"`
+    profile             string
+    requestedWindow     string
+    destinations        []Destination
 }
 
 type certChainPubKey struct {
     Chain             string `yaml:"chain"      json:"chain"`
     PublicCertificate string `yaml:"pubcert"    json:"pubcert"`
-    PrivateKey        string `yaml:"privatekey" json:"privatekey"`
+    PrivateKey        string `yaml:"privatekey,omitempty" json:"privatekey,omitempty"`
+    Destinations      []DestinationStatus `yaml:"destinations,omitempty" json:"destinations,omitempty"`
+    leaf              *x509.Certificate
+}
+
+// NewCertManifest builds the manifest sent to Lemur using the built-in
+// client-2w profile. Any destinations given are attached to the certificate
+// so Lemur uploads it to them on creation.
+func NewCertManifest(authority, commonName, email, start, end, rbacgroup string, destinations ...Destination) (*certManifest) {
+    return defaultCertProfile.NewCertManifest(authority, commonName, email, start, end, rbacgroup, destinations...)
 }
 
-func NewCertManifest(authority, commonName, email, start, end, rbacgroup string) (*certManifest) {
-    var extensions = map[string]map[string]map[string]bool{
-        "extensions": {"keyUsage": {"isCritical": true,
-                                    "useDigitalSignature": true},
-                       "extendedKeyUsage": {"isCritical": true,
-                                            "clientAuth": true},
-                       "subjectKeyIdentifier": {"isCritical": false,
-                                                "includeSKI": true}}}
+// NewCertManifest builds the manifest sent to Lemur for a certificate of
+// this profile. The subject fields and extensions come from the profile.
+func (p *CertProfile) NewCertManifest(authority, commonName, email, start, end, rbacgroup string, destinations ...Destination) (*certManifest) {
+    return p.newCertManifest(authority, commonName, email, start, end, rbacgroup, destinations)
+}
+
+// NewCSRCertManifest builds a manifest asking Lemur to sign a CSR instead of
+// generating a key. The common name is taken from the CSR.
+func (p *CertProfile) NewCSRCertManifest(authority, csrPEM, commonName, email, start, end, rbacgroup string, destinations ...Destination) (*certManifest) {
+    man := p.newCertManifest(authority, commonName, email, start, end, rbacgroup, destinations)
+    man.CSR = csrPEM
+    return man
+}
+
+func (p *CertProfile) newCertManifest(authority, commonName, email, start, end, rbacgroup string, destinations []Destination) (*certManifest) {
+    organization, organizationalUnit := p.Organization, p.OrganizationalUnit
+    if organization == "" {
+        organization = rbacgroup
+    }
+    if organizationalUnit == "" {
+        organizationalUnit = rbacgroup
+    }
     authObj := map[string]string{"name": authority}
     man := certManifest{Authority: authObj,
                         CommonName: commonName,
                         Email: email,
                         StartDate: start,
                         EndDate: end,
-                        Description: "Temporary Client Certificate (2 weeks)",
-                        Country: "US",
-                        State: "OR",
-                        Location: "Portland",
-                        Organization: rbacgroup,
-                        OrganizationalUnit: rbacgroup,
+                        Description: p.Description,
+                        Country: p.Country,
+                        State: p.State,
+                        Location: p.Location,
+                        Organization: organization,
+                        OrganizationalUnit: organizationalUnit,
                         Active: true,
-                        Extensions: extensions}
-    man.makeDigest() // make sure this is the only call to makeDigest
+                        Extensions: p.extensions(),
+                        profile: p.Name,
+                        destinations: destinations}
+    for _, destination := range destinations {
+        man.Destinations = append(man.Destinations, lemurRef{Id: destination.Id})
+    }
     return &man
 }
 
-// makeDigest hashes the description of the certificate manifest, guaranteeing
-// that it is unique and therefore searchable. Useful since tracking IDs is
-// difficult.
+// Fingerprint identifies what a manifest asks for, so that a reused
+// idempotency key can be told apart from a retry. Only the fields a client
+// controls are hashed, in a fixed order.
 // Called on a certManifest pointer
-// Returns nothing
-func (c *certManifest) makeDigest(){
-    c.Once.Do(func() {
-        bytesBuf, _ := yaml.Marshal(*c)
-        hasher := sha256.New()
-        hasher.Write(bytesBuf)
-        desc := fmt.Sprintf("%s:%s",
-                            base64.URLEncoding.EncodeToString(hasher.Sum(nil)),
-                            c.Description)
-        c.Description = desc
-    })
-}
-
-func (l *LemurRequester) doCheckRequest(r *http.Request) ([]byte, error) {
-    r.Header.Set("Content-Type", "application/json")
-    r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", l.Token))
-    response, err := l.Client.Do(r)
-    if err != nil {
-        Logs.Errorf("Unable to make HTTP Client Request to '%+v'\nError: %+v\n", r, err)
-        return nil, err
+// Returns the fingerprint as a string
+func (c *certManifest) Fingerprint() string {
+    destinations := []string{}
+    for _, destination := range c.Destinations {
+        destinations = append(destinations, strconv.Itoa(destination.Id))
     }
-    nonErrorHttpHundreds := map[int]bool{2: true, 3: true}
-    if !nonErrorHttpHundreds[response.StatusCode / 100] {
-        defer response.Body.Close()
-        body, _ := ioutil.ReadAll(response.Body)
-        return nil, fmt.Errorf("Bad response (%+v) from request (%+v), response body: '%+v'", response.StatusCode, r.URL, string(body))
+    sort.Strings(destinations)
+    // Relative windows resolve differently on every retry, so use the window
+    // as the client wrote it when we have it
+    window := c.requestedWindow
+    if window == "" {
+        window = c.StartDate + "/" + c.EndDate
     }
-    bufferBody, err := ioutil.ReadAll(response.Body)
-    if err != nil {
-        Logs.Errorf("Unable to read response body from request'%+v'\nError: %+v\n", r, err)
-        return nil, err
+    fields := []string{c.profile,
+                       c.Authority["name"],
+                       c.CommonName,
+                       c.Email,
+                       window,
+                       c.Organization,
+                       strings.TrimSpace(c.CSR),
+                       c.KeyType,
+                       strings.Join(destinations, ",")}
+    hasher := sha256.New()
+    for _, field := range fields {
+        hasher.Write([]byte(field))
+        hasher.Write([]byte{0})
     }
-    return bufferBody, nil
+    return base64.URLEncoding.EncodeToString(hasher.Sum(nil))
 }
 
-
-func (l *LemurRequester) getAuthToken() (error) {
-    if len(l.Token) > 0 {
-        return nil
-    }
-    user := os.Getenv(LemurUserEnv)
-    if len(user) == 0 {
-        return errors.New("LEMUR_USER|LEMUR_PASS environment variable(s) not set. Cannot continue.")
-    }
-    pass := os.Getenv(LemurPasswordEnv)
-    l.Client = &http.Client{Timeout: time.Second * 30}
-    data := map[string]string{"username": user, "password": pass}
-    jsonData, _ := json.Marshal(&data)
-    address := []string{LemurUrl, LemurApiVersion, AuthorizeUri}
-    authReq, err := http.NewRequest("POST",
-                                    strings.Join(address, ""),
-                                    bytes.NewBuffer(jsonData))
-    bufferBody, err := l.doCheckRequest(authReq)
-    if err != nil {
-        return err
-    }
-    var tokenBody authToken
-    decoder := json.NewDecoder(bytes.NewReader(bufferBody))
-    decoder.UseNumber()
-    if err := decoder.Decode(&tokenBody); err != nil {
-        return err
-    }
-    l.Token = tokenBody.Token
-    return nil
-}
-
-// ValidateCert checks the manifest for existing certificates and creates one
-// if none are found
+// ValidateCert issues a certificate for the manifest and returns its
+// verified material. With an idempotency key, a retry of an earlier request
+// returns the certificate that request issued, unless it has since been
+// revoked or deactivated, in which case a new one is issued for the key.
 // Called on a LemurRequester pointer
-// Takes a certManifest pointer as argument
+// Takes a certManifest pointer and an idempotency key (may be empty) as
+// arguments
 // Returns a certChainPubKey pointer and an error
-func (l *LemurRequester) ValidateCert(c *certManifest) (*certChainPubKey, error) {
-    if err := l.getAuthToken(); err != nil {
-        Logs.Errorf("Error ensuring auth token in ValidateCert\nError: %+v\n", err)
+func (l *LemurRequester) ValidateCert(c *certManifest, idempotencyKey string) (*certChainPubKey, error) {
+    cert, err := l.issueOnce(c, idempotencyKey)
+    if err != nil {
         return nil, err
     }
-    address := []string{LemurUrl, LemurApiVersion, CertificatesUri}
-    getCertReq, err := http.NewRequest("GET",
-                                       strings.Join(address, ""),
-                                       nil)
-    query := getCertReq.URL.Query()
-    query.Add("sortBy", "date_created")
-    query.Add("sortDir", "desc")
-    query.Add("filter", fmt.Sprintf("%s;%s", "description", c.Description))
-    getCertReq.URL.RawQuery = query.Encode()
-    Logs.Infof("Making request to url %+v", getCertReq.URL)
-    bufferBody, err := l.doCheckRequest(getCertReq)
+    // Keys for CSR certificates never reach Lemur, so there is nothing to fetch
+    withKey := c.CSR == "" && l.KeyFetchAllowed(c.Authority["name"])
+    chainCertKey, err := l.CertChainPubKey(cert, withKey)
     if err != nil {
         return nil, err
     }
-    var certificates interface{}
-    decoder := json.NewDecoder(bytes.NewReader(bufferBody))
-    decoder.UseNumber()
-    err = decoder.Decode(&certificates)
-    if err != nil {
-        Logs.Errorf("Unable to Unmarshal certificates data to json: %+v", err)
+    if _, err := l.VerifyCertMaterial(chainCertKey, cert, c); err != nil {
         return nil, err
     }
-    certsMap := certificates.(map[string]interface{})
-    numCerts, err := certsMap["total"].(json.Number).Int64()
+    chainCertKey.Destinations = destinationStatuses(c.destinations, cert)
+    return chainCertKey, nil
+}
+
+// issueOnce creates the manifest's certificate in Lemur, or, if the
+// idempotency key already has a usable certificate, looks that one up
+// Called on a LemurRequester pointer
+// Takes a certManifest pointer and an idempotency key (may be empty) as
+// arguments
+// Returns a Certificate pointer and an error
+func (l *LemurRequester) issueOnce(c *certManifest, idempotencyKey string) (*Certificate, error) {
+    if idempotencyKey == "" {
+        return l.createCert(c)
+    }
+    fingerprint := c.Fingerprint()
+    id, err := l.idempotency.Begin(idempotencyKey, fingerprint)
     if err != nil {
         return nil, err
     }
-    var newestCert map[string]interface{}
-    if numCerts < 1 {
-        Logs.Infof("No cert matching manifest exists yet. Trying to create new cert.\n")
-        newestCert, err = l.createCert(c)
-        if err != nil {
-            Logs.Errorf("Unable to create new certificate: %+v\n", err)
+    issued := 0
+    defer func() { l.idempotency.Finish(idempotencyKey, fingerprint, issued) }()
+    if id != 0 {
+        cert, err := l.GetCertificate(id)
+        if lemurErr, ok := err.(*LemurError); ok && lemurErr.StatusCode == http.StatusNotFound {
+            Logs.Infof("Certificate %d for this idempotency key no longer exists. Issuing a new one.", id)
+        } else if err != nil {
             return nil, err
+        } else if !cert.IsUsable() {
+            Logs.Infof("Certificate %d for this idempotency key is revoked or inactive. Issuing a new one.", id)
+        } else {
+            Logs.Infof("Idempotency key matches certificate %d. Returning it.", id)
+            LemurCertsStatsd.Incr("idempotent.replayed", nil, 1)
+            issued = id
+            return cert, nil
         }
-    } else {
-        // else certs >= 1, so just use the newest one
-        Logs.Infof("At least one cert matching manifest exist. Returning newest instance.\n")
-        items := certsMap["items"].([]interface{})
-        newestCert = items[0].(map[string]interface{})
     }
-    chain := newestCert["chain"].(string)
-    body := newestCert["body"].(string)
-    certId, _ := newestCert["id"].(json.Number).Int64()
-    key, err := l.getCertKeyById(certId)
+    cert, err := l.createCert(c)
     if err != nil {
-        Logs.Errorf("Unable to get certificate key by id: %+v\n", err)
         return nil, err
     }
-    return &certChainPubKey{Chain: chain,
-                            PublicCertificate: body,
-                            PrivateKey: key}, nil
+    issued = cert.Id
+    return cert, nil
 }
 
-// createCert creates a new certificate
+// FindIssued looks in Lemur for a certificate already issued for the
+// manifest since the given time: the newest usable one with its common name
+// and authority whose material verifies against the manifest. Unlike
+// idempotency keys, which may only be kept in memory, this survives
+// restarts.
 // Called on a LemurRequester pointer
-// Takes a certManifest pointer as argument
-// Returns a map of string to interface and an error
-func (l *LemurRequester) createCert(c *certManifest) (map[string]interface{}, error) {
-    if err := l.getAuthToken(); err != nil {
-        Logs.Errorf("Error ensuring auth token in getCertKeyById()\nError: %+v\n", err)
-        return nil, err
-    }
-    jsonData, _ := json.Marshal(*c)
-    address := []string{LemurUrl, LemurApiVersion, CertificatesUri}
-    Logs.Infof("Trying to create new certificate with address %+v and data %+v", address, string(jsonData))
-    certReq, err := http.NewRequest("POST",
-                                    strings.Join(address, ""),
-                                    bytes.NewReader(jsonData))
-    bufferBody, err := l.doCheckRequest(certReq)
-    if err != nil {
-        Logs.Errorf("Unable to POST request for new certificate: %+v", err)
-        return nil, err
-    }
-    var certificates interface{}
-    decoder := json.NewDecoder(bytes.NewReader(bufferBody))
-    decoder.UseNumber()
-    if err := decoder.Decode(&certificates); err != nil {
-        Logs.Errorf("Unable to Unmarshal new certificate data to json\nError: %+v\n", err)
-        return nil, err
+// Takes a certManifest pointer and the earliest creation time to accept
+// Returns a certChainPubKey pointer, nil if there is no such certificate,
+// and an error
+func (l *LemurRequester) FindIssued(c *certManifest, since time.Time) (*certChainPubKey, error) {
+    query := url.Values{}
+    query.Set("filter", "cn;" + c.CommonName)
+    query.Set("sortBy", "date_created")
+    query.Set("sortDir", "desc")
+    certs := l.IterateCertificates(query)
+    for certs.Next() {
+        cert := certs.Certificate()
+        created, err := parseLemurTime(cert.DateCreated)
+        if err != nil {
+            continue
+        }
+        if created.Before(since) {
+            break
+        }
+        // Lemur's filter matches substrings
+        if !strings.EqualFold(cert.CN, c.CommonName) || !cert.IsUsable() ||
+           cert.Authority == nil || cert.Authority.Name != c.Authority["name"] {
+            continue
+        }
+        withKey := c.CSR == "" && l.KeyFetchAllowed(c.Authority["name"])
+        chainCertKey, err := l.CertChainPubKey(cert, withKey)
+        if err != nil {
+            return nil, err
+        }
+        if _, err := l.VerifyCertMaterial(chainCertKey, cert, c); err != nil {
+            Logs.Infof("Certificate %d does not match the request, not reusing it: %v", cert.Id, err)
+            continue
+        }
+        chainCertKey.Destinations = destinationStatuses(c.destinations, cert)
+        return chainCertKey, nil
     }
-    certsMap := certificates.(map[string]interface{})
-    return certsMap, nil
+    return nil, certs.Err()
 }
 
-// getCertKeyById gets the private key for a certificate given that cert's id
+// CertChainPubKey pairs an issued certificate's body and chain with its
+// private key, fetched from Lemur only if withKey is set
 // Called on a LemurRequester pointer
-// Takes an int as argument
-// Returns a string and an error
-func (l *LemurRequester) getCertKeyById(id int64) (string, error) {
-    if err := l.getAuthToken(); err != nil {
-        Logs.Errorf("Error ensuring auth token in getCertKeyById()\nError: %+v\n", err)
-        return "", err
+// Takes a Certificate pointer and a bool as arguments
+// Returns a certChainPubKey pointer and an error
+func (l *LemurRequester) CertChainPubKey(cert *Certificate, withKey bool) (*certChainPubKey, error) {
+    if err := cert.CheckIssued(); err != nil {
+        Logs.Errorf("Lemur returned an incomplete certificate: %+v\n", err)
+        return nil, err
     }
-    address := []string{LemurUrl,
-                        LemurApiVersion,
-                        CertificatesUri,
-                        fmt.Sprintf("/%d",id),
-                        "/key"}
-    getCertKeyReq, err := http.NewRequest("GET",
-                                          strings.Join(address, ""),
-                                          nil)
-    bufferBody, err := l.doCheckRequest(getCertKeyReq)
-    if err != nil {
-        return "", err
+    chainCertKey := &certChainPubKey{Chain: *cert.Chain, PublicCertificate: cert.Body}
+    if !withKey {
+        return chainCertKey, nil
     }
-    var key interface{}
-    decoder := json.NewDecoder(bytes.NewReader(bufferBody))
-    decoder.UseNumber()
-    if err := decoder.Decode(&key); err != nil {
-        Logs.Errorf("Unable to Unmarshal certificate key to json. Error: %+v\n", err)
-        return "", err
+    key, err := l.getCertKeyById(cert.Id)
+    if err != nil {
+        Logs.Errorf("Unable to get certificate key by id: %+v\n", err)
+        return nil, err
     }
-    keyMap := key.(map[string]interface{})
-    certKey := keyMap["key"].(string)
-    return certKey, nil
+    chainCertKey.PrivateKey = key
+    return chainCertKey, nil
 }
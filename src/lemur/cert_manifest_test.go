@@ -19,9 +19,18 @@ func TestNewCertManifest(t *testing.T) {
        man.EndDate != "1970-01-02" {
         t.Errorf("NewCertManifest should result in a *certManifest with populated fields!")
     }
-    desc := man.Description
-    man.makeDigest()
-    if desc != man.Description {
-        t.Errorf("Calls to .makeDigest() should not change the description!")
+    if man.Description != "Temporary Client Certificate (2 weeks)" {
+        t.Errorf("The description should be left readable, got '%s'", man.Description)
+    }
+    same := NewCertManifest("test_authority", "common.name", "email@example.com", "1970-01-01", "1970-01-02", "TestOrg")
+    other := NewCertManifest("test_authority", "common.name", "email@example.com", "1970-01-01", "1970-01-03", "TestOrg")
+    if man.Fingerprint() != same.Fingerprint() || man.Fingerprint() == other.Fingerprint() {
+        t.Errorf("Fingerprints should match only for identical requests!")
+    }
+    // A relative window resolves to different dates on a retry
+    retry := NewCertManifest("test_authority", "common.name", "email@example.com", "1970-01-01", "1970-01-03", "TestOrg")
+    man.requestedWindow, retry.requestedWindow = "/14d", "/14d"
+    if man.Fingerprint() != retry.Fingerprint() {
+        t.Errorf("Fingerprints should use the window as requested!")
     }
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/asn1"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "strings"
+)
+
+const MinCSRRSABits = 2048
+
+var oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// csrExtensions are the extensions a CSR may ask for. Anything else, from
+// name constraints to basic constraints, is refused rather than passed on
+// to the authority.
+var csrExtensions = map[string]bool{"2.5.29.14": true, // subjectKeyIdentifier
+                                    "2.5.29.15": true, // keyUsage
+                                    "2.5.29.17": true, // subjectAltName
+                                    "2.5.29.37": true} // extKeyUsage
+
+// csrSANTags are the GeneralName tags a CSR's subjectAltName may use:
+// rfc822Name, dNSName and iPAddress. URIs (e.g. spiffe://), directory names
+// and otherNames are refused.
+var csrSANTags = map[int]string{1: "email", 2: "DNS", 7: "IP"}
+
+// ErrNoPrivateKey is returned when a bundle needs a private key that the
+// portal does not have, because the certificate was issued from a CSR or
+// its authority has key fetching disabled
+var ErrNoPrivateKey = errors.New("No private key is available for this certificate; it was issued from a CSR or its authority does not allow key retrieval")
+
+// CSRError explains why a CSR was rejected; its message is shown to callers
+type CSRError struct {
+    Reason string
+}
+
+func (e *CSRError) Error() string {
+    return fmt.Sprintf("Invalid CSR: %s", e.Reason)
+}
+
+// ParseCSR decodes a PEM certificate signing request and checks that it is
+// signed by the key it carries and that the key is strong enough
+// Takes a PEM string as argument
+// Returns an x509.CertificateRequest pointer and an error
+func ParseCSR(csrPEM string) (*x509.CertificateRequest, error) {
+    block, _ := pem.Decode([]byte(csrPEM))
+    if block == nil || (block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST") {
+        return nil, &CSRError{Reason: "no PEM CERTIFICATE REQUEST block found"}
+    }
+    csr, err := x509.ParseCertificateRequest(block.Bytes)
+    if err != nil {
+        return nil, &CSRError{Reason: err.Error()}
+    }
+    if err := csr.CheckSignature(); err != nil {
+        return nil, &CSRError{Reason: fmt.Sprintf("signature does not verify: %v", err)}
+    }
+    switch key := csr.PublicKey.(type) {
+    case *rsa.PublicKey:
+        if key.N.BitLen() < MinCSRRSABits {
+            return nil, &CSRError{Reason: fmt.Sprintf("RSA keys must be at least %d bits", MinCSRRSABits)}
+        }
+    case *ecdsa.PublicKey:
+        if key.Curve.Params().BitSize < 256 {
+            return nil, &CSRError{Reason: "EC keys must use P-256 or a larger curve"}
+        }
+    default:
+        return nil, &CSRError{Reason: "only RSA and EC keys are accepted"}
+    }
+    return csr, nil
+}
+
+// checkCSRExtensions makes sure a CSR only asks for the extensions and SAN
+// types in csrExtensions and csrSANTags
+// Takes the CSR
+// Returns an error
+func checkCSRExtensions(csr *x509.CertificateRequest) error {
+    for _, extension := range csr.Extensions {
+        if !csrExtensions[extension.Id.String()] {
+            return &CSRError{Reason: fmt.Sprintf("extension %s is not allowed", extension.Id)}
+        }
+        if !extension.Id.Equal(oidSubjectAltName) {
+            continue
+        }
+        var names asn1.RawValue
+        rest, err := asn1.Unmarshal(extension.Value, &names)
+        if err != nil || len(rest) > 0 || !names.IsCompound || names.Tag != asn1.TagSequence {
+            return &CSRError{Reason: "subjectAltName extension is malformed"}
+        }
+        for data := names.Bytes; len(data) > 0; {
+            var name asn1.RawValue
+            if data, err = asn1.Unmarshal(data, &name); err != nil {
+                return &CSRError{Reason: "subjectAltName extension is malformed"}
+            }
+            if _, ok := csrSANTags[name.Tag]; !ok || name.Class != asn1.ClassContextSpecific {
+                return &CSRError{Reason: "only DNS, IP and email SANs are allowed"}
+            }
+        }
+    }
+    if len(csr.URIs) > 0 {
+        return &CSRError{Reason: "URI SANs are not allowed"}
+    }
+    return nil
+}
+
+// CheckCSRSubject makes sure a CSR only names what the caller may ask for.
+// Email SANs must be their username and IP SANs are never allowed. For
+// client profiles the common name must be their username or its local part
+// and DNS SANs are refused. Profiles with the serverAuth extended key usage
+// take host names: the common name and DNS SANs are left to the issuance
+// policy's common_names rule, as the common name of any request is.
+// Takes the CSR, the username from the caller's token and the profile
+// Returns an error
+func CheckCSRSubject(csr *x509.CertificateRequest, username string, profile *CertProfile) error {
+    if username == "" {
+        return &CSRError{Reason: "token has no username to check the CSR against"}
+    }
+    if err := checkCSRExtensions(csr); err != nil {
+        return err
+    }
+    for _, email := range csr.EmailAddresses {
+        if !strings.EqualFold(email, username) {
+            return &CSRError{Reason: fmt.Sprintf("email SAN '%s' does not match '%s'", email, username)}
+        }
+    }
+    if len(csr.IPAddresses) > 0 {
+        return &CSRError{Reason: "IP SANs are not allowed"}
+    }
+    if profile.ServerAuth() {
+        return nil
+    }
+    localPart := username
+    if at := strings.Index(username, "@"); at > 0 {
+        localPart = username[:at]
+    }
+    commonName := csr.Subject.CommonName
+    if !strings.EqualFold(commonName, username) && !strings.EqualFold(commonName, localPart) {
+        return &CSRError{Reason: fmt.Sprintf("common name '%s' must be '%s' or '%s'", commonName, localPart, username)}
+    }
+    if len(csr.DNSNames) > 0 {
+        return &CSRError{Reason: fmt.Sprintf("DNS SANs are only allowed for server profiles, not '%s'", profile.Name)}
+    }
+    return nil
+}
+
+// KeyFetchAllowed reports whether private keys for an authority's
+// certificates may be fetched from Lemur, per lemur.disable_key_fetch
+func (l *LemurRequester) KeyFetchAllowed(authority string) bool {
+    for _, disabled := range l.disableKeyFetch {
+        if disabled == authority {
+            return false
+        }
+    }
+    return true
+}
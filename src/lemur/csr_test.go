@@ -0,0 +1,137 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/asn1"
+    "encoding/pem"
+    "fmt"
+    "net"
+    "net/http"
+    "net/url"
+    "strings"
+    "testing"
+)
+
+func testCSR(t *testing.T, template *x509.CertificateRequest) []byte {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return der
+}
+
+func TestParseCSR(t *testing.T) {
+    der := testCSR(t, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "first.last"}})
+    csr, err := ParseCSR(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})))
+    if err != nil {
+        t.Fatalf("A freshly signed CSR should parse: %v", err)
+    }
+    if csr.Subject.CommonName != "first.last" {
+        t.Errorf("Expected common name first.last, got %s", csr.Subject.CommonName)
+    }
+    // Flip a bit in the signature
+    der[len(der) - 1] ^= 0x01
+    if _, err := ParseCSR(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))); err == nil {
+        t.Errorf("A CSR with a bad signature should be rejected!")
+    }
+    if _, err := ParseCSR("not a csr"); err == nil {
+        t.Errorf("Garbage should be rejected!")
+    }
+}
+
+// parsedCSR signs a CSR from template and parses it back, so that its
+// extensions are filled in as they would be for a submitted one
+func parsedCSR(t *testing.T, template *x509.CertificateRequest) *x509.CertificateRequest {
+    csr, err := x509.ParseCertificateRequest(testCSR(t, template))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return csr
+}
+
+func TestCheckCSRSubject(t *testing.T) {
+    client := &CertProfile{Name: "client-2w", ExtKeyUsages: []string{"clientAuth"}}
+    server := &CertProfile{Name: "server-tls", ExtKeyUsages: []string{"serverAuth"}}
+    mine := parsedCSR(t, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "first.last"},
+                                                  EmailAddresses: []string{"first.last@example.com"}})
+    if err := CheckCSRSubject(mine, "first.last@example.com", client); err != nil {
+        t.Errorf("A CSR naming the caller should be accepted: %v", err)
+    }
+    theirs := parsedCSR(t, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "someone.else"}})
+    if err := CheckCSRSubject(theirs, "first.last@example.com", client); err == nil {
+        t.Errorf("A CSR naming someone else should be rejected!")
+    }
+    host := parsedCSR(t, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "www.example.com"},
+                                                  DNSNames: []string{"www.example.com", "example.com"}})
+    if err := CheckCSRSubject(host, "first.last@example.com", client); err == nil {
+        t.Errorf("A CSR with DNS SANs should be rejected for client profiles!")
+    }
+    if err := CheckCSRSubject(host, "first.last@example.com", server); err != nil {
+        t.Errorf("A CSR with DNS SANs should be accepted for server profiles: %v", err)
+    }
+
+    spiffe, _ := url.Parse("spiffe://example.com/first.last")
+    otherName, _ := asn1.Marshal([]asn1.RawValue{{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: []byte{0x06, 0x01, 0x2a}}})
+    refused := map[string]*x509.CertificateRequest{
+        "a URI SAN": {Subject: pkix.Name{CommonName: "first.last"}, URIs: []*url.URL{spiffe}},
+        "an IP SAN": {Subject: pkix.Name{CommonName: "www.example.com"}, IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}},
+        "an otherName SAN": {Subject: pkix.Name{CommonName: "first.last"},
+                             ExtraExtensions: []pkix.Extension{{Id: oidSubjectAltName, Value: otherName}}},
+        "an unknown extension": {Subject: pkix.Name{CommonName: "first.last"},
+                                 ExtraExtensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 2, 3, 4}, Value: []byte{0x05, 0x00}}}},
+    }
+    for name, template := range refused {
+        for _, profile := range []*CertProfile{client, server} {
+            if err := CheckCSRSubject(parsedCSR(t, template), "first.last@example.com", profile); err == nil {
+                t.Errorf("A CSR with %s should be rejected for %s!", name, profile.Name)
+            }
+        }
+    }
+}
+
+func TestCertBundleKeyFetch(t *testing.T) {
+    fake, lemur := newTestLemur(t)
+    defer fake.Close()
+    oldSecret, oldFlags, oldClient := secretKey, Flags, LemurClient
+    defer func() { secretKey, Flags, LemurClient = oldSecret, oldFlags, oldClient }()
+    secretKey = NewTokenSecret()
+    Flags = &flagOptArgs{Config: &InstanceConfig{}}
+    LemurClient = lemur
+    for i := 0; i < 3; i++ {
+        if _, err := lemur.createCert(NewCertManifest("TestCA", "first.last", "first.last@example.com", "", "", "TestOrg")); err != nil {
+            t.Fatal(err)
+        }
+    }
+    download := func(id int) string {
+        recorder := userRequest(t, "GET", fmt.Sprintf("/v1/certs/%d/bundle", id), "", "first.last@example.com", "TestOrg")
+        if recorder.Code != http.StatusOK {
+            t.Fatalf("Certificate %d should download, got %d %s", id, recorder.Code, recorder.Body.String())
+        }
+        return recorder.Body.String()
+    }
+    keyFetches := func(id int) int {
+        return fake.Requests("GET", fmt.Sprintf("%s/%d/key", CertificatesUri, id))
+    }
+
+    if bundle := download(1); !strings.Contains(bundle, "privatekey") || keyFetches(1) != 1 {
+        t.Errorf("Keys should be fetched for authorities not in disable_key_fetch!")
+    }
+    lemur.disableKeyFetch = []string{"TestCA"}
+    if bundle := download(2); strings.Contains(bundle, "privatekey") || keyFetches(2) != 0 {
+        t.Errorf("Keys should not be fetched for authorities in disable_key_fetch!")
+    }
+    // A certificate Lemur reports without an authority fails closed
+    lemur.disableKeyFetch = nil
+    fake.certs[2].Authority = nil
+    if bundle := download(3); strings.Contains(bundle, "privatekey") || keyFetches(3) != 0 {
+        t.Errorf("Keys should not be fetched for certificates with no authority!")
+    }
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+    "fmt"
+)
+
+const (
+    DestinationUploaded = "uploaded"
+    DestinationFailed   = "failed"
+)
+
+// DestinationStatus tells the caller whether a certificate made it to a
+// destination they asked for
+type DestinationStatus struct {
+    Label  string `yaml:"label"  json:"label"`
+    Status string `yaml:"status" json:"status"`
+}
+
+// DestinationOption is what the UI and API show for a destination
+type DestinationOption struct {
+    Label       string `json:"label"`
+    Description string `json:"description"`
+    Plugin      string `json:"plugin,omitempty"`
+}
+
+// ListDestinations fetches every destination from Lemur
+// Called on a LemurRequester pointer
+// Returns a slice of Destination and an error
+func (l *LemurRequester) ListDestinations() ([]Destination, error) {
+    var destinations []Destination
+    for page := 1; ; page++ {
+        address := fmt.Sprintf("%s?count=%d&page=%d", l.address(DestinationsUri), l.pageSize, page)
+        var list DestinationList
+        if err := l.doJSON("GET", address, nil, &list); err != nil {
+            return nil, err
+        }
+        destinations = append(destinations, list.Items...)
+        if len(list.Items) < l.pageSize || len(destinations) >= list.Total || len(destinations) >= l.maxResults {
+            return destinations, nil
+        }
+    }
+}
+
+// CachedDestinations returns every destination, from cache when fresh enough
+func (l *LemurRequester) CachedDestinations() ([]Destination, error) {
+    value, err := l.destinations.Get(func() (interface{}, error) {
+        return l.ListDestinations()
+    })
+    if err != nil {
+        return nil, err
+    }
+    return value.([]Destination), nil
+}
+
+// DestinationsByLabel resolves destination labels to Lemur destinations
+// Called on a LemurRequester pointer
+// Takes a slice of labels
+// Returns the destinations found, the labels that matched nothing, and an
+// error
+func (l *LemurRequester) DestinationsByLabel(labels []string) ([]Destination, []string, error) {
+    if len(labels) == 0 {
+        return nil, nil, nil
+    }
+    destinations, err := l.CachedDestinations()
+    if err != nil {
+        return nil, nil, err
+    }
+    byLabel := map[string]Destination{}
+    for _, destination := range destinations {
+        byLabel[destination.Label] = destination
+    }
+    var found []Destination
+    var unknown []string
+    for _, label := range labels {
+        if destination, ok := byLabel[label]; ok {
+            found = append(found, destination)
+        } else {
+            unknown = append(unknown, label)
+        }
+    }
+    return found, unknown, nil
+}
+
+// Option converts a Destination to the DestinationOption shown to users
+func (d *Destination) Option() DestinationOption {
+    option := DestinationOption{Label: d.Label, Description: d.Description}
+    if d.Plugin != nil {
+        option.Plugin = d.Plugin.Title
+    }
+    return option
+}
+
+// destinationStatuses reports, for each requested destination, whether
+// Lemur attached it to the issued certificate. Lemur uploads to a
+// destination as it attaches it, so a missing destination means the upload
+// failed.
+func destinationStatuses(requested []Destination, cert *Certificate) []DestinationStatus {
+    attached := map[int]bool{}
+    for _, destination := range cert.Destinations {
+        attached[destination.Id] = true
+    }
+    var statuses []DestinationStatus
+    for _, destination := range requested {
+        status := DestinationFailed
+        if attached[destination.Id] {
+            status = DestinationUploaded
+        }
+        statuses = append(statuses, DestinationStatus{Label: destination.Label, Status: status})
+    }
+    return statuses
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestDestinationsByLabel(t *testing.T) {
+    fake, lemur := newTestLemur(t)
+    defer fake.Close()
+    fake.AddDestination("aws-prod", "Production AWS account")
+    fake.AddDestination("aws-dev", "Development AWS account")
+    fake.AddDestination("s3-backup", "Backup bucket")
+
+    found, unknown, err := lemur.DestinationsByLabel([]string{"s3-backup", "aws-prod", "aws-typo"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(found) != 2 || found[0].Label != "s3-backup" || found[1].Label != "aws-prod" {
+        t.Errorf("Destinations on every page should be found in the order asked for, got %+v", found)
+    }
+    if len(unknown) != 1 || unknown[0] != "aws-typo" {
+        t.Errorf("Labels matching nothing should be reported, got %v", unknown)
+    }
+    if found, unknown, err := lemur.DestinationsByLabel(nil); found != nil || unknown != nil || err != nil {
+        t.Errorf("No labels should need no lookup!")
+    }
+
+    // Issuing reports each requested destination as uploaded
+    manifest := NewCertManifest("TestCA", "first.last", "first.last@example.com", "", "", "TestOrg", found...)
+    issued, err := lemur.ValidateCert(manifest, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(issued.Destinations) != 2 || issued.Destinations[0] != (DestinationStatus{Label: "s3-backup", Status: DestinationUploaded}) ||
+       issued.Destinations[1].Status != DestinationUploaded {
+        t.Errorf("Both destinations should be uploaded, got %+v", issued.Destinations)
+    }
+}
+
+func TestDestinationStatuses(t *testing.T) {
+    requested := []Destination{{Id: 1, Label: "aws-prod"}, {Id: 2, Label: "aws-dev"}}
+    cert := &Certificate{Destinations: []Destination{{Id: 2, Label: "aws-dev"}}}
+    statuses := destinationStatuses(requested, cert)
+    if len(statuses) != 2 || statuses[0].Status != DestinationFailed || statuses[1].Status != DestinationUploaded {
+        t.Errorf("Destinations Lemur did not attach should be reported as failed, got %+v", statuses)
+    }
+    if statuses := destinationStatuses(nil, cert); statuses != nil {
+        t.Errorf("Without requested destinations there should be no statuses, got %+v", statuses)
+    }
+}
@@ -0,0 +1,705 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha1"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "math/big"
+    "net"
+    "net/http"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/dgrijalva/jwt-go"
+    "github.com/gorilla/mux"
+)
+
+const (
+    FakeLemurUser     = "lemur"
+    FakeLemurPassword = "lemur"
+    FakeLemurTokenTTL = time.Hour
+)
+
+// FakeLemur is an in-memory stand-in for the parts of the Lemur API this
+// client uses: login, certificates (search, create, fetch, key, revoke),
+// authorities and destinations. Each authority is a throwaway CA, so issued
+// certificates are real X.509 certificates that chain correctly.
+//
+// It backs the LemurRequester tests and the -fake_lemur local mode. Failures
+// and latency can be injected to exercise retries and the circuit breaker.
+//
+//     fake, _ := NewFakeLemur("ClientCA")
+//     fake.Start("127.0.0.1:0")
+//     defer fake.Close()
+//     config := LemurConfig{Url: fake.URL()}
+type FakeLemur struct {
+    mu           sync.Mutex
+    listener     net.Listener
+    server       *http.Server
+    secret       []byte
+    tokens       map[string]time.Time
+    authorities  []*fakeAuthority
+    destinations []Destination
+    certs        []*fakeCert
+    failures     []*fakeFailure
+    latency      time.Duration
+    requests     map[string]int
+}
+
+type fakeAuthority struct {
+    Authority
+    cert *x509.Certificate
+    key  *ecdsa.PrivateKey
+    pem  string
+}
+
+type fakeCert struct {
+    Certificate
+    key string
+}
+
+type fakeFailure struct {
+    method string
+    path   string
+    status int
+    times  int
+}
+
+// fakeCertRequest is the subset of a Lemur certificate request we act on
+type fakeCertRequest struct {
+    Authority    map[string]string `json:"authority"`
+    CommonName   string            `json:"commonName"`
+    Owner        string            `json:"owner"`
+    Description  string            `json:"description"`
+    StartDate    string            `json:"validityStart"`
+    EndDate      string            `json:"validityEnd"`
+    CSR          string            `json:"csr"`
+    KeyType      string            `json:"keyType"`
+    Destinations []lemurRef        `json:"destinations"`
+    Extensions   map[string]map[string]map[string]bool `json:"extensions"`
+}
+
+// NewFakeLemur creates a fake Lemur with one CA per authority name given
+func NewFakeLemur(authorities ...string) (*FakeLemur, error) {
+    secret := make([]byte, 32)
+    if _, err := rand.Read(secret); err != nil {
+        return nil, err
+    }
+    fake := &FakeLemur{secret: secret,
+                       tokens: map[string]time.Time{},
+                       requests: map[string]int{}}
+    for _, name := range authorities {
+        if err := fake.AddAuthority(name); err != nil {
+            return nil, err
+        }
+    }
+    return fake, nil
+}
+
+// AddAuthority creates a new CA. Roles are the Lemur roles, i.e. RBAC
+// groups, allowed to use it.
+func (f *FakeLemur) AddAuthority(name string, roles ...string) error {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return err
+    }
+    now := time.Now().UTC()
+    template := &x509.Certificate{SerialNumber: big.NewInt(now.UnixNano()),
+                                  Subject: pkix.Name{CommonName: name, Organization: []string{"Fake Lemur"}},
+                                  NotBefore: now.Add(-time.Hour),
+                                  NotAfter: now.AddDate(10, 0, 0),
+                                  IsCA: true,
+                                  BasicConstraintsValid: true,
+                                  KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign}
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        return err
+    }
+    cert, err := x509.ParseCertificate(der)
+    if err != nil {
+        return err
+    }
+    caPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    id := len(f.authorities) + 1
+    authority := &fakeAuthority{cert: cert, key: key, pem: caPEM}
+    authority.Authority = Authority{Id: id,
+                                    Name: name,
+                                    Owner: "secops@example.com",
+                                    Description: fmt.Sprintf("Fake %s authority", name),
+                                    Active: true,
+                                    Plugin: &Plugin{Slug: "fake-issuer", Title: "Fake"},
+                                    AuthorityCertificate: &AuthorityCertificate{Id: id,
+                                                                                Name: name,
+                                                                                CN: name,
+                                                                                Body: caPEM,
+                                                                                NotBefore: cert.NotBefore.Format(time.RFC3339),
+                                                                                NotAfter: cert.NotAfter.Format(time.RFC3339)}}
+    for i, role := range roles {
+        authority.Roles = append(authority.Roles, Role{Id: i + 1, Name: role})
+    }
+    f.authorities = append(f.authorities, authority)
+    return nil
+}
+
+// AddDestination adds a destination certificates can be published to
+func (f *FakeLemur) AddDestination(label, description string) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.destinations = append(f.destinations, Destination{Id: len(f.destinations) + 1,
+                                                        Label: label,
+                                                        Description: description,
+                                                        Plugin: &Plugin{Slug: "fake-destination", Title: "Fake"}})
+}
+
+// FailNext makes the next times requests whose method and path (below the
+// API prefix) match fail with status. A method of "" matches any method; a
+// path ending in "*" matches as a prefix.
+func (f *FakeLemur) FailNext(method, path string, status, times int) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.failures = append(f.failures, &fakeFailure{method: method, path: path, status: status, times: times})
+}
+
+// SetLatency delays every response by latency
+func (f *FakeLemur) SetLatency(latency time.Duration) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.latency = latency
+}
+
+// ExpireTokens forgets every issued token, so the next request gets a 401
+func (f *FakeLemur) ExpireTokens() {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.tokens = map[string]time.Time{}
+}
+
+// Requests counts the requests seen for a method and path below the API
+// prefix, e.g. Requests("POST", "/auth/login")
+func (f *FakeLemur) Requests(method, path string) int {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return f.requests[method + " " + path]
+}
+
+// Certificate returns a copy of a certificate by id, or nil
+func (f *FakeLemur) Certificate(id int) *Certificate {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    if id < 1 || id > len(f.certs) {
+        return nil
+    }
+    cert := f.certs[id - 1].Certificate
+    return &cert
+}
+
+// Start serves the fake on addr, e.g. "127.0.0.1:0" for a random port
+func (f *FakeLemur) Start(addr string) error {
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        return err
+    }
+    f.listener = listener
+    f.server = &http.Server{Handler: f.Handler()}
+    go f.server.Serve(listener)
+    return nil
+}
+
+// URL is the base url to put in lemur.url once started
+func (f *FakeLemur) URL() string {
+    return fmt.Sprintf("http://%s", f.listener.Addr())
+}
+
+// Close stops serving
+func (f *FakeLemur) Close() error {
+    return f.listener.Close()
+}
+
+// Handler returns the fake's routes, mounted below DefaultLemurApiPrefix
+func (f *FakeLemur) Handler() http.Handler {
+    router := mux.NewRouter()
+    api := router.PathPrefix(DefaultLemurApiPrefix).Subrouter()
+    api.HandleFunc(AuthorizeUri, f.login).Methods("POST")
+    api.HandleFunc(CertificatesUri, f.authed(f.listCertificates)).Methods("GET")
+    api.HandleFunc(CertificatesUri, f.authed(f.createCertificate)).Methods("POST")
+    api.HandleFunc(CertificatesUri + "/{id:[0-9]+}", f.authed(f.getCertificate)).Methods("GET")
+    api.HandleFunc(CertificatesUri + "/{id:[0-9]+}/key", f.authed(f.getKey)).Methods("GET")
+    api.HandleFunc(CertificatesUri + "/{id:[0-9]+}/revoke", f.authed(f.revoke)).Methods("PUT")
+    api.HandleFunc(AuthorityUri, f.authed(f.listAuthorities)).Methods("GET")
+    api.HandleFunc(DestinationsUri, f.authed(f.listDestinations)).Methods("GET")
+    return f.inject(router)
+}
+
+// inject applies latency, counts requests and serves injected failures
+func (f *FakeLemur) inject(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        path := strings.TrimPrefix(r.URL.Path, DefaultLemurApiPrefix)
+        f.mu.Lock()
+        f.requests[r.Method + " " + path]++
+        latency := f.latency
+        status := 0
+        for i, failure := range f.failures {
+            if failure.matches(r.Method, path) {
+                status = failure.status
+                failure.times--
+                if failure.times <= 0 {
+                    f.failures = append(f.failures[:i], f.failures[i + 1:]...)
+                }
+                break
+            }
+        }
+        f.mu.Unlock()
+        if latency > 0 {
+            time.Sleep(latency)
+        }
+        if status != 0 {
+            fakeError(w, status, "injected failure")
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+func (failure *fakeFailure) matches(method, path string) bool {
+    if failure.method != "" && failure.method != method {
+        return false
+    }
+    if strings.HasSuffix(failure.path, "*") {
+        return strings.HasPrefix(path, strings.TrimSuffix(failure.path, "*"))
+    }
+    return failure.path == path
+}
+
+func fakeError(w http.ResponseWriter, status int, message string) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(lemurErrorBody{Message: message})
+}
+
+func fakeJSON(w http.ResponseWriter, value interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(value)
+}
+
+func (f *FakeLemur) login(w http.ResponseWriter, r *http.Request) {
+    var credentials authJsonRequest
+    if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+        fakeError(w, http.StatusBadRequest, "unable to decode login")
+        return
+    }
+    if credentials.UserName != FakeLemurUser || credentials.Password != FakeLemurPassword {
+        fakeError(w, http.StatusUnauthorized, "invalid credentials")
+        return
+    }
+    expiry := time.Now().Add(FakeLemurTokenTTL)
+    token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+        "sub": credentials.UserName,
+        "exp": expiry.Unix(),
+        "jti": strconv.FormatInt(time.Now().UnixNano(), 10),
+    }).SignedString(f.secret)
+    if err != nil {
+        fakeError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    f.mu.Lock()
+    f.tokens[token] = expiry
+    f.mu.Unlock()
+    fakeJSON(w, authToken{Token: token})
+}
+
+// authed rejects requests without a live token from login
+func (f *FakeLemur) authed(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+        f.mu.Lock()
+        expiry, ok := f.tokens[token]
+        f.mu.Unlock()
+        if !ok || time.Now().After(expiry) {
+            fakeError(w, http.StatusUnauthorized, "token is invalid or expired")
+            return
+        }
+        next(w, r)
+    }
+}
+
+// fakePage applies Lemur's count and page parameters to n items
+func fakePage(r *http.Request, n int) (int, int) {
+    count, err := strconv.Atoi(r.URL.Query().Get("count"))
+    if err != nil || count < 1 {
+        count = 10
+    }
+    pageNumber, err := strconv.Atoi(r.URL.Query().Get("page"))
+    if err != nil || pageNumber < 1 {
+        pageNumber = 1
+    }
+    start := (pageNumber - 1) * count
+    if start > n {
+        start = n
+    }
+    end := start + count
+    if end > n {
+        end = n
+    }
+    return start, end
+}
+
+// fakeCertsByDate sorts certificates by creation, using the id to break ties
+// between certificates created in the same second
+type fakeCertsByDate []Certificate
+
+func (c fakeCertsByDate) Len() int      { return len(c) }
+func (c fakeCertsByDate) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c fakeCertsByDate) Less(i, j int) bool {
+    if c[i].DateCreated != c[j].DateCreated {
+        return c[i].DateCreated < c[j].DateCreated
+    }
+    return c[i].Id < c[j].Id
+}
+
+// listCertificates supports Lemur's "field;value" filter on owner, cn, name
+// and description (a case-insensitive substring match, like Lemur's) and
+// sorting by date_created
+func (f *FakeLemur) listCertificates(w http.ResponseWriter, r *http.Request) {
+    var field, value string
+    if filter := r.URL.Query().Get("filter"); filter != "" {
+        parts := strings.SplitN(filter, ";", 2)
+        if len(parts) != 2 {
+            fakeError(w, http.StatusBadRequest, "filter must be field;value")
+            return
+        }
+        field, value = parts[0], strings.ToLower(parts[1])
+    }
+    f.mu.Lock()
+    var matches []Certificate
+    for _, cert := range f.certs {
+        var candidate string
+        switch field {
+        case "":
+        case "owner":
+            candidate = cert.Owner
+        case "cn":
+            candidate = cert.CN
+        case "name":
+            candidate = cert.Name
+        case "description":
+            candidate = cert.Description
+        default:
+            f.mu.Unlock()
+            fakeError(w, http.StatusBadRequest, fmt.Sprintf("cannot filter on %s", field))
+            return
+        }
+        if field == "" || strings.Contains(strings.ToLower(candidate), value) {
+            matches = append(matches, cert.Certificate)
+        }
+    }
+    f.mu.Unlock()
+    if r.URL.Query().Get("sortDir") == "desc" {
+        sort.Sort(sort.Reverse(fakeCertsByDate(matches)))
+    } else {
+        sort.Sort(fakeCertsByDate(matches))
+    }
+    start, end := fakePage(r, len(matches))
+    fakeJSON(w, CertificateList{Total: len(matches), Items: matches[start:end]})
+}
+
+func (f *FakeLemur) findCert(r *http.Request) *fakeCert {
+    id, _ := strconv.Atoi(mux.Vars(r)["id"])
+    if id < 1 || id > len(f.certs) {
+        return nil
+    }
+    return f.certs[id - 1]
+}
+
+func (f *FakeLemur) getCertificate(w http.ResponseWriter, r *http.Request) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    cert := f.findCert(r)
+    if cert == nil {
+        fakeError(w, http.StatusNotFound, "certificate not found")
+        return
+    }
+    fakeJSON(w, cert.Certificate)
+}
+
+// getKey answers like Lemur: a null key for certificates issued from a CSR
+func (f *FakeLemur) getKey(w http.ResponseWriter, r *http.Request) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    cert := f.findCert(r)
+    if cert == nil {
+        fakeError(w, http.StatusNotFound, "certificate not found")
+        return
+    }
+    if cert.key == "" {
+        fakeJSON(w, map[string]interface{}{"key": nil})
+        return
+    }
+    fakeJSON(w, certificateKey{Key: cert.key})
+}
+
+func (f *FakeLemur) revoke(w http.ResponseWriter, r *http.Request) {
+    var request lemurRevokeRequest
+    if err := json.NewDecoder(r.Body).Decode(&request); err != nil || !CRLReasons[request.CRLReason] {
+        fakeError(w, http.StatusBadRequest, "crlReason is required")
+        return
+    }
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    cert := f.findCert(r)
+    if cert == nil {
+        fakeError(w, http.StatusNotFound, "certificate not found")
+        return
+    }
+    cert.Revoked = true
+    cert.Status = "revoked"
+    fakeJSON(w, map[string]int{"id": cert.Id})
+}
+
+func (f *FakeLemur) listAuthorities(w http.ResponseWriter, r *http.Request) {
+    f.mu.Lock()
+    var authorities []Authority
+    for _, authority := range f.authorities {
+        authorities = append(authorities, authority.Authority)
+    }
+    f.mu.Unlock()
+    start, end := fakePage(r, len(authorities))
+    fakeJSON(w, AuthorityList{Total: len(authorities), Items: authorities[start:end]})
+}
+
+func (f *FakeLemur) listDestinations(w http.ResponseWriter, r *http.Request) {
+    f.mu.Lock()
+    destinations := append([]Destination(nil), f.destinations...)
+    f.mu.Unlock()
+    start, end := fakePage(r, len(destinations))
+    fakeJSON(w, DestinationList{Total: len(destinations), Items: destinations[start:end]})
+}
+
+func (f *FakeLemur) createCertificate(w http.ResponseWriter, r *http.Request) {
+    var request fakeCertRequest
+    if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+        fakeError(w, http.StatusBadRequest, "unable to decode certificate request")
+        return
+    }
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    var authority *fakeAuthority
+    for _, candidate := range f.authorities {
+        if candidate.Name == request.Authority["name"] {
+            authority = candidate
+        }
+    }
+    if authority == nil {
+        fakeError(w, http.StatusBadRequest, fmt.Sprintf("authority '%s' does not exist", request.Authority["name"]))
+        return
+    }
+    var destinations []Destination
+    for _, ref := range request.Destinations {
+        if ref.Id < 1 || ref.Id > len(f.destinations) {
+            fakeError(w, http.StatusBadRequest, fmt.Sprintf("destination %d does not exist", ref.Id))
+            return
+        }
+        destinations = append(destinations, f.destinations[ref.Id - 1])
+    }
+    cert, err := authority.issue(&request)
+    if err != nil {
+        fakeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    cert.Id = len(f.certs) + 1
+    cert.Destinations = destinations
+    f.certs = append(f.certs, cert)
+    fakeJSON(w, cert.Certificate)
+}
+
+// issue signs a certificate for a request, generating a key unless the
+// request carries a CSR
+func (a *fakeAuthority) issue(request *fakeCertRequest) (*fakeCert, error) {
+    commonName := request.CommonName
+    var publicKey interface{}
+    var keyPEM string
+    if request.CSR != "" {
+        csr, err := ParseCSR(request.CSR)
+        if err != nil {
+            return nil, err
+        }
+        publicKey = csr.PublicKey
+        commonName = csr.Subject.CommonName
+    } else {
+        var err error
+        publicKey, keyPEM, err = fakeKey(request.KeyType)
+        if err != nil {
+            return nil, err
+        }
+    }
+    if commonName == "" {
+        return nil, errors.New("commonName is required")
+    }
+    now := time.Now().UTC()
+    notBefore, err := fakeDate(request.StartDate, now)
+    if err != nil {
+        return nil, err
+    }
+    notAfter, err := fakeDate(request.EndDate, now.AddDate(1, 0, 0))
+    if err != nil {
+        return nil, err
+    }
+    if !notAfter.After(notBefore) {
+        return nil, errors.New("validityEnd must be after validityStart")
+    }
+    if notAfter.After(a.cert.NotAfter) {
+        return nil, errors.New("validityEnd is past the authority's expiry")
+    }
+    serialBytes := make([]byte, 16)
+    if _, err := rand.Read(serialBytes); err != nil {
+        return nil, err
+    }
+    serial := new(big.Int).SetBytes(serialBytes)
+    template := &x509.Certificate{SerialNumber: serial,
+                                  Subject: pkix.Name{CommonName: commonName},
+                                  NotBefore: notBefore,
+                                  NotAfter: notAfter,
+                                  BasicConstraintsValid: true}
+    if err := applyFakeExtensions(template, request.Extensions["extensions"], publicKey); err != nil {
+        return nil, err
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, a.cert, publicKey, a.key)
+    if err != nil {
+        return nil, err
+    }
+    chain := a.pem
+    authority := a.Authority
+    return &fakeCert{
+        Certificate: Certificate{Name: fmt.Sprintf("%s-%s-%s-%s", commonName, a.Name,
+                                                   notBefore.Format("20060102"), notAfter.Format("20060102")),
+                                 CN: commonName,
+                                 Owner: request.Owner,
+                                 Description: request.Description,
+                                 Body: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+                                 Chain: &chain,
+                                 Serial: serial.String(),
+                                 Issuer: a.Name,
+                                 KeyType: "ECCPRIME256V1",
+                                 Active: true,
+                                 Status: "valid",
+                                 NotBefore: notBefore.Format(time.RFC3339),
+                                 NotAfter: notAfter.Format(time.RFC3339),
+                                 DateCreated: now.Format(time.RFC3339),
+                                 Authority: &authority},
+        key: keyPEM,
+    }, nil
+}
+
+// applyFakeExtensions sets the key usages and subject key identifier a
+// request asks for, defaulting to a digital signature client certificate
+func applyFakeExtensions(template *x509.Certificate, extensions map[string]map[string]bool, publicKey interface{}) error {
+    for flag, wanted := range extensions["keyUsage"] {
+        if usage, ok := manifestKeyUsages[flag]; ok && wanted {
+            template.KeyUsage |= usage
+        }
+    }
+    for flag, wanted := range extensions["extendedKeyUsage"] {
+        if usage, ok := manifestExtKeyUsages[flag]; ok && wanted {
+            template.ExtKeyUsage = append(template.ExtKeyUsage, usage)
+        }
+    }
+    if template.KeyUsage == 0 {
+        template.KeyUsage = x509.KeyUsageDigitalSignature
+    }
+    if len(template.ExtKeyUsage) == 0 {
+        template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+    }
+    if extensions["subjectKeyIdentifier"]["includeSKI"] {
+        der, err := x509.MarshalPKIXPublicKey(publicKey)
+        if err != nil {
+            return err
+        }
+        ski := sha1.Sum(der)
+        template.SubjectKeyId = ski[:]
+    }
+    return nil
+}
+
+// fakeKey generates a key of a Lemur key type. Without one it generates a
+// P-256 key, which is quicker than Lemur's RSA default.
+func fakeKey(keyType string) (interface{}, string, error) {
+    curves := map[string]elliptic.Curve{"": elliptic.P256(),
+                                        "ECCPRIME256V1": elliptic.P256(),
+                                        "ECCSECP384R1": elliptic.P384(),
+                                        "ECCSECP521R1": elliptic.P521()}
+    if curve, ok := curves[keyType]; ok {
+        key, err := ecdsa.GenerateKey(curve, rand.Reader)
+        if err != nil {
+            return nil, "", err
+        }
+        der, err := x509.MarshalECPrivateKey(key)
+        if err != nil {
+            return nil, "", err
+        }
+        return &key.PublicKey, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})), nil
+    }
+    bits := map[string]int{"RSA2048": 2048, "RSA4096": 4096}[keyType]
+    if bits == 0 {
+        return nil, "", fmt.Errorf("unknown keyType '%s'", keyType)
+    }
+    key, err := rsa.GenerateKey(rand.Reader, bits)
+    if err != nil {
+        return nil, "", err
+    }
+    der := x509.MarshalPKCS1PrivateKey(key)
+    return &key.PublicKey, string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: der})), nil
+}
+
+// fakeDate parses a validity date as Lemur does, falling back when empty
+func fakeDate(value string, fallback time.Time) (time.Time, error) {
+    if value == "" {
+        return fallback, nil
+    }
+    return parseLemurTime(value)
+}
+
+// StartFakeLemur runs a fake Lemur for local development and points config
+// at it. The configured server certificate authority and shared
+// authorities are created, plus a FakeClientCA every group may use.
+// Called from GetFlags when -fake_lemur is set
+func StartFakeLemur(config *InstanceConfig) (*FakeLemur, error) {
+    fake, err := NewFakeLemur()
+    if err != nil {
+        return nil, err
+    }
+    config.Lemur.SharedAuthorities = append(config.Lemur.SharedAuthorities, "FakeClientCA")
+    names := map[string]bool{}
+    for _, name := range append([]string{config.CertAuthority}, config.Lemur.SharedAuthorities...) {
+        if name == "" || names[name] {
+            continue
+        }
+        names[name] = true
+        if err := fake.AddAuthority(name); err != nil {
+            return nil, err
+        }
+    }
+    fake.AddDestination("fake-s3", "Fake S3 bucket")
+    fake.AddDestination("fake-aws", "Fake AWS account")
+    if err := fake.Start("127.0.0.1:0"); err != nil {
+        return nil, err
+    }
+    config.Lemur.Url = fake.URL()
+    config.Lemur.ApiPrefix = DefaultLemurApiPrefix
+    os.Setenv(LemurUserEnv, FakeLemurUser)
+    os.Setenv(LemurPasswordEnv, FakeLemurPassword)
+    Logs.Warningf("Using a fake, in-memory Lemur at %s. Certificates it issues are worthless.", fake.URL())
+    return fake, nil
+}
+
@@ -20,6 +20,7 @@ type flagOptArgs struct {
     MakoServiceId *string
     MakoEnv       *string
     MakoVer       *string
+    FakeLemur     *bool
 }
 
 // IsZeroOrNil uses reflection to determin whether or not any interface x
@@ -50,6 +51,18 @@ type InstanceConfig struct {
     CommonName     string `yaml:"common_name"`
     EmailAddress   string `yaml:"email_address"`
     CertOrg        string `yaml:"certificate_org"`
+    AdminGroups    []string `yaml:"admin_groups"`
+    Profiles       map[string]*CertProfile `yaml:"profiles"`
+    DefaultProfile string `yaml:"default_profile"`
+    ServerProfile  string `yaml:"server_profile"`
+    PolicyFile     string `yaml:"policy_file"`
+    Policy         *IssuancePolicy `yaml:"-"`
+    Tokens         TokenConfig `yaml:"tokens"`
+    Okta           OktaConfig `yaml:"okta"`
+    Login          string `yaml:"login"`
+    OIDC           OIDCConfig `yaml:"oidc"`
+    SAML           SAMLConfig `yaml:"saml"`
+    Lemur          LemurConfig `yaml:"lemur"`
 }
 
 func (c *InstanceConfig) Parse(config string) error {
@@ -63,20 +76,17 @@ func (c *InstanceConfig) Parse(config string) error {
         Logs.Errorf("%+v", err)
         return err
     }
-    if c.IdpMetadata == "" {
-        Logs.Errorf("Lemur-client config: invalid cert")
-    }
-    if c.IdpIssuer == "" {
-        Logs.Errorf("Lemur-client config: invalid idp issuer")
-    }
-    if c.IdpApiAuthUrl == "" {
-        Logs.Errorf("Lemur-client config: invalid auth url")
-    }
-    if c.SamlCallback == "" {
-        Logs.Errorf("Lemur-client config: invalid saml callback")
-    }
-    if c.AudienceURI == "" {
-        Logs.Errorf("Lemur-client config: invalid audience uri")
+    // The SAML settings are not needed by deployments logging in with OIDC
+    if c.Login != LoginOIDC {
+        if c.IdpMetadata == "" {
+            Logs.Errorf("Lemur-client config: invalid idp metadata")
+        }
+        if c.SamlCallback == "" {
+            Logs.Errorf("Lemur-client config: invalid saml callback")
+        }
+        if c.AudienceURI == "" {
+            Logs.Errorf("Lemur-client config: invalid audience uri")
+        }
     }
     if c.CertAuthority == "" {
         Logs.Errorf("Lemur-client config: invalid cert authority")
@@ -111,7 +121,8 @@ func GetFlags() (*flagOptArgs) {
                           StatsdPort:    flag.String("statsd_port", "8125", "statsd port"),
                           MakoServiceId: flag.String("mako_service_id", "lemur-client", "MAKO Service ID"),
                           MakoEnv:       flag.String("mako_environment", "develop", "MAKO Environment"),
-                          MakoVer:       flag.String("mako_version", "", "MAKO Version")}
+                          MakoVer:       flag.String("mako_version", "", "MAKO Version"),
+                          FakeLemur:     flag.Bool("fake_lemur", false, "Use an in-memory fake Lemur (local development only)")}
     configyaml := "config.yaml"
     configPath := flag.String("config", configyaml, "Path to config yaml")
     flag.Parse()
@@ -120,6 +131,41 @@ func GetFlags() (*flagOptArgs) {
         Logs.Errorf("Unable to parse config file!")
         panic(err)
     }
+    if err := config.ValidateProfiles(); err != nil {
+        Logs.Errorf("%+v", err)
+        panic(err)
+    }
+    if config.PolicyFile != "" {
+        policy, err := LoadIssuancePolicy(config.PolicyFile)
+        if err != nil {
+            Logs.Errorf("%+v", err)
+            panic(err)
+        }
+        config.Policy = policy
+    } else {
+        Logs.Warningf("No policy_file configured. Every group may request any certificate.")
+    }
+    // LEMUR_* environment variables take precedence over the lemur section
+    config.Lemur.ApplyEnv()
+    config.Okta.ApplyEnv()
+    if err := config.Okta.Validate(); err != nil {
+        Logs.Errorf("%+v", err)
+        panic(err)
+    }
+    if err := config.ValidateLogin(); err != nil {
+        Logs.Errorf("%+v", err)
+        panic(err)
+    }
+    if *flags.FakeLemur {
+        if _, err := StartFakeLemur(&config); err != nil {
+            Logs.Errorf("Unable to start fake Lemur: %+v", err)
+            panic(err)
+        }
+    }
+    if err := config.Lemur.Validate(); err != nil {
+        Logs.Errorf("%+v", err)
+        panic(err)
+    }
     flags.Config = &config
     // Unfortunately there's no good way around using temp variables and the
     // struct members must be pointers
@@ -147,7 +193,7 @@ func GetFlags() (*flagOptArgs) {
             Logs.Errorf("%+v", err)
             panic(err)
         }
-        *flags.AdminPort = string(intport + 1)
+        *flags.AdminPort = strconv.Itoa(intport + 1)
     }
     // Expect port to be entered as "8080" and not ":8080"
     *flags.HostPort = fmt.Sprintf(":%s", *flags.HostPort)
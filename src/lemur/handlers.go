@@ -4,6 +4,11 @@ import (
   "net/http"
   "fmt"
   "encoding/json"
+  "net/url"
+  "strconv"
+  "strings"
+  "time"
+  "github.com/gorilla/mux"
 )
 
 
@@ -20,27 +25,61 @@ type authJsonRequest struct {
     Password string `json:"password"`
 }
 
+// refreshCookie holds the browser's refresh token. Unlike the auth cookie
+// scripts cannot read it; it is only ever sent back to us.
+const refreshCookie = "refresh"
+
+// setSessionCookies hands a browser its app token and refresh token
+func setSessionCookies(w http.ResponseWriter, tokens map[string]string) {
+    http.SetCookie(w, &http.Cookie{
+        Name: "auth",
+        Value: tokens["token"],
+        Path: "/"})
+    http.SetCookie(w, &http.Cookie{
+        Name: refreshCookie,
+        Value: tokens["refresh_token"],
+        Path: "/",
+        MaxAge: int(secretKey.sessions.absolute.Seconds()),
+        Secure: true,
+        HttpOnly: true})
+}
+
+// clearSessionCookies removes the app token and refresh token cookies
+func clearSessionCookies(w http.ResponseWriter) {
+    for _, name := range []string{"auth", refreshCookie} {
+        http.SetCookie(w, &http.Cookie{
+            Name: name,
+            Value: "",
+            Path: "/",
+            MaxAge: -1})
+    }
+}
+
 func (h *authHandler) ServeHTTP (w http.ResponseWriter, r *http.Request) {
     var cookie, err = r.Cookie("auth")
-    if  err == http.ErrNoCookie || cookie.Value == "" {
-        w.Header().Set("Location", "/login")
-        w.WriteHeader(http.StatusTemporaryRedirect)
-        return
+    if err == nil && cookie.Value != "" {
+        if _, err := secretKey.ValidateToken(cookie.Value) ; err == nil {
+            h.next.ServeHTTP(w, r)
+            return
+        }
     }
-    token := cookie.Value
-    if _, err := secretKey.ValidateToken(token) ; err != nil {
-        w.Header().Set("Location", "/login")
-        w.WriteHeader(http.StatusTemporaryRedirect)
-        return
+    // The app token has expired, but the session may still be open
+    if refresh, err := r.Cookie(refreshCookie); err == nil && refresh.Value != "" {
+        if tokens, err := secretKey.RefreshSession(refresh.Value); err == nil {
+            LemurHttpStatsd.Incr("tokens.refreshed", nil, 1)
+            setSessionCookies(w, tokens)
+            h.next.ServeHTTP(w, r)
+            return
+        }
     }
-    h.next.ServeHTTP(w, r)
+    w.Header().Set("Location", "/login")
+    w.WriteHeader(http.StatusTemporaryRedirect)
 }
 
 func (h *apiAuthHandler) ServeHTTP (w http.ResponseWriter, r *http.Request) {
     var token = r.Header.Get("Authorization")
     if _, err := secretKey.ValidateToken(token) ; err != nil {
-        w.WriteHeader(http.StatusBadRequest)
-        w.Write([]byte("401 - Bad token."))
+        writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Bad token.")
         return
     } else {
         // success - call the next handler
@@ -56,14 +95,40 @@ func TokenAuth(h http.HandlerFunc) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         var token = r.Header.Get("Authorization")
         if _, err := secretKey.ValidateToken(token) ; err != nil {
-            w.WriteHeader(http.StatusUnauthorized)
-            w.Write([]byte("401 - Bad token."))
+            writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Bad token.")
             return
         }
         h.ServeHTTP(w, r)
     })
 }
 
+// AdminAuth guards an admin endpoint: the caller must send an app token, in
+// the Authorization header, whose rbac group is one of admin_groups
+func AdminAuth(h http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        token := r.Header.Get("Authorization")
+        if _, err := secretKey.ValidateToken(token); err != nil {
+            writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Bad token.")
+            return
+        }
+        claims := secretKey.GetClaims(token)
+        rbacGroup, _ := claims["rbac"].(string)
+        if !isAdmin(rbacGroup) {
+            LemurHttpStatsd.Incr("admin.denied", nil, 1)
+            Logs.Warningf("Refusing %s %s to %v of group %s", r.Method, r.URL.Path, claims["username"], rbacGroup)
+            writeError(w, r, http.StatusForbidden, CodeForbidden, "Only members of an admin group may use this endpoint.")
+            return
+        }
+        h(w, r)
+    }
+}
+
+// adminCaller names the admin AdminAuth let through, for the logs
+func adminCaller(r *http.Request) string {
+    username, _ := secretKey.GetClaims(r.Header.Get("Authorization"))["username"].(string)
+    return username
+}
+
 func OKHandler(w http.ResponseWriter, r *http.Request) {
     w.WriteHeader(http.StatusOK)
     w.Write([]byte("200 - Well met!"))
@@ -75,89 +140,580 @@ func RootHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
-    w.Header().Set("Location", OktaProvider.ServiceProvider.IdentityProviderSSOURL)
+    if OIDCProvider != nil {
+        OIDCLoginHandler(w, r)
+        return
+    }
+    var location string
+    sp, err := SAMLProvider.ServiceProvider()
+    if err == nil {
+        location, err = sp.BuildAuthURL("")
+    }
+    if err != nil {
+        LemurHttpStatsd.Incr("error", nil, 1)
+        Logs.Errorf("Unable to start SAML login: %+v", err)
+        writeError(w, r, http.StatusBadGateway, CodeIdpError, "Unable to reach the identity provider.")
+        return
+    }
+    w.Header().Set("Location", location)
+    w.WriteHeader(http.StatusTemporaryRedirect)
+}
+
+// OIDCLoginHandler sends the user to the OIDC IdP to log in. What the
+// callback needs to finish the login is kept in a short-lived cookie, so
+// any replica can take the callback.
+func OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+    login := newOIDCLogin()
+    location, err := OIDCProvider.AuthCodeURL(login)
+    if err != nil {
+        LemurHttpStatsd.Incr("error", nil, 1)
+        Logs.Errorf("Unable to start OIDC login: %+v", err)
+        writeError(w, r, http.StatusBadGateway, CodeIdpError, "Unable to reach the identity provider.")
+        return
+    }
+    http.SetCookie(w, &http.Cookie{
+        Name: oidcLoginCookie,
+        Value: login.String(),
+        Path: "/",
+        MaxAge: int(oidcLoginTimeout.Seconds()),
+        Secure: true,
+        HttpOnly: true})
+    w.Header().Set("Location", location)
     w.WriteHeader(http.StatusTemporaryRedirect)
 }
 
+// OIDCCallbackHandler finishes an OIDC login: it redeems the authorization
+// code, verifies the ID token and hands out the same app token and refresh
+// token as AssertionHandler
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+    cookie, err := r.Cookie(oidcLoginCookie)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, CodeBadRequest, "No login in progress; start again at /login.")
+        return
+    }
+    http.SetCookie(w, &http.Cookie{
+        Name: oidcLoginCookie,
+        Value: "",
+        Path: "/",
+        MaxAge: -1})
+    login, err := parseOIDCLogin(cookie.Value)
+    if err != nil || r.FormValue("state") != login.State {
+        LemurHttpStatsd.Incr("error", nil, 1)
+        writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Login state does not match; start again at /login.")
+        return
+    }
+    if idpErr := r.FormValue("error"); idpErr != "" {
+        writeError(w, r, http.StatusUnauthorized, CodeAuthenticationFailed, "Authentication failure: %s %s", idpErr, r.FormValue("error_description"))
+        return
+    }
+    idToken, err := OIDCProvider.Exchange(r.FormValue("code"), login)
+    if err != nil {
+        LemurHttpStatsd.Incr("error", nil, 1)
+        Logs.Errorf("Unable to redeem OIDC authorization code: %+v", err)
+        writeError(w, r, http.StatusBadGateway, CodeIdpError, "Unable to redeem the authorization code.")
+        return
+    }
+    claims, err := OIDCProvider.VerifyIDToken(idToken, login)
+    if err != nil {
+        LemurHttpStatsd.Incr("error", nil, 1)
+        Logs.Errorf("Refusing OIDC ID token: %+v", err)
+        writeError(w, r, http.StatusUnauthorized, CodeAuthenticationFailed, "Unable to verify the ID token.")
+        return
+    }
+    username, group, err := OIDCProvider.Identity(claims)
+    if err == ErrNoOIDCGroup {
+        writeError(w, r, http.StatusForbidden, CodeForbidden, "%s has no group to request certificates with.", username)
+        return
+    } else if err != nil {
+        Logs.Errorf("%+v", err)
+        writeError(w, r, http.StatusUnauthorized, CodeAuthenticationFailed, "%v", err)
+        return
+    }
+    LemurCertsStatsd.Incr("authenticate", nil, 1)
+    data, err := secretKey.StartSession(username, group)
+    if err != nil {
+        LemurHttpStatsd.Incr("error", nil, 1)
+        Logs.Errorf("Unable to generate authentication token: %+v", err)
+        writeError(w, r, http.StatusInternalServerError, CodeInternal, "Unable to generate authentication token.")
+        return
+    }
+    LemurHttpStatsd.Incr("tokens", nil, 1)
+    setSessionCookies(w, data)
+    http.Redirect(w, r, "/certs", http.StatusSeeOther)
+}
+
 func AssertionHandler (w http.ResponseWriter, r *http.Request) {
     err := r.ParseForm()
     if err != nil {
         LemurHttpStatsd.Incr("error", nil, 1)
         Logs.Errorf("Unable to understand form: %+v", err)
-        w.WriteHeader(http.StatusBadRequest)
-        w.Write([]byte("400 - Unable to understand form."))
+        writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Unable to understand form.")
+        return
+    }
+    sp, err := SAMLProvider.ServiceProvider()
+    if err != nil {
+        LemurHttpStatsd.Incr("error", nil, 1)
+        Logs.Errorf("Unable to check assertion: %+v", err)
+        writeError(w, r, http.StatusBadGateway, CodeIdpError, "The identity provider's metadata is not available.")
         return
     }
-    assertionInfo, err := OktaProvider.ServiceProvider.RetrieveAssertionInfo(r.FormValue("SAMLResponse"))
+    assertionInfo, err := sp.RetrieveAssertionInfo(r.FormValue("SAMLResponse"))
     if err != nil {
         LemurHttpStatsd.Incr("error", nil, 1)
         Logs.Errorf("Unable to understand assertion information: %+v", err)
-        w.WriteHeader(http.StatusBadRequest)
-        w.Write([]byte("400 - Unable to understand assertion information."))
+        writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Unable to understand assertion information.")
+        return
+    }
+    // gosaml2 only warns about these, but an assertion for another service
+    // or outside its validity period must not log anyone in
+    if assertionInfo.WarningInfo.InvalidTime || assertionInfo.WarningInfo.NotInAudience {
+        LemurHttpStatsd.Incr("error", nil, 1)
+        Logs.Errorf("Refusing assertion for %s: %+v", assertionInfo.NameID, *assertionInfo.WarningInfo)
+        writeError(w, r, http.StatusUnauthorized, CodeAuthenticationFailed, "The assertion is expired or not meant for this service.")
+        return
+    }
+    username, group, err := SAMLProvider.Identity(assertionInfo)
+    if err == ErrNoSAMLGroup {
+        writeError(w, r, http.StatusForbidden, CodeForbidden, "%s has no group to request certificates with.", username)
+        return
+    } else if err != nil {
+        Logs.Errorf("%+v", err)
+        writeError(w, r, http.StatusUnauthorized, CodeAuthenticationFailed, "%v", err)
         return
     }
     LemurCertsStatsd.Incr("authenticate", nil, 1)
-    data, err := secretKey.MakeToken(assertionInfo.Values["username"].Values[0].Value,
-                                     assertionInfo.Values["rbac"].Values[0].Value)
+    data, err := secretKey.StartSession(username, group)
     if err != nil {
         LemurHttpStatsd.Incr("error", nil, 1)
         Logs.Errorf("Unable to generate authentication token: %+v", err)
-        w.WriteHeader(http.StatusInternalServerError)
-        w.Write([]byte("500 - Unable to generate authentication token."))
+        writeError(w, r, http.StatusInternalServerError, CodeInternal, "Unable to generate authentication token.")
         return
     }
     LemurHttpStatsd.Incr("tokens", nil, 1)
-    http.SetCookie(w, &http.Cookie{
-        Name: "auth",
-        Value: data.(map[string]string)["token"],
-        Path: "/"})
+    setSessionCookies(w, data)
     w.Header().Set("Location", "/certs")
     // Use http.StatusSeeOther to get around annoying RPG problem
     // https://en.wikipedia.org/wiki/Post/Redirect/Get
     http.Redirect(w, r, "/certs", http.StatusSeeOther)
 }
 
+// ListAuthoritiesHandler lists the authorities the caller's RBAC group may
+// request certificates from
+func ListAuthoritiesHandler (w http.ResponseWriter, r *http.Request) {
+    claims := secretKey.GetClaims(r.Header.Get("Authorization"))
+    rbacGroup, _ := claims["rbac"].(string)
+    authorities, err := LemurClient.AuthoritiesForGroup(rbacGroup)
+    if err != nil {
+        LemurHttpStatsd.Incr("errors", nil, 1)
+        Logs.Errorf("Unable to list authorities: %+v", err)
+        writeError(w, r, http.StatusBadGateway, CodeLemurError, "Unable to list authorities from Lemur.")
+        return
+    }
+    options := []AuthorityOption{}
+    for i := range authorities {
+        option := authorities[i].Option()
+        option.CSROnly = !LemurClient.KeyFetchAllowed(authorities[i].Name)
+        options = append(options, option)
+    }
+    output, _ := json.Marshal(map[string]interface{}{"total": len(options), "items": options})
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(output)
+}
+
+// ListProfilesHandler lists the certificate profiles configured in
+// config.yaml
+func ListProfilesHandler (w http.ResponseWriter, r *http.Request) {
+    profiles := Flags.Config.ProfileList()
+    output, _ := json.Marshal(map[string]interface{}{"total": len(profiles),
+                                                     "default": Flags.Config.DefaultProfile,
+                                                     "items": profiles})
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(output)
+}
+
+// ListDestinationsHandler lists the Lemur destinations certificates can be
+// published to
+func ListDestinationsHandler (w http.ResponseWriter, r *http.Request) {
+    destinations, err := LemurClient.CachedDestinations()
+    if err != nil {
+        LemurHttpStatsd.Incr("errors", nil, 1)
+        Logs.Errorf("Unable to list destinations: %+v", err)
+        writeError(w, r, http.StatusBadGateway, CodeLemurError, "Unable to list destinations from Lemur.")
+        return
+    }
+    options := []DestinationOption{}
+    for i := range destinations {
+        options = append(options, destinations[i].Option())
+    }
+    output, _ := json.Marshal(map[string]interface{}{"total": len(options), "items": options})
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(output)
+}
+
+// CreateCertHandler issues a certificate. The request is checked in full,
+// required fields, validity window and policy, before anything is sent to
+// Lemur.
 func CreateCertHandler (w http.ResponseWriter, r *http.Request) {
     var token = r.Header.Get("Authorization")
     claims := secretKey.GetClaims(token)
-    if _, ok := claims["rbac"]; !ok {
-		LemurCertsStatsd.Incr("errors", nil, 1)
-		Logs.Errorf("%+v", ok)
-        w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, ok)
+    rbacGroup, ok := claims["rbac"].(string)
+    if !ok {
+        LemurCertsStatsd.Incr("errors", nil, 1)
+        writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "Token has no RBAC group.")
         return
     }
-    rbacGroup := claims["rbac"].(string)
-    decoder := json.NewDecoder(r.Body)
+    username, _ := claims["username"].(string)
+    format, password, err := bundleOptions(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, CodeBadRequest, "%v", err)
+        return
+    }
+    idempotencyKey := r.Header.Get(IdempotencyKeyHeader)
+    if idempotencyKey != "" {
+        if !ValidIdempotencyKey(idempotencyKey) {
+            writeError(w, r, http.StatusBadRequest, CodeBadRequest, "%s must be 1 to %d printable ASCII characters.", IdempotencyKeyHeader, MaxIdempotencyKeyLength)
+            return
+        }
+        // Keys are per user so that one user's key can never return
+        // another's certificate
+        idempotencyKey = "user/" + username + "/" + idempotencyKey
+    }
+    defer r.Body.Close()
     var certReq certJsonRequest
-    err := decoder.Decode(&certReq)
+    if err := json.NewDecoder(r.Body).Decode(&certReq); err != nil {
+        LemurCertsStatsd.Incr("errors", nil, 1)
+        writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Request body is not a valid certificate request: %v", err)
+        return
+    }
+    LemurCertsStatsd.Incr("requests", nil, 1)
+    fields := map[string]string{}
+    if certReq.Authority == "" {
+        fields["authority"] = "is required"
+    }
+    if certReq.CommonName == "" && certReq.CSR == "" {
+        fields["commonName"] = "is required unless a csr is given"
+    }
+    if certReq.Email == "" {
+        fields["owner"] = "is required"
+    } else if !isAdmin(rbacGroup) && !strings.EqualFold(certReq.Email, username) {
+        // Owners may revoke their certificates, so only admins hand them out
+        fields["owner"] = "must be your username unless you are in an admin group"
+    }
+    if certReq.KeyType != "" && !KnownKeyType(certReq.KeyType) {
+        fields["keyType"] = "must be one of " + strings.Join(LemurKeyTypes, ", ")
+    }
+    profile, err := Flags.Config.Profile(certReq.Profile)
+    if err != nil {
+        fields["profile"] = "does not exist"
+    }
+    var startDate, endDate string
+    if profile != nil {
+        startDate, endDate, err = profile.Window(certReq.StartDate, certReq.EndDate, time.Now())
+        if verr, ok := err.(*ValidityError); ok {
+            for field, problem := range verr.Fields {
+                fields[field] = problem
+            }
+        }
+    }
+    if len(fields) > 0 {
+        writeFieldErrors(w, r, "Some fields of the certificate request are invalid.", fields)
+        return
+    }
+    authority, err := LemurClient.AuthorityForGroup(rbacGroup, certReq.Authority)
+    if err != nil {
+        LemurCertsStatsd.Incr("errors", nil, 1)
+        Logs.Errorf("Unable to look up authorities: %+v", err)
+        writeError(w, r, http.StatusBadGateway, CodeLemurError, "Unable to look up authorities from Lemur.")
+        return
+    }
+    if authority == nil {
+        LemurCertsStatsd.Incr("denied", nil, 1)
+        writeError(w, r, http.StatusForbidden, CodeForbidden, "Authority '%s' is not available to group '%s'.", certReq.Authority, rbacGroup)
+        return
+    }
+    if !profile.AllowsAuthority(authority.Name) {
+        writeFieldErrors(w, r, "Some fields of the certificate request are invalid.",
+                         map[string]string{"profile": fmt.Sprintf("cannot be issued by authority '%s'", authority.Name)})
+        return
+    }
+    destinations, unknown, err := LemurClient.DestinationsByLabel(certReq.Destinations)
+    if err != nil {
+        LemurCertsStatsd.Incr("errors", nil, 1)
+        Logs.Errorf("Unable to look up destinations: %+v", err)
+        writeError(w, r, http.StatusBadGateway, CodeLemurError, "Unable to look up destinations from Lemur.")
+        return
+    }
+    if len(unknown) > 0 {
+        LemurCertsStatsd.Incr("errors", nil, 1)
+        writeFieldErrors(w, r, "Some fields of the certificate request are invalid.",
+                         map[string]string{"destinations": "has unknown destination(s) " + strings.Join(unknown, ", ")})
+        return
+    }
+    var manifest *certManifest
+    var keyType string
+    var dnsNames []string
+    if certReq.CSR != "" {
+        csr, err := ParseCSR(certReq.CSR)
+        if err != nil {
+            LemurCertsStatsd.Incr("errors", nil, 1)
+            writeFieldErrors(w, r, "Some fields of the certificate request are invalid.", map[string]string{"csr": err.Error()})
+            return
+        }
+        if err := CheckCSRSubject(csr, username, profile); err != nil {
+            LemurCertsStatsd.Incr("denied", nil, 1)
+            Logs.Warningf("User %s (%s) submitted a CSR naming what they may not ask for: %v", username, rbacGroup, err)
+            writeError(w, r, http.StatusForbidden, CodeForbidden, "%v", err)
+            return
+        }
+        if certReq.CommonName != "" && !strings.EqualFold(certReq.CommonName, csr.Subject.CommonName) {
+            writeFieldErrors(w, r, "Some fields of the certificate request are invalid.",
+                             map[string]string{"commonName": fmt.Sprintf("does not match the CSR's '%s'", csr.Subject.CommonName)})
+            return
+        }
+        if format == BundlePKCS12 || format == BundleJKS {
+            writeError(w, r, http.StatusBadRequest, CodeBadRequest, "%s bundles need the private key, which stays with you when you submit a CSR.", format)
+            return
+        }
+        LemurCertsStatsd.Incr("csr", nil, 1)
+        keyType = PublicKeyType(csr.PublicKey)
+        dnsNames = csr.DNSNames
+        manifest = profile.NewCSRCertManifest(certReq.Authority,
+                                              certReq.CSR,
+                                              csr.Subject.CommonName,
+                                              certReq.Email,
+                                              startDate,
+                                              endDate,
+                                              rbacGroup,
+                                              destinations...)
+    } else if !LemurClient.KeyFetchAllowed(authority.Name) {
+        writeFieldErrors(w, r, "Some fields of the certificate request are invalid.",
+                         map[string]string{"csr": fmt.Sprintf("is required, authority '%s' only issues certificates from a CSR", authority.Name)})
+        return
+    } else {
+        manifest = profile.NewCertManifest(certReq.Authority,
+                                           certReq.CommonName,
+                                           certReq.Email,
+                                           startDate,
+                                           endDate,
+                                           rbacGroup,
+                                           destinations...)
+        keyType = certReq.KeyType
+        if keyType == "" {
+            keyType = DefaultLemurKeyType
+        }
+        manifest.KeyType = keyType
+    }
+    manifest.requestedWindow = certReq.StartDate + "/" + certReq.EndDate
+    issuance := &IssuanceRequest{Group: rbacGroup,
+                                 Username: username,
+                                 Authority: authority.Name,
+                                 CommonName: manifest.CommonName,
+                                 DNSNames: dnsNames,
+                                 Owner: manifest.Email,
+                                 KeyType: keyType,
+                                 Start: manifest.StartDate,
+                                 End: manifest.EndDate}
+    if err := Flags.Config.Policy.Check(issuance, time.Now()); err != nil {
+        LemurCertsStatsd.Incr("denied", []string{"rule:" + err.(*PolicyViolation).Rule}, 1)
+        Logs.Warningf("User %s: %v", username, err)
+        writeError(w, r, http.StatusForbidden, CodePolicyViolation, "%v", err)
+        return
+    }
+    chainCertKey, err := LemurClient.ValidateCert(manifest, idempotencyKey)
+    if _, ok := err.(*VerificationError); ok {
+        writeError(w, r, http.StatusBadGateway, CodeVerificationFailed, "%v", err)
+        return
+    } else if err == ErrIdempotencyKeyReused {
+        writeError(w, r, http.StatusUnprocessableEntity, CodeIdempotencyKeyReused, "%v", err)
+        return
+    } else if err == ErrIdempotencyKeyInFlight {
+        writeError(w, r, http.StatusConflict, CodeConflict, "%v", err)
+        return
+    } else if err != nil {
+        LemurCertsStatsd.Incr("errors", nil, 1)
+        Logs.Errorf("%+v", err)
+        writeError(w, r, http.StatusBadGateway, CodeLemurError, "Unable to issue certificate: %v", err)
+        return
+    }
+    LemurCertsStatsd.Incr("issued", nil, 1)
+    for _, destination := range chainCertKey.Destinations {
+        LemurCertsStatsd.Incr("destination." + destination.Status, nil, 1)
+    }
+    bundle, err := chainCertKey.Bundle(format, manifest.CommonName, password)
+    if err != nil {
+        LemurCertsStatsd.Incr("errors", nil, 1)
+        Logs.Errorf("Unable to build %s bundle: %+v", format, err)
+        writeError(w, r, http.StatusInternalServerError, CodeInternal, "Unable to build %s bundle: %v", format, err)
+        return
+    }
+    LemurCertsStatsd.Incr("bundle." + format, nil, 1)
+    bundle.Write(w)
+}
+
+// CertBundleHandler downloads an existing certificate with its chain and
+// private key, in the format given by the format query parameter. Only the
+// certificate's owner or an admin may download it. Certificates issued from
+// a CSR, or by an authority in lemur.disable_key_fetch, come without a key.
+func CertBundleHandler (w http.ResponseWriter, r *http.Request) {
+    claims := secretKey.GetClaims(r.Header.Get("Authorization"))
+    username, _ := claims["username"].(string)
+    rbacGroup, _ := claims["rbac"].(string)
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Certificate id must be a number.")
+        return
+    }
+    format, password, err := bundleOptions(r)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, CodeBadRequest, "%v", err)
+        return
+    }
+    cert, err := LemurClient.GetCertificate(id)
+    if lemurErr, ok := err.(*LemurError); ok && lemurErr.StatusCode == http.StatusNotFound {
+        writeError(w, r, http.StatusNotFound, CodeNotFound, "No such certificate.")
+        return
+    } else if err != nil {
+        LemurCertsStatsd.Incr("errors", nil, 1)
+        Logs.Errorf("Unable to look up certificate %d: %+v", id, err)
+        writeError(w, r, http.StatusBadGateway, CodeLemurError, "Unable to look up certificate in Lemur.")
+        return
+    }
+    if !mayManage(username, rbacGroup, cert) {
+        LemurCertsStatsd.Incr("denied", nil, 1)
+        Logs.Warningf("User %s (%s) tried to download certificate %d owned by %s", username, rbacGroup, id, cert.Owner)
+        writeError(w, r, http.StatusForbidden, CodeForbidden, "Only the certificate's owner or an admin may download it.")
+        return
+    }
+    if !cert.IsUsable() {
+        writeError(w, r, http.StatusGone, CodeGone, "Certificate has been revoked or deactivated.")
+        return
+    }
+    // Without an authority there is nothing to check disable_key_fetch
+    // against, so the key is not fetched
+    withKey := cert.Authority != nil && LemurClient.KeyFetchAllowed(cert.Authority.Name)
+    chainCertKey, err := LemurClient.CertChainPubKey(cert, withKey)
+    if _, ok := err.(*MissingFieldError); ok && withKey {
+        // Lemur has no key for certificates it signed from a CSR
+        chainCertKey, err = LemurClient.CertChainPubKey(cert, false)
+    }
+    if err != nil {
+        LemurCertsStatsd.Incr("errors", nil, 1)
+        writeError(w, r, http.StatusBadGateway, CodeLemurError, "Unable to fetch certificate key from Lemur.")
+        return
+    }
+    if _, err := LemurClient.VerifyCertMaterial(chainCertKey, cert, nil); err != nil {
+        writeError(w, r, http.StatusBadGateway, CodeVerificationFailed, "%v", err)
+        return
+    }
+    bundle, err := chainCertKey.Bundle(format, cert.CN, password)
+    if err == ErrNoPrivateKey {
+        writeError(w, r, http.StatusConflict, CodeConflict, "%v", err)
+        return
+    } else if err != nil {
+        LemurCertsStatsd.Incr("errors", nil, 1)
+        Logs.Errorf("Unable to build %s bundle for certificate %d: %+v", format, id, err)
+        writeError(w, r, http.StatusInternalServerError, CodeInternal, "Unable to build %s bundle: %v", format, err)
+        return
+    }
+    LemurCertsStatsd.Incr("bundle." + format, nil, 1)
+    Logs.Infof("Certificate %d downloaded as %s by %s (%s)", id, format, username, rbacGroup)
+    bundle.Write(w)
+}
+
+// ListCertsHandler lists the certificates owned by the caller. Admins may
+// list another user's certificates with the owner query parameter.
+func ListCertsHandler (w http.ResponseWriter, r *http.Request) {
+    claims := secretKey.GetClaims(r.Header.Get("Authorization"))
+    username, _ := claims["username"].(string)
+    rbacGroup, _ := claims["rbac"].(string)
+    owner := username
+    if requested := r.URL.Query().Get("owner"); requested != "" && requested != username {
+        if !isAdmin(rbacGroup) {
+            writeError(w, r, http.StatusForbidden, CodeForbidden, "Only admins may list other users' certificates.")
+            return
+        }
+        owner = requested
+    }
+    if owner == "" {
+        writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Token has no username.")
+        return
+    }
+    certs := LemurClient.CertificatesByOwner(owner)
+    summaries := []CertificateSummary{}
+    for certs.Next() {
+        summaries = append(summaries, certs.Certificate().Summary())
+    }
+    if err := certs.Err(); err != nil {
+        LemurHttpStatsd.Incr("errors", nil, 1)
+        Logs.Errorf("Unable to list certificates for %s: %+v", owner, err)
+        writeError(w, r, http.StatusBadGateway, CodeLemurError, "Unable to list certificates from Lemur.")
+        return
+    }
+    output, _ := json.Marshal(map[string]interface{}{"owner": owner,
+                                                     "total": certs.Total(),
+                                                     "truncated": certs.Truncated(),
+                                                     "items": summaries})
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(output)
+}
+
+// RevokeCertHandler revokes a certificate in Lemur. Only the certificate's
+// owner or a member of an admin group may revoke it.
+func RevokeCertHandler (w http.ResponseWriter, r *http.Request) {
+    claims := secretKey.GetClaims(r.Header.Get("Authorization"))
+    username, _ := claims["username"].(string)
+    rbacGroup, _ := claims["rbac"].(string)
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
     if err != nil {
-		LemurCertsStatsd.Incr("errors", nil, 1)
-		Logs.Errorf("%+v", err)
-	}
-	LemurCertsStatsd.Incr("requests", nil, 1)
+        writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Certificate id must be a number.")
+        return
+    }
+    var revokeReq revokeJsonRequest
     defer r.Body.Close()
-	manifest := NewCertManifest(certReq.Authority,
-								certReq.CommonName,
-								certReq.Email,
-								certReq.StartDate,
-								certReq.EndDate,
-                                rbacGroup)
-	lemurReq := &LemurRequester{}
-	chainCertKey, err := lemurReq.ValidateCert(manifest)
-	if err != nil {
-		LemurCertsStatsd.Incr("errors", nil, 1)
-		Logs.Errorf("%+v", err)
-        w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, err)
-	} else {
-		LemurCertsStatsd.Incr("issued", nil, 1)
-		output, _ := json.Marshal(chainCertKey)
-        w.Header().Set("Content-Type", "application/json")
-		w.Write(output)
-	}
+    if err := json.NewDecoder(r.Body).Decode(&revokeReq); err != nil {
+        writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Unable to understand request: %v", err)
+        return
+    }
+    if !CRLReasons[revokeReq.Reason] {
+        writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Unknown revocation reason '%s'.", revokeReq.Reason)
+        return
+    }
+    cert, err := LemurClient.GetCertificate(id)
+    if lemurErr, ok := err.(*LemurError); ok && lemurErr.StatusCode == http.StatusNotFound {
+        writeError(w, r, http.StatusNotFound, CodeNotFound, "No such certificate.")
+        return
+    } else if err != nil {
+        LemurCertsStatsd.Incr("errors", nil, 1)
+        Logs.Errorf("Unable to look up certificate %d: %+v", id, err)
+        writeError(w, r, http.StatusBadGateway, CodeLemurError, "Unable to look up certificate in Lemur.")
+        return
+    }
+    if !mayManage(username, rbacGroup, cert) {
+        LemurCertsStatsd.Incr("denied", nil, 1)
+        Logs.Warningf("User %s (%s) tried to revoke certificate %d owned by %s", username, rbacGroup, id, cert.Owner)
+        writeError(w, r, http.StatusForbidden, CodeForbidden, "Only the certificate's owner or an admin may revoke it.")
+        return
+    }
+    if err := LemurClient.RevokeCertificate(id, revokeReq.Reason, username, revokeReq.Comments); err != nil {
+        LemurCertsStatsd.Incr("errors", nil, 1)
+        Logs.Errorf("Unable to revoke certificate %d: %+v", id, err)
+        writeError(w, r, http.StatusBadGateway, CodeLemurError, "Unable to revoke certificate: %v", err)
+        return
+    }
+    LemurCertsStatsd.Incr("revoked", nil, 1)
+    Logs.Infof("Certificate %d (%s) revoked by %s (%s), reason %s", id, cert.CN, username, rbacGroup, revokeReq.Reason)
+    output, _ := json.Marshal(map[string]interface{}{"id": id,
+                                                     "revoked": true,
+                                                     "reason": revokeReq.Reason,
+                                                     "revokedBy": username})
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(output)
 }
 
+// GetTokenHandler logs a user in with their Okta username and password. If
+// Okta wants a second factor the answer lists the push and TOTP factors the
+// user has, with the stateToken to pass to VerifyFactorHandler; otherwise
+// it carries the app token and refresh token.
 func GetTokenHandler (w http.ResponseWriter, r *http.Request) {
     decoder := json.NewDecoder(r.Body)
     var authReq authJsonRequest
@@ -165,33 +721,120 @@ func GetTokenHandler (w http.ResponseWriter, r *http.Request) {
     if err != nil {
         LemurHttpStatsd.Incr("errors", nil, 1)
         Logs.Errorf("%+v", err)
-        w.WriteHeader(http.StatusBadRequest)
-        w.Write([]byte("400 - Unable to understand request."))
+        writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Unable to understand request: %v", err)
         return
     }
-    response, err := OktaProvider.OktaApiAuth(authReq)
-    if err != nil {
+    fields := map[string]string{}
+    if authReq.UserName == "" {
+        fields["username"] = "is required"
+    }
+    if authReq.Password == "" {
+        fields["password"] = "is required"
+    }
+    if len(fields) > 0 {
+        writeFieldErrors(w, r, "Some fields of the request are invalid.", fields)
+        return
+    }
+    if OktaProvider == nil || OktaProvider.Config.Okta.ApiToken == "" {
+        writeError(w, r, http.StatusNotFound, CodeNotFound, "API login is not configured.")
+        return
+    }
+    transaction, err := OktaProvider.OktaApiAuth(authReq)
+    Logs.Infof("Made a login attempt against %s for %s", OktaProvider.Config.IdpApiAuthUrl, authReq.UserName)
+    finishOktaLogin(w, r, transaction, err)
+}
+
+type verifyFactorJsonRequest struct {
+    StateToken string `json:"stateToken"`
+    PassCode   string `json:"passCode"`
+}
+
+// VerifyFactorHandler answers Okta's MFA challenge with one of the factors
+// GetTokenHandler listed. TOTP factors take the passCode. Push factors are
+// sent without one, and answer MFA_CHALLENGE with factorResult WAITING until
+// the user responds on their phone; send the same request again every few
+// seconds until the answer carries a token.
+func VerifyFactorHandler (w http.ResponseWriter, r *http.Request) {
+    var verifyReq verifyFactorJsonRequest
+    defer r.Body.Close()
+    if err := json.NewDecoder(r.Body).Decode(&verifyReq); err != nil {
+        writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Unable to understand request: %v", err)
+        return
+    }
+    if verifyReq.StateToken == "" {
+        writeFieldErrors(w, r, "Some fields of the request are invalid.", map[string]string{"stateToken": "is required"})
+        return
+    }
+    if OktaProvider == nil || OktaProvider.Config.Okta.ApiToken == "" {
+        writeError(w, r, http.StatusNotFound, CodeNotFound, "API login is not configured.")
+        return
+    }
+    transaction, err := OktaProvider.VerifyFactor(mux.Vars(r)["factorId"], verifyReq.StateToken, verifyReq.PassCode)
+    finishOktaLogin(w, r, transaction, err)
+}
+
+// finishOktaLogin answers with the next step of an Okta Authn login, and
+// only mints tokens once Okta reports SUCCESS
+func finishOktaLogin(w http.ResponseWriter, r *http.Request, transaction *oktaAuthnTransaction, err error) {
+    if apiErr, ok := err.(*oktaApiError); ok && apiErr.Refused() {
+        LemurHttpStatsd.Incr("logins.failed", nil, 1)
+        writeError(w, r, http.StatusUnauthorized, CodeAuthenticationFailed, "Authentication failure: %s", apiErr.ErrorSummary)
+        return
+    } else if err != nil {
         LemurHttpStatsd.Incr("errors", nil, 1)
         Logs.Errorf("%+v", err)
-        w.WriteHeader(http.StatusInternalServerError)
-        w.Write([]byte("500 - Unable to send request to Idp API auth url."))
-        return
-    } else if response.StatusCode >= 400 {
-        w.WriteHeader(response.StatusCode)
-        w.Write([]byte(fmt.Sprintf("%d - authentication failure", response.StatusCode)))
+        writeError(w, r, http.StatusBadGateway, CodeIdpError, "Unable to reach the Idp API.")
         return
     }
-    Logs.Infof("Made a login attempt against %s, status code %d", OktaProvider.Config.IdpApiAuthUrl, response.StatusCode)
-    data, err := secretKey.MakeToken(authReq.UserName, "")
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        w.Write([]byte("500 - Unable to generate authentication token."))
+    var output []byte
+    switch transaction.Status {
+    case OktaAuthnSuccess:
+        username, group, err := OktaProvider.UserGroup(transaction.SessionToken)
+        if err == ErrNoOktaGroup {
+            writeError(w, r, http.StatusForbidden, CodeForbidden, "%s has no Okta group to request certificates with.", username)
+            return
+        } else if err != nil {
+            LemurHttpStatsd.Incr("errors", nil, 1)
+            Logs.Errorf("%+v", err)
+            writeError(w, r, http.StatusBadGateway, CodeIdpError, "Unable to look up the user's Okta group.")
+            return
+        }
+        data, err := secretKey.StartSession(username, group)
+        if err != nil {
+            writeError(w, r, http.StatusInternalServerError, CodeInternal, "Unable to generate authentication token.")
+            return
+        }
+        LemurCertsStatsd.Incr("authenticate", nil, 1)
+        LemurHttpStatsd.Incr("tokens", nil, 1)
+        data["status"] = transaction.Status
+        output, _ = json.Marshal(data)
+    case OktaAuthnMFARequired:
+        factors := transaction.SupportedFactors()
+        if len(factors) == 0 {
+            writeError(w, r, http.StatusUnauthorized, CodeAuthenticationFailed, "Okta requires a second factor, but no push or TOTP factor is enrolled.")
+            return
+        }
+        output, _ = json.Marshal(map[string]interface{}{"status": transaction.Status,
+                                                        "stateToken": transaction.StateToken,
+                                                        "expiresAt": transaction.ExpiresAt,
+                                                        "factors": factors})
+    case OktaAuthnMFAChallenge:
+        if transaction.FactorResult == OktaFactorRejected || transaction.FactorResult == OktaFactorTimeout {
+            LemurHttpStatsd.Incr("logins.failed", nil, 1)
+            writeError(w, r, http.StatusUnauthorized, CodeAuthenticationFailed, "Authentication failure: push %s.", strings.ToLower(transaction.FactorResult))
+            return
+        }
+        output, _ = json.Marshal(map[string]interface{}{"status": transaction.Status,
+                                                        "stateToken": transaction.StateToken,
+                                                        "expiresAt": transaction.ExpiresAt,
+                                                        "factorResult": transaction.FactorResult})
+    default:
+        LemurHttpStatsd.Incr("logins.failed", nil, 1)
+        writeError(w, r, http.StatusUnauthorized, CodeAuthenticationFailed, "Okta login is %s; finish it in a browser.", transaction.Status)
         return
     }
-    LemurHttpStatsd.Incr("tokens", nil, 1)
-    output, _ := json.Marshal(data)
-    w.WriteHeader(http.StatusOK)
     w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusOK)
     w.Write(output)
 }
 
@@ -202,13 +845,216 @@ func PingHandler (w http.ResponseWriter, r *http.Request) {
     return
 }
 
+// InventoryHandler streams a certificate inventory from Lemur as newline
+// delimited JSON, one certificate summary per line. Either of the optional
+// owner and filter query parameters is passed on to Lemur's search; owner
+// keeps only certificates whose owner is exactly that address. The export
+// stops at the configured lemur.max_results, in which case the last line is
+// a {"truncated": true} marker.
+func InventoryHandler (w http.ResponseWriter, r *http.Request) {
+    query := url.Values{}
+    owner, filter := r.URL.Query().Get("owner"), r.URL.Query().Get("filter")
+    // owner is itself a Lemur filter, and Lemur takes only one
+    if owner != "" && filter != "" {
+        writeFieldErrors(w, r, "Some fields of the request are invalid.",
+                         map[string]string{"filter": "cannot be combined with owner"})
+        return
+    }
+    if filter != "" {
+        query.Set("filter", filter)
+    }
+    var certs *CertificateIterator
+    if owner != "" {
+        certs = LemurClient.CertificatesByOwner(owner)
+    } else {
+        certs = LemurClient.IterateCertificates(query)
+    }
+    w.Header().Set("Content-Type", "application/x-ndjson")
+    encoder := json.NewEncoder(w)
+    exported := 0
+    for certs.Next() {
+        if err := encoder.Encode(certs.Certificate().Summary()); err != nil {
+            Logs.Errorf("Unable to write inventory: %+v", err)
+            return
+        }
+        exported++
+    }
+    if err := certs.Err(); err != nil {
+        LemurHttpStatsd.Incr("errors", nil, 1)
+        Logs.Errorf("Inventory export stopped after %d certificates: %+v", exported, err)
+        if exported == 0 {
+            writeError(w, r, http.StatusBadGateway, CodeLemurError, "Unable to list certificates from Lemur.")
+        }
+        return
+    }
+    if certs.Truncated() {
+        encoder.Encode(map[string]bool{"truncated": true})
+    }
+    Logs.Infof("Exported %d of %d certificates", exported, certs.Total())
+}
+
 // HealthcheckHandler always returns 200 OK
 // At the time of this writing, there is no scenario in which normal program
 // execution will continue but also be unusable; any error preventing use will
 // also panic()
+// A Lemur outage is reported through the circuit breaker state but does not
+// make the application unhealthy, since restarting us will not fix Lemur.
+// Neither does IdP metadata that cannot be loaded, which is retried.
 func HealthcheckHandler (w http.ResponseWriter, r *http.Request) {
-    w.WriteHeader(http.StatusOK)
+    state, failures := LemurClient.Breaker.Status()
+    health := map[string]interface{}{
+        "application": map[string]interface{}{"healthy": true},
+        "lemur": map[string]interface{}{"circuit": state,
+                                        "consecutive_failures": failures,
+                                        "available": state != BreakerOpen},
+    }
+    if SAMLProvider != nil {
+        health["saml"] = SAMLProvider.Status()
+    }
+    output, _ := json.Marshal(health)
     w.Header().Set("Content-Type", "application/json")
-    w.Write([]byte(`{"application": {"healthy": true} }`))
+    w.WriteHeader(http.StatusOK)
+    w.Write(output)
     return
 }
+
+// RotateTokenKeyHandler makes a fresh key the app token signing key. Tokens
+// signed with the previous keys keep validating until they are retired.
+func RotateTokenKeyHandler (w http.ResponseWriter, r *http.Request) {
+    kid, err := secretKey.Rotate()
+    if err == ErrTokenKeysReadOnly {
+        writeError(w, r, http.StatusConflict, CodeConflict, "%v", err)
+        return
+    } else if err != nil {
+        Logs.Errorf("Unable to rotate token keys: %+v", err)
+        writeError(w, r, http.StatusInternalServerError, CodeInternal, "Unable to rotate token keys: %v", err)
+        return
+    }
+    LemurHttpStatsd.Incr("token_keys.rotated", nil, 1)
+    Logs.Infof("Rotated token signing key to %s at the request of %s", kid, adminCaller(r))
+    output, _ := json.Marshal(map[string]interface{}{"kid": kid, "keys": secretKey.KeyIds()})
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(output)
+}
+
+// JWKSHandler publishes the public keys app tokens are signed with, so that
+// other services can verify them
+func JWKSHandler (w http.ResponseWriter, r *http.Request) {
+    output, _ := json.Marshal(secretKey.JWKS())
+    w.Header().Set("Content-Type", "application/json")
+    // Short, so that consumers see a rotated key soon
+    w.Header().Set("Cache-Control", "public, max-age=60")
+    w.Write(output)
+}
+
+// LogoutHandler revokes the caller's app token, taken from the Authorization
+// header or the auth cookie, ends its session and clears the cookies
+func LogoutHandler (w http.ResponseWriter, r *http.Request) {
+    token := r.Header.Get("Authorization")
+    if cookie, err := r.Cookie("auth"); token == "" && err == nil {
+        token = cookie.Value
+    }
+    clearSessionCookies(w)
+    // The app token may have expired while its session is still open
+    if refresh, err := r.Cookie(refreshCookie); err == nil && refresh.Value != "" {
+        // A refresh token the session did not hand out has nothing to end
+        if err := secretKey.EndSession(refresh.Value); err != nil && err != ErrRefreshTokenInvalid {
+            Logs.Errorf("Unable to end session: %+v", err)
+            writeError(w, r, http.StatusInternalServerError, CodeInternal, "Unable to end session.")
+            return
+        }
+    }
+    // A token that no longer validates cannot be used anyway, so there is
+    // nothing to revoke
+    if _, err := secretKey.ValidateToken(token); err == nil {
+        if err := secretKey.Revoke(token); err != nil {
+            Logs.Errorf("Unable to revoke token: %+v", err)
+            writeError(w, r, http.StatusInternalServerError, CodeInternal, "Unable to revoke token.")
+            return
+        }
+        LemurHttpStatsd.Incr("logout", nil, 1)
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+type refreshJsonRequest struct {
+    RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshHandler exchanges a refresh token for a new app token and the next
+// refresh token. Browsers send theirs in the refresh cookie and get the new
+// ones back as cookies; other clients send {"refresh_token": ...} and get
+// both back in the body. Each refresh token works once.
+func RefreshHandler (w http.ResponseWriter, r *http.Request) {
+    var refreshReq refreshJsonRequest
+    fromCookie := false
+    if cookie, err := r.Cookie(refreshCookie); err == nil && cookie.Value != "" {
+        refreshReq.RefreshToken, fromCookie = cookie.Value, true
+    } else {
+        defer r.Body.Close()
+        if err := json.NewDecoder(r.Body).Decode(&refreshReq); err != nil {
+            writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Unable to understand request: %v", err)
+            return
+        }
+        if refreshReq.RefreshToken == "" {
+            writeFieldErrors(w, r, "Some fields of the request are invalid.", map[string]string{"refresh_token": "is required"})
+            return
+        }
+    }
+    tokens, err := secretKey.RefreshSession(refreshReq.RefreshToken)
+    if err == ErrRefreshTokenReused {
+        LemurHttpStatsd.Incr("tokens.refresh_reused", nil, 1)
+        Logs.Warningf("A refresh token was used twice; ended its session")
+    }
+    if err == ErrRefreshTokenInvalid || err == ErrRefreshTokenReused || err == ErrSessionExpired {
+        if fromCookie {
+            clearSessionCookies(w)
+        }
+        writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "%v", err)
+        return
+    } else if err != nil {
+        Logs.Errorf("Unable to refresh session: %+v", err)
+        writeError(w, r, http.StatusInternalServerError, CodeInternal, "Unable to refresh session.")
+        return
+    }
+    LemurHttpStatsd.Incr("tokens.refreshed", nil, 1)
+    if fromCookie {
+        setSessionCookies(w, tokens)
+        // The refresh token stays out of reach of scripts
+        delete(tokens, "refresh_token")
+    }
+    output, _ := json.Marshal(tokens)
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(output)
+}
+
+type revokeUserJsonRequest struct {
+    Username string `json:"username"`
+}
+
+// RevokeUserTokensHandler revokes every app token issued to a user so far
+// and ends their sessions, e.g. when they leave
+func RevokeUserTokensHandler (w http.ResponseWriter, r *http.Request) {
+    var revokeReq revokeUserJsonRequest
+    defer r.Body.Close()
+    if err := json.NewDecoder(r.Body).Decode(&revokeReq); err != nil {
+        writeError(w, r, http.StatusBadRequest, CodeMalformedBody, "Unable to understand request: %v", err)
+        return
+    }
+    if revokeReq.Username == "" {
+        writeFieldErrors(w, r, "Some fields of the request are invalid.", map[string]string{"username": "is required"})
+        return
+    }
+    revokedBefore, err := secretKey.RevokeUser(revokeReq.Username)
+    if err != nil {
+        Logs.Errorf("Unable to revoke tokens for %s: %+v", revokeReq.Username, err)
+        writeError(w, r, http.StatusInternalServerError, CodeInternal, "Unable to revoke tokens: %v", err)
+        return
+    }
+    LemurHttpStatsd.Incr("tokens.revoked_users", nil, 1)
+    Logs.Infof("Revoked all tokens issued to %s at the request of %s", revokeReq.Username, adminCaller(r))
+    output, _ := json.Marshal(map[string]interface{}{"username": revokeReq.Username,
+                                                     "revokedBefore": revokedBefore.UTC().Format(time.RFC3339)})
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(output)
+}
@@ -13,7 +13,8 @@ func HTTPLogger(inner http.Handler, name string) http.Handler {
         inner.ServeHTTP(w, r)
 
         Logs.Infof(
-            "%s\t%s\t%s\t%s",
+            "%s\t%s\t%s\t%s\t%s",
+            RequestIdFrom(r),
             r.Method,
             r.RequestURI,
             name,
@@ -0,0 +1,148 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "io/ioutil"
+    "os"
+    "sync"
+    "time"
+)
+
+// IdempotencyKeyHeader carries a client-chosen key identifying one logical
+// certificate request. Retrying with the same key returns the certificate
+// issued the first time instead of issuing another.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// MaxIdempotencyKeyLength bounds the keys clients may send
+const MaxIdempotencyKeyLength = 255
+
+var ErrIdempotencyKeyReused = errors.New("Idempotency-Key was already used for a different request")
+var ErrIdempotencyKeyInFlight = errors.New("A request with this Idempotency-Key is still in progress")
+
+// idempotencyRecord is what we remember about a key: the request it was
+// first used with and the Lemur certificate that request produced
+type idempotencyRecord struct {
+    Fingerprint   string    `json:"fingerprint"`
+    CertificateId int       `json:"certificateId"`
+    Created       time.Time `json:"created"`
+}
+
+// IdempotencyStore maps idempotency keys to Lemur certificate ids. Records
+// expire after ttl. With a path the records are kept in a JSON file so they
+// survive restarts; without one they are only kept in memory.
+type IdempotencyStore struct {
+    mu       sync.Mutex
+    path     string
+    ttl      time.Duration
+    records  map[string]idempotencyRecord
+    inflight map[string]bool
+}
+
+// NewIdempotencyStore opens the store at path, loading any records already
+// written there
+func NewIdempotencyStore(path string, ttl time.Duration) (*IdempotencyStore, error) {
+    store := &IdempotencyStore{path: path,
+                               ttl: ttl,
+                               records: map[string]idempotencyRecord{},
+                               inflight: map[string]bool{}}
+    if path == "" {
+        return store, nil
+    }
+    data, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return store, nil
+    } else if err != nil {
+        return nil, err
+    }
+    if err := json.Unmarshal(data, &store.records); err != nil {
+        return nil, err
+    }
+    return store, nil
+}
+
+// ValidIdempotencyKey reports whether key is acceptable: printable ASCII and
+// no longer than MaxIdempotencyKeyLength
+func ValidIdempotencyKey(key string) bool {
+    if key == "" || len(key) > MaxIdempotencyKeyLength {
+        return false
+    }
+    for _, c := range key {
+        if c < 0x20 || c > 0x7e {
+            return false
+        }
+    }
+    return true
+}
+
+// Begin claims key for a request with the given fingerprint
+// Called on an IdempotencyStore pointer
+// Takes the key and the request fingerprint as arguments
+// Returns the certificate id recorded for the key (0 if none) and an error,
+// which is ErrIdempotencyKeyReused if the key belongs to a different request
+// or ErrIdempotencyKeyInFlight if another request holds it. Every successful
+// Begin must be followed by Finish.
+func (s *IdempotencyStore) Begin(key, fingerprint string) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.inflight[key] {
+        return 0, ErrIdempotencyKeyInFlight
+    }
+    record, ok := s.records[key]
+    if ok && time.Since(record.Created) > s.ttl {
+        delete(s.records, key)
+        record, ok = idempotencyRecord{}, false
+    }
+    if ok && record.Fingerprint != fingerprint {
+        return 0, ErrIdempotencyKeyReused
+    }
+    s.inflight[key] = true
+    return record.CertificateId, nil
+}
+
+// Finish releases key and, if id is set, records it as the key's
+// certificate. A failed write is logged rather than returned since the
+// certificate has already been issued by then.
+// Called on an IdempotencyStore pointer
+// Takes the key, the request fingerprint and a certificate id (0 if the
+// request failed) as arguments
+// Returns nothing
+func (s *IdempotencyStore) Finish(key, fingerprint string, id int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    delete(s.inflight, key)
+    if id == 0 {
+        return
+    }
+    record, ok := s.records[key]
+    if ok && record.CertificateId == id {
+        return
+    }
+    s.records[key] = idempotencyRecord{Fingerprint: fingerprint, CertificateId: id, Created: time.Now()}
+    if err := s.save(); err != nil {
+        Logs.Errorf("Unable to write idempotency store %s: %+v", s.path, err)
+    }
+}
+
+// save drops expired records and writes the rest to the store's file. The
+// caller must hold mu.
+func (s *IdempotencyStore) save() error {
+    for key, record := range s.records {
+        if time.Since(record.Created) > s.ttl {
+            delete(s.records, key)
+        }
+    }
+    if s.path == "" {
+        return nil
+    }
+    data, err := json.Marshal(s.records)
+    if err != nil {
+        return err
+    }
+    // Write then rename so a crash never leaves a truncated store behind
+    tmp := s.path + ".tmp"
+    if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+        return err
+    }
+    return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestIdempotencyStore(t *testing.T) {
+    dir, err := ioutil.TempDir("", "idempotency")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "idempotency.json")
+    store, err := NewIdempotencyStore(path, time.Hour)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if id, err := store.Begin("key", "fingerprint"); err != nil || id != 0 {
+        t.Fatalf("A new key should have no certificate, got %d: %v", id, err)
+    }
+    if _, err := store.Begin("key", "fingerprint"); err != ErrIdempotencyKeyInFlight {
+        t.Errorf("A key should not be claimed twice at once, got %v", err)
+    }
+    store.Finish("key", "fingerprint", 42)
+
+    reopened, err := NewIdempotencyStore(path, time.Hour)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if id, err := reopened.Begin("key", "fingerprint"); err != nil || id != 42 {
+        t.Errorf("Keys should survive a restart, got %d: %v", id, err)
+    }
+    reopened.Finish("key", "fingerprint", 0)
+    if _, err := reopened.Begin("key", "other"); err != ErrIdempotencyKeyReused {
+        t.Errorf("A key should not be reused for a different request, got %v", err)
+    }
+
+    expired, err := NewIdempotencyStore(path, time.Nanosecond)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if id, err := expired.Begin("key", "other"); err != nil || id != 0 {
+        t.Errorf("Expired keys should be forgotten, got %d: %v", id, err)
+    }
+
+    if ValidIdempotencyKey("") || ValidIdempotencyKey("tab\there") || !ValidIdempotencyKey("4f1c-retry") {
+        t.Errorf("Idempotency keys should be printable ASCII!")
+    }
+}
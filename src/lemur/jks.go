@@ -0,0 +1,175 @@
+package main
+
+import (
+    "bytes"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/asn1"
+    "encoding/binary"
+    "strconv"
+    "strings"
+    "time"
+    "unicode/utf16"
+)
+
+// A minimal writer for Sun's JKS keystore format, which older Java runtimes
+// still expect. Private keys are protected with Sun's proprietary
+// KeyProtector scheme and the whole file with a SHA-1 integrity digest.
+
+const (
+    jksMagic            = 0xFEEDFEED
+    jksVersion          = 2
+    jksPrivateKeyEntry  = 1
+    jksTrustedCertEntry = 2
+)
+
+var oidSunKeyProtector = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+
+// jksWriter accumulates keystore entries in Java's DataOutputStream layout
+type jksWriter struct {
+    buf     bytes.Buffer
+    entries int
+}
+
+func (j *jksWriter) uint32(v uint32) {
+    binary.Write(&j.buf, binary.BigEndian, v)
+}
+
+func (j *jksWriter) int64(v int64) {
+    binary.Write(&j.buf, binary.BigEndian, v)
+}
+
+// utf writes a string the way DataOutputStream.writeUTF does. Aliases and
+// certificate types are plain ASCII, for which modified UTF-8 and UTF-8 agree.
+func (j *jksWriter) utf(s string) {
+    binary.Write(&j.buf, binary.BigEndian, uint16(len(s)))
+    j.buf.WriteString(s)
+}
+
+func (j *jksWriter) bytes(b []byte) {
+    j.uint32(uint32(len(b)))
+    j.buf.Write(b)
+}
+
+func (j *jksWriter) certificate(cert *x509.Certificate) {
+    j.utf("X.509")
+    j.bytes(cert.Raw)
+}
+
+func (j *jksWriter) PrivateKey(alias string, protectedKey []byte, chain []*x509.Certificate, created time.Time) {
+    j.uint32(jksPrivateKeyEntry)
+    j.utf(alias)
+    j.int64(created.UnixNano() / int64(time.Millisecond))
+    j.bytes(protectedKey)
+    j.uint32(uint32(len(chain)))
+    for _, cert := range chain {
+        j.certificate(cert)
+    }
+    j.entries++
+}
+
+func (j *jksWriter) TrustedCert(alias string, cert *x509.Certificate, created time.Time) {
+    j.uint32(jksTrustedCertEntry)
+    j.utf(alias)
+    j.int64(created.UnixNano() / int64(time.Millisecond))
+    j.certificate(cert)
+    j.entries++
+}
+
+// Bytes returns the finished keystore: header, entries and the integrity
+// digest keyed by password
+func (j *jksWriter) Bytes(password string) []byte {
+    var out bytes.Buffer
+    binary.Write(&out, binary.BigEndian, uint32(jksMagic))
+    binary.Write(&out, binary.BigEndian, uint32(jksVersion))
+    binary.Write(&out, binary.BigEndian, uint32(j.entries))
+    out.Write(j.buf.Bytes())
+    digest := sha1.New()
+    digest.Write(jksPassword(password))
+    digest.Write([]byte("Mighty Aphrodite"))
+    digest.Write(out.Bytes())
+    out.Write(digest.Sum(nil))
+    return out.Bytes()
+}
+
+// jksPassword encodes a password as UTF-16 big endian without a terminator
+func jksPassword(password string) []byte {
+    encoded := utf16.Encode([]rune(password))
+    out := make([]byte, 0, len(encoded) * 2)
+    for _, r := range encoded {
+        out = append(out, byte(r >> 8), byte(r))
+    }
+    return out
+}
+
+// jksProtectKey encrypts a PKCS#8 key with sun.security.provider.KeyProtector:
+// the key is XORed with a SHA-1 keystream seeded by a random salt, followed
+// by a SHA-1 checksum of the plaintext
+func jksProtectKey(pkcs8Key []byte, password string) ([]byte, error) {
+    salt := make([]byte, sha1.Size)
+    if _, err := rand.Read(salt); err != nil {
+        return nil, err
+    }
+    return jksProtectKeyWithSalt(pkcs8Key, password, salt)
+}
+
+// jksProtectKeyWithSalt is jksProtectKey with a given salt, so the result
+// can be compared with a known keystore
+func jksProtectKeyWithSalt(pkcs8Key []byte, password string, salt []byte) ([]byte, error) {
+    passwordBytes := jksPassword(password)
+    keystream := make([]byte, 0, len(pkcs8Key) + sha1.Size)
+    digest := salt
+    for len(keystream) < len(pkcs8Key) {
+        hash := sha1.New()
+        hash.Write(passwordBytes)
+        hash.Write(digest)
+        digest = hash.Sum(nil)
+        keystream = append(keystream, digest...)
+    }
+    protected := make([]byte, 0, len(salt) + len(pkcs8Key) + sha1.Size)
+    protected = append(protected, salt...)
+    for i, b := range pkcs8Key {
+        protected = append(protected, b ^ keystream[i])
+    }
+    checksum := sha1.New()
+    checksum.Write(passwordBytes)
+    checksum.Write(pkcs8Key)
+    protected = append(protected, checksum.Sum(nil)...)
+    return asn1.Marshal(encryptedPrivateKeyInfo{
+        AlgorithmIdentifier: pkix.AlgorithmIdentifier{Algorithm: oidSunKeyProtector,
+                                                      Parameters: asn1.RawValue{FullBytes: []byte{asn1.TagNull, 0}}},
+        EncryptedData: protected,
+    })
+}
+
+// EncodeJKS builds a keystore holding the private key and its chain, and a
+// truststore holding the issuing chain, both protected by password
+// Takes a PKCS#8 DER private key, the leaf, the chain, the key alias and
+// the password
+// Returns the keystore, the truststore and an error
+func EncodeJKS(pkcs8Key []byte, leaf *x509.Certificate, chain []*x509.Certificate, alias, password string) ([]byte, []byte, error) {
+    protectedKey, err := jksProtectKey(pkcs8Key, password)
+    if err != nil {
+        return nil, nil, err
+    }
+    now := time.Now()
+    var keystore jksWriter
+    keystore.PrivateKey(alias, protectedKey, append([]*x509.Certificate{leaf}, chain...), now)
+    var truststore jksWriter
+    for i, cert := range chain {
+        truststore.TrustedCert(jksAlias(cert, i), cert, now)
+    }
+    return keystore.Bytes(password), truststore.Bytes(password), nil
+}
+
+// jksAlias names a CA certificate in the truststore. keytool lower-cases
+// aliases, so we do too.
+func jksAlias(cert *x509.Certificate, index int) string {
+    name := sanitizeFilename(cert.Subject.CommonName)
+    if name == "" {
+        name = "ca"
+    }
+    return strings.ToLower(name) + "-" + strconv.Itoa(index)
+}
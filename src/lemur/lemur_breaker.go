@@ -0,0 +1,170 @@
+package main
+
+import (
+    "errors"
+    "math/rand"
+    "net"
+    "net/http"
+    "net/url"
+    "sync"
+    "time"
+)
+
+// ErrLemurUnavailable is returned without contacting Lemur while the circuit
+// breaker is open
+var ErrLemurUnavailable = errors.New("Lemur is unavailable, failing fast until it recovers")
+
+const (
+    BreakerClosed   = "closed"
+    BreakerOpen     = "open"
+    BreakerHalfOpen = "half-open"
+)
+
+// circuitBreaker stops us from piling requests onto Lemur while it is down.
+// After threshold consecutive failures it opens and rejects calls; once
+// cooldown has passed a single probe is let through, and its result decides
+// whether the breaker closes again or stays open for another cooldown.
+type circuitBreaker struct {
+    mu        sync.Mutex
+    state     string
+    failures  int
+    threshold int
+    cooldown  time.Duration
+    openedAt  time.Time
+    probing   bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+    return &circuitBreaker{state: BreakerClosed, threshold: threshold, cooldown: cooldown}
+}
+
+// Allow returns ErrLemurUnavailable if a call should not be attempted
+func (b *circuitBreaker) Allow() error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    switch b.state {
+    case BreakerOpen:
+        if time.Since(b.openedAt) < b.cooldown {
+            LemurHttpStatsd.Incr("upstream.rejected", nil, 1)
+            return ErrLemurUnavailable
+        }
+        b.setState(BreakerHalfOpen)
+        b.probing = true
+        return nil
+    case BreakerHalfOpen:
+        if b.probing {
+            LemurHttpStatsd.Incr("upstream.rejected", nil, 1)
+            return ErrLemurUnavailable
+        }
+        b.probing = true
+        return nil
+    }
+    return nil
+}
+
+// Success records a call that reached a healthy Lemur
+func (b *circuitBreaker) Success() {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.failures = 0
+    b.probing = false
+    if b.state != BreakerClosed {
+        Logs.Infof("Lemur is reachable again, closing circuit breaker.")
+        b.setState(BreakerClosed)
+    }
+}
+
+// Failure records a call that failed because of Lemur or the network
+func (b *circuitBreaker) Failure() {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.failures++
+    b.probing = false
+    if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.threshold) {
+        Logs.Warningf("Lemur failed %d time(s) in a row, opening circuit breaker for %s.", b.failures, b.cooldown)
+        b.openedAt = time.Now()
+        b.setState(BreakerOpen)
+    }
+}
+
+// setState must be called with mu held
+func (b *circuitBreaker) setState(state string) {
+    b.state = state
+    open := 0.0
+    if state != BreakerClosed {
+        open = 1.0
+    }
+    LemurHttpStatsd.Gauge("upstream.circuit_open", open, nil, 1)
+}
+
+// Status reports the breaker state and current failure streak
+func (b *circuitBreaker) Status() (string, int) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown {
+        return BreakerHalfOpen, b.failures
+    }
+    return b.state, b.failures
+}
+
+// retryPolicy computes exponential backoff with full jitter
+type retryPolicy struct {
+    retries    int
+    base       time.Duration
+    max        time.Duration
+    mu         sync.Mutex
+    random     *rand.Rand
+}
+
+func newRetryPolicy(retries int, base, max time.Duration) *retryPolicy {
+    return &retryPolicy{retries: retries,
+                        base: base,
+                        max: max,
+                        random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Backoff returns how long to wait before retry number attempt (from 0)
+func (p *retryPolicy) Backoff(attempt int) time.Duration {
+    ceiling := p.base << uint(attempt)
+    if ceiling > p.max || ceiling <= 0 {
+        ceiling = p.max
+    }
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return time.Duration(p.random.Int63n(int64(ceiling) + 1))
+}
+
+// isUpstreamFailure says whether an error means Lemur (or the way to it) is
+// unhealthy, as opposed to Lemur rejecting a bad request
+func isUpstreamFailure(err error) bool {
+    if err == nil {
+        return false
+    }
+    if lemurErr, ok := err.(*LemurError); ok {
+        return lemurErr.StatusCode >= 500
+    }
+    return true
+}
+
+// isRetryable says whether an idempotent request that failed with err is
+// worth trying again
+func isRetryable(err error) bool {
+    if lemurErr, ok := err.(*LemurError); ok {
+        switch lemurErr.StatusCode {
+        case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusTooManyRequests:
+            return true
+        }
+        return false
+    }
+    return err != nil
+}
+
+// neverSent says whether a request failed before any of it reached Lemur,
+// which is the only case in which a non-idempotent request may be repeated
+func neverSent(err error) bool {
+    if urlErr, ok := err.(*url.Error); ok {
+        err = urlErr.Err
+    }
+    opErr, ok := err.(*net.OpError)
+    return ok && opErr.Op == "dial"
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+    breaker := newCircuitBreaker(2, 50 * time.Millisecond)
+    breaker.Failure()
+    if err := breaker.Allow(); err != nil {
+        t.Errorf("Breaker should stay closed below its failure threshold!")
+    }
+    breaker.Failure()
+    if err := breaker.Allow(); err != ErrLemurUnavailable {
+        t.Errorf("Breaker should open once the failure threshold is reached!")
+    }
+    time.Sleep(60 * time.Millisecond)
+    // After the cooldown exactly one probe is let through
+    if err := breaker.Allow(); err != nil {
+        t.Errorf("Breaker should allow a probe after its cooldown!")
+    }
+    if err := breaker.Allow(); err != ErrLemurUnavailable {
+        t.Errorf("Breaker should only allow one probe at a time!")
+    }
+    breaker.Success()
+    if state, failures := breaker.Status(); state != BreakerClosed || failures != 0 {
+        t.Errorf("A successful probe should close the breaker, got %s with %d failures", state, failures)
+    }
+}
+
+func TestRetryBackoff(t *testing.T) {
+    policy := newRetryPolicy(5, 100 * time.Millisecond, time.Second)
+    for attempt := 0; attempt < 10; attempt++ {
+        if wait := policy.Backoff(attempt); wait < 0 || wait > time.Second {
+            t.Errorf("Backoff for attempt %d should be within [0, 1s], got %s", attempt, wait)
+        }
+    }
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+    "github.com/dgrijalva/jwt-go"
+)
+
+const (
+    LemurUserEnv      = "LEMUR_USER"
+    LemurPasswordEnv  = "LEMUR_PASS"
+    AuthorityUri      = "/authorities"
+    DestinationsUri   = "/destinations"
+    CertificatesUri   = "/certificates"
+    AuthorizeUri      = "/auth/login"
+)
+
+// lemurTokenRefreshMargin is how long before its expiry a token is replaced
+const lemurTokenRefreshMargin = 5 * time.Minute
+
+// lemurTokenFallbackTTL is used when a token's expiry cannot be decoded
+const lemurTokenFallbackTTL = time.Hour
+
+// LemurRequester is a long-lived Lemur session. It is safe for concurrent use:
+// the bearer token is cached and shared, and the http.Client keeps a pool of
+// connections to Lemur.
+type LemurRequester struct {
+    Client            *http.Client
+    Breaker           *circuitBreaker
+    baseUrl           string
+    retry             *retryPolicy
+    pageSize          int
+    maxResults        int
+    authorities       *listCache
+    destinations      *listCache
+    sharedAuthorities []string
+    disableKeyFetch   []string
+    idempotency       *IdempotencyStore
+    tokenMu           sync.Mutex
+    token             string
+    tokenExpiry       time.Time
+}
+
+// NewLemurRequester creates a Lemur session with a pooled transport set up
+// from config. No login happens until the first request.
+func NewLemurRequester(config *LemurConfig) (*LemurRequester, error) {
+    tlsConfig, err := config.TLSConfig()
+    if err != nil {
+        return nil, err
+    }
+    proxy, err := config.proxyFunc()
+    if err != nil {
+        return nil, err
+    }
+    retries := DefaultLemurRetries
+    if config.Retries != nil {
+        retries = *config.Retries
+    }
+    pageSize := config.PageSize
+    if pageSize < 1 {
+        pageSize = DefaultLemurPageSize
+    }
+    maxResults := config.MaxResults
+    if maxResults < 1 {
+        maxResults = DefaultLemurMaxResults
+    }
+    idempotency, err := NewIdempotencyStore(config.IdempotencyStore, config.IdempotencyTTLDuration())
+    if err != nil {
+        return nil, fmt.Errorf("Lemur-client config: unable to load lemur.idempotency_store: %v", err)
+    }
+    transport := &http.Transport{
+        Proxy: proxy,
+        TLSClientConfig: tlsConfig,
+        DialContext: (&net.Dialer{
+            Timeout:   30 * time.Second,
+            KeepAlive: 30 * time.Second,
+        }).DialContext,
+        MaxIdleConns:        100,
+        MaxIdleConnsPerHost: 10,
+        IdleConnTimeout:     90 * time.Second,
+        TLSHandshakeTimeout: 10 * time.Second,
+    }
+    return &LemurRequester{
+        Client: &http.Client{Transport: transport, Timeout: config.TimeoutDuration()},
+        Breaker: newCircuitBreaker(config.BreakerFailures, config.BreakerCooldownDuration()),
+        baseUrl: config.BaseUrl(),
+        retry: newRetryPolicy(retries,
+                              config.RetryBackoffDuration(),
+                              config.RetryMaxBackoffDuration()),
+        pageSize: pageSize,
+        maxResults: maxResults,
+        authorities: newListCache(config.CacheTTLDuration()),
+        destinations: newListCache(config.CacheTTLDuration()),
+        sharedAuthorities: config.SharedAuthorities,
+        disableKeyFetch: config.DisableKeyFetch,
+        idempotency: idempotency,
+    }, nil
+}
+
+// address builds a full Lemur API url out of uri parts
+func (l *LemurRequester) address(uri ...string) string {
+    address := append([]string{l.baseUrl}, uri...)
+    return strings.Join(address, "")
+}
+
+// doJSON sends an authenticated request to Lemur and decodes the JSON
+// response into out. If Lemur rejects the token with a 401 the session logs in
+// again and the request is retried once. Transient failures are retried as
+// described on sendWithRetry.
+// Called on a LemurRequester pointer
+// Takes a method, a url, an optional request body (marshalled to JSON) and a
+// pointer to decode the response into (may be nil)
+// Returns an error, which is a *LemurError if Lemur answered with a non-2xx
+// status
+func (l *LemurRequester) doJSON(method, address string, in interface{}, out interface{}) error {
+    var body []byte
+    if in != nil {
+        data, err := json.Marshal(in)
+        if err != nil {
+            return err
+        }
+        body = data
+    }
+    token, err := l.getAuthToken()
+    if err != nil {
+        Logs.Errorf("Error ensuring auth token for %s %s\nError: %+v\n", method, address, err)
+        return err
+    }
+    idempotent := method == "GET" || method == "HEAD"
+    err = l.sendWithRetry(method, address, token, body, out, idempotent)
+    if lemurErr, ok := err.(*LemurError); ok && lemurErr.StatusCode == http.StatusUnauthorized {
+        Logs.Infof("Lemur rejected our token, logging in again.")
+        l.invalidateToken(token)
+        token, err = l.getAuthToken()
+        if err != nil {
+            return err
+        }
+        err = l.sendWithRetry(method, address, token, body, out, idempotent)
+    }
+    return err
+}
+
+// sendWithRetry makes a request through the circuit breaker, retrying with
+// backoff on transient failures. Idempotent requests are retried on network
+// errors and 502/503/504/429 responses. Anything else (e.g. creating a
+// certificate) is only retried when the connection to Lemur could not be
+// made at all, since then Lemur provably never saw the request.
+// Called on a LemurRequester pointer
+// Takes the same arguments as send, plus whether the request is idempotent
+// Returns an error
+func (l *LemurRequester) sendWithRetry(method, address, token string, body []byte, out interface{}, idempotent bool) error {
+    var err error
+    for attempt := 0; ; attempt++ {
+        if err := l.Breaker.Allow(); err != nil {
+            return err
+        }
+        err = l.send(method, address, token, body, out)
+        if isUpstreamFailure(err) {
+            l.Breaker.Failure()
+        } else {
+            l.Breaker.Success()
+        }
+        retryable := neverSent(err) || (idempotent && isRetryable(err))
+        if err == nil || !retryable || attempt >= l.retry.retries {
+            return err
+        }
+        wait := l.retry.Backoff(attempt)
+        LemurHttpStatsd.Incr("upstream.retries", nil, 1)
+        Logs.Warningf("Retrying %s %s in %s after attempt %d failed: %+v", method, address, wait, attempt + 1, err)
+        time.Sleep(wait)
+    }
+}
+
+// send makes a single request to Lemur
+// Called on a LemurRequester pointer
+// Takes a method, a url, a bearer token (may be empty), a JSON body (may be
+// nil) and a pointer to decode the response into (may be nil)
+// Returns an error
+func (l *LemurRequester) send(method, address, token string, body []byte, out interface{}) error {
+    request, err := http.NewRequest(method, address, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    request.Header.Set("Content-Type", "application/json")
+    request.Header.Set("Accept", "application/json")
+    if token != "" {
+        request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+    }
+    response, err := l.Client.Do(request)
+    if err != nil {
+        Logs.Errorf("Unable to make HTTP Client Request to '%s %s'\nError: %+v\n", method, request.URL, err)
+        return err
+    }
+    defer response.Body.Close()
+    bufferBody, err := ioutil.ReadAll(response.Body)
+    if err != nil {
+        Logs.Errorf("Unable to read response body from request '%s %s'\nError: %+v\n", method, request.URL, err)
+        return err
+    }
+    if response.StatusCode / 100 != 2 {
+        lemurErr := &LemurError{StatusCode: response.StatusCode,
+                                Method: method,
+                                URL: request.URL.String()}
+        var errBody lemurErrorBody
+        if err := json.Unmarshal(bufferBody, &errBody); err == nil {
+            lemurErr.Message = errBody.String()
+        } else {
+            lemurErr.Message = strings.TrimSpace(string(bufferBody))
+        }
+        return lemurErr
+    }
+    if out == nil {
+        return nil
+    }
+    if err := json.Unmarshal(bufferBody, out); err != nil {
+        Logs.Errorf("Unable to decode response from '%s %s'\nError: %+v\n", method, request.URL, err)
+        return fmt.Errorf("Unable to decode Lemur response from %s: %v", request.URL, err)
+    }
+    return nil
+}
+
+// getAuthToken returns the cached bearer token, logging in to Lemur first if
+// there is none or it is about to expire. Concurrent callers wait for a single
+// login rather than each logging in.
+func (l *LemurRequester) getAuthToken() (string, error) {
+    l.tokenMu.Lock()
+    defer l.tokenMu.Unlock()
+    if l.token != "" && time.Now().Add(lemurTokenRefreshMargin).Before(l.tokenExpiry) {
+        return l.token, nil
+    }
+    user := os.Getenv(LemurUserEnv)
+    if len(user) == 0 {
+        return "", errors.New("LEMUR_USER|LEMUR_PASS environment variable(s) not set. Cannot continue.")
+    }
+    pass := os.Getenv(LemurPasswordEnv)
+    data, _ := json.Marshal(map[string]string{"username": user, "password": pass})
+    var tokenBody authToken
+    // Logging in has no side effects, so it is as safe to retry as a GET
+    if err := l.sendWithRetry("POST", l.address(AuthorizeUri), "", data, &tokenBody, true); err != nil {
+        return "", err
+    }
+    if tokenBody.Token == "" {
+        return "", &MissingFieldError{Object: "login response", Field: "token"}
+    }
+    expiry, err := tokenExpiry(tokenBody.Token)
+    if err != nil {
+        Logs.Warningf("Unable to read expiry of Lemur token, assuming %s: %+v", lemurTokenFallbackTTL, err)
+        expiry = time.Now().Add(lemurTokenFallbackTTL)
+    }
+    Logs.Infof("Logged in to Lemur, token expires at %s", expiry)
+    l.token = tokenBody.Token
+    l.tokenExpiry = expiry
+    return l.token, nil
+}
+
+// invalidateToken drops the cached token if it is still the one given, so a
+// token refreshed by another goroutine in the meantime is kept
+func (l *LemurRequester) invalidateToken(token string) {
+    l.tokenMu.Lock()
+    defer l.tokenMu.Unlock()
+    if l.token == token {
+        l.token = ""
+        l.tokenExpiry = time.Time{}
+    }
+}
+
+// tokenExpiry reads the exp claim out of a Lemur JWT without verifying it;
+// we can't verify Lemur's signature and only need to know when to refresh
+func tokenExpiry(token string) (time.Time, error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return time.Time{}, errors.New("token is not a JWT")
+    }
+    payload, err := jwt.DecodeSegment(parts[1])
+    if err != nil {
+        return time.Time{}, err
+    }
+    var claims struct {
+        Exp *float64 `json:"exp"`
+    }
+    if err := json.Unmarshal(payload, &claims); err != nil {
+        return time.Time{}, err
+    }
+    if claims.Exp == nil {
+        return time.Time{}, errors.New("token has no exp claim")
+    }
+    return time.Unix(int64(*claims.Exp), 0), nil
+}
+
+// createCert creates a new certificate
+// Called on a LemurRequester pointer
+// Takes a certManifest pointer as argument
+// Returns a Certificate pointer and an error
+func (l *LemurRequester) createCert(c *certManifest) (*Certificate, error) {
+    Logs.Infof("Trying to create new certificate for %s with authority %s", c.CommonName, c.Authority["name"])
+    var certificate Certificate
+    if err := l.doJSON("POST", l.address(CertificatesUri), c, &certificate); err != nil {
+        Logs.Errorf("Unable to POST request for new certificate: %+v", err)
+        return nil, err
+    }
+    return &certificate, nil
+}
+
+// getCertKeyById gets the private key for a certificate given that cert's id
+// Called on a LemurRequester pointer
+// Takes an int as argument
+// Returns a string and an error
+func (l *LemurRequester) getCertKeyById(id int) (string, error) {
+    address := l.address(CertificatesUri, fmt.Sprintf("/%d", id), "/key")
+    var key certificateKey
+    if err := l.doJSON("GET", address, nil, &key); err != nil {
+        return "", err
+    }
+    if key.Key == "" {
+        return "", &MissingFieldError{Object: "certificate key", Field: "key"}
+    }
+    return key.Key, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+    "crypto/tls"
+    "net/http"
+    "os"
+    "testing"
+    "time"
+)
+
+// newTestLemur starts a fake Lemur with one authority and returns a client
+// for it with fast retries
+func newTestLemur(t *testing.T) (*FakeLemur, *LemurRequester) {
+    fake, err := NewFakeLemur("TestCA")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := fake.Start("127.0.0.1:0"); err != nil {
+        t.Fatal(err)
+    }
+    os.Setenv(LemurUserEnv, FakeLemurUser)
+    os.Setenv(LemurPasswordEnv, FakeLemurPassword)
+    config := LemurConfig{Url: fake.URL(),
+                          RetryBackoff: "1ms",
+                          RetryMaxBackoff: "5ms",
+                          BreakerCooldown: "50ms",
+                          PageSize: 2}
+    config.ApplyEnv()
+    if err := config.Validate(); err != nil {
+        t.Fatal(err)
+    }
+    lemur, err := NewLemurRequester(&config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return fake, lemur
+}
+
+func TestValidateCertIdempotency(t *testing.T) {
+    fake, lemur := newTestLemur(t)
+    defer fake.Close()
+    manifest := NewCertManifest("TestCA", "first.last", "first.last@example.com", "", "", "TestOrg")
+    issued, err := lemur.ValidateCert(manifest, "key-1")
+    if err != nil {
+        t.Fatalf("ValidateCert should issue a certificate: %v", err)
+    }
+    if _, err := tls.X509KeyPair([]byte(issued.PublicCertificate), []byte(issued.PrivateKey)); err != nil {
+        t.Errorf("Issued certificate and key should match: %v", err)
+    }
+    again, err := lemur.ValidateCert(NewCertManifest("TestCA", "first.last", "first.last@example.com", "", "", "TestOrg"), "key-1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if again.PublicCertificate != issued.PublicCertificate {
+        t.Errorf("A retry with the same key should return the existing certificate!")
+    }
+    if created := fake.Requests("POST", CertificatesUri); created != 1 {
+        t.Errorf("Expected one certificate to be created, got %d", created)
+    }
+    if logins := fake.Requests("POST", AuthorizeUri); logins != 1 {
+        t.Errorf("The session token should be reused, got %d logins", logins)
+    }
+    if _, err := lemur.ValidateCert(NewCertManifest("TestCA", "someone.else", "", "", "", "TestOrg"), "key-1"); err != ErrIdempotencyKeyReused {
+        t.Errorf("A key reused for a different request should be refused, got %v", err)
+    }
+    if _, err := lemur.ValidateCert(manifest, ""); err != nil {
+        t.Fatal(err)
+    }
+    if created := fake.Requests("POST", CertificatesUri); created != 2 {
+        t.Errorf("Without a key every request should issue, got %d certificates", created)
+    }
+    if err := lemur.RevokeCertificate(1, "superseded", "first.last", ""); err != nil {
+        t.Fatal(err)
+    }
+    replaced, err := lemur.ValidateCert(manifest, "key-1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if replaced.PublicCertificate == issued.PublicCertificate {
+        t.Errorf("A revoked certificate should not be returned for its key!")
+    }
+}
+
+func TestFindIssued(t *testing.T) {
+    fake, lemur := newTestLemur(t)
+    defer fake.Close()
+    now := time.Now().UTC()
+    monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+    server := func(commonName string) *certManifest {
+        return NewCertManifest("TestCA", commonName, "", now.AddDate(0, 0, 1).Format("2006-01-02"), now.AddDate(1, 0, 0).Format("2006-01-02"), "TestOrg")
+    }
+    if found, err := lemur.FindIssued(server("lemur.example.com"), monthStart); err != nil || found != nil {
+        t.Fatalf("Nothing should be found before issuing, got %v %v", found, err)
+    }
+    issued, err := lemur.ValidateCert(server("lemur.example.com"), "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    // A fresh manifest, as after a restart with no idempotency keys
+    found, err := lemur.FindIssued(server("lemur.example.com"), monthStart)
+    if err != nil || found == nil || found.PublicCertificate != issued.PublicCertificate || found.PrivateKey == "" {
+        t.Fatalf("The certificate issued this month should be found with its key, got %v", err)
+    }
+    if found, _ := lemur.FindIssued(server("lemur.example.co"), monthStart); found != nil {
+        t.Errorf("Only an exact common name should match!")
+    }
+    if found, _ := lemur.FindIssued(NewCertManifest("TestCA", "lemur.example.com", "", now.AddDate(0, 0, 5).Format("2006-01-02"), "", "TestOrg"), monthStart); found != nil {
+        t.Errorf("A certificate for another validity window should not match!")
+    }
+    if found, _ := lemur.FindIssued(server("lemur.example.com"), now.Add(time.Hour)); found != nil {
+        t.Errorf("Certificates created before since should not match!")
+    }
+    if err := lemur.RevokeCertificate(1, "superseded", "first.last", ""); err != nil {
+        t.Fatal(err)
+    }
+    if found, _ := lemur.FindIssued(server("lemur.example.com"), monthStart); found != nil {
+        t.Errorf("A revoked certificate should not be reused!")
+    }
+    if created := fake.Requests("POST", CertificatesUri); created != 1 {
+        t.Errorf("Looking certificates up should not issue any, got %d", created)
+    }
+}
+
+func TestLemurRequesterRelogin(t *testing.T) {
+    fake, lemur := newTestLemur(t)
+    defer fake.Close()
+    if _, err := lemur.ListAuthorities(); err != nil {
+        t.Fatal(err)
+    }
+    fake.ExpireTokens()
+    if _, err := lemur.ListAuthorities(); err != nil {
+        t.Errorf("A 401 should trigger a fresh login: %v", err)
+    }
+    if logins := fake.Requests("POST", AuthorizeUri); logins != 2 {
+        t.Errorf("Expected a second login, got %d", logins)
+    }
+}
+
+func TestLemurTokenCache(t *testing.T) {
+    fake, lemur := newTestLemur(t)
+    defer fake.Close()
+    token, err := lemur.getAuthToken()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if expiry := lemur.tokenExpiry; expiry.Before(time.Now().Add(FakeLemurTokenTTL - time.Minute)) || expiry.After(time.Now().Add(FakeLemurTokenTTL)) {
+        t.Errorf("The token's expiry should be read from its exp claim, got %s", expiry)
+    }
+    if again, _ := lemur.getAuthToken(); again != token || fake.Requests("POST", AuthorizeUri) != 1 {
+        t.Errorf("A live token should be reused!")
+    }
+    // Within the refresh margin the token is replaced before Lemur rejects it
+    lemur.tokenExpiry = time.Now().Add(lemurTokenRefreshMargin - time.Second)
+    if _, err := lemur.getAuthToken(); err != nil || fake.Requests("POST", AuthorizeUri) != 2 {
+        t.Errorf("A token about to expire should be refreshed, got %d logins: %v", fake.Requests("POST", AuthorizeUri), err)
+    }
+    // A token refreshed by someone else is not thrown away
+    current := lemur.token
+    lemur.invalidateToken(token)
+    if lemur.token != current {
+        t.Errorf("Invalidating a stale token should keep the current one!")
+    }
+
+    if _, err := tokenExpiry("not-a-jwt"); err == nil {
+        t.Errorf("Tokens that are not JWTs should have no expiry!")
+    }
+    if _, err := tokenExpiry("e30.e30.sig"); err == nil {
+        t.Errorf("Tokens without an exp claim should have no expiry!")
+    }
+}
+
+func TestLemurRequesterRetriesAndBreaker(t *testing.T) {
+    fake, lemur := newTestLemur(t)
+    defer fake.Close()
+    fake.FailNext("GET", AuthorityUri, http.StatusServiceUnavailable, 2)
+    if _, err := lemur.ListAuthorities(); err != nil {
+        t.Errorf("Transient 503s should be retried: %v", err)
+    }
+    // Creating a certificate is not idempotent, so a 503 is not retried
+    fake.FailNext("POST", CertificatesUri, http.StatusServiceUnavailable, 1)
+    if _, err := lemur.createCert(NewCertManifest("TestCA", "first.last", "", "", "", "TestOrg")); err == nil {
+        t.Errorf("A failed certificate creation should not be retried!")
+    }
+    // Fail everything until the breaker opens
+    fake.FailNext("", "*", http.StatusInternalServerError, 100)
+    for i := 0; i < DefaultLemurBreakerFailures; i++ {
+        lemur.ListAuthorities()
+    }
+    if _, err := lemur.ListAuthorities(); err != ErrLemurUnavailable {
+        t.Errorf("Breaker should be open after repeated failures, got %v", err)
+    }
+}
+
+func TestLemurRequesterTimeout(t *testing.T) {
+    fake, lemur := newTestLemur(t)
+    defer fake.Close()
+    lemur.Client.Timeout = 20 * time.Millisecond
+    lemur.retry.retries = 0
+    fake.SetLatency(100 * time.Millisecond)
+    if _, err := lemur.ListAuthorities(); err == nil {
+        t.Errorf("A slow Lemur should time out!")
+    }
+}
+
+func TestIterateAndRevoke(t *testing.T) {
+    fake, lemur := newTestLemur(t)
+    defer fake.Close()
+    for _, cn := range []string{"a", "b", "c", "d", "e"} {
+        if _, err := lemur.createCert(NewCertManifest("TestCA", cn, "owner@example.com", "", "", "TestOrg")); err != nil {
+            t.Fatal(err)
+        }
+    }
+    certs := lemur.CertificatesByOwner("owner@example.com")
+    seen := 0
+    for certs.Next() {
+        seen++
+    }
+    if err := certs.Err(); err != nil || seen != 5 || certs.Total() != 5 {
+        t.Errorf("Expected 5 certificates over 3 pages, got %d (total %d): %v", seen, certs.Total(), err)
+    }
+    if err := lemur.RevokeCertificate(3, "keyCompromise", "first.last", ""); err != nil {
+        t.Fatal(err)
+    }
+    cert, err := lemur.GetCertificate(3)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if cert.IsUsable() || cert.LifecycleStatus(time.Now()) != StatusRevoked {
+        t.Errorf("Certificate 3 should be revoked")
+    }
+}
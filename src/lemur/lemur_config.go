@@ -0,0 +1,243 @@
+package main
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "time"
+)
+
+const (
+    DefaultLemurApiPrefix       = "/api/1"
+    DefaultLemurTimeout         = "30s"
+    DefaultLemurRetries         = 3
+    DefaultLemurRetryBackoff    = "200ms"
+    DefaultLemurRetryMaxBackoff = "5s"
+    DefaultLemurBreakerFailures = 5
+    DefaultLemurBreakerCooldown = "30s"
+    DefaultLemurPageSize        = 100
+    DefaultLemurMaxResults      = 1000
+    DefaultLemurCacheTTL        = "5m"
+    DefaultLemurIdempotencyTTL  = "24h"
+)
+
+// LemurConfig describes how to reach Lemur. The connection settings can be
+// overridden by the LEMUR_* environment variables listed in ApplyEnv.
+// Retries is a pointer so that an explicit 0 can be told apart from unset.
+type LemurConfig struct {
+    Url               string   `yaml:"url"`
+    ApiPrefix         string   `yaml:"api_prefix"`
+    Timeout           string   `yaml:"timeout"`
+    CaBundle          string   `yaml:"ca_bundle"`
+    ClientCert        string   `yaml:"client_cert"`
+    ClientKey         string   `yaml:"client_key"`
+    Proxy             string   `yaml:"proxy"`
+    Retries           *int     `yaml:"retries"`
+    RetryBackoff      string   `yaml:"retry_backoff"`
+    RetryMaxBackoff   string   `yaml:"retry_max_backoff"`
+    BreakerFailures   int      `yaml:"breaker_failures"`
+    BreakerCooldown   string   `yaml:"breaker_cooldown"`
+    PageSize          int      `yaml:"page_size"`
+    MaxResults        int      `yaml:"max_results"`
+    CacheTTL          string   `yaml:"cache_ttl"`
+    SharedAuthorities []string `yaml:"shared_authorities"`
+    // Authorities whose private keys must never be fetched from Lemur; they
+    // only issue certificates from a CSR
+    DisableKeyFetch   []string `yaml:"disable_key_fetch"`
+    // The file idempotency keys are recorded in. If unset they are only kept
+    // in memory and are forgotten on restart.
+    IdempotencyStore  string   `yaml:"idempotency_store"`
+    IdempotencyTTL    string   `yaml:"idempotency_ttl"`
+}
+
+// ApplyEnv overrides config values with any LEMUR_* environment variables
+// that are set, and fills in defaults for anything still empty
+func (c *LemurConfig) ApplyEnv() {
+    overrides := map[string]*string{
+        "LEMUR_URL":         &c.Url,
+        "LEMUR_API_PREFIX":  &c.ApiPrefix,
+        "LEMUR_TIMEOUT":     &c.Timeout,
+        "LEMUR_CA_BUNDLE":   &c.CaBundle,
+        "LEMUR_CLIENT_CERT": &c.ClientCert,
+        "LEMUR_CLIENT_KEY":  &c.ClientKey,
+        "LEMUR_PROXY":       &c.Proxy,
+    }
+    for env, field := range overrides {
+        if value := os.Getenv(env); value != "" {
+            *field = value
+        }
+    }
+    if c.ApiPrefix == "" {
+        c.ApiPrefix = DefaultLemurApiPrefix
+    }
+    if c.Timeout == "" {
+        c.Timeout = DefaultLemurTimeout
+    }
+    if c.Retries == nil {
+        retries := DefaultLemurRetries
+        c.Retries = &retries
+    }
+    if c.RetryBackoff == "" {
+        c.RetryBackoff = DefaultLemurRetryBackoff
+    }
+    if c.RetryMaxBackoff == "" {
+        c.RetryMaxBackoff = DefaultLemurRetryMaxBackoff
+    }
+    if c.BreakerFailures == 0 {
+        c.BreakerFailures = DefaultLemurBreakerFailures
+    }
+    if c.BreakerCooldown == "" {
+        c.BreakerCooldown = DefaultLemurBreakerCooldown
+    }
+    if c.PageSize == 0 {
+        c.PageSize = DefaultLemurPageSize
+    }
+    if c.MaxResults == 0 {
+        c.MaxResults = DefaultLemurMaxResults
+    }
+    if c.CacheTTL == "" {
+        c.CacheTTL = DefaultLemurCacheTTL
+    }
+    if c.IdempotencyTTL == "" {
+        c.IdempotencyTTL = DefaultLemurIdempotencyTTL
+    }
+}
+
+// Validate makes sure the Lemur config is usable, loading any certificate
+// files it names so that mistakes are caught at startup
+func (c *LemurConfig) Validate() error {
+    if c.Url == "" {
+        return errors.New("Lemur-client config: lemur.url (or LEMUR_URL) must be set")
+    }
+    base, err := url.Parse(c.Url)
+    if err != nil || base.Host == "" || (base.Scheme != "https" && base.Scheme != "http") {
+        return fmt.Errorf("Lemur-client config: lemur.url '%s' is not an http(s) url", c.Url)
+    }
+    if !strings.HasPrefix(c.ApiPrefix, "/") {
+        return fmt.Errorf("Lemur-client config: lemur.api_prefix '%s' must start with '/'", c.ApiPrefix)
+    }
+    durations := map[string]string{
+        "timeout":           c.Timeout,
+        "retry_backoff":     c.RetryBackoff,
+        "retry_max_backoff": c.RetryMaxBackoff,
+        "breaker_cooldown":  c.BreakerCooldown,
+        "cache_ttl":         c.CacheTTL,
+        "idempotency_ttl":   c.IdempotencyTTL,
+    }
+    for name, value := range durations {
+        if duration, err := time.ParseDuration(value); err != nil || duration <= 0 {
+            return fmt.Errorf("Lemur-client config: lemur.%s '%s' is not a positive duration", name, value)
+        }
+    }
+    if c.Retries == nil || *c.Retries < 0 {
+        return errors.New("Lemur-client config: lemur.retries must not be negative")
+    }
+    if c.BreakerFailures < 1 {
+        return errors.New("Lemur-client config: lemur.breaker_failures must be at least 1")
+    }
+    if c.PageSize < 1 {
+        return errors.New("Lemur-client config: lemur.page_size must be at least 1")
+    }
+    if c.MaxResults < c.PageSize {
+        return errors.New("Lemur-client config: lemur.max_results must be at least lemur.page_size")
+    }
+    if _, err := c.proxyFunc(); err != nil {
+        return err
+    }
+    if _, err := c.TLSConfig(); err != nil {
+        return err
+    }
+    return nil
+}
+
+// BaseUrl is the Lemur url with the API prefix appended
+func (c *LemurConfig) BaseUrl() string {
+    return strings.TrimRight(c.Url, "/") + c.ApiPrefix
+}
+
+// durationOr parses value, falling back to fallback if it does not parse.
+// Validate has already rejected bad values by the time these are used.
+func durationOr(value, fallback string) time.Duration {
+    duration, err := time.ParseDuration(value)
+    if err != nil {
+        duration, _ = time.ParseDuration(fallback)
+    }
+    return duration
+}
+
+// TimeoutDuration returns the configured request timeout
+func (c *LemurConfig) TimeoutDuration() time.Duration {
+    return durationOr(c.Timeout, DefaultLemurTimeout)
+}
+
+// RetryBackoffDuration returns the backoff before the first retry
+func (c *LemurConfig) RetryBackoffDuration() time.Duration {
+    return durationOr(c.RetryBackoff, DefaultLemurRetryBackoff)
+}
+
+// RetryMaxBackoffDuration returns the longest backoff between retries
+func (c *LemurConfig) RetryMaxBackoffDuration() time.Duration {
+    return durationOr(c.RetryMaxBackoff, DefaultLemurRetryMaxBackoff)
+}
+
+// BreakerCooldownDuration returns how long the breaker stays open
+func (c *LemurConfig) BreakerCooldownDuration() time.Duration {
+    return durationOr(c.BreakerCooldown, DefaultLemurBreakerCooldown)
+}
+
+// CacheTTLDuration returns how long Lemur listings are cached
+func (c *LemurConfig) CacheTTLDuration() time.Duration {
+    return durationOr(c.CacheTTL, DefaultLemurCacheTTL)
+}
+
+// IdempotencyTTLDuration returns how long idempotency keys are remembered
+func (c *LemurConfig) IdempotencyTTLDuration() time.Duration {
+    return durationOr(c.IdempotencyTTL, DefaultLemurIdempotencyTTL)
+}
+
+// TLSConfig builds the TLS settings used to talk to Lemur: the system roots
+// or a custom CA bundle, plus an optional client certificate for mTLS
+func (c *LemurConfig) TLSConfig() (*tls.Config, error) {
+    tlsConfig := &tls.Config{}
+    if c.CaBundle != "" {
+        pem, err := ioutil.ReadFile(c.CaBundle)
+        if err != nil {
+            return nil, fmt.Errorf("Lemur-client config: unable to read lemur.ca_bundle: %v", err)
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("Lemur-client config: no certificates found in lemur.ca_bundle '%s'", c.CaBundle)
+        }
+        tlsConfig.RootCAs = pool
+    }
+    if (c.ClientCert == "") != (c.ClientKey == "") {
+        return nil, errors.New("Lemur-client config: lemur.client_cert and lemur.client_key must be set together")
+    }
+    if c.ClientCert != "" {
+        cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+        if err != nil {
+            return nil, fmt.Errorf("Lemur-client config: unable to load Lemur client certificate: %v", err)
+        }
+        tlsConfig.Certificates = []tls.Certificate{cert}
+    }
+    return tlsConfig, nil
+}
+
+// proxyFunc returns the proxy selector for the Lemur transport; without an
+// explicit proxy the usual HTTPS_PROXY/NO_PROXY variables apply
+func (c *LemurConfig) proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+    if c.Proxy == "" {
+        return http.ProxyFromEnvironment, nil
+    }
+    proxy, err := url.Parse(c.Proxy)
+    if err != nil || proxy.Host == "" {
+        return nil, fmt.Errorf("Lemur-client config: lemur.proxy '%s' is not a valid url", c.Proxy)
+    }
+    return http.ProxyURL(proxy), nil
+}
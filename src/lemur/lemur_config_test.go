@@ -0,0 +1,87 @@
+package main
+
+import (
+    "encoding/pem"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// validLemurConfig is a config that passes Validate, for tests to break
+func validLemurConfig() *LemurConfig {
+    config := &LemurConfig{Url: "https://lemur.example.com/"}
+    config.ApplyEnv()
+    return config
+}
+
+func TestLemurConfigApplyEnv(t *testing.T) {
+    for _, env := range []string{"LEMUR_URL", "LEMUR_TIMEOUT"} {
+        defer os.Setenv(env, os.Getenv(env))
+    }
+    os.Setenv("LEMUR_URL", "https://lemur.internal")
+    os.Setenv("LEMUR_TIMEOUT", "5s")
+    noRetries := 0
+    config := &LemurConfig{Url: "https://lemur.example.com", Timeout: "1m", Retries: &noRetries}
+    config.ApplyEnv()
+    if config.Url != "https://lemur.internal" || config.Timeout != "5s" {
+        t.Errorf("LEMUR_* variables should override config.yaml, got %s %s", config.Url, config.Timeout)
+    }
+    if config.ApiPrefix != DefaultLemurApiPrefix || config.PageSize != DefaultLemurPageSize || config.CacheTTL != DefaultLemurCacheTTL {
+        t.Errorf("Unset values should get defaults, got %+v", config)
+    }
+    if *config.Retries != 0 {
+        t.Errorf("An explicit 0 retries should be kept, got %d", *config.Retries)
+    }
+    if config.BaseUrl() != "https://lemur.internal/api/1" {
+        t.Errorf("The API prefix should be appended to the url, got %s", config.BaseUrl())
+    }
+}
+
+func TestLemurConfigValidate(t *testing.T) {
+    if err := validLemurConfig().Validate(); err != nil {
+        t.Fatalf("A config with just a url should be valid: %v", err)
+    }
+    dir, err := ioutil.TempDir("", "lemur-config")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    garbage := filepath.Join(dir, "garbage.pem")
+    ioutil.WriteFile(garbage, []byte("not a certificate"), 0600)
+
+    negative := -1
+    bad := map[string]func(*LemurConfig){
+        "no url":                   func(c *LemurConfig) { c.Url = "" },
+        "a non-http url":           func(c *LemurConfig) { c.Url = "ftp://lemur.example.com" },
+        "a relative api prefix":    func(c *LemurConfig) { c.ApiPrefix = "api/1" },
+        "a bad timeout":            func(c *LemurConfig) { c.Timeout = "soon" },
+        "negative retries":         func(c *LemurConfig) { c.Retries = &negative },
+        "no breaker failures":      func(c *LemurConfig) { c.BreakerFailures = -1 },
+        "max results below a page": func(c *LemurConfig) { c.MaxResults = c.PageSize - 1 },
+        "a bad proxy":              func(c *LemurConfig) { c.Proxy = "::" },
+        "a missing ca bundle":      func(c *LemurConfig) { c.CaBundle = filepath.Join(dir, "missing.pem") },
+        "an empty ca bundle":       func(c *LemurConfig) { c.CaBundle = garbage },
+        "a client cert alone":      func(c *LemurConfig) { c.ClientCert = garbage },
+    }
+    for name, change := range bad {
+        config := validLemurConfig()
+        change(config)
+        if err := config.Validate(); err == nil {
+            t.Errorf("A config with %s should be refused!", name)
+        }
+    }
+
+    server := httptest.NewTLSServer(http.NotFoundHandler())
+    defer server.Close()
+    bundle := filepath.Join(dir, "ca.pem")
+    ioutil.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+    config := validLemurConfig()
+    config.CaBundle = bundle
+    tlsConfig, err := config.TLSConfig()
+    if err != nil || tlsConfig.RootCAs == nil {
+        t.Errorf("A CA bundle should replace the system roots, got %v", err)
+    }
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+    "fmt"
+    "net/url"
+    "strconv"
+    "strings"
+)
+
+// CertificateIterator walks every certificate matching a Lemur search one
+// page at a time, so only a single page is ever held in memory. It stops
+// after maxResults certificates; Truncated reports whether there were more.
+// An owner search also skips certificates Lemur matched on part of the owner.
+//
+//     certs := LemurClient.IterateCertificates(query)
+//     for certs.Next() {
+//         cert := certs.Certificate()
+//     }
+//     if err := certs.Err(); err != nil { ... }
+type CertificateIterator struct {
+    lemur      *LemurRequester
+    query      url.Values
+    owner      string
+    pageSize   int
+    maxResults int
+    page       int
+    items      []Certificate
+    index      int
+    seen       int
+    total      int
+    lastPage   bool
+    truncated  bool
+    current    *Certificate
+    err        error
+}
+
+// IterateCertificates returns an iterator over the certificates matching
+// query. Any count or page parameters in query are replaced.
+// Called on a LemurRequester pointer
+// Takes url.Values of Lemur query parameters (filter, sortBy, ...)
+// Returns a CertificateIterator pointer
+func (l *LemurRequester) IterateCertificates(query url.Values) *CertificateIterator {
+    paged := url.Values{}
+    for key, values := range query {
+        if key != "count" && key != "page" {
+            paged[key] = values
+        }
+    }
+    return &CertificateIterator{lemur: l,
+                                query: paged,
+                                pageSize: l.pageSize,
+                                maxResults: l.maxResults}
+}
+
+// CertificatesByOwner iterates over the certificates owned by an email
+// address, newest first. Lemur's owner filter matches substrings, so
+// bob@example.com would also get jimbob@example.com's certificates; only
+// owners equal to the address, ignoring case, are kept.
+func (l *LemurRequester) CertificatesByOwner(owner string) *CertificateIterator {
+    query := url.Values{}
+    query.Set("filter", fmt.Sprintf("owner;%s", owner))
+    query.Set("sortBy", "date_created")
+    query.Set("sortDir", "desc")
+    certs := l.IterateCertificates(query)
+    certs.owner = owner
+    return certs
+}
+
+// Next advances to the next certificate, fetching another page if needed
+// Returns false when there are no more certificates, the result limit was
+// reached, or an error occurred
+func (it *CertificateIterator) Next() bool {
+    if it.err != nil {
+        return false
+    }
+    if it.seen >= it.maxResults {
+        it.truncated = it.more()
+        return false
+    }
+    for {
+        if it.index >= len(it.items) {
+            if it.lastPage || !it.fetch() {
+                return false
+            }
+        }
+        cert := &it.items[it.index]
+        it.index++
+        if it.matches(cert) {
+            it.current = cert
+            it.seen++
+            return true
+        }
+    }
+}
+
+// matches reports whether a certificate Lemur returned is one we asked for
+func (it *CertificateIterator) matches(cert *Certificate) bool {
+    return it.owner == "" || strings.EqualFold(cert.Owner, it.owner)
+}
+
+// more reports whether certificates are left after the result limit. The
+// rest of the current page is checked; later pages are assumed to match.
+func (it *CertificateIterator) more() bool {
+    for i := it.index; i < len(it.items); i++ {
+        if it.matches(&it.items[i]) {
+            return true
+        }
+    }
+    return !it.lastPage
+}
+
+// fetch loads the next page, returning false if it was empty or failed
+func (it *CertificateIterator) fetch() bool {
+    it.page++
+    query := url.Values{}
+    for key, values := range it.query {
+        query[key] = values
+    }
+    query.Set("count", strconv.Itoa(it.pageSize))
+    query.Set("page", strconv.Itoa(it.page))
+    address := fmt.Sprintf("%s?%s", it.lemur.address(CertificatesUri), query.Encode())
+    Logs.Infof("Making request to url %s", address)
+    var certificates CertificateList
+    if err := it.lemur.doJSON("GET", address, nil, &certificates); err != nil {
+        it.err = err
+        return false
+    }
+    it.items = certificates.Items
+    it.index = 0
+    it.total = certificates.Total
+    it.lastPage = len(certificates.Items) < it.pageSize || it.page * it.pageSize >= certificates.Total
+    return len(it.items) > 0
+}
+
+// Certificate returns the certificate Next advanced to
+func (it *CertificateIterator) Certificate() *Certificate {
+    return it.current
+}
+
+// Err returns the error that stopped iteration, if any
+func (it *CertificateIterator) Err() error {
+    return it.err
+}
+
+// Total is the number of matching certificates Lemur reported. For an owner
+// search Lemur's count includes the partial matches, so it is the number of
+// exact matches found instead, which stops at the limit when Truncated.
+func (it *CertificateIterator) Total() int {
+    if it.owner != "" {
+        return it.seen
+    }
+    return it.total
+}
+
+// Truncated reports whether iteration stopped at the result limit with
+// certificates left over
+func (it *CertificateIterator) Truncated() bool {
+    return it.truncated
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/url"
+    "strings"
+    "testing"
+)
+
+func TestCertificateIterator(t *testing.T) {
+    fake, lemur := newTestLemur(t)
+    defer fake.Close()
+    for _, cn := range []string{"a", "b", "c", "d", "e"} {
+        if _, err := lemur.createCert(NewCertManifest("TestCA", cn, "owner@example.com", "", "", "TestOrg")); err != nil {
+            t.Fatal(err)
+        }
+    }
+    lemur.createCert(NewCertManifest("TestCA", "f", "other@example.com", "", "", "TestOrg"))
+
+    // Newest first, two to a page, whatever count the caller asked for
+    query := url.Values{"filter": {"owner;owner@example.com"}, "sortBy": {"date_created"}, "sortDir": {"desc"}, "count": {"1000"}}
+    certs := lemur.IterateCertificates(query)
+    ids := []int{}
+    for certs.Next() {
+        ids = append(ids, certs.Certificate().Id)
+    }
+    if err := certs.Err(); err != nil || len(ids) != 5 || ids[0] != 5 || ids[4] != 1 || certs.Truncated() {
+        t.Errorf("Expected certificates 5 to 1, untruncated, got %v (truncated %v): %v", ids, certs.Truncated(), err)
+    }
+    if pages := fake.Requests("GET", CertificatesUri); pages != 3 {
+        t.Errorf("Five certificates should take three pages of two, got %d", pages)
+    }
+
+    // The result limit stops early and says so
+    lemur.maxResults = 3
+    certs = lemur.IterateCertificates(query)
+    seen := 0
+    for certs.Next() {
+        seen++
+    }
+    if seen != 3 || !certs.Truncated() || certs.Total() != 5 {
+        t.Errorf("Expected 3 of 5 certificates and a truncated result, got %d of %d (truncated %v)", seen, certs.Total(), certs.Truncated())
+    }
+    lemur.maxResults = 4
+    certs = lemur.CertificatesByOwner("other@example.com")
+    for certs.Next() {
+    }
+    if certs.Truncated() {
+        t.Errorf("Results under the limit should not be truncated!")
+    }
+
+    // An error part way through stops iteration and is reported
+    lemur.maxResults = 10
+    certs = lemur.CertificatesByOwner("owner@example.com")
+    certs.Next()
+    certs.Next()
+    fake.FailNext("GET", CertificatesUri, http.StatusBadRequest, 1)
+    if certs.Next() || certs.Err() == nil {
+        t.Errorf("A failed page should stop iteration with an error!")
+    }
+}
+
+func TestCertificatesByOwner(t *testing.T) {
+    fake, lemur := newTestLemur(t)
+    defer fake.Close()
+    oldSecret, oldClient := secretKey, LemurClient
+    defer func() { secretKey, LemurClient = oldSecret, oldClient }()
+    secretKey = NewTokenSecret()
+    LemurClient = lemur
+    // Lemur's owner;bob@example.com also matches jimbob@example.com
+    for _, owner := range []string{"bob@example.com", "jimbob@example.com", "Bob@Example.com", "jimbob@example.com", "bob@example.com"} {
+        if _, err := lemur.createCert(NewCertManifest("TestCA", "cert", owner, "", "", "TestOrg")); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    certs := lemur.CertificatesByOwner("bob@example.com")
+    ids := []int{}
+    for certs.Next() {
+        ids = append(ids, certs.Certificate().Id)
+    }
+    if err := certs.Err(); err != nil || len(ids) != 3 || ids[0] != 5 || ids[1] != 3 || ids[2] != 1 || certs.Total() != 3 {
+        t.Errorf("Only bob's own certificates should be listed and counted, got %v of %d: %v", ids, certs.Total(), err)
+    }
+    lemur.maxResults = 2
+    certs = lemur.CertificatesByOwner("bob@example.com")
+    for certs.Next() {
+    }
+    if !certs.Truncated() {
+        t.Errorf("A third certificate of bob's past the limit should truncate!")
+    }
+    lemur.maxResults = 3
+    certs = lemur.CertificatesByOwner("jimbob@example.com")
+    for certs.Next() {
+    }
+    if certs.Total() != 2 || certs.Truncated() {
+        t.Errorf("jimbob should have two certificates, untruncated, got %d (truncated %v)", certs.Total(), certs.Truncated())
+    }
+
+    var listing struct {
+        Total int                  `json:"total"`
+        Items []CertificateSummary `json:"items"`
+    }
+    recorder := userRequest(t, "GET", "/v1/certs", "", "bob@example.com", "TestOrg")
+    json.Unmarshal(recorder.Body.Bytes(), &listing)
+    if recorder.Code != http.StatusOK || listing.Total != 3 || len(listing.Items) != 3 {
+        t.Fatalf("bob should list their three certificates, got %d %q", recorder.Code, recorder.Body.String())
+    }
+    for _, item := range listing.Items {
+        if !strings.EqualFold(item.Owner, "bob@example.com") {
+            t.Errorf("bob should not see %s's certificate %d!", item.Owner, item.Id)
+        }
+    }
+}
+
+func TestInventory(t *testing.T) {
+    fake, lemur := newTestLemur(t)
+    defer fake.Close()
+    oldSecret, oldFlags, oldClient := secretKey, Flags, LemurClient
+    defer func() { secretKey, Flags, LemurClient = oldSecret, oldFlags, oldClient }()
+    secretKey = NewTokenSecret()
+    LemurClient = lemur
+    admin, user := adminTokens()
+    // Lemur's owner;owner@example.com also matches coowner@example.com
+    for _, owner := range []string{"owner@example.com", "coowner@example.com", "owner@example.com", "owner@example.com", "other@example.com"} {
+        if _, err := lemur.createCert(NewCertManifest("TestCA", "cert", owner, "", "", "TestOrg")); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    if recorder := adminRequest("GET", "/inventory", nil, ""); recorder.Code != http.StatusUnauthorized {
+        t.Errorf("The inventory should need a token, got %d", recorder.Code)
+    }
+    if recorder := adminRequest("GET", "/inventory", nil, user); recorder.Code != http.StatusForbidden {
+        t.Errorf("The inventory should be refused outside admin_groups, got %d", recorder.Code)
+    }
+    recorder := adminRequest("GET", "/inventory?owner=owner@example.com", nil, admin)
+    if lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n"); recorder.Code != http.StatusOK || len(lines) != 3 {
+        t.Errorf("Admins should get the owner's certificates, got %d %q", recorder.Code, recorder.Body.String())
+    }
+    if strings.Contains(recorder.Body.String(), "coowner@example.com") {
+        t.Errorf("Owners merely containing the address should not be exported!")
+    }
+    recorder = adminRequest("GET", "/inventory?owner=owner@example.com&filter=cn%3Ba", nil, admin)
+    if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), CodeInvalidFields) {
+        t.Errorf("owner and filter together should be refused rather than one dropped, got %d", recorder.Code)
+    }
+    lemur.maxResults = 2
+    recorder = adminRequest("GET", "/inventory", nil, admin)
+    lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+    if len(lines) != 3 || lines[2] != `{"truncated":true}` {
+        t.Errorf("A truncated export should end with a marker, got %q", recorder.Body.String())
+    }
+}
+
+func TestListCertsHandler(t *testing.T) {
+    fake, lemur := newTestLemur(t)
+    defer fake.Close()
+    oldSecret, oldFlags, oldClient := secretKey, Flags, LemurClient
+    defer func() { secretKey, Flags, LemurClient = oldSecret, oldFlags, oldClient }()
+    secretKey = NewTokenSecret()
+    Flags = &flagOptArgs{Config: &InstanceConfig{AdminGroups: []string{"SecurityAdmins"}}}
+    LemurClient = lemur
+    for _, owner := range []string{"first.last@example.com", "first.last@example.com", "first.last@example.com", "other@example.com"} {
+        if _, err := lemur.createCert(NewCertManifest("TestCA", "cert", owner, "", "", "TestOrg")); err != nil {
+            t.Fatal(err)
+        }
+    }
+    lemur.RevokeCertificate(1, "superseded", "first.last@example.com", "")
+    var listing struct {
+        Owner     string               `json:"owner"`
+        Total     int                  `json:"total"`
+        Truncated bool                 `json:"truncated"`
+        Items     []CertificateSummary `json:"items"`
+    }
+
+    recorder := userRequest(t, "GET", "/v1/certs", "", "first.last@example.com", "TestOrg")
+    if err := json.Unmarshal(recorder.Body.Bytes(), &listing); err != nil || recorder.Code != http.StatusOK {
+        t.Fatalf("Listing should answer JSON, got %d %q", recorder.Code, recorder.Body.String())
+    }
+    if listing.Owner != "first.last@example.com" || listing.Total != 3 || len(listing.Items) != 3 || listing.Truncated {
+        t.Errorf("Users should get their own three certificates across pages, got %+v", listing)
+    }
+    if newest, oldest := listing.Items[0], listing.Items[2]; newest.Id != 3 || newest.Status != StatusActive || newest.Authority != "TestCA" ||
+       len(newest.Digest) != 64 || oldest.Status != StatusRevoked {
+        t.Errorf("Summaries should come newest first with status, authority and digest, got %+v", listing.Items)
+    }
+    if strings.Contains(recorder.Body.String(), "PRIVATE KEY") || strings.Contains(recorder.Body.String(), "BEGIN CERTIFICATE") {
+        t.Errorf("Listings should not carry certificate material!")
+    }
+
+    if recorder := userRequest(t, "GET", "/v1/certs?owner=other@example.com", "", "first.last@example.com", "TestOrg"); recorder.Code != http.StatusForbidden {
+        t.Errorf("Users should not list other owners' certificates, got %d", recorder.Code)
+    }
+    recorder = userRequest(t, "GET", "/v1/certs?owner=other@example.com", "", "admin@example.com", "SecurityAdmins")
+    json.Unmarshal(recorder.Body.Bytes(), &listing)
+    if recorder.Code != http.StatusOK || listing.Owner != "other@example.com" || listing.Total != 1 {
+        t.Errorf("Admins should list any owner's certificates, got %d %+v", recorder.Code, listing)
+    }
+    lemur.maxResults = 2
+    recorder = userRequest(t, "GET", "/v1/certs", "", "first.last@example.com", "TestOrg")
+    json.Unmarshal(recorder.Body.Bytes(), &listing)
+    if len(listing.Items) != 2 || !listing.Truncated {
+        t.Errorf("Listings past lemur.max_results should be marked truncated, got %+v", listing)
+    }
+}
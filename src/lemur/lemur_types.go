@@ -0,0 +1,268 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/pem"
+    "fmt"
+    "strings"
+    "time"
+)
+
+// LemurError is returned whenever Lemur answers with a non-2xx status code.
+// Message holds whatever Lemur put in its error body, if anything.
+type LemurError struct {
+    StatusCode int
+    Method     string
+    URL        string
+    Message    string
+}
+
+func (e *LemurError) Error() string {
+    if e.Message == "" {
+        return fmt.Sprintf("Lemur returned %d for %s %s", e.StatusCode, e.Method, e.URL)
+    }
+    return fmt.Sprintf("Lemur returned %d for %s %s: %s", e.StatusCode, e.Method, e.URL, e.Message)
+}
+
+// MissingFieldError is returned when a Lemur response decodes cleanly but is
+// missing a field we cannot do without (e.g. a certificate with no chain).
+type MissingFieldError struct {
+    Object string
+    Field  string
+}
+
+func (e *MissingFieldError) Error() string {
+    return fmt.Sprintf("Lemur %s is missing required field '%s'", e.Object, e.Field)
+}
+
+// lemurErrorBody covers the shapes Lemur uses to report errors
+type lemurErrorBody struct {
+    Message string                 `json:"message"`
+    Reasons map[string]interface{} `json:"reasons"`
+}
+
+func (b *lemurErrorBody) String() string {
+    if b.Message != "" {
+        return b.Message
+    }
+    var reasons []string
+    for field, reason := range b.Reasons {
+        reasons = append(reasons, fmt.Sprintf("%s: %v", field, reason))
+    }
+    return strings.Join(reasons, "; ")
+}
+
+type authToken struct {
+    Token string `json:"token"`
+}
+
+type certificateKey struct {
+    Key string `json:"key"`
+}
+
+// Role is a Lemur RBAC role as embedded in authorities and users
+type Role struct {
+    Id   int    `json:"id"`
+    Name string `json:"name"`
+}
+
+// Plugin describes the Lemur plugin backing an authority, destination or
+// notification
+type Plugin struct {
+    Slug        string `json:"slug"`
+    Title       string `json:"title"`
+    Description string `json:"description"`
+}
+
+// AuthorityCertificate is the CA certificate embedded in an Authority
+type AuthorityCertificate struct {
+    Id        int    `json:"id"`
+    Name      string `json:"name"`
+    CN        string `json:"cn"`
+    Body      string `json:"body"`
+    NotBefore string `json:"notBefore"`
+    NotAfter  string `json:"notAfter"`
+}
+
+type Authority struct {
+    Id                   int                   `json:"id"`
+    Name                 string                `json:"name"`
+    Owner                string                `json:"owner"`
+    Description          string                `json:"description"`
+    Active               bool                  `json:"active"`
+    Plugin               *Plugin               `json:"plugin"`
+    Roles                []Role                `json:"roles"`
+    AuthorityCertificate *AuthorityCertificate `json:"authorityCertificate"`
+}
+
+type Destination struct {
+    Id          int     `json:"id"`
+    Label       string  `json:"label"`
+    Description string  `json:"description"`
+    Plugin      *Plugin `json:"plugin"`
+}
+
+type Notification struct {
+    Id          int     `json:"id"`
+    Label       string  `json:"label"`
+    Description string  `json:"description"`
+    Active      bool    `json:"active"`
+    Plugin      *Plugin `json:"plugin"`
+}
+
+// Certificate is a Lemur certificate. Chain is a pointer because Lemur sends
+// null for certificates it has no chain for.
+type Certificate struct {
+    Id            int            `json:"id"`
+    Name          string         `json:"name"`
+    CN            string         `json:"cn"`
+    Owner         string         `json:"owner"`
+    Description   string         `json:"description"`
+    Body          string         `json:"body"`
+    Chain         *string        `json:"chain"`
+    Serial        string         `json:"serial"`
+    Issuer        string         `json:"issuer"`
+    KeyType       string         `json:"keyType"`
+    Active        bool           `json:"active"`
+    Revoked       bool           `json:"revoked"`
+    Status        string         `json:"status"`
+    NotBefore     string         `json:"notBefore"`
+    NotAfter      string         `json:"notAfter"`
+    DateCreated   string         `json:"dateCreated"`
+    Authority     *Authority     `json:"authority"`
+    Destinations  []Destination  `json:"destinations"`
+    Notifications []Notification `json:"notifications"`
+}
+
+// CheckIssued makes sure a certificate has everything we need to hand it to
+// a user
+// Called on a Certificate pointer
+// Returns an error naming the first missing field
+func (c *Certificate) CheckIssued() error {
+    if c.Id == 0 {
+        return &MissingFieldError{Object: "certificate", Field: "id"}
+    }
+    if c.Body == "" {
+        return &MissingFieldError{Object: "certificate", Field: "body"}
+    }
+    if c.Chain == nil || *c.Chain == "" {
+        return &MissingFieldError{Object: "certificate", Field: "chain"}
+    }
+    return nil
+}
+
+// ExpiringWindow is how close to its expiry a certificate is reported as
+// expiring
+const ExpiringWindow = 7 * 24 * time.Hour
+
+const (
+    StatusActive   = "active"
+    StatusExpiring = "expiring"
+    StatusExpired  = "expired"
+    StatusRevoked  = "revoked"
+    StatusInactive = "inactive"
+)
+
+// CertificateSummary is the public, key-free view of a certificate that we
+// hand out in listings and exports. Digest is the SHA-256 fingerprint of the
+// certificate.
+type CertificateSummary struct {
+    Id         int    `json:"id"`
+    Name       string `json:"name"`
+    CommonName string `json:"commonName"`
+    Owner      string `json:"owner"`
+    Authority  string `json:"authority"`
+    NotBefore  string `json:"notBefore"`
+    NotAfter   string `json:"notAfter"`
+    Active     bool   `json:"active"`
+    Status     string `json:"status"`
+    Digest     string `json:"digest"`
+}
+
+// Summary strips a certificate down to a CertificateSummary
+func (c *Certificate) Summary() CertificateSummary {
+    summary := CertificateSummary{Id: c.Id,
+                                  Name: c.Name,
+                                  CommonName: c.CN,
+                                  Owner: c.Owner,
+                                  NotBefore: c.NotBefore,
+                                  NotAfter: c.NotAfter,
+                                  Active: c.Active,
+                                  Status: c.LifecycleStatus(time.Now()),
+                                  Digest: c.Fingerprint()}
+    if c.Authority != nil {
+        summary.Authority = c.Authority.Name
+    }
+    return summary
+}
+
+// LifecycleStatus says where a certificate is in its life as of now
+func (c *Certificate) LifecycleStatus(now time.Time) string {
+    if c.Revoked || c.Status == "revoked" {
+        return StatusRevoked
+    }
+    if !c.Active {
+        return StatusInactive
+    }
+    notAfter, err := parseLemurTime(c.NotAfter)
+    if err != nil {
+        return StatusActive
+    }
+    if !now.Before(notAfter) {
+        return StatusExpired
+    }
+    if now.Add(ExpiringWindow).After(notAfter) {
+        return StatusExpiring
+    }
+    return StatusActive
+}
+
+// Fingerprint returns the hex SHA-256 digest of the certificate's DER
+// encoding, or an empty string if the body is not a PEM certificate
+func (c *Certificate) Fingerprint() string {
+    block, _ := pem.Decode([]byte(c.Body))
+    if block == nil {
+        return ""
+    }
+    digest := sha256.Sum256(block.Bytes)
+    return hex.EncodeToString(digest[:])
+}
+
+// lemurTimeLayouts are the timestamp formats Lemur has been seen to emit
+var lemurTimeLayouts = []string{
+    time.RFC3339,
+    "2006-01-02T15:04:05",
+    "2006-01-02T15:04:05.999999",
+    "2006-01-02",
+}
+
+// parseLemurTime parses a Lemur timestamp into UTC
+func parseLemurTime(value string) (time.Time, error) {
+    for _, layout := range lemurTimeLayouts {
+        if t, err := time.Parse(layout, value); err == nil {
+            return t.UTC(), nil
+        }
+    }
+    return time.Time{}, fmt.Errorf("Unable to parse Lemur timestamp '%s'", value)
+}
+
+type CertificateList struct {
+    Total int           `json:"total"`
+    Items []Certificate `json:"items"`
+}
+
+type AuthorityList struct {
+    Total int         `json:"total"`
+    Items []Authority `json:"items"`
+}
+
+type DestinationList struct {
+    Total int           `json:"total"`
+    Items []Destination `json:"items"`
+}
+
+type NotificationList struct {
+    Total int            `json:"total"`
+    Items []Notification `json:"items"`
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestDecodeCertificate(t *testing.T) {
+    body := `{"id": 7, "cn": "first.last", "owner": "first.last@example.com", "body": "-----BEGIN CERTIFICATE-----",
+              "chain": null, "active": true, "authority": {"id": 1, "name": "TestCA", "roles": [{"id": 2, "name": "TestOrg"}]},
+              "destinations": [{"id": 3, "label": "aws-prod", "plugin": {"slug": "aws-destination"}}]}`
+    var cert Certificate
+    if err := json.Unmarshal([]byte(body), &cert); err != nil {
+        t.Fatalf("A Lemur certificate should decode: %v", err)
+    }
+    if cert.Id != 7 || cert.Authority == nil || cert.Authority.Roles[0].Name != "TestOrg" || cert.Destinations[0].Plugin.Slug != "aws-destination" {
+        t.Errorf("Nested objects should decode, got %+v", cert)
+    }
+    err := cert.CheckIssued()
+    if missing, ok := err.(*MissingFieldError); !ok || missing.Field != "chain" {
+        t.Errorf("A null chain should be reported as missing, got %v", err)
+    }
+    chain := "-----BEGIN CERTIFICATE-----"
+    cert.Chain = &chain
+    if err := cert.CheckIssued(); err != nil {
+        t.Errorf("A complete certificate should pass: %v", err)
+    }
+    cert.Body = ""
+    if missing, ok := cert.CheckIssued().(*MissingFieldError); !ok || missing.Field != "body" {
+        t.Errorf("A missing body should be reported!")
+    }
+
+    // Schema surprises are errors, never panics
+    var list CertificateList
+    if err := json.Unmarshal([]byte(`{"total": 1, "items": "oops"}`), &list); err == nil {
+        t.Errorf("A list whose items are not a list should not decode!")
+    }
+}
+
+func TestLemurErrorBody(t *testing.T) {
+    answers := map[string]struct {
+        status  int
+        body    string
+        message string
+    }{
+        "/message": {http.StatusBadRequest, `{"message": "Authority not found"}`, "Authority not found"},
+        "/reasons": {http.StatusBadRequest, `{"reasons": {"owner": "Not a valid email address."}}`, "owner: Not a valid email address."},
+        "/text":    {http.StatusBadGateway, "upstream down\n", "upstream down"},
+    }
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/garbled" {
+            w.Write([]byte("{\"items\": ["))
+            return
+        }
+        answer := answers[r.URL.Path]
+        w.WriteHeader(answer.status)
+        w.Write([]byte(answer.body))
+    }))
+    defer server.Close()
+    lemur := &LemurRequester{Client: server.Client()}
+    for path, answer := range answers {
+        err := lemur.send("GET", server.URL + path, "", nil, &CertificateList{})
+        lemurErr, ok := err.(*LemurError)
+        if !ok || lemurErr.StatusCode != answer.status || lemurErr.Message != answer.message {
+            t.Errorf("%s should give a LemurError with status %d and message %q, got %v", path, answer.status, answer.message, err)
+        }
+    }
+    err := lemur.send("GET", server.URL + "/garbled", "", nil, &CertificateList{})
+    if _, ok := err.(*LemurError); ok || err == nil || !strings.Contains(err.Error(), "decode") {
+        t.Errorf("A 200 that does not decode should be a decoding error, got %v", err)
+    }
+}
+
+func TestLifecycleStatus(t *testing.T) {
+    now := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+    statuses := map[string]Certificate{
+        StatusActive:   {Active: true, NotAfter: "2017-06-01T00:00:00+00:00"},
+        StatusExpiring: {Active: true, NotAfter: "2017-03-05T00:00:00"},
+        StatusExpired:  {Active: true, NotAfter: "2017-02-28"},
+        StatusRevoked:  {Active: true, Revoked: true, NotAfter: "2017-06-01"},
+        StatusInactive: {Active: false, NotAfter: "2017-06-01"},
+    }
+    for want, cert := range statuses {
+        if status := cert.LifecycleStatus(now); status != want {
+            t.Errorf("Certificate %+v should be %s, got %s", cert, want, status)
+        }
+    }
+    if (&Certificate{Body: "not PEM"}).Fingerprint() != "" {
+        t.Errorf("A body that is not PEM should have no digest!")
+    }
+}
@@ -11,6 +11,7 @@ import (
 var LemurCertsStatsd *statsd.Client
 var LemurHttpStatsd *statsd.Client
 var OktaProvider *oktaProvider
+var LemurClient *LemurRequester
 var secretKey *authSecret
 var Flags *flagOptArgs
 
@@ -35,9 +36,14 @@ func main() {
     Logs.Infof("Got flags: %+v\n", Flags)
 
     // Set up our app/auth secret
-    Logs.Infof("Creating apptoken secret...")
-    secretKey = NewTokenSecret()
-    Logs.Infof("Created apptoken secret!")
+    Logs.Infof("Loading apptoken keys...")
+    var err error
+    secretKey, err = LoadTokenSecret(&Flags.Config.Tokens)
+    if err != nil {
+        Logs.Errorf("Unable to load apptoken keys: %+v", err)
+        panic(err)
+    }
+    Logs.Infof("Loaded apptoken keys %v", secretKey.KeyIds())
 
     // Set up a statsd client for certs metrics
     LemurCertsStatsd = NewCertsStatsd(*Flags.StatsdHost, *Flags.StatsdPort)
@@ -57,8 +63,35 @@ func main() {
     defer LemurHttpStatsd.Close() // Unfortunately this must be done in main()
     Logs.Infof("lemur.http statsd client established")
 
-    // Set up the okta provider so we can auth
-    OktaProvider = NewOktaProvider(&*Flags.Config)
+    // Set up the shared Lemur session used by every certificate request
+    LemurClient, err = NewLemurRequester(&Flags.Config.Lemur)
+    if err != nil {
+        Logs.Errorf("Unable to set up Lemur session: %+v", err)
+        panic(err)
+    }
+    Logs.Infof("Lemur session pointed at %s", Flags.Config.Lemur.BaseUrl())
+
+    // Set up the identity provider users log in with
+    if Flags.Config.Login == LoginOIDC {
+        OIDCProvider = NewOIDCProvider(&Flags.Config.OIDC)
+        // Only a warning: the discovery document is fetched again on the
+        // first login
+        if _, err := OIDCProvider.Discover(); err != nil {
+            Logs.Warningf("Unable to fetch OIDC discovery document: %+v", err)
+        }
+        Logs.Infof("OIDC login through %s", Flags.Config.OIDC.Issuer)
+    } else {
+        // Never fatal: until the IdP metadata loads, logins fail and Run
+        // keeps retrying
+        SAMLProvider = NewSAMLProvider(&*Flags.Config)
+        go SAMLProvider.Run(nil)
+        Logs.Infof("SAML login with metadata from %s", Flags.Config.IdpMetadata)
+    }
+    // API logins go straight to Okta, whichever provider browsers use
+    if Flags.Config.Okta.ApiToken != "" {
+        OktaProvider = NewOktaProvider(&*Flags.Config)
+        Logs.Infof("Okta API login through %s", Flags.Config.IdpApiAuthUrl)
+    }
 
     // Set up the routes for the web server
     router := NewRouter()
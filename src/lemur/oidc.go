@@ -0,0 +1,515 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math/big"
+    "net/http"
+    "net/url"
+    "os"
+    "regexp"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    "github.com/dgrijalva/jwt-go"
+)
+
+// Ways users can log in through a browser, chosen with login in
+// config.yaml
+const (
+    LoginSAML = "saml"
+    LoginOIDC = "oidc"
+)
+
+// OIDCClientSecretEnv holds the OIDC client secret, taking precedence over
+// oidc.client_secret so it can come from a secret store
+const OIDCClientSecretEnv = "OIDC_CLIENT_SECRET"
+
+// Defaults for the oidc section of config.yaml
+const (
+    DefaultOIDCUsernameClaim = "email"
+    DefaultOIDCGroupClaim    = "groups"
+    DefaultOIDCDisplayName   = "OpenID Connect"
+)
+
+var DefaultOIDCScopes = []string{"openid", "profile", "email", "groups"}
+
+// oidcKeyRefetchInterval is how often the IdP's keys may be fetched again
+// on meeting an ID token signed with a key we do not know
+const oidcKeyRefetchInterval = time.Minute
+
+// oidcLoginTimeout is how long a user has to log in at the IdP
+const oidcLoginTimeout = 10 * time.Minute
+
+// oidcLoginCookie carries the state, nonce and PKCE verifier of a login in
+// progress from the redirect to the IdP to the callback
+const oidcLoginCookie = "oidc_login"
+
+var ErrNoOIDCGroup = errors.New("No group found in the ID token for the rbac claim")
+
+// OIDCConfig is the oidc section of config.yaml. The issuer's discovery
+// document, at /.well-known/openid-configuration, supplies the endpoints
+// and keys. UsernameClaim and GroupClaim name the ID token claims that
+// become the app token's username and rbac claims; with several groups
+// the first by name matching GroupFilter is used. ClientSecret is left out
+// for public clients, which rely on PKCE alone.
+type OIDCConfig struct {
+    Issuer        string   `yaml:"issuer"`
+    ClientId      string   `yaml:"client_id"`
+    ClientSecret  string   `yaml:"client_secret" json:"-"`
+    RedirectUrl   string   `yaml:"redirect_url"`
+    Scopes        []string `yaml:"scopes"`
+    UsernameClaim string   `yaml:"username_claim"`
+    GroupClaim    string   `yaml:"group_claim"`
+    GroupFilter   string   `yaml:"group_filter"`
+    DisplayName   string   `yaml:"display_name"`
+}
+
+// ApplyEnv overrides oidc.client_secret with OIDC_CLIENT_SECRET if it is
+// set, and fills in defaults for anything still empty
+func (c *OIDCConfig) ApplyEnv() {
+    if secret := os.Getenv(OIDCClientSecretEnv); secret != "" {
+        c.ClientSecret = secret
+    }
+    if len(c.Scopes) == 0 {
+        c.Scopes = DefaultOIDCScopes
+    }
+    if c.UsernameClaim == "" {
+        c.UsernameClaim = DefaultOIDCUsernameClaim
+    }
+    if c.GroupClaim == "" {
+        c.GroupClaim = DefaultOIDCGroupClaim
+    }
+    if c.DisplayName == "" {
+        c.DisplayName = DefaultOIDCDisplayName
+    }
+}
+
+// Validate makes sure the OIDC config is usable
+func (c *OIDCConfig) Validate() error {
+    for name, value := range map[string]string{"issuer": c.Issuer, "redirect_url": c.RedirectUrl} {
+        parsed, err := url.Parse(value)
+        if err != nil || parsed.Host == "" || (parsed.Scheme != "https" && parsed.Scheme != "http") {
+            return fmt.Errorf("Lemur-client config: oidc.%s '%s' is not an http(s) url", name, value)
+        }
+    }
+    if c.ClientId == "" {
+        return errors.New("Lemur-client config: oidc.client_id must be set")
+    }
+    if _, err := regexp.Compile(c.GroupFilter); err != nil {
+        return fmt.Errorf("Lemur-client config: oidc.group_filter: %v", err)
+    }
+    return nil
+}
+
+// ValidateLogin checks the login setting, which defaults to saml, and the
+// saml or oidc section for the one chosen
+func (c *InstanceConfig) ValidateLogin() error {
+    switch c.Login {
+    case "":
+        c.Login = LoginSAML
+    case LoginSAML:
+    case LoginOIDC:
+        c.OIDC.ApplyEnv()
+        return c.OIDC.Validate()
+    default:
+        return fmt.Errorf("Lemur-client config: login must be %s or %s", LoginSAML, LoginOIDC)
+    }
+    c.SAML.ApplyDefaults()
+    if strings.HasPrefix(c.IdpMetadata, "http://") {
+        return fmt.Errorf("Lemur-client config: %v", ErrSAMLMetadataInsecure)
+    }
+    return c.SAML.Validate()
+}
+
+// LoginName is what the login page calls the way users log in
+func LoginName() string {
+    if Flags != nil && Flags.Config != nil && Flags.Config.Login == LoginOIDC {
+        return Flags.Config.OIDC.DisplayName
+    }
+    if Flags != nil && Flags.Config != nil && Flags.Config.SAML.DisplayName != "" {
+        return Flags.Config.SAML.DisplayName
+    }
+    return DefaultSAMLDisplayName
+}
+
+// oidcDiscovery is the part of the discovery document we use
+type oidcDiscovery struct {
+    Issuer                string `json:"issuer"`
+    AuthorizationEndpoint string `json:"authorization_endpoint"`
+    TokenEndpoint         string `json:"token_endpoint"`
+    JwksUri               string `json:"jwks_uri"`
+}
+
+// oidcProvider logs users in with the authorization code flow and PKCE.
+// The discovery document is fetched on first use, and the IdP's keys
+// whenever an ID token names one we do not have yet.
+type oidcProvider struct {
+    Config      *OIDCConfig
+    client      *http.Client
+    mu          sync.Mutex
+    discovery   *oidcDiscovery
+    keys        map[string]interface{}
+    keysFetched time.Time
+}
+
+var OIDCProvider *oidcProvider
+
+func NewOIDCProvider(config *OIDCConfig) *oidcProvider {
+    return &oidcProvider{Config: config,
+                         client: &http.Client{Timeout: time.Second * 30},
+                         keys: map[string]interface{}{}}
+}
+
+// getJSON fetches url and decodes the JSON answer into result
+func (o *oidcProvider) getJSON(url string, result interface{}) error {
+    response, err := o.client.Get(url)
+    if err != nil {
+        return err
+    }
+    defer response.Body.Close()
+    if response.StatusCode != http.StatusOK {
+        return fmt.Errorf("%s answered %d", url, response.StatusCode)
+    }
+    if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+        return fmt.Errorf("Unable to understand %s: %v", url, err)
+    }
+    return nil
+}
+
+// Discover returns the issuer's discovery document, fetching it if it has
+// not been fetched yet
+func (o *oidcProvider) Discover() (*oidcDiscovery, error) {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    if o.discovery != nil {
+        return o.discovery, nil
+    }
+    discovery := &oidcDiscovery{}
+    if err := o.getJSON(strings.TrimRight(o.Config.Issuer, "/") + "/.well-known/openid-configuration", discovery); err != nil {
+        return nil, err
+    }
+    if discovery.Issuer != o.Config.Issuer {
+        return nil, fmt.Errorf("Discovery document is for issuer '%s', not '%s'", discovery.Issuer, o.Config.Issuer)
+    }
+    if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JwksUri == "" {
+        return nil, errors.New("Discovery document lacks an authorization, token or jwks endpoint")
+    }
+    o.discovery = discovery
+    return discovery, nil
+}
+
+// oidcLogin is a login in progress. The verifier's hash goes to the IdP
+// with the user; the verifier itself only with the code, proving that
+// whoever redeems the code started the login.
+type oidcLogin struct {
+    State    string
+    Nonce    string
+    Verifier string
+}
+
+func randomUrlString() string {
+    data := make([]byte, 32)
+    if _, err := rand.Read(data); err != nil {
+        Logs.Errorf("Unable to generate random string: %+v", err)
+    }
+    return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func newOIDCLogin() *oidcLogin {
+    return &oidcLogin{State: randomUrlString(), Nonce: randomUrlString(), Verifier: randomUrlString()}
+}
+
+// String packs the login into a cookie value. The parts are base64url, so
+// never contain a dot.
+func (l *oidcLogin) String() string {
+    return l.State + "." + l.Nonce + "." + l.Verifier
+}
+
+func parseOIDCLogin(value string) (*oidcLogin, error) {
+    parts := strings.Split(value, ".")
+    if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+        return nil, errors.New("Malformed login cookie")
+    }
+    return &oidcLogin{State: parts[0], Nonce: parts[1], Verifier: parts[2]}, nil
+}
+
+// AuthCodeURL is where to send the user to log in
+func (o *oidcProvider) AuthCodeURL(login *oidcLogin) (string, error) {
+    discovery, err := o.Discover()
+    if err != nil {
+        return "", err
+    }
+    challenge := sha256.Sum256([]byte(login.Verifier))
+    query := url.Values{
+        "response_type": {"code"},
+        "client_id": {o.Config.ClientId},
+        "redirect_uri": {o.Config.RedirectUrl},
+        "scope": {strings.Join(o.Config.Scopes, " ")},
+        "state": {login.State},
+        "nonce": {login.Nonce},
+        "code_challenge": {base64.RawURLEncoding.EncodeToString(challenge[:])},
+        "code_challenge_method": {"S256"},
+    }
+    separator := "?"
+    if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+        separator = "&"
+    }
+    return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange redeems an authorization code at the token endpoint
+// Returns the raw ID token and an error
+func (o *oidcProvider) Exchange(code string, login *oidcLogin) (string, error) {
+    discovery, err := o.Discover()
+    if err != nil {
+        return "", err
+    }
+    form := url.Values{
+        "grant_type": {"authorization_code"},
+        "code": {code},
+        "redirect_uri": {o.Config.RedirectUrl},
+        "client_id": {o.Config.ClientId},
+        "code_verifier": {login.Verifier},
+    }
+    request, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+    if err != nil {
+        return "", err
+    }
+    request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    request.Header.Set("Accept", "application/json")
+    if o.Config.ClientSecret != "" {
+        request.SetBasicAuth(url.QueryEscape(o.Config.ClientId), url.QueryEscape(o.Config.ClientSecret))
+    }
+    response, err := o.client.Do(request)
+    if err != nil {
+        return "", err
+    }
+    defer response.Body.Close()
+    var answer struct {
+        IdToken          string `json:"id_token"`
+        Error            string `json:"error"`
+        ErrorDescription string `json:"error_description"`
+    }
+    json.NewDecoder(response.Body).Decode(&answer)
+    if response.StatusCode != http.StatusOK {
+        return "", fmt.Errorf("Token endpoint answered %d %s: %s", response.StatusCode, answer.Error, answer.ErrorDescription)
+    }
+    if answer.IdToken == "" {
+        return "", errors.New("Token endpoint answered without an id_token")
+    }
+    return answer.IdToken, nil
+}
+
+// parseJWK turns a JSON Web Key into the RSA or ECDSA public key jwt-go
+// verifies with
+func parseJWK(jwk map[string]interface{}) (interface{}, error) {
+    number := func(name string) (*big.Int, error) {
+        value, _ := jwk[name].(string)
+        data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+        if err != nil || len(data) == 0 {
+            return nil, fmt.Errorf("JWK has no valid '%s'", name)
+        }
+        return new(big.Int).SetBytes(data), nil
+    }
+    switch jwk["kty"] {
+    case "RSA":
+        n, err := number("n")
+        if err != nil {
+            return nil, err
+        }
+        e, err := number("e")
+        if err != nil {
+            return nil, err
+        }
+        return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+    case "EC":
+        curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+        curve, ok := curves[fmt.Sprint(jwk["crv"])]
+        if !ok {
+            return nil, fmt.Errorf("JWK has unknown curve '%v'", jwk["crv"])
+        }
+        x, err := number("x")
+        if err != nil {
+            return nil, err
+        }
+        y, err := number("y")
+        if err != nil {
+            return nil, err
+        }
+        if !curve.IsOnCurve(x, y) {
+            return nil, errors.New("JWK point is not on its curve")
+        }
+        return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+    }
+    return nil, fmt.Errorf("JWK has unsupported key type '%v'", jwk["kty"])
+}
+
+// fetchKeys replaces the IdP's signing keys with those it now publishes.
+// The caller must hold the lock.
+func (o *oidcProvider) fetchKeys() error {
+    var set struct {
+        Keys []map[string]interface{} `json:"keys"`
+    }
+    if err := o.getJSON(o.discovery.JwksUri, &set); err != nil {
+        return err
+    }
+    keys := map[string]interface{}{}
+    for _, jwk := range set.Keys {
+        if use, ok := jwk["use"].(string); ok && use != "sig" {
+            continue
+        }
+        key, err := parseJWK(jwk)
+        if err != nil {
+            Logs.Warningf("Skipping IdP key %v: %+v", jwk["kid"], err)
+            continue
+        }
+        keys[fmt.Sprint(jwk["kid"])] = key
+    }
+    o.keys, o.keysFetched = keys, time.Now()
+    return nil
+}
+
+// keyFunc gives jwt-go the IdP key named by an ID token's kid header,
+// fetching the keys again if it is new to us, as after a rotation
+func (o *oidcProvider) keyFunc(token *jwt.Token) (interface{}, error) {
+    if _, err := o.Discover(); err != nil {
+        return nil, err
+    }
+    id := fmt.Sprint(token.Header["kid"])
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    key, ok := o.keys[id]
+    if !ok && time.Since(o.keysFetched) > oidcKeyRefetchInterval {
+        if err := o.fetchKeys(); err != nil {
+            return nil, err
+        }
+        key, ok = o.keys[id]
+    }
+    if !ok {
+        return nil, fmt.Errorf("Unknown IdP key '%s'", id)
+    }
+    switch key.(type) {
+    case *rsa.PublicKey:
+        if _, isRSA := token.Method.(*jwt.SigningMethodRSA); !isRSA {
+            return nil, fmt.Errorf("Unexpected signing method: %+v", token.Header["alg"])
+        }
+    case *ecdsa.PublicKey:
+        if _, isECDSA := token.Method.(*jwt.SigningMethodECDSA); !isECDSA {
+            return nil, fmt.Errorf("Unexpected signing method: %+v", token.Header["alg"])
+        }
+    }
+    return key, nil
+}
+
+// VerifyIDToken checks an ID token's signature against the IdP's keys,
+// that it was issued by the IdP for us and this login, and that it is
+// current
+func (o *oidcProvider) VerifyIDToken(idToken string, login *oidcLogin) (jwt.MapClaims, error) {
+    parser := &jwt.Parser{ValidMethods: []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"},
+                          SkipClaimsValidation: true}
+    token, err := parser.Parse(idToken, o.keyFunc)
+    if err != nil || !token.Valid {
+        return nil, fmt.Errorf("Invalid ID token: %v", err)
+    }
+    claims := token.Claims.(jwt.MapClaims)
+    now := time.Now()
+    if !claims.VerifyIssuer(o.Config.Issuer, true) {
+        return nil, errors.New("ID token has the wrong issuer")
+    }
+    if !verifyIDTokenAudience(claims, o.Config.ClientId) {
+        return nil, errors.New("ID token has the wrong audience")
+    }
+    if !claims.VerifyExpiresAt(now.Add(-tokenClockSkew).Unix(), true) {
+        return nil, errors.New("Expired ID token")
+    }
+    if !claims.VerifyIssuedAt(now.Add(tokenClockSkew).Unix(), false) {
+        return nil, errors.New("ID token is not valid yet")
+    }
+    if nonce, _ := claims["nonce"].(string); nonce != login.Nonce {
+        return nil, errors.New("ID token is for another login")
+    }
+    return claims, nil
+}
+
+// verifyIDTokenAudience checks that an ID token was issued to clientId. The
+// aud claim may be one audience or a list; jwt-go only handles the former.
+// With several audiences the token must also have been issued to us, as
+// azp says.
+// Returns whether the token is for clientId
+func verifyIDTokenAudience(claims jwt.MapClaims, clientId string) bool {
+    audiences := []string{}
+    switch value := claims["aud"].(type) {
+    case string:
+        audiences = append(audiences, value)
+    case []interface{}:
+        for _, audience := range value {
+            if name, ok := audience.(string); ok {
+                audiences = append(audiences, name)
+            }
+        }
+    }
+    found := false
+    for _, audience := range audiences {
+        if subtle.ConstantTimeCompare([]byte(audience), []byte(clientId)) == 1 {
+            found = true
+        }
+    }
+    if !found {
+        return false
+    }
+    azp, hasAzp := claims["azp"].(string)
+    if len(audiences) > 1 || hasAzp {
+        return subtle.ConstantTimeCompare([]byte(azp), []byte(clientId)) == 1
+    }
+    return true
+}
+
+// Identity reads the username and the group for the rbac claim from an ID
+// token. The group claim may hold one group or a list. An email username
+// must have email_verified set.
+// Returns the username, the group and an error
+func (o *oidcProvider) Identity(claims jwt.MapClaims) (string, string, error) {
+    username, _ := claims[o.Config.UsernameClaim].(string)
+    if username == "" {
+        return "", "", fmt.Errorf("ID token has no '%s' claim", o.Config.UsernameClaim)
+    }
+    // Anyone can put an address they don't own on their IdP account
+    if o.Config.UsernameClaim == "email" {
+        if verified, _ := claims["email_verified"].(bool); !verified {
+            return "", "", fmt.Errorf("ID token email %s is not verified", username)
+        }
+    }
+    groups := []string{}
+    switch value := claims[o.Config.GroupClaim].(type) {
+    case string:
+        groups = append(groups, value)
+    case []interface{}:
+        for _, group := range value {
+            if name, ok := group.(string); ok {
+                groups = append(groups, name)
+            }
+        }
+    }
+    filter := regexp.MustCompile(o.Config.GroupFilter)
+    names := []string{}
+    for _, group := range groups {
+        if group != "" && filter.MatchString(group) {
+            names = append(names, group)
+        }
+    }
+    if len(names) == 0 {
+        return username, "", ErrNoOIDCGroup
+    }
+    sort.Strings(names)
+    return username, names[0], nil
+}
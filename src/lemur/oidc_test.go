@@ -0,0 +1,228 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+    "time"
+    "github.com/dgrijalva/jwt-go"
+)
+
+// stubIdP is a minimal OpenID Connect provider: it approves every login at
+// its authorization endpoint and checks the PKCE verifier, client secret
+// and redirect at its token endpoint
+type stubIdP struct {
+    server    *httptest.Server
+    published *signingKey
+    signer    *signingKey
+    claims    map[string]interface{}
+    grants    map[string]url.Values
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+    key, err := newSigningKey(TokenAlgES256)
+    if err != nil {
+        t.Fatal(err)
+    }
+    idp := &stubIdP{published: key, signer: key, claims: map[string]interface{}{}, grants: map[string]url.Values{}}
+    idp.server = httptest.NewServer(idp)
+    return idp
+}
+
+func (s *stubIdP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    r.ParseForm()
+    answer := func(status int, body interface{}) {
+        output, _ := json.Marshal(body)
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(status)
+        w.Write(output)
+    }
+    switch r.URL.Path {
+    case "/.well-known/openid-configuration":
+        answer(http.StatusOK, map[string]string{"issuer": s.server.URL,
+                                                "authorization_endpoint": s.server.URL + "/authorize",
+                                                "token_endpoint": s.server.URL + "/token",
+                                                "jwks_uri": s.server.URL + "/jwks"})
+    case "/jwks":
+        answer(http.StatusOK, map[string]interface{}{"keys": []interface{}{s.published.JWK()}})
+    case "/authorize":
+        if r.FormValue("response_type") != "code" || r.FormValue("code_challenge_method") != "S256" {
+            answer(http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+            return
+        }
+        code := newTokenId()
+        s.grants[code] = r.Form
+        http.Redirect(w, r, r.FormValue("redirect_uri") + "?code=" + code + "&state=" + url.QueryEscape(r.FormValue("state")), http.StatusFound)
+    case "/token":
+        grant, ok := s.grants[r.FormValue("code")]
+        delete(s.grants, r.FormValue("code"))
+        verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+        user, password, _ := r.BasicAuth()
+        if !ok || user != "lemur-client" || password != "s3cret" ||
+           r.FormValue("redirect_uri") != grant.Get("redirect_uri") ||
+           base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.Get("code_challenge") {
+            answer(http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+            return
+        }
+        claims := jwt.MapClaims{"iss": s.server.URL,
+                                "aud": grant.Get("client_id"),
+                                "sub": "00u1",
+                                "iat": time.Now().Unix(),
+                                "exp": time.Now().Add(time.Hour).Unix(),
+                                "nonce": grant.Get("nonce"),
+                                "email": "first.last@example.com",
+                                "email_verified": true,
+                                "groups": []string{"Everyone", "TestOrg"}}
+        for name, value := range s.claims {
+            claims[name] = value
+        }
+        token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+        token.Header["kid"] = s.signer.Id
+        idToken, _ := token.SignedString(s.signer.signKey())
+        answer(http.StatusOK, map[string]string{"access_token": "opaque", "token_type": "Bearer", "id_token": idToken})
+    default:
+        http.NotFound(w, r)
+    }
+}
+
+// loginAt goes through the login redirect and the stub's authorization
+// endpoint, returning the callback request the browser would make
+func (s *stubIdP) loginAt(t *testing.T) *http.Request {
+    recorder := httptest.NewRecorder()
+    LoginHandler(recorder, httptest.NewRequest("GET", "/auth/login", nil))
+    location := recorder.Header().Get("Location")
+    if recorder.Code != http.StatusTemporaryRedirect || !strings.HasPrefix(location, s.server.URL + "/authorize?") {
+        t.Fatalf("Logging in should redirect to the IdP, got %d %s", recorder.Code, location)
+    }
+    cookie := (&http.Response{Header: recorder.Header()}).Cookies()[0]
+    client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+    response, err := client.Get(location)
+    if err != nil {
+        t.Fatal(err)
+    }
+    response.Body.Close()
+    callback, _ := url.Parse(response.Header.Get("Location"))
+    request := httptest.NewRequest("GET", "/v1/_oidc_callback?" + callback.RawQuery, nil)
+    request.AddCookie(cookie)
+    return request
+}
+
+// callback finishes a login and returns the response
+func callback(request *http.Request) *httptest.ResponseRecorder {
+    recorder := httptest.NewRecorder()
+    OIDCCallbackHandler(recorder, request)
+    return recorder
+}
+
+func TestOIDCLogin(t *testing.T) {
+    idp := newStubIdP(t)
+    defer idp.server.Close()
+    oldProvider, oldSecret := OIDCProvider, secretKey
+    defer func() { OIDCProvider, secretKey = oldProvider, oldSecret }()
+    secretKey = NewTokenSecret()
+    config := &OIDCConfig{Issuer: idp.server.URL,
+                          ClientId: "lemur-client",
+                          ClientSecret: "s3cret",
+                          RedirectUrl: "https://lemurclient.example.com/v1/_oidc_callback",
+                          GroupFilter: "^Test"}
+    config.ApplyEnv()
+    OIDCProvider = NewOIDCProvider(config)
+
+    recorder := callback(idp.loginAt(t))
+    if recorder.Code != http.StatusSeeOther {
+        t.Fatalf("Logging in should succeed, got %d: %s", recorder.Code, recorder.Body.String())
+    }
+    var authCookie string
+    for _, cookie := range (&http.Response{Header: recorder.Header()}).Cookies() {
+        if cookie.Name == "auth" {
+            authCookie = cookie.Value
+        }
+    }
+    claims := secretKey.GetClaims(authCookie)
+    if claims["username"] != "first.last@example.com" || claims["rbac"] != "TestOrg" {
+        t.Errorf("App tokens should carry the configured claims, got %+v", claims)
+    }
+
+    request := idp.loginAt(t)
+    query := request.URL.Query()
+    query.Set("state", "forged")
+    request.URL.RawQuery = query.Encode()
+    if recorder := callback(request); recorder.Code != http.StatusBadRequest {
+        t.Errorf("Callbacks for another login should be refused, got %d", recorder.Code)
+    }
+
+    // Claims the ID token must not get wrong
+    bad := map[string]interface{}{
+        "nonce": "replayed",
+        "aud": "another-client",
+        "email_verified": false,
+        "iss": "https://evil.example.com",
+        "exp": time.Now().Add(-time.Hour).Unix(),
+    }
+    for name, value := range bad {
+        idp.claims = map[string]interface{}{name: value}
+        if recorder := callback(idp.loginAt(t)); recorder.Code != http.StatusUnauthorized {
+            t.Errorf("ID tokens with a bad %s should be refused, got %d", name, recorder.Code)
+        }
+    }
+    // Several audiences need azp to name us
+    idp.claims = map[string]interface{}{"aud": []string{"another-client", "lemur-client"}}
+    if recorder := callback(idp.loginAt(t)); recorder.Code != http.StatusUnauthorized {
+        t.Errorf("ID tokens with several audiences and no azp should be refused, got %d", recorder.Code)
+    }
+    idp.claims["azp"] = "another-client"
+    if recorder := callback(idp.loginAt(t)); recorder.Code != http.StatusUnauthorized {
+        t.Errorf("ID tokens authorized for another client should be refused, got %d", recorder.Code)
+    }
+    idp.claims["azp"] = "lemur-client"
+    if recorder := callback(idp.loginAt(t)); recorder.Code != http.StatusSeeOther {
+        t.Errorf("ID tokens listing us among several audiences should be accepted, got %d", recorder.Code)
+    }
+    idp.claims = map[string]interface{}{"aud": []string{"lemur-client"}}
+    if recorder := callback(idp.loginAt(t)); recorder.Code != http.StatusSeeOther {
+        t.Errorf("ID tokens with a list of one audience should be accepted, got %d", recorder.Code)
+    }
+    idp.claims = map[string]interface{}{"groups": []string{"Everyone"}}
+    if recorder := callback(idp.loginAt(t)); recorder.Code != http.StatusForbidden {
+        t.Errorf("Users without a matching group should be refused, got %d", recorder.Code)
+    }
+    idp.claims = map[string]interface{}{}
+
+    // A rotated key is fetched; an unpublished one is refused
+    rotated, _ := newSigningKey(TokenAlgES256)
+    idp.published, idp.signer = rotated, rotated
+    OIDCProvider.keysFetched = time.Time{}
+    if recorder := callback(idp.loginAt(t)); recorder.Code != http.StatusSeeOther {
+        t.Errorf("ID tokens signed with a rotated key should be accepted, got %d", recorder.Code)
+    }
+    forger, _ := newSigningKey(TokenAlgES256)
+    idp.signer = forger
+    OIDCProvider.keysFetched = time.Time{}
+    if recorder := callback(idp.loginAt(t)); recorder.Code != http.StatusUnauthorized {
+        t.Errorf("ID tokens signed with an unpublished key should be refused, got %d", recorder.Code)
+    }
+}
+
+func TestOIDCConfig(t *testing.T) {
+    config := &InstanceConfig{}
+    if err := config.ValidateLogin(); err != nil || config.Login != LoginSAML {
+        t.Errorf("Login should default to SAML, got %s %v", config.Login, err)
+    }
+    config = &InstanceConfig{Login: LoginOIDC, OIDC: OIDCConfig{Issuer: "https://idp.example.com"}}
+    if err := config.ValidateLogin(); err == nil {
+        t.Errorf("OIDC logins should need a client id and redirect url!")
+    }
+    config.OIDC.ClientId, config.OIDC.RedirectUrl = "lemur-client", "https://lemurclient.example.com/v1/_oidc_callback"
+    if err := config.ValidateLogin(); err != nil || config.OIDC.UsernameClaim != "email" || config.OIDC.GroupClaim != "groups" {
+        t.Errorf("OIDC claims should default, got %+v %v", config.OIDC, err)
+    }
+    config.Login = "kerberos"
+    if err := config.ValidateLogin(); err == nil {
+        t.Errorf("Unknown logins should be refused!")
+    }
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "os"
+    "regexp"
+    "sort"
+    "time"
+)
+
+// OktaApiTokenEnv holds the Okta API token, taking precedence over
+// okta.api_token so the token can come from a secret store
+const OktaApiTokenEnv = "OKTA_API_TOKEN"
+
+// Okta Authn transaction states we act on. Any other state, such as
+// LOCKED_OUT or PASSWORD_EXPIRED, has to be dealt with in a browser.
+const (
+    OktaAuthnSuccess      = "SUCCESS"
+    OktaAuthnMFARequired  = "MFA_REQUIRED"
+    OktaAuthnMFAChallenge = "MFA_CHALLENGE"
+    OktaAuthnPasswordWarn = "PASSWORD_WARN"
+)
+
+// Okta factor types that can be verified over the API
+const (
+    OktaFactorPush = "push"
+    OktaFactorTOTP = "token:software:totp"
+)
+
+// Push verification results reported with MFA_CHALLENGE
+const (
+    OktaFactorWaiting  = "WAITING"
+    OktaFactorRejected = "REJECTED"
+    OktaFactorTimeout  = "TIMEOUT"
+)
+
+var ErrNoOktaGroup = errors.New("No Okta group found for the user's rbac claim")
+
+// validOktaId matches the ids Okta gives factors and users, so that they
+// can be put in request paths
+var validOktaId = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+
+// OktaConfig is the okta section of config.yaml. The API token is only
+// needed for API logins, to look up the groups of the user logging in.
+// GroupFilter is a regular expression picking which of a user's groups
+// becomes their rbac claim; unset means any group but Everyone.
+type OktaConfig struct {
+    ApiToken    string `yaml:"api_token" json:"-"`
+    GroupFilter string `yaml:"group_filter"`
+}
+
+// ApplyEnv overrides okta.api_token with OKTA_API_TOKEN if it is set
+func (c *OktaConfig) ApplyEnv() {
+    if token := os.Getenv(OktaApiTokenEnv); token != "" {
+        c.ApiToken = token
+    }
+}
+
+// Validate makes sure the group filter compiles
+func (c *OktaConfig) Validate() error {
+    if _, err := regexp.Compile(c.GroupFilter); err != nil {
+        return fmt.Errorf("Lemur-client config: okta.group_filter: %v", err)
+    }
+    return nil
+}
+
+// oktaFactor is an MFA factor a user has enrolled
+type oktaFactor struct {
+    Id         string `json:"id"`
+    FactorType string `json:"factorType"`
+    Provider   string `json:"provider"`
+}
+
+// oktaAuthnTransaction is the state of an Okta Authn login. StateToken
+// carries it between steps; SessionToken is only set on SUCCESS.
+type oktaAuthnTransaction struct {
+    Status       string `json:"status"`
+    StateToken   string `json:"stateToken,omitempty"`
+    SessionToken string `json:"sessionToken,omitempty"`
+    ExpiresAt    string `json:"expiresAt,omitempty"`
+    FactorResult string `json:"factorResult,omitempty"`
+    Embedded     struct {
+        Factors []oktaFactor `json:"factors"`
+    } `json:"_embedded"`
+}
+
+// SupportedFactors lists the user's factors that can be verified over the
+// API: Okta Verify push and TOTP
+func (t *oktaAuthnTransaction) SupportedFactors() []oktaFactor {
+    factors := []oktaFactor{}
+    for _, factor := range t.Embedded.Factors {
+        if factor.FactorType == OktaFactorPush || factor.FactorType == OktaFactorTOTP {
+            factors = append(factors, factor)
+        }
+    }
+    return factors
+}
+
+// oktaApiError is an error answer from Okta
+type oktaApiError struct {
+    Status       int    `json:"-"`
+    ErrorCode    string `json:"errorCode"`
+    ErrorSummary string `json:"errorSummary"`
+}
+
+func (e *oktaApiError) Error() string {
+    return fmt.Sprintf("Okta answered %d %s: %s", e.Status, e.ErrorCode, e.ErrorSummary)
+}
+
+// Refused reports whether Okta refused the request itself, e.g. a wrong
+// password or passcode, rather than failing
+func (e *oktaApiError) Refused() bool {
+    return e.Status >= 400 && e.Status < 500 && e.Status != http.StatusTooManyRequests
+}
+
+// oktaBaseUrl is the Okta org idp_api_auth_url belongs to
+func (o *oktaProvider) oktaBaseUrl() (string, error) {
+    authUrl, err := url.Parse(o.Config.IdpApiAuthUrl)
+    if err != nil || authUrl.Host == "" {
+        return "", fmt.Errorf("idp_api_auth_url '%s' is not a url", o.Config.IdpApiAuthUrl)
+    }
+    return authUrl.Scheme + "://" + authUrl.Host, nil
+}
+
+// oktaRequest sends a JSON request to the Okta org, with the API token if
+// withToken is set, and decodes the answer into result
+func (o *oktaProvider) oktaRequest(method, path string, body interface{}, withToken bool, result interface{}) error {
+    base, err := o.oktaBaseUrl()
+    if err != nil {
+        return err
+    }
+    var payload []byte
+    if body != nil {
+        payload, _ = json.Marshal(body)
+    }
+    request, err := http.NewRequest(method, base + path, bytes.NewReader(payload))
+    if err != nil {
+        return err
+    }
+    request.Header.Set("Content-Type", "application/json")
+    request.Header.Set("Accept", "application/json")
+    if withToken {
+        request.Header.Set("Authorization", "SSWS " + o.Config.Okta.ApiToken)
+    }
+    client := &http.Client{Timeout: time.Second * 30}
+    response, err := client.Do(request)
+    if err != nil {
+        Logs.Errorf("Unable to make HTTP Client request to '%s'\nError: %+v\n", base + path, err)
+        return err
+    }
+    defer response.Body.Close()
+    if response.StatusCode >= 400 {
+        apiErr := &oktaApiError{Status: response.StatusCode}
+        json.NewDecoder(response.Body).Decode(apiErr)
+        return apiErr
+    }
+    if result == nil {
+        return nil
+    }
+    if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+        return fmt.Errorf("Unable to understand Okta's answer to %s: %v", path, err)
+    }
+    return nil
+}
+
+// OktaApiAuth starts an Okta Authn login with a username and password. A
+// password that is about to expire does not stop the login.
+// Takes an authJsonRequest
+// Returns the transaction and an error, an *oktaApiError if Okta refused
+func (o *oktaProvider) OktaApiAuth(jsonData authJsonRequest) (*oktaAuthnTransaction, error) {
+    transaction := &oktaAuthnTransaction{}
+    if err := o.oktaRequest("POST", "/api/v1/authn", jsonData, false, transaction); err != nil {
+        return nil, err
+    }
+    if transaction.Status == OktaAuthnPasswordWarn {
+        skipped := &oktaAuthnTransaction{}
+        err := o.oktaRequest("POST", "/api/v1/authn/skip", map[string]string{"stateToken": transaction.StateToken}, false, skipped)
+        return skipped, err
+    }
+    return transaction, nil
+}
+
+// VerifyFactor answers an MFA_REQUIRED or MFA_CHALLENGE transaction with a
+// factor. A TOTP factor needs the passCode; a push factor is sent without
+// one and then verified again, without one, until the user answers it.
+// Returns the transaction and an error, an *oktaApiError if Okta refused
+func (o *oktaProvider) VerifyFactor(factorId, stateToken, passCode string) (*oktaAuthnTransaction, error) {
+    if !validOktaId.MatchString(factorId) {
+        return nil, &oktaApiError{Status: http.StatusNotFound, ErrorSummary: "Unknown factor"}
+    }
+    body := map[string]string{"stateToken": stateToken}
+    if passCode != "" {
+        body["passCode"] = passCode
+    }
+    transaction := &oktaAuthnTransaction{}
+    if err := o.oktaRequest("POST", "/api/v1/authn/factors/" + factorId + "/verify", body, false, transaction); err != nil {
+        return nil, err
+    }
+    return transaction, nil
+}
+
+// UserGroup exchanges the session token of a successful login for an Okta
+// session, and looks up the user it belongs to and the group to put in
+// their rbac claim: the first, by name, matching okta.group_filter. The
+// session is closed again, as only the app token is wanted.
+// Returns the user's login, the group and an error
+func (o *oktaProvider) UserGroup(sessionToken string) (string, string, error) {
+    if o.Config.Okta.ApiToken == "" {
+        return "", "", errors.New("okta.api_token is not set")
+    }
+    var session struct {
+        Id     string `json:"id"`
+        UserId string `json:"userId"`
+        Login  string `json:"login"`
+    }
+    if err := o.oktaRequest("POST", "/api/v1/sessions", map[string]string{"sessionToken": sessionToken}, true, &session); err != nil {
+        return "", "", fmt.Errorf("Unable to open Okta session: %v", err)
+    }
+    if !validOktaId.MatchString(session.UserId) || !validOktaId.MatchString(session.Id) {
+        return "", "", errors.New("Okta returned a session without a valid user")
+    }
+    defer func() {
+        if err := o.oktaRequest("DELETE", "/api/v1/sessions/" + session.Id, nil, true, nil); err != nil {
+            Logs.Warningf("Unable to close Okta session for %s: %+v", session.Login, err)
+        }
+    }()
+    var groups []struct {
+        Type    string `json:"type"`
+        Profile struct {
+            Name string `json:"name"`
+        } `json:"profile"`
+    }
+    if err := o.oktaRequest("GET", "/api/v1/users/" + session.UserId + "/groups", nil, true, &groups); err != nil {
+        return "", "", fmt.Errorf("Unable to look up Okta groups for %s: %v", session.Login, err)
+    }
+    filter := regexp.MustCompile(o.Config.Okta.GroupFilter)
+    names := []string{}
+    for _, group := range groups {
+        // Everyone is built in and says nothing about the user
+        if group.Type != "BUILT_IN" && filter.MatchString(group.Profile.Name) {
+            names = append(names, group.Profile.Name)
+        }
+    }
+    if len(names) == 0 {
+        return session.Login, "", ErrNoOktaGroup
+    }
+    sort.Strings(names)
+    return session.Login, names[0], nil
+}
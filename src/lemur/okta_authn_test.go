@@ -0,0 +1,183 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+// stubOkta answers the Okta Authn, Sessions and Users APIs the way an Okta
+// org does for a handful of test users. The password is always "secret".
+type stubOkta struct {
+    pushPolls      int
+    closedSessions int
+}
+
+func (s *stubOkta) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    answer := func(status int, body string) {
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(status)
+        w.Write([]byte(body))
+    }
+    mfaRequired := `{"status": "MFA_REQUIRED", "stateToken": "state1", "_embedded": {"factors": [
+        {"id": "pushFactor1", "factorType": "push", "provider": "OKTA"},
+        {"id": "totpFactor1", "factorType": "token:software:totp", "provider": "GOOGLE"},
+        {"id": "smsFactor1", "factorType": "sms", "provider": "OKTA"}]}}`
+    if strings.HasPrefix(r.URL.Path, "/api/v1/sessions") || strings.HasPrefix(r.URL.Path, "/api/v1/users") {
+        if r.Header.Get("Authorization") != "SSWS test-token" {
+            answer(http.StatusUnauthorized, `{"errorCode": "E0000011", "errorSummary": "Invalid token provided"}`)
+            return
+        }
+    }
+    var body map[string]string
+    json.NewDecoder(r.Body).Decode(&body)
+    switch r.Method + " " + r.URL.Path {
+    case "POST /api/v1/authn":
+        if body["password"] != "secret" {
+            answer(http.StatusUnauthorized, `{"errorCode": "E0000004", "errorSummary": "Authentication failed"}`)
+        } else if body["username"] == "mfa.user" {
+            answer(http.StatusOK, mfaRequired)
+        } else if body["username"] == "locked.user" {
+            answer(http.StatusOK, `{"status": "LOCKED_OUT"}`)
+        } else if body["username"] == "expiring.user" {
+            answer(http.StatusOK, `{"status": "PASSWORD_WARN", "stateToken": "state1"}`)
+        } else {
+            answer(http.StatusOK, `{"status": "SUCCESS", "sessionToken": "session-` + body["username"] + `"}`)
+        }
+    case "POST /api/v1/authn/skip":
+        answer(http.StatusOK, `{"status": "SUCCESS", "sessionToken": "session-expiring.user"}`)
+    case "POST /api/v1/authn/factors/totpFactor1/verify":
+        if body["stateToken"] != "state1" || body["passCode"] != "123456" {
+            answer(http.StatusForbidden, `{"errorCode": "E0000068", "errorSummary": "Invalid Passcode/Answer"}`)
+            return
+        }
+        answer(http.StatusOK, `{"status": "SUCCESS", "sessionToken": "session-mfa.user"}`)
+    case "POST /api/v1/authn/factors/pushFactor1/verify":
+        s.pushPolls++
+        if s.pushPolls < 2 {
+            answer(http.StatusOK, `{"status": "MFA_CHALLENGE", "stateToken": "state1", "factorResult": "WAITING"}`)
+            return
+        }
+        answer(http.StatusOK, `{"status": "SUCCESS", "sessionToken": "session-mfa.user"}`)
+    case "POST /api/v1/sessions":
+        user := strings.TrimPrefix(body["sessionToken"], "session-")
+        userId := "user1"
+        if user == "groupless.user" {
+            userId = "user2"
+        }
+        answer(http.StatusOK, `{"id": "sess1", "userId": "` + userId + `", "login": "` + user + `@example.com"}`)
+    case "DELETE /api/v1/sessions/sess1":
+        s.closedSessions++
+        w.WriteHeader(http.StatusNoContent)
+    case "GET /api/v1/users/user1/groups":
+        answer(http.StatusOK, `[{"type": "BUILT_IN", "profile": {"name": "Everyone"}},
+                                {"type": "OKTA_GROUP", "profile": {"name": "TestOrg"}},
+                                {"type": "APP_GROUP", "profile": {"name": "AnotherOrg"}}]`)
+    case "GET /api/v1/users/user2/groups":
+        answer(http.StatusOK, `[{"type": "BUILT_IN", "profile": {"name": "Everyone"}}]`)
+    default:
+        answer(http.StatusNotFound, `{"errorCode": "E0000007", "errorSummary": "Not found"}`)
+    }
+}
+
+// oktaLogin posts body to path through the router and decodes the answer
+func oktaLogin(t *testing.T, path, body string) (int, map[string]interface{}) {
+    request := httptest.NewRequest("POST", path, strings.NewReader(body))
+    recorder := httptest.NewRecorder()
+    NewRouter().ServeHTTP(recorder, request)
+    var answer map[string]interface{}
+    if err := json.Unmarshal(recorder.Body.Bytes(), &answer); err != nil {
+        t.Fatalf("%s should answer JSON, got %q", path, recorder.Body.String())
+    }
+    return recorder.Code, answer
+}
+
+func TestOktaLogin(t *testing.T) {
+    stub := &stubOkta{}
+    server := httptest.NewServer(stub)
+    defer server.Close()
+    oldProvider, oldSecret := OktaProvider, secretKey
+    defer func() { OktaProvider, secretKey = oldProvider, oldSecret }()
+    secretKey = NewTokenSecret()
+    OktaProvider = &oktaProvider{Config: &InstanceConfig{IdpApiAuthUrl: server.URL + "/api/v1/authn",
+                                                         Okta: OktaConfig{ApiToken: "test-token", GroupFilter: "^Test"}}}
+
+    code, answer := oktaLogin(t, "/v1/auth/login", `{"username": "first.last", "password": "secret"}`)
+    if code != http.StatusOK || answer["status"] != "SUCCESS" {
+        t.Fatalf("Logging in without MFA should succeed, got %d %+v", code, answer)
+    }
+    claims := secretKey.GetClaims(answer["token"].(string))
+    if claims["username"] != "first.last@example.com" || claims["rbac"] != "TestOrg" {
+        t.Errorf("Tokens should carry the Okta login and the group matching okta.group_filter, got %+v", claims)
+    }
+    if answer["refresh_token"] == nil {
+        t.Errorf("API logins should get a refresh token!")
+    }
+    if stub.closedSessions != 1 {
+        t.Errorf("The Okta session used to look up groups should be closed!")
+    }
+
+    code, answer = oktaLogin(t, "/v1/auth/login", `{"username": "first.last", "password": "wrong"}`)
+    if code != http.StatusUnauthorized || answer["code"] != CodeAuthenticationFailed {
+        t.Errorf("Wrong passwords should be refused, got %d %+v", code, answer)
+    }
+    code, answer = oktaLogin(t, "/v1/auth/login", `{"username": "locked.user", "password": "secret"}`)
+    if code != http.StatusUnauthorized || answer["token"] != nil {
+        t.Errorf("Only SUCCESS should mint a token, got %d %+v", code, answer)
+    }
+    code, answer = oktaLogin(t, "/v1/auth/login", `{"username": "expiring.user", "password": "secret"}`)
+    if code != http.StatusOK || answer["token"] == nil {
+        t.Errorf("A password about to expire should not stop the login, got %d %+v", code, answer)
+    }
+    code, answer = oktaLogin(t, "/v1/auth/login", `{"username": "groupless.user", "password": "secret"}`)
+    if code != http.StatusForbidden {
+        t.Errorf("Users without a matching group should be refused, got %d %+v", code, answer)
+    }
+    code, answer = oktaLogin(t, "/v1/auth/login", `{"username": "first.last"}`)
+    if code != http.StatusBadRequest || answer["fields"] == nil {
+        t.Errorf("Logins without a password should be refused, got %d %+v", code, answer)
+    }
+}
+
+func TestOktaLoginMFA(t *testing.T) {
+    stub := &stubOkta{}
+    server := httptest.NewServer(stub)
+    defer server.Close()
+    oldProvider, oldSecret := OktaProvider, secretKey
+    defer func() { OktaProvider, secretKey = oldProvider, oldSecret }()
+    secretKey = NewTokenSecret()
+    OktaProvider = &oktaProvider{Config: &InstanceConfig{IdpApiAuthUrl: server.URL + "/api/v1/authn",
+                                                         Okta: OktaConfig{ApiToken: "test-token"}}}
+
+    code, answer := oktaLogin(t, "/v1/auth/login", `{"username": "mfa.user", "password": "secret"}`)
+    if code != http.StatusOK || answer["status"] != "MFA_REQUIRED" || answer["token"] != nil {
+        t.Fatalf("Logins needing MFA should not get a token yet, got %d %+v", code, answer)
+    }
+    if factors := answer["factors"].([]interface{}); len(factors) != 2 {
+        t.Errorf("Only push and TOTP factors should be offered, got %+v", factors)
+    }
+
+    code, answer = oktaLogin(t, "/v1/auth/login/factors/totpFactor1/verify", `{"stateToken": "state1", "passCode": "000000"}`)
+    if code != http.StatusUnauthorized {
+        t.Errorf("Wrong passcodes should be refused, got %d %+v", code, answer)
+    }
+    code, answer = oktaLogin(t, "/v1/auth/login/factors/totpFactor1/verify", `{"stateToken": "state1", "passCode": "123456"}`)
+    if code != http.StatusOK || answer["token"] == nil {
+        t.Errorf("Verifying TOTP should mint a token, got %d %+v", code, answer)
+    }
+    claims := secretKey.GetClaims(answer["token"].(string))
+    if claims["rbac"] != "AnotherOrg" {
+        t.Errorf("Without okta.group_filter the first group by name should be used, got %+v", claims["rbac"])
+    }
+
+    code, answer = oktaLogin(t, "/v1/auth/login/factors/pushFactor1/verify", `{"stateToken": "state1"}`)
+    if code != http.StatusOK || answer["status"] != "MFA_CHALLENGE" || answer["factorResult"] != "WAITING" || answer["token"] != nil {
+        t.Errorf("Pushes waiting for the user should be polled, got %d %+v", code, answer)
+    }
+    code, answer = oktaLogin(t, "/v1/auth/login/factors/pushFactor1/verify", `{"stateToken": "state1"}`)
+    if code != http.StatusOK || answer["token"] == nil {
+        t.Errorf("Accepted pushes should mint a token, got %d %+v", code, answer)
+    }
+}
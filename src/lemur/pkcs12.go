@@ -0,0 +1,335 @@
+package main
+
+import (
+    "crypto/cipher"
+    "crypto/des"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/asn1"
+    "math/big"
+    "unicode/utf16"
+)
+
+// A minimal PKCS#12 (RFC 7292) encoder: one shrouded private key and its
+// certificate chain, encrypted with pbeWithSHAAnd3-KeyTripleDES-CBC and
+// protected by an HMAC-SHA1 MAC. That combination is readable by OpenSSL,
+// Java's keytool and the Windows certificate import wizard.
+
+const pkcs12Iterations = 2048
+
+var (
+    oidData                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+    oidEncryptedData         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+    oidPKCS8ShroudedKeyBag   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+    oidCertBag               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+    oidX509Certificate       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+    oidFriendlyName          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+    oidLocalKeyId            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+    oidPBEWithSHAAnd3KeyTDES = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+    oidSHA1                  = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+type pfxPdu struct {
+    Version  int
+    AuthSafe contentInfo
+    MacData  macData
+}
+
+type contentInfo struct {
+    ContentType asn1.ObjectIdentifier
+    Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type encryptedData struct {
+    Version              int
+    EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+    ContentType                asn1.ObjectIdentifier
+    ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+    EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type safeBag struct {
+    Id         asn1.ObjectIdentifier
+    Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+    Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+    Id    asn1.ObjectIdentifier
+    Value asn1.RawValue `asn1:"set"`
+}
+
+type certBag struct {
+    Id   asn1.ObjectIdentifier
+    Data []byte `asn1:"tag:0,explicit"`
+}
+
+type encryptedPrivateKeyInfo struct {
+    AlgorithmIdentifier pkix.AlgorithmIdentifier
+    EncryptedData       []byte
+}
+
+type pbeParams struct {
+    Salt       []byte
+    Iterations int
+}
+
+type macData struct {
+    Mac        digestInfo
+    MacSalt    []byte
+    Iterations int
+}
+
+type digestInfo struct {
+    Algorithm pkix.AlgorithmIdentifier
+    Digest    []byte
+}
+
+// EncodePKCS12 builds a password protected PKCS#12 file holding a private
+// key, its leaf certificate and the rest of the chain
+// Takes a PKCS#8 DER private key, the leaf, the chain, a friendly name for
+// the entry and the password
+// Returns the DER encoded PFX and an error
+func EncodePKCS12(pkcs8Key []byte, leaf *x509.Certificate, chain []*x509.Certificate, name, password string) ([]byte, error) {
+    bmpPassword := bmpString(password)
+    localKeyId := sha1.Sum(leaf.Raw)
+    attributes, err := pkcs12Attributes(localKeyId[:], name)
+    if err != nil {
+        return nil, err
+    }
+
+    // The key goes in its own shrouded bag inside a plain data ContentInfo
+    shroudedKey, err := pkcs12ShroudKey(pkcs8Key, bmpPassword)
+    if err != nil {
+        return nil, err
+    }
+    keyBag := safeBag{Id: oidPKCS8ShroudedKeyBag,
+                      Value: explicitTag0(shroudedKey),
+                      Attributes: attributes}
+    keyContents, err := asn1.Marshal([]safeBag{keyBag})
+    if err != nil {
+        return nil, err
+    }
+    keyInfo, err := dataContentInfo(keyContents)
+    if err != nil {
+        return nil, err
+    }
+
+    // The certificates all go in one encrypted ContentInfo; only the leaf
+    // carries the localKeyId tying it to the key
+    var certBags []safeBag
+    for i, cert := range append([]*x509.Certificate{leaf}, chain...) {
+        bagData, err := asn1.Marshal(certBag{Id: oidX509Certificate, Data: cert.Raw})
+        if err != nil {
+            return nil, err
+        }
+        bag := safeBag{Id: oidCertBag, Value: explicitTag0(bagData)}
+        if i == 0 {
+            bag.Attributes = attributes
+        }
+        certBags = append(certBags, bag)
+    }
+    certContents, err := asn1.Marshal(certBags)
+    if err != nil {
+        return nil, err
+    }
+    certInfo, err := encryptedContentInfoFor(certContents, bmpPassword)
+    if err != nil {
+        return nil, err
+    }
+
+    authenticatedSafe, err := asn1.Marshal([]contentInfo{keyInfo, certInfo})
+    if err != nil {
+        return nil, err
+    }
+    authSafe, err := dataContentInfo(authenticatedSafe)
+    if err != nil {
+        return nil, err
+    }
+    mac, err := pkcs12Mac(authenticatedSafe, bmpPassword)
+    if err != nil {
+        return nil, err
+    }
+    return asn1.Marshal(pfxPdu{Version: 3, AuthSafe: authSafe, MacData: *mac})
+}
+
+// explicitTag0 wraps DER in a [0] EXPLICIT tag; encoding/asn1 ignores tag
+// options on RawValue fields, so this has to be done by hand
+func explicitTag0(der []byte) asn1.RawValue {
+    return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+func dataContentInfo(data []byte) (contentInfo, error) {
+    octets, err := asn1.Marshal(data)
+    if err != nil {
+        return contentInfo{}, err
+    }
+    return contentInfo{ContentType: oidData, Content: explicitTag0(octets)}, nil
+}
+
+func encryptedContentInfoFor(data, bmpPassword []byte) (contentInfo, error) {
+    algorithm, encrypted, err := pbeEncrypt(data, bmpPassword)
+    if err != nil {
+        return contentInfo{}, err
+    }
+    content, err := asn1.Marshal(encryptedData{
+        Version: 0,
+        EncryptedContentInfo: encryptedContentInfo{ContentType: oidData,
+                                                   ContentEncryptionAlgorithm: algorithm,
+                                                   EncryptedContent: encrypted},
+    })
+    if err != nil {
+        return contentInfo{}, err
+    }
+    return contentInfo{ContentType: oidEncryptedData, Content: explicitTag0(content)}, nil
+}
+
+func pkcs12ShroudKey(pkcs8Key, bmpPassword []byte) ([]byte, error) {
+    algorithm, encrypted, err := pbeEncrypt(pkcs8Key, bmpPassword)
+    if err != nil {
+        return nil, err
+    }
+    return asn1.Marshal(encryptedPrivateKeyInfo{AlgorithmIdentifier: algorithm, EncryptedData: encrypted})
+}
+
+func pkcs12Attributes(localKeyId []byte, name string) ([]pkcs12Attribute, error) {
+    keyId, err := asn1.Marshal(localKeyId)
+    if err != nil {
+        return nil, err
+    }
+    attributes := []pkcs12Attribute{
+        {Id: oidLocalKeyId, Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: keyId}},
+    }
+    if name != "" {
+        // BMPString has no encoding/asn1 support either; drop the NUL
+        // terminator bmpString adds for passwords
+        bmpName := bmpString(name)
+        friendlyName, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: 30, Bytes: bmpName[:len(bmpName) - 2]})
+        if err != nil {
+            return nil, err
+        }
+        attributes = append(attributes, pkcs12Attribute{
+            Id: oidFriendlyName,
+            Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: friendlyName},
+        })
+    }
+    return attributes, nil
+}
+
+// pbeEncrypt encrypts data with pbeWithSHAAnd3-KeyTripleDES-CBC and a fresh
+// salt, returning the algorithm identifier to store alongside it
+func pbeEncrypt(data, bmpPassword []byte) (pkix.AlgorithmIdentifier, []byte, error) {
+    salt := make([]byte, 8)
+    if _, err := rand.Read(salt); err != nil {
+        return pkix.AlgorithmIdentifier{}, nil, err
+    }
+    params, err := asn1.Marshal(pbeParams{Salt: salt, Iterations: pkcs12Iterations})
+    if err != nil {
+        return pkix.AlgorithmIdentifier{}, nil, err
+    }
+    key := pkcs12KDF(bmpPassword, salt, pkcs12Iterations, 1, 24)
+    iv := pkcs12KDF(bmpPassword, salt, pkcs12Iterations, 2, 8)
+    block, err := des.NewTripleDESCipher(key)
+    if err != nil {
+        return pkix.AlgorithmIdentifier{}, nil, err
+    }
+    padding := block.BlockSize() - len(data) % block.BlockSize()
+    padded := make([]byte, len(data), len(data) + padding)
+    copy(padded, data)
+    for i := 0; i < padding; i++ {
+        padded = append(padded, byte(padding))
+    }
+    encrypted := make([]byte, len(padded))
+    cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, padded)
+    algorithm := pkix.AlgorithmIdentifier{Algorithm: oidPBEWithSHAAnd3KeyTDES,
+                                          Parameters: asn1.RawValue{FullBytes: params}}
+    return algorithm, encrypted, nil
+}
+
+func pkcs12Mac(authenticatedSafe, bmpPassword []byte) (*macData, error) {
+    salt := make([]byte, 8)
+    if _, err := rand.Read(salt); err != nil {
+        return nil, err
+    }
+    key := pkcs12KDF(bmpPassword, salt, pkcs12Iterations, 3, 20)
+    mac := hmac.New(sha1.New, key)
+    mac.Write(authenticatedSafe)
+    return &macData{
+        Mac: digestInfo{Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1,
+                                                           Parameters: asn1.RawValue{FullBytes: []byte{asn1.TagNull, 0}}},
+                        Digest: mac.Sum(nil)},
+        MacSalt: salt,
+        Iterations: pkcs12Iterations,
+    }, nil
+}
+
+// bmpString encodes a password as PKCS#12 expects: UTF-16 big endian with
+// a two byte NUL terminator
+func bmpString(s string) []byte {
+    encoded := utf16.Encode([]rune(s))
+    out := make([]byte, 0, len(encoded) * 2 + 2)
+    for _, r := range encoded {
+        out = append(out, byte(r >> 8), byte(r))
+    }
+    return append(out, 0, 0)
+}
+
+// pkcs12KDF is the SHA-1 key derivation function from RFC 7292 appendix B.2
+// Takes the BMP encoded password, salt, iteration count, purpose id (1 for
+// keys, 2 for IVs, 3 for MAC keys) and the number of bytes wanted
+func pkcs12KDF(password, salt []byte, iterations int, id byte, size int) []byte {
+    const u = 20 // SHA-1 output size
+    const v = 64 // SHA-1 block size
+    diversifier := make([]byte, v)
+    for i := range diversifier {
+        diversifier[i] = id
+    }
+    fill := func(in []byte) []byte {
+        if len(in) == 0 {
+            return nil
+        }
+        out := make([]byte, v * ((len(in) + v - 1) / v))
+        for i := range out {
+            out[i] = in[i % len(in)]
+        }
+        return out
+    }
+    I := append(fill(salt), fill(password)...)
+    var result []byte
+    for len(result) < size {
+        hash := sha1.New()
+        hash.Write(diversifier)
+        hash.Write(I)
+        A := hash.Sum(nil)
+        for r := 1; r < iterations; r++ {
+            sum := sha1.Sum(A)
+            A = sum[:]
+        }
+        result = append(result, A...)
+        if len(result) >= size {
+            break
+        }
+        // I_j = (I_j + B + 1) mod 2^(v*8) for every v byte block of I
+        B := new(big.Int).SetBytes(fill(A[:u]))
+        one := big.NewInt(1)
+        modulus := new(big.Int).Lsh(one, v * 8)
+        for j := 0; j < len(I); j += v {
+            Ij := new(big.Int).SetBytes(I[j:j + v])
+            Ij.Add(Ij, B)
+            Ij.Add(Ij, one)
+            Ij.Mod(Ij, modulus)
+            block := Ij.Bytes()
+            for k := range I[j:j + v] {
+                I[j + k] = 0
+            }
+            copy(I[j + v - len(block):j + v], block)
+        }
+    }
+    return result[:size]
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/rsa"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "strings"
+    "time"
+    "gopkg.in/yaml.v2"
+)
+
+// DefaultLemurKeyType is the key Lemur generates when a request names none
+const DefaultLemurKeyType = "RSA2048"
+
+// LemurKeyTypes are the key types Lemur can generate, and that policies may
+// allow. Keys from a CSR are named the same way.
+var LemurKeyTypes = []string{"RSA2048", "RSA4096", "ECCPRIME256V1", "ECCSECP384R1", "ECCSECP521R1"}
+
+// ecKeyTypes maps curve names onto Lemur's key type names
+var ecKeyTypes = map[string]string{"P-256": "ECCPRIME256V1",
+                                   "P-384": "ECCSECP384R1",
+                                   "P-521": "ECCSECP521R1"}
+
+// KnownKeyType reports whether Lemur understands keyType
+func KnownKeyType(keyType string) bool {
+    for _, known := range LemurKeyTypes {
+        if keyType == known {
+            return true
+        }
+    }
+    return false
+}
+
+// PublicKeyType names a public key, e.g. from a CSR, as a Lemur key type
+func PublicKeyType(publicKey interface{}) string {
+    switch key := publicKey.(type) {
+    case *rsa.PublicKey:
+        return fmt.Sprintf("RSA%d", key.N.BitLen())
+    case *ecdsa.PublicKey:
+        return ecKeyTypes[key.Curve.Params().Name]
+    }
+    return ""
+}
+
+// GroupPolicy constrains what one RBAC group may request. An empty rule
+// allows anything. CommonNames entries are either exact names, which may use
+// the {username} and {localpart} placeholders, or "*.domain", which matches
+// one extra label in front of domain.
+type GroupPolicy struct {
+    Authorities  []string `yaml:"authorities"`
+    CommonNames  []string `yaml:"common_names"`
+    OwnerDomains []string `yaml:"owner_domains"`
+    MaxValidity  string   `yaml:"max_validity"`
+    KeyTypes     []string `yaml:"key_types"`
+}
+
+// IssuancePolicy is the policy file: rules per RBAC group, and default rules
+// for groups not listed. Without default rules, unlisted groups may not
+// request anything.
+type IssuancePolicy struct {
+    Default *GroupPolicy            `yaml:"default"`
+    Groups  map[string]*GroupPolicy `yaml:"groups"`
+}
+
+// IssuanceRequest is what a certificate request asks for, as checked
+// against the policy. DNSNames are a CSR's DNS SANs, held to the same rule
+// as CommonName. Start and End are the validity window sent to Lemur; an
+// empty Start means now.
+type IssuanceRequest struct {
+    Group      string
+    Username   string
+    Authority  string
+    CommonName string
+    DNSNames   []string
+    Owner      string
+    KeyType    string
+    Start      string
+    End        string
+}
+
+// PolicyViolation names the policy rule that rejected a request; its
+// message is shown to the caller
+type PolicyViolation struct {
+    Group  string
+    Rule   string
+    Reason string
+}
+
+func (e *PolicyViolation) Error() string {
+    return fmt.Sprintf("Policy for group '%s' rejected the request (%s): %s", e.Group, e.Rule, e.Reason)
+}
+
+// LoadIssuancePolicy reads and checks the policy file at path
+// Takes a file path
+// Returns an IssuancePolicy pointer and an error
+func LoadIssuancePolicy(path string) (*IssuancePolicy, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("Lemur-client config: unable to read policy_file: %v", err)
+    }
+    var policy IssuancePolicy
+    if err := yaml.Unmarshal(data, &policy); err != nil {
+        return nil, fmt.Errorf("Lemur-client config: unable to parse policy_file: %v", err)
+    }
+    rules := map[string]*GroupPolicy{"default": policy.Default}
+    for group, rule := range policy.Groups {
+        rules["groups." + group] = rule
+    }
+    for name, rule := range rules {
+        if rule == nil {
+            continue
+        }
+        if err := rule.validate(); err != nil {
+            return nil, fmt.Errorf("Lemur-client config: policy %s: %v", name, err)
+        }
+    }
+    return &policy, nil
+}
+
+func (g *GroupPolicy) validate() error {
+    if g.MaxValidity != "" {
+        if _, err := ParseValidityDuration(g.MaxValidity); err != nil {
+            return fmt.Errorf("max_validity %v", err)
+        }
+    }
+    for _, keyType := range g.KeyTypes {
+        if !KnownKeyType(keyType) {
+            return fmt.Errorf("unknown key type '%s', expected one of %s", keyType, strings.Join(LemurKeyTypes, ", "))
+        }
+    }
+    for _, pattern := range g.CommonNames {
+        if strings.Contains(strings.TrimPrefix(pattern, "*."), "*") {
+            return fmt.Errorf("common name pattern '%s' may only start with '*.'", pattern)
+        }
+    }
+    return nil
+}
+
+// ForGroup returns the rules for an RBAC group, or nil if it has none
+func (p *IssuancePolicy) ForGroup(group string) *GroupPolicy {
+    if rule, ok := p.Groups[group]; ok && rule != nil {
+        return rule
+    }
+    return p.Default
+}
+
+// Check applies the caller's group policy to a request. Without a policy
+// file every request is allowed.
+// Called on an IssuancePolicy pointer, which may be nil
+// Takes an IssuanceRequest pointer and the current time as arguments
+// Returns an error, which is a *PolicyViolation naming the rule that failed
+func (p *IssuancePolicy) Check(req *IssuanceRequest, now time.Time) error {
+    if p == nil {
+        return nil
+    }
+    rule := p.ForGroup(req.Group)
+    if rule == nil {
+        return &PolicyViolation{Group: req.Group, Rule: "groups", Reason: "the group has no issuance policy"}
+    }
+    violation := func(name, format string, args ...interface{}) error {
+        return &PolicyViolation{Group: req.Group, Rule: name, Reason: fmt.Sprintf(format, args...)}
+    }
+    if len(rule.Authorities) > 0 && !containsFold(rule.Authorities, req.Authority) {
+        return violation("authorities", "authority '%s' is not one of %s", req.Authority, strings.Join(rule.Authorities, ", "))
+    }
+    if len(rule.CommonNames) > 0 && !rule.commonNameAllowed(req.CommonName, req.Username) {
+        return violation("common_names", "common name '%s' does not match any of %s", req.CommonName, strings.Join(rule.CommonNames, ", "))
+    }
+    for _, name := range req.DNSNames {
+        if len(rule.CommonNames) > 0 && !rule.commonNameAllowed(name, req.Username) {
+            return violation("common_names", "DNS SAN '%s' does not match any of %s", name, strings.Join(rule.CommonNames, ", "))
+        }
+    }
+    if len(rule.OwnerDomains) > 0 {
+        at := strings.LastIndex(req.Owner, "@")
+        if at < 0 || !containsFold(rule.OwnerDomains, req.Owner[at + 1:]) {
+            return violation("owner_domains", "owner '%s' is not an address at %s", req.Owner, strings.Join(rule.OwnerDomains, ", "))
+        }
+    }
+    if rule.MaxValidity != "" {
+        if err := rule.checkValidity(req, now); err != nil {
+            return violation("max_validity", "%v", err)
+        }
+    }
+    if len(rule.KeyTypes) > 0 && !containsFold(rule.KeyTypes, req.KeyType) {
+        return violation("key_types", "key type '%s' is not one of %s", req.KeyType, strings.Join(rule.KeyTypes, ", "))
+    }
+    return nil
+}
+
+// commonNameAllowed matches a common name against the rule's patterns
+func (g *GroupPolicy) commonNameAllowed(commonName, username string) bool {
+    localPart := username
+    if at := strings.Index(username, "@"); at > 0 {
+        localPart = username[:at]
+    }
+    commonName = strings.ToLower(commonName)
+    for _, pattern := range g.CommonNames {
+        pattern = strings.ToLower(pattern)
+        if strings.HasPrefix(pattern, "*.") {
+            label := strings.TrimSuffix(commonName, pattern[1:])
+            if label != commonName && label != "" && !strings.Contains(label, ".") {
+                return true
+            }
+            continue
+        }
+        // Without a username the placeholders must not match anything
+        if strings.Contains(pattern, "{username}") || strings.Contains(pattern, "{localpart}") {
+            if username == "" {
+                continue
+            }
+            pattern = strings.Replace(pattern, "{username}", strings.ToLower(username), -1)
+            pattern = strings.Replace(pattern, "{localpart}", strings.ToLower(localPart), -1)
+        }
+        if commonName == pattern {
+            return true
+        }
+    }
+    return false
+}
+
+// checkValidity makes sure the request's window fits max_validity
+func (g *GroupPolicy) checkValidity(req *IssuanceRequest, now time.Time) error {
+    if req.End == "" {
+        return errors.New("an end date is required")
+    }
+    start := now.UTC()
+    if req.Start != "" {
+        parsed, err := parseLemurTime(req.Start)
+        if err != nil {
+            return fmt.Errorf("start '%s' is not a date", req.Start)
+        }
+        start = parsed
+    }
+    end, err := parseLemurTime(req.End)
+    if err != nil {
+        return fmt.Errorf("end '%s' is not a date", req.End)
+    }
+    maxValidity, _ := ParseValidityDuration(g.MaxValidity)
+    if end.Sub(start) > maxValidity {
+        return fmt.Errorf("certificates may be valid for at most %s", g.MaxValidity)
+    }
+    return nil
+}
+
+func containsFold(list []string, value string) bool {
+    for _, item := range list {
+        if strings.EqualFold(item, value) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "io/ioutil"
+    "os"
+    "testing"
+    "time"
+)
+
+const testPolicy = `
+default:
+  authorities: [SharedClientCA]
+  common_names: ["{localpart}"]
+  owner_domains: [example.com]
+  max_validity: 14d
+groups:
+  TeamA:
+    authorities: [TeamACA]
+    common_names: ["{username}", "*.team-a.example.com"]
+    owner_domains: [example.com, team-a.example.com]
+    max_validity: 90d
+    key_types: [ECCPRIME256V1, RSA4096]
+`
+
+func loadTestPolicy(t *testing.T, policy string) (*IssuancePolicy, error) {
+    file, err := ioutil.TempFile("", "policy")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.Remove(file.Name())
+    file.WriteString(policy)
+    file.Close()
+    return LoadIssuancePolicy(file.Name())
+}
+
+func TestLoadIssuancePolicy(t *testing.T) {
+    if _, err := loadTestPolicy(t, testPolicy); err != nil {
+        t.Fatalf("The test policy should load: %v", err)
+    }
+    bad := []string{"default:\n  key_types: [DSA1024]\n",
+                    "groups:\n  TeamA:\n    max_validity: forever\n",
+                    "groups:\n  TeamA:\n    common_names: [\"first.*.example.com\"]\n",
+                    "groups: [TeamA]\n"}
+    for _, policy := range bad {
+        if _, err := loadTestPolicy(t, policy); err == nil {
+            t.Errorf("Policy %q should not load!", policy)
+        }
+    }
+}
+
+func TestIssuancePolicyCheck(t *testing.T) {
+    policy, err := loadTestPolicy(t, testPolicy)
+    if err != nil {
+        t.Fatal(err)
+    }
+    now := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+    teamA := func() *IssuanceRequest {
+        return &IssuanceRequest{Group: "TeamA",
+                                Username: "first.last@example.com",
+                                Authority: "TeamACA",
+                                CommonName: "build.team-a.example.com",
+                                Owner: "first.last@team-a.example.com",
+                                KeyType: "ECCPRIME256V1",
+                                End: "2017-05-01"}
+    }
+    if err := policy.Check(teamA(), now); err != nil {
+        t.Errorf("A request within TeamA's policy should pass: %v", err)
+    }
+    violations := map[string]func(*IssuanceRequest){
+        "authorities":   func(r *IssuanceRequest) { r.Authority = "SharedClientCA" },
+        "common_names":  func(r *IssuanceRequest) { r.CommonName = "a.build.team-a.example.com" },
+        "owner_domains": func(r *IssuanceRequest) { r.Owner = "first.last@elsewhere.com" },
+        "max_validity":  func(r *IssuanceRequest) { r.End = "2017-07-01" },
+        "key_types":     func(r *IssuanceRequest) { r.KeyType = "RSA2048" },
+    }
+    for rule, change := range violations {
+        request := teamA()
+        change(request)
+        err := policy.Check(request, now)
+        if violation, ok := err.(*PolicyViolation); !ok || violation.Rule != rule {
+            t.Errorf("Expected the %s rule to reject the request, got %v", rule, err)
+        }
+    }
+    request := teamA()
+    request.DNSNames = []string{"build.team-a.example.com", "build.team-b.example.com"}
+    if violation, ok := policy.Check(request, now).(*PolicyViolation); !ok || violation.Rule != "common_names" {
+        t.Errorf("DNS SANs should be held to the common_names rule!")
+    }
+    request = teamA()
+    request.CommonName = "First.Last@example.com"
+    if err := policy.Check(request, now); err != nil {
+        t.Errorf("{username} should match the username, ignoring case: %v", err)
+    }
+
+    other := &IssuanceRequest{Group: "TeamB",
+                              Username: "someone@example.com",
+                              Authority: "SharedClientCA",
+                              CommonName: "someone",
+                              Owner: "someone@example.com",
+                              KeyType: "RSA2048",
+                              Start: "2017-03-01",
+                              End: "2017-03-10"}
+    if err := policy.Check(other, now); err != nil {
+        t.Errorf("Groups without rules should get the default ones: %v", err)
+    }
+    other.End = ""
+    if err := policy.Check(other, now); err == nil {
+        t.Errorf("A max_validity rule should require an end date!")
+    }
+    noDefault := &IssuancePolicy{Groups: policy.Groups}
+    if err := noDefault.Check(&IssuanceRequest{Group: "TeamB"}, now); err == nil {
+        t.Errorf("Without default rules, unlisted groups should be refused!")
+    }
+    var none *IssuancePolicy
+    if err := none.Check(other, now); err != nil {
+        t.Errorf("Without a policy file everything should be allowed: %v", err)
+    }
+}
+
+func TestPublicKeyType(t *testing.T) {
+    key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if keyType := PublicKeyType(&key.PublicKey); keyType != "ECCSECP384R1" {
+        t.Errorf("A P-384 key should be ECCSECP384R1, got '%s'", keyType)
+    }
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// DefaultCertProfileName is the profile used when a request names none and
+// config.yaml sets no default_profile
+const DefaultCertProfileName = "client-2w"
+
+// CertProfile is a named set of defaults for a kind of certificate: its
+// subject fields, key usages, how long it is valid for by default and at
+// most, and which authorities may issue it. An empty Organization or
+// OrganizationalUnit is filled in with the requester's RBAC group, an empty
+// MaxValidity means no limit and empty Authorities means any authority.
+type CertProfile struct {
+    Name               string   `yaml:"-"                   json:"name"`
+    Description        string   `yaml:"description"         json:"description"`
+    Country            string   `yaml:"country"             json:"country,omitempty"`
+    State              string   `yaml:"state"               json:"state,omitempty"`
+    Location           string   `yaml:"location"            json:"location,omitempty"`
+    Organization       string   `yaml:"organization"        json:"organization,omitempty"`
+    OrganizationalUnit string   `yaml:"organizational_unit" json:"organizationalUnit,omitempty"`
+    KeyUsages          []string `yaml:"key_usages"          json:"keyUsages"`
+    ExtKeyUsages       []string `yaml:"extended_key_usages" json:"extendedKeyUsages"`
+    DefaultValidity    string   `yaml:"default_validity"    json:"defaultValidity,omitempty"`
+    MaxValidity        string   `yaml:"max_validity"        json:"maxValidity,omitempty"`
+    Authorities        []string `yaml:"authorities"         json:"authorities,omitempty"`
+}
+
+// defaultCertProfile is used when config.yaml defines no profiles. It
+// describes the certificates this service has always issued.
+var defaultCertProfile = CertProfile{Name: DefaultCertProfileName,
+                                     Description: "Temporary Client Certificate (2 weeks)",
+                                     Country: "US",
+                                     State: "OR",
+                                     Location: "Portland",
+                                     KeyUsages: []string{"digitalSignature"},
+                                     ExtKeyUsages: []string{"clientAuth"},
+                                     DefaultValidity: "14d"}
+
+// ProfileError is returned when a request does not fit its profile
+type ProfileError struct {
+    Profile string
+    Reason  string
+}
+
+func (e *ProfileError) Error() string {
+    return fmt.Sprintf("Profile '%s': %s", e.Profile, e.Reason)
+}
+
+// ParseValidityDuration parses a validity period. On top of what
+// time.ParseDuration accepts it understands whole days ("14d") and weeks
+// ("2w").
+func ParseValidityDuration(value string) (time.Duration, error) {
+    var unit time.Duration
+    switch {
+    case strings.HasSuffix(value, "d"):
+        unit = 24 * time.Hour
+    case strings.HasSuffix(value, "w"):
+        unit = 7 * 24 * time.Hour
+    default:
+        duration, err := time.ParseDuration(value)
+        if err != nil || duration <= 0 {
+            return 0, fmt.Errorf("'%s' is not a positive duration", value)
+        }
+        return duration, nil
+    }
+    count, err := strconv.Atoi(value[:len(value) - 1])
+    if err != nil || count <= 0 {
+        return 0, fmt.Errorf("'%s' is not a positive duration", value)
+    }
+    return time.Duration(count) * unit, nil
+}
+
+// keyUsageFlag turns a key usage name as written in a profile, e.g.
+// digitalSignature, into Lemur's extension flag, e.g. useDigitalSignature
+func keyUsageFlag(usage string) string {
+    if usage == "" {
+        return ""
+    }
+    return "use" + strings.ToUpper(usage[:1]) + usage[1:]
+}
+
+// Validate makes sure the profile only names key usages we know how to
+// request and verify, and that its validity periods parse
+func (p *CertProfile) Validate() error {
+    for _, usage := range p.KeyUsages {
+        if _, ok := manifestKeyUsages[keyUsageFlag(usage)]; !ok {
+            return &ProfileError{Profile: p.Name, Reason: fmt.Sprintf("unknown key usage '%s'", usage)}
+        }
+    }
+    for _, usage := range p.ExtKeyUsages {
+        if _, ok := manifestExtKeyUsages[usage]; !ok {
+            return &ProfileError{Profile: p.Name, Reason: fmt.Sprintf("unknown extended key usage '%s'", usage)}
+        }
+    }
+    var defaultValidity, maxValidity time.Duration
+    var err error
+    if p.DefaultValidity != "" {
+        if defaultValidity, err = ParseValidityDuration(p.DefaultValidity); err != nil {
+            return &ProfileError{Profile: p.Name, Reason: "default_validity " + err.Error()}
+        }
+    }
+    if p.MaxValidity != "" {
+        if maxValidity, err = ParseValidityDuration(p.MaxValidity); err != nil {
+            return &ProfileError{Profile: p.Name, Reason: "max_validity " + err.Error()}
+        }
+        if defaultValidity > maxValidity {
+            return &ProfileError{Profile: p.Name, Reason: "default_validity is longer than max_validity"}
+        }
+    }
+    return nil
+}
+
+// AllowsAuthority reports whether the profile may be issued by authority
+func (p *CertProfile) AllowsAuthority(authority string) bool {
+    if len(p.Authorities) == 0 {
+        return true
+    }
+    for _, allowed := range p.Authorities {
+        if allowed == authority {
+            return true
+        }
+    }
+    return false
+}
+
+// ServerAuth reports whether the profile issues server certificates, i.e.
+// has the serverAuth extended key usage
+func (p *CertProfile) ServerAuth() bool {
+    for _, usage := range p.ExtKeyUsages {
+        if usage == "serverAuth" {
+            return true
+        }
+    }
+    return false
+}
+
+// Window resolves a requested validity window for this profile, see
+// ResolveValidity
+// Called on a CertProfile pointer
+// Takes the requested start and end (either may be empty) and the current
+// time as arguments
+// Returns the start and end to send to Lemur, in UTC, and an error, which
+// is a *ValidityError naming each bad field
+func (p *CertProfile) Window(start, end string, now time.Time) (string, string, error) {
+    startTime, endTime, err := ResolveValidity(start, end, p, now)
+    if err != nil {
+        return "", "", err
+    }
+    return startTime.Format(time.RFC3339), endTime.Format(time.RFC3339), nil
+}
+
+// extensions builds the Lemur extension flags for the profile's key usages
+func (p *CertProfile) extensions() map[string]map[string]map[string]bool {
+    keyUsage := map[string]bool{"isCritical": true}
+    for _, usage := range p.KeyUsages {
+        keyUsage[keyUsageFlag(usage)] = true
+    }
+    extensions := map[string]map[string]bool{"keyUsage": keyUsage,
+                                              "subjectKeyIdentifier": {"isCritical": false,
+                                                                       "includeSKI": true}}
+    if len(p.ExtKeyUsages) > 0 {
+        extKeyUsage := map[string]bool{"isCritical": true}
+        for _, usage := range p.ExtKeyUsages {
+            extKeyUsage[usage] = true
+        }
+        extensions["extendedKeyUsage"] = extKeyUsage
+    }
+    return map[string]map[string]map[string]bool{"extensions": extensions}
+}
+
+// ValidateProfiles checks the profiles in config.yaml, naming each after its
+// key. Without any profiles the built-in client-2w profile is used.
+func (c *InstanceConfig) ValidateProfiles() error {
+    if len(c.Profiles) == 0 {
+        profile := defaultCertProfile
+        c.Profiles = map[string]*CertProfile{DefaultCertProfileName: &profile}
+    }
+    for name, profile := range c.Profiles {
+        if profile == nil {
+            return fmt.Errorf("Lemur-client config: profile '%s' is empty", name)
+        }
+        profile.Name = name
+        if err := profile.Validate(); err != nil {
+            return fmt.Errorf("Lemur-client config: %v", err)
+        }
+    }
+    if c.DefaultProfile == "" {
+        c.DefaultProfile = DefaultCertProfileName
+    }
+    for _, name := range []string{c.DefaultProfile, c.ServerProfile} {
+        if _, ok := c.Profiles[name]; name != "" && !ok {
+            return fmt.Errorf("Lemur-client config: no profile named '%s'", name)
+        }
+    }
+    return nil
+}
+
+// Profile looks up a profile by name, or the default profile if name is
+// empty
+// Called on an InstanceConfig pointer
+// Takes a profile name
+// Returns a CertProfile pointer and an error, which is a *ProfileError if
+// there is no such profile
+func (c *InstanceConfig) Profile(name string) (*CertProfile, error) {
+    if name == "" {
+        name = c.DefaultProfile
+    }
+    if len(c.Profiles) == 0 && (name == "" || name == DefaultCertProfileName) {
+        profile := defaultCertProfile
+        return &profile, nil
+    }
+    profile, ok := c.Profiles[name]
+    if !ok {
+        return nil, &ProfileError{Profile: name, Reason: "no such profile"}
+    }
+    return profile, nil
+}
+
+// ProfileList returns every profile, sorted by name
+func (c *InstanceConfig) ProfileList() []CertProfile {
+    names := []string{}
+    for name := range c.Profiles {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    profiles := []CertProfile{}
+    for _, name := range names {
+        profiles = append(profiles, *c.Profiles[name])
+    }
+    return profiles
+}
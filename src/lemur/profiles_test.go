@@ -0,0 +1,82 @@
+package main
+
+import (
+    "crypto/x509"
+    "testing"
+    "time"
+)
+
+func TestParseValidityDuration(t *testing.T) {
+    valid := map[string]time.Duration{"14d": 14 * 24 * time.Hour,
+                                      "2w": 14 * 24 * time.Hour,
+                                      "36h": 36 * time.Hour}
+    for value, expected := range valid {
+        if got, err := ParseValidityDuration(value); err != nil || got != expected {
+            t.Errorf("'%s' should parse to %s, got %s: %v", value, expected, got, err)
+        }
+    }
+    for _, value := range []string{"", "d", "0d", "-1w", "1.5d", "forever"} {
+        if _, err := ParseValidityDuration(value); err == nil {
+            t.Errorf("'%s' should not parse!", value)
+        }
+    }
+}
+
+func TestValidateProfiles(t *testing.T) {
+    config := InstanceConfig{}
+    if err := config.ValidateProfiles(); err != nil {
+        t.Fatal(err)
+    }
+    if profile, err := config.Profile(""); err != nil || profile.Name != DefaultCertProfileName {
+        t.Errorf("Without profiles the built-in one should be the default: %v", err)
+    }
+    if _, err := config.Profile("server-tls"); err == nil {
+        t.Errorf("Unknown profiles should be refused!")
+    }
+    bad := []*CertProfile{{KeyUsages: []string{"digitalSignatures"}},
+                          {ExtKeyUsages: []string{"anything"}},
+                          {DefaultValidity: "30d", MaxValidity: "14d"},
+                          {MaxValidity: "soon"}}
+    for _, profile := range bad {
+        config := InstanceConfig{Profiles: map[string]*CertProfile{DefaultCertProfileName: profile}}
+        if err := config.ValidateProfiles(); err == nil {
+            t.Errorf("Profile %+v should not validate!", profile)
+        }
+    }
+    config = InstanceConfig{Profiles: map[string]*CertProfile{"server-tls": {}}}
+    if err := config.ValidateProfiles(); err == nil {
+        t.Errorf("A default_profile that does not exist should not validate!")
+    }
+}
+
+func TestProfileManifest(t *testing.T) {
+    fake, lemur := newTestLemur(t)
+    defer fake.Close()
+    profile := &CertProfile{Name: "server-tls",
+                            Description: "Server certificate",
+                            Country: "DE",
+                            Organization: "Ops",
+                            KeyUsages: []string{"digitalSignature", "keyEncipherment"},
+                            ExtKeyUsages: []string{"serverAuth"}}
+    if err := profile.Validate(); err != nil {
+        t.Fatal(err)
+    }
+    manifest := profile.NewCertManifest("TestCA", "host.example.com", "ops@example.com", "", "", "TestOrg")
+    if manifest.Description != "Server certificate" || manifest.Country != "DE" ||
+       manifest.Organization != "Ops" || manifest.OrganizationalUnit != "TestOrg" {
+        t.Errorf("Subject fields should come from the profile, falling back to the RBAC group: %+v", manifest)
+    }
+    if manifest.Fingerprint() == NewCertManifest("TestCA", "host.example.com", "ops@example.com", "", "", "TestOrg").Fingerprint() {
+        t.Errorf("Requests for different profiles should not share a fingerprint!")
+    }
+    if _, err := lemur.ValidateCert(manifest, ""); err != nil {
+        t.Fatalf("A certificate issued for the profile should verify: %v", err)
+    }
+    leaf, err := parseCertificates(fake.Certificate(1).Body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if leaf[0].KeyUsage & x509.KeyUsageKeyEncipherment == 0 || leaf[0].ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+        t.Errorf("The certificate should carry the profile's key usages!")
+    }
+}
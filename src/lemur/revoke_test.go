@@ -0,0 +1,68 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+// userRequest sends a request through the router with an app token for
+// username in group
+func userRequest(t *testing.T, method, path, body, username, group string) *httptest.ResponseRecorder {
+    token, err := secretKey.MakeToken(username, group)
+    if err != nil {
+        t.Fatal(err)
+    }
+    request := httptest.NewRequest(method, path, strings.NewReader(body))
+    request.Header.Set("Authorization", token.(map[string]string)["token"])
+    recorder := httptest.NewRecorder()
+    NewRouter().ServeHTTP(recorder, request)
+    return recorder
+}
+
+func TestRevokeCertHandler(t *testing.T) {
+    fake, lemur := newTestLemur(t)
+    defer fake.Close()
+    oldSecret, oldFlags, oldClient := secretKey, Flags, LemurClient
+    defer func() { secretKey, Flags, LemurClient = oldSecret, oldFlags, oldClient }()
+    secretKey = NewTokenSecret()
+    Flags = &flagOptArgs{Config: &InstanceConfig{AdminGroups: []string{"SecurityAdmins"}}}
+    LemurClient = lemur
+    for i := 0; i < 2; i++ {
+        if _, err := lemur.createCert(NewCertManifest("TestCA", "first.last", "first.last@example.com", "", "", "TestOrg")); err != nil {
+            t.Fatal(err)
+        }
+    }
+    revoke := func(id int, reason, username, group string) *httptest.ResponseRecorder {
+        return userRequest(t, "POST", fmt.Sprintf("/v1/certs/%d/revoke", id), `{"reason": "` + reason + `"}`, username, group)
+    }
+
+    if recorder := revoke(1, "keyCompromise", "someone.else@example.com", "TestOrg"); recorder.Code != http.StatusForbidden {
+        t.Errorf("Only the owner or an admin should revoke, got %d", recorder.Code)
+    }
+    if fake.Certificate(1).Revoked {
+        t.Fatalf("A refused revocation should not reach Lemur!")
+    }
+    if recorder := revoke(1, "bogus", "first.last@example.com", "TestOrg"); recorder.Code != http.StatusBadRequest {
+        t.Errorf("Unknown reasons should be refused, got %d", recorder.Code)
+    }
+    recorder := revoke(1, "keyCompromise", "First.Last@example.com", "TestOrg")
+    if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"revokedBy":"First.Last@example.com"`) {
+        t.Errorf("Owners should revoke their certificates, ignoring case, got %d %s", recorder.Code, recorder.Body.String())
+    }
+    if !fake.Certificate(1).Revoked || fake.Certificate(2).Revoked {
+        t.Errorf("Only certificate 1 should be revoked!")
+    }
+    if recorder := revoke(2, "superseded", "admin@example.com", "SecurityAdmins"); recorder.Code != http.StatusOK || !fake.Certificate(2).Revoked {
+        t.Errorf("Admins should revoke anyone's certificates, got %d", recorder.Code)
+    }
+    if recorder := revoke(99, "superseded", "first.last@example.com", "TestOrg"); recorder.Code != http.StatusNotFound {
+        t.Errorf("Unknown certificates should be 404, got %d", recorder.Code)
+    }
+
+    if mayManage("", "TestOrg", &Certificate{Owner: ""}) {
+        t.Errorf("Tokens without a username should not manage ownerless certificates!")
+    }
+}
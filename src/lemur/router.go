@@ -19,6 +19,7 @@ func NewRouter() *mux.Router {
 
         handler = route.Handler
         handler = HTTPLogger(handler, route.Name)
+        handler = RequestID(handler)
 
         router.
             Methods(route.Method).
@@ -32,6 +33,7 @@ func NewRouter() *mux.Router {
 
         handler = route.HandlerFunc
         handler = HTTPLogger(handler, route.Name)
+        handler = RequestID(handler)
 
         router.
             Methods(route.Method).
@@ -56,6 +58,7 @@ func NewAdminRouter() *mux.Router {
 
         handler = route.HandlerFunc
         handler = HTTPLogger(handler, route.Name)
+        handler = RequestID(handler)
 
         router.
             Methods(route.Method).
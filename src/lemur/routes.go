@@ -43,6 +43,7 @@ func (t *templateHandler) ServeHTTP(w http.ResponseWriter, r*http.Request) {
     })
     data := map[string]interface{}{
         "Host": r.Host,
+        "LoginName": LoginName(),
     }
     t.templ.Execute(w, data)
 }
@@ -53,6 +54,12 @@ var handlRoutes = HandlRoutes{
         "Certs",
         "GET",
         "/certs",
+        MustAuth(&templateHandler{filename: "certs.html"}),
+    },
+    HandlRoute{
+        "CreateCert",
+        "GET",
+        "/certs/new",
         MustAuth(&templateHandler{filename: "create_cert.html"}),
     },
     HandlRoute{
@@ -81,18 +88,84 @@ var funcRoutes = FuncRoutes{
         "/v1/_saml_callback",
         AssertionHandler,
     },
+    FuncRoute{
+        "OIDCCallback",
+        "GET",
+        "/v1/_oidc_callback",
+        OIDCCallbackHandler,
+    },
     FuncRoute{
         "CreateCertificates",
         "POST",
         "/v1/createcert",
         TokenAuth(CreateCertHandler).(http.HandlerFunc),
     },
-//    FuncRoute{
-//        "AuthToken",
-//        "POST",
-//        "/v1/auth/login",
-//        GetTokenHandler,
-//    },
+    FuncRoute{
+        "ListAuthorities",
+        "GET",
+        "/v1/authorities",
+        TokenAuth(ListAuthoritiesHandler).(http.HandlerFunc),
+    },
+    FuncRoute{
+        "ListProfiles",
+        "GET",
+        "/v1/profiles",
+        TokenAuth(ListProfilesHandler).(http.HandlerFunc),
+    },
+    FuncRoute{
+        "ListDestinations",
+        "GET",
+        "/v1/destinations",
+        TokenAuth(ListDestinationsHandler).(http.HandlerFunc),
+    },
+    FuncRoute{
+        "ListCertificates",
+        "GET",
+        "/v1/certs",
+        TokenAuth(ListCertsHandler).(http.HandlerFunc),
+    },
+    FuncRoute{
+        "RevokeCertificate",
+        "POST",
+        "/v1/certs/{id:[0-9]+}/revoke",
+        TokenAuth(RevokeCertHandler).(http.HandlerFunc),
+    },
+    FuncRoute{
+        "CertificateBundle",
+        "GET",
+        "/v1/certs/{id:[0-9]+}/bundle",
+        TokenAuth(CertBundleHandler).(http.HandlerFunc),
+    },
+    FuncRoute{
+        "AuthToken",
+        "POST",
+        "/v1/auth/login",
+        GetTokenHandler,
+    },
+    FuncRoute{
+        "VerifyFactor",
+        "POST",
+        "/v1/auth/login/factors/{factorId:[A-Za-z0-9]+}/verify",
+        VerifyFactorHandler,
+    },
+    FuncRoute{
+        "Logout",
+        "POST",
+        "/v1/auth/logout",
+        LogoutHandler,
+    },
+    FuncRoute{
+        "Refresh",
+        "POST",
+        "/v1/auth/refresh",
+        RefreshHandler,
+    },
+    FuncRoute{
+        "JWKS",
+        "GET",
+        "/.well-known/jwks.json",
+        JWKSHandler,
+    },
     FuncRoute{
         "ValidateToken",
         "GET",
@@ -113,4 +186,22 @@ var adminRoutes = AdminRoutes{
         "/healthcheck",
         HealthcheckHandler,
     },
+    AdminRoute{
+        "RotateTokenKey",
+        "POST",
+        "/token-keys/rotate",
+        AdminAuth(RotateTokenKeyHandler),
+    },
+    AdminRoute{
+        "RevokeUserTokens",
+        "POST",
+        "/tokens/revoke",
+        AdminAuth(RevokeUserTokensHandler),
+    },
+    AdminRoute{
+        "Inventory",
+        "GET",
+        "/inventory",
+        AdminAuth(InventoryHandler),
+    },
 }
@@ -0,0 +1,383 @@
+package main
+
+import (
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "regexp"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    "github.com/russellhaering/gosaml2"
+    "github.com/russellhaering/gosaml2/types"
+    "github.com/russellhaering/goxmldsig"
+)
+
+// Defaults for the saml section of config.yaml
+const (
+    DefaultSAMLMetadataRefresh   = "1h"
+    DefaultSAMLUsernameAttribute = "username"
+    DefaultSAMLGroupAttribute    = "rbac"
+    DefaultSAMLDisplayName       = "Single sign-on"
+)
+
+// samlRetryBackoff is how long to wait before retrying metadata that could
+// not be loaded. It doubles on each failure, up to the refresh interval.
+const samlRetryBackoff = 5 * time.Second
+
+// SAML bindings for the IdP's single sign-on service. We send users with a
+// redirect, and take a POST binding only if that is all the IdP offers.
+const (
+    samlBindingRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+    samlBindingPost     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+)
+
+const samlNameIdFormatUnspecified = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+
+var ErrSAMLMetadataNotLoaded = errors.New("The identity provider's metadata has not been loaded yet")
+var ErrSAMLMetadataInsecure = errors.New("idp_metadata must be an https URL or a file, not http")
+var ErrNoSAMLGroup = errors.New("No group found in the assertion for the rbac claim")
+
+// SAMLConfig is the saml section of config.yaml. idp_metadata, a URL or a
+// file, is re-read every MetadataRefresh so that a change of IdP signing
+// certificate needs no restart. Each copy that loads is written to
+// MetadataCache, which is used when the IdP cannot be reached at startup.
+// UsernameAttribute and GroupAttribute name the assertion attributes that
+// become the app token's username and rbac claims; without a username
+// attribute the NameID is used. With several groups the first in the
+// assertion matching GroupFilter is used.
+type SAMLConfig struct {
+    MetadataCache     string `yaml:"metadata_cache"`
+    MetadataRefresh   string `yaml:"metadata_refresh"`
+    UsernameAttribute string `yaml:"username_attribute"`
+    GroupAttribute    string `yaml:"group_attribute"`
+    GroupFilter       string `yaml:"group_filter"`
+    DisplayName       string `yaml:"display_name"`
+}
+
+// ApplyDefaults fills in defaults for anything unset
+func (c *SAMLConfig) ApplyDefaults() {
+    if c.MetadataRefresh == "" {
+        c.MetadataRefresh = DefaultSAMLMetadataRefresh
+    }
+    if c.UsernameAttribute == "" {
+        c.UsernameAttribute = DefaultSAMLUsernameAttribute
+    }
+    if c.GroupAttribute == "" {
+        c.GroupAttribute = DefaultSAMLGroupAttribute
+    }
+    if c.DisplayName == "" {
+        c.DisplayName = DefaultSAMLDisplayName
+    }
+}
+
+// Validate makes sure the SAML config is usable
+func (c *SAMLConfig) Validate() error {
+    if duration, err := time.ParseDuration(c.MetadataRefresh); err != nil || duration <= 0 {
+        return fmt.Errorf("Lemur-client config: saml.metadata_refresh '%s' is not a positive duration", c.MetadataRefresh)
+    }
+    if _, err := regexp.Compile(c.GroupFilter); err != nil {
+        return fmt.Errorf("Lemur-client config: saml.group_filter: %v", err)
+    }
+    return nil
+}
+
+// RefreshDuration returns how often the metadata is re-read
+func (c *SAMLConfig) RefreshDuration() time.Duration {
+    return durationOr(c.MetadataRefresh, DefaultSAMLMetadataRefresh)
+}
+
+// samlEntity is the part of an IdP's metadata we use. Unlike the gosaml2
+// type it keeps the entityID and every single sign-on binding.
+type samlEntity struct {
+    XMLName          xml.Name
+    EntityID         string `xml:"entityID,attr"`
+    IDPSSODescriptor *struct {
+        KeyDescriptors       []types.KeyDescriptor       `xml:"KeyDescriptor"`
+        SingleSignOnServices []types.SingleSignOnService `xml:"SingleSignOnService"`
+    } `xml:"IDPSSODescriptor"`
+    Entities []samlEntity `xml:"EntityDescriptor"`
+}
+
+// samlIdentityProvider is what one copy of the metadata says about the IdP
+type samlIdentityProvider struct {
+    EntityID     string
+    SSOURL       string
+    Certificates []*x509.Certificate
+}
+
+// parseSAMLMetadata reads an EntityDescriptor, or an EntitiesDescriptor
+// holding the IdP's, and picks out its single sign-on URL and signing
+// certificates. issuer picks the entity when there are several; if it is
+// empty the first IdP is used.
+func parseSAMLMetadata(data []byte, issuer string) (*samlIdentityProvider, error) {
+    root := samlEntity{}
+    if err := xml.Unmarshal(data, &root); err != nil {
+        return nil, fmt.Errorf("Unable to parse IdP metadata: %v", err)
+    }
+    entities := []samlEntity{root}
+    if root.XMLName.Local == "EntitiesDescriptor" {
+        entities = root.Entities
+    }
+    var entity *samlEntity
+    for i := range entities {
+        if entities[i].IDPSSODescriptor != nil && (issuer == "" || entities[i].EntityID == issuer) {
+            entity = &entities[i]
+            break
+        }
+    }
+    if entity == nil {
+        return nil, fmt.Errorf("IdP metadata has no IdP with entityID '%s'", issuer)
+    }
+    idp := &samlIdentityProvider{EntityID: entity.EntityID}
+    for _, binding := range []string{samlBindingRedirect, samlBindingPost} {
+        for _, service := range entity.IDPSSODescriptor.SingleSignOnServices {
+            if idp.SSOURL == "" && service.Binding == binding {
+                idp.SSOURL = service.Location
+            }
+        }
+    }
+    if idp.SSOURL == "" {
+        return nil, errors.New("IdP metadata has no HTTP-Redirect or HTTP-POST single sign-on service")
+    }
+    for _, key := range entity.IDPSSODescriptor.KeyDescriptors {
+        if key.Use != "" && key.Use != "signing" {
+            continue
+        }
+        // Base64 in XML is often wrapped
+        encoded := strings.Join(strings.Fields(key.KeyInfo.X509Data.X509Certificate.Data), "")
+        der, err := base64.StdEncoding.DecodeString(encoded)
+        if err != nil {
+            return nil, fmt.Errorf("IdP metadata has a malformed certificate: %v", err)
+        }
+        certificate, err := x509.ParseCertificate(der)
+        if err != nil {
+            return nil, fmt.Errorf("IdP metadata has a malformed certificate: %v", err)
+        }
+        idp.Certificates = append(idp.Certificates, certificate)
+    }
+    if len(idp.Certificates) == 0 {
+        return nil, errors.New("IdP metadata has no signing certificate")
+    }
+    return idp, nil
+}
+
+// fingerprints identifies the IdP's certificates, to log when they change
+func (idp *samlIdentityProvider) fingerprints() string {
+    prints := []string{}
+    for _, certificate := range idp.Certificates {
+        sum := sha256.Sum256(certificate.Raw)
+        prints = append(prints, hex.EncodeToString(sum[:8]))
+    }
+    sort.Strings(prints)
+    return strings.Join(prints, ",")
+}
+
+// samlProvider logs users in through any SAML 2.0 IdP. The IdP's metadata
+// is loaded from idp_metadata, falling back to saml.metadata_cache, and
+// re-read on a schedule: the service provider is rebuilt from each copy
+// that loads, so rolled over signing certificates are trusted as soon as
+// the IdP publishes them and dropped once it stops. Until some copy has
+// loaded, logins fail rather than the service.
+type samlProvider struct {
+    Config    *InstanceConfig
+    client    *http.Client
+    mu        sync.RWMutex
+    sp        *saml2.SAMLServiceProvider
+    idp       *samlIdentityProvider
+    refreshed time.Time
+    lastError error
+}
+
+var SAMLProvider *samlProvider
+
+// samlMetadataClient fetches idp_metadata URLs
+var samlMetadataClient = &http.Client{Timeout: time.Second * 30}
+
+// NewSAMLProvider loads the IdP metadata, from the cache if the IdP cannot
+// be reached. Failing both it still returns the provider, which Run keeps
+// retrying.
+func NewSAMLProvider(config *InstanceConfig) *samlProvider {
+    p := &samlProvider{Config: config, client: samlMetadataClient}
+    if err := p.Refresh(); err != nil {
+        Logs.Errorf("Unable to load IdP metadata from %s: %+v", config.IdpMetadata, err)
+        if err := p.loadCache(); err != nil {
+            Logs.Errorf("Unable to load cached IdP metadata: %+v", err)
+        }
+    }
+    return p
+}
+
+// fetch reads idp_metadata, an https URL or a file. The metadata carries
+// the certificates assertions are checked against, so it is never read over
+// plain http.
+func (p *samlProvider) fetch() ([]byte, error) {
+    source := p.Config.IdpMetadata
+    if strings.HasPrefix(source, "http://") {
+        return nil, ErrSAMLMetadataInsecure
+    }
+    if !strings.HasPrefix(source, "https://") {
+        return ioutil.ReadFile(source)
+    }
+    response, err := p.client.Get(source)
+    if err != nil {
+        return nil, err
+    }
+    defer response.Body.Close()
+    if response.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("%s answered %d", source, response.StatusCode)
+    }
+    return ioutil.ReadAll(response.Body)
+}
+
+// use builds a service provider from a copy of the metadata and swaps it in
+func (p *samlProvider) use(data []byte, from string) error {
+    idp, err := parseSAMLMetadata(data, p.Config.IdpIssuer)
+    if err != nil {
+        return err
+    }
+    issuer := p.Config.IdpIssuer
+    if issuer == "" {
+        issuer = idp.EntityID
+    }
+    sp := &saml2.SAMLServiceProvider{
+        IdentityProviderSSOURL:      idp.SSOURL,
+        IdentityProviderIssuer:      issuer,
+        ServiceProviderIssuer:       p.Config.AudienceURI,
+        AssertionConsumerServiceURL: p.Config.SamlCallback,
+        AudienceURI:                 p.Config.AudienceURI,
+        NameIdFormat:                samlNameIdFormatUnspecified,
+        // The NameID stands in for a missing username attribute
+        AllowMissingAttributes:      true,
+        IDPCertificateStore:         &dsig.MemoryX509CertificateStore{Roots: idp.Certificates},
+        // We have no key the IdP knows, so AuthnRequests go unsigned
+        SPKeyStore:                  dsig.RandomKeyStoreForTest(),
+    }
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.idp == nil || p.idp.fingerprints() != idp.fingerprints() {
+        Logs.Infof("Trusting IdP %s signing certificates %s from %s", idp.EntityID, idp.fingerprints(), from)
+    }
+    p.sp, p.idp, p.refreshed = sp, idp, time.Now()
+    return nil
+}
+
+// Refresh re-reads the metadata. If it cannot be read or does not parse,
+// the metadata already loaded stays in use; otherwise it replaces it and is
+// written to the cache.
+func (p *samlProvider) Refresh() error {
+    data, err := p.fetch()
+    if err == nil {
+        err = p.use(data, p.Config.IdpMetadata)
+    }
+    p.mu.Lock()
+    p.lastError = err
+    p.mu.Unlock()
+    if err != nil {
+        return err
+    }
+    if cache := p.Config.SAML.MetadataCache; cache != "" {
+        if err := (&watchedFile{path: cache}).Write(data, newTokenId()); err != nil {
+            Logs.Warningf("Unable to write saml.metadata_cache: %+v", err)
+        }
+    }
+    return nil
+}
+
+// loadCache loads the metadata last written to the cache
+func (p *samlProvider) loadCache() error {
+    cache := p.Config.SAML.MetadataCache
+    if cache == "" {
+        return errors.New("saml.metadata_cache is not set")
+    }
+    data, err := ioutil.ReadFile(cache)
+    if err != nil {
+        return err
+    }
+    return p.use(data, cache)
+}
+
+// Run refreshes the metadata every saml.metadata_refresh until stop is
+// closed. While no metadata has loaded it retries sooner, backing off.
+func (p *samlProvider) Run(stop <-chan struct{}) {
+    interval := p.Config.SAML.RefreshDuration()
+    backoff := samlRetryBackoff
+    for {
+        wait := interval
+        if _, err := p.ServiceProvider(); err != nil {
+            wait, backoff = backoff, backoff * 2
+            if backoff > interval {
+                backoff = interval
+            }
+        }
+        select {
+        case <-stop:
+            return
+        case <-time.After(wait):
+        }
+        if err := p.Refresh(); err != nil {
+            LemurHttpStatsd.Incr("saml.metadata.failed", nil, 1)
+            Logs.Errorf("Unable to refresh IdP metadata from %s: %+v", p.Config.IdpMetadata, err)
+        } else {
+            backoff = samlRetryBackoff
+        }
+    }
+}
+
+// ServiceProvider returns the service provider built from the latest
+// metadata
+func (p *samlProvider) ServiceProvider() (*saml2.SAMLServiceProvider, error) {
+    if p == nil {
+        return nil, ErrSAMLMetadataNotLoaded
+    }
+    p.mu.RLock()
+    defer p.mu.RUnlock()
+    if p.sp == nil {
+        return nil, ErrSAMLMetadataNotLoaded
+    }
+    return p.sp, nil
+}
+
+// Status describes the metadata in use, for the health check
+func (p *samlProvider) Status() map[string]interface{} {
+    p.mu.RLock()
+    defer p.mu.RUnlock()
+    status := map[string]interface{}{"loaded": p.sp != nil}
+    if p.idp != nil {
+        status["entity_id"] = p.idp.EntityID
+        status["certificates"] = p.idp.fingerprints()
+        status["refreshed"] = p.refreshed.UTC().Format(time.RFC3339)
+    }
+    if p.lastError != nil {
+        status["error"] = p.lastError.Error()
+    }
+    return status
+}
+
+// Identity reads the username and the group for the rbac claim from an
+// assertion. The group attribute may have several values; the first in
+// the IdP's order matching the filter is used.
+// Returns the username, the group and an error
+func (p *samlProvider) Identity(assertion *saml2.AssertionInfo) (string, string, error) {
+    username := assertion.Values.Get(p.Config.SAML.UsernameAttribute)
+    if username == "" {
+        username = assertion.NameID
+    }
+    if username == "" {
+        return "", "", fmt.Errorf("Assertion has no '%s' attribute or NameID", p.Config.SAML.UsernameAttribute)
+    }
+    filter := regexp.MustCompile(p.Config.SAML.GroupFilter)
+    for _, value := range assertion.Values[p.Config.SAML.GroupAttribute].Values {
+        if value.Value != "" && filter.MatchString(value.Value) {
+            return username, value.Value, nil
+        }
+    }
+    return username, "", ErrNoSAMLGroup
+}
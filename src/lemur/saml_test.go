@@ -0,0 +1,325 @@
+package main
+
+import (
+    "encoding/base64"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+    "github.com/beevik/etree"
+    "github.com/russellhaering/goxmldsig"
+)
+
+const (
+    testSAMLEntityId = "http://www.okta.com/exk1"
+    testSAMLCallback = "https://lemurclient.example.com/v1/_saml_callback"
+    testSAMLAudience = "https://lemurclient.example.com"
+)
+
+// stubSAMLIdP serves metadata over https publishing the certificates of
+// published, and signs responses with signer. Metadata is fetched with a
+// client trusting the stub until close.
+type stubSAMLIdP struct {
+    server    *httptest.Server
+    published []dsig.X509KeyStore
+    signer    dsig.X509KeyStore
+    broken    bool
+    oldClient *http.Client
+}
+
+func newStubSAMLIdP() *stubSAMLIdP {
+    key := dsig.RandomKeyStoreForTest()
+    idp := &stubSAMLIdP{published: []dsig.X509KeyStore{key}, signer: key, oldClient: samlMetadataClient}
+    idp.server = httptest.NewTLSServer(idp)
+    samlMetadataClient = idp.server.Client()
+    return idp
+}
+
+func (s *stubSAMLIdP) close() {
+    s.server.Close()
+    samlMetadataClient = s.oldClient
+}
+
+func (s *stubSAMLIdP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if s.broken {
+        http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+        return
+    }
+    w.Header().Set("Content-Type", "application/samlmetadata+xml")
+    w.Write([]byte(samlMetadata(testSAMLEntityId, s.published...)))
+}
+
+// samlMetadata describes an IdP signing with the certificates of keys, the
+// way IdPs do: wrapped base64 and both SSO bindings
+func samlMetadata(entityId string, keys ...dsig.X509KeyStore) string {
+    descriptors := ""
+    for _, key := range keys {
+        _, der, _ := key.GetKeyPair()
+        encoded := base64.StdEncoding.EncodeToString(der)
+        wrapped := ""
+        for len(encoded) > 64 {
+            wrapped, encoded = wrapped + encoded[:64] + "\n", encoded[64:]
+        }
+        descriptors += `<md:KeyDescriptor use="signing"><ds:KeyInfo><ds:X509Data><ds:X509Certificate>` +
+                       wrapped + encoded + `</ds:X509Certificate></ds:X509Data></ds:KeyInfo></md:KeyDescriptor>`
+    }
+    return `<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:ds="http://www.w3.org/2000/09/xmldsig#" entityID="` + entityId + `">
+  <md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">` + descriptors + `
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://idp.example.com/sso/post"/>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso/redirect"/>
+  </md:IDPSSODescriptor>
+</md:EntityDescriptor>`
+}
+
+// samlResponse is a signed response for first.last with the given groups,
+// valid from notBefore for an hour
+func (s *stubSAMLIdP) samlResponse(t *testing.T, audience string, notBefore time.Time, groups ...string) string {
+    values := ""
+    for _, group := range groups {
+        values += `<saml:AttributeValue>` + group + `</saml:AttributeValue>`
+    }
+    now := time.Now().UTC().Format(time.RFC3339)
+    response := fmt.Sprintf(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_%s" Version="2.0" IssueInstant="%s" Destination="%s">
+  <saml:Issuer>%s</saml:Issuer>
+  <samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>
+  <saml:Assertion ID="_%s" Version="2.0" IssueInstant="%s">
+    <saml:Issuer>%s</saml:Issuer>
+    <saml:Subject>
+      <saml:NameID>first.last@example.com</saml:NameID>
+      <saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">
+        <saml:SubjectConfirmationData NotOnOrAfter="%s" Recipient="%s"/>
+      </saml:SubjectConfirmation>
+    </saml:Subject>
+    <saml:Conditions NotBefore="%s" NotOnOrAfter="%s">
+      <saml:AudienceRestriction><saml:Audience>%s</saml:Audience></saml:AudienceRestriction>
+    </saml:Conditions>
+    <saml:AttributeStatement><saml:Attribute Name="rbac">%s</saml:Attribute></saml:AttributeStatement>
+  </saml:Assertion>
+</samlp:Response>`, newTokenId(), now, testSAMLCallback, testSAMLEntityId, newTokenId(), now, testSAMLEntityId,
+        time.Now().Add(time.Hour).UTC().Format(time.RFC3339), testSAMLCallback,
+        notBefore.UTC().Format(time.RFC3339), notBefore.Add(time.Hour).UTC().Format(time.RFC3339), audience, values)
+    doc := etree.NewDocument()
+    if err := doc.ReadFromString(response); err != nil {
+        t.Fatal(err)
+    }
+    signed, err := dsig.NewDefaultSigningContext(s.signer).SignEnveloped(doc.Root())
+    if err != nil {
+        t.Fatal(err)
+    }
+    doc.SetRoot(signed)
+    output, _ := doc.WriteToBytes()
+    return base64.StdEncoding.EncodeToString(output)
+}
+
+// postAssertion posts a SAML response to AssertionHandler
+func postAssertion(encoded string) *httptest.ResponseRecorder {
+    form := url.Values{"SAMLResponse": {encoded}}
+    request := httptest.NewRequest("POST", "/v1/_saml_callback", strings.NewReader(form.Encode()))
+    request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    recorder := httptest.NewRecorder()
+    AssertionHandler(recorder, request)
+    return recorder
+}
+
+func testSAMLConfig(metadata, cache string) *InstanceConfig {
+    config := &InstanceConfig{IdpMetadata: metadata,
+                              SamlCallback: testSAMLCallback,
+                              AudienceURI: testSAMLAudience,
+                              SAML: SAMLConfig{MetadataCache: cache, GroupFilter: "^Test"}}
+    config.SAML.ApplyDefaults()
+    return config
+}
+
+func TestSAMLMetadata(t *testing.T) {
+    idp := newStubSAMLIdP()
+    defer idp.close()
+    dir, err := ioutil.TempDir("", "saml")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    cache := filepath.Join(dir, "metadata.xml")
+
+    provider := NewSAMLProvider(testSAMLConfig(idp.server.URL, cache))
+    sp, err := provider.ServiceProvider()
+    if err != nil {
+        t.Fatalf("Metadata should load from a URL, got %v", err)
+    }
+    if sp.IdentityProviderSSOURL != "https://idp.example.com/sso/redirect" || sp.IdentityProviderIssuer != testSAMLEntityId {
+        t.Errorf("The redirect binding and the entityID should be used, got %s %s", sp.IdentityProviderSSOURL, sp.IdentityProviderIssuer)
+    }
+    if sp.AudienceURI != testSAMLAudience {
+        t.Errorf("Assertions should be checked against audience_uri, got %s", sp.AudienceURI)
+    }
+    if cached, err := ioutil.ReadFile(cache); err != nil || !strings.Contains(string(cached), testSAMLEntityId) {
+        t.Errorf("Loaded metadata should be cached, got %v", err)
+    }
+
+    // The IdP is down at startup: the cache stands in
+    idp.broken = true
+    provider = NewSAMLProvider(testSAMLConfig(idp.server.URL, cache))
+    if _, err := provider.ServiceProvider(); err != nil {
+        t.Errorf("Cached metadata should be used when the IdP is down, got %v", err)
+    }
+    if status := provider.Status(); status["loaded"] != true || status["error"] == nil {
+        t.Errorf("The health check should show the failed refresh, got %+v", status)
+    }
+
+    // Neither: no panic, and logins fail until a refresh works
+    provider = NewSAMLProvider(testSAMLConfig(idp.server.URL, filepath.Join(dir, "missing.xml")))
+    if _, err := provider.ServiceProvider(); err != ErrSAMLMetadataNotLoaded {
+        t.Errorf("Without metadata there should be no service provider, got %v", err)
+    }
+    oldProvider := SAMLProvider
+    defer func() { SAMLProvider = oldProvider }()
+    SAMLProvider = provider
+    recorder := httptest.NewRecorder()
+    LoginHandler(recorder, httptest.NewRequest("GET", "/auth/login", nil))
+    if recorder.Code != http.StatusBadGateway {
+        t.Errorf("Logins should fail without metadata, got %d", recorder.Code)
+    }
+    idp.broken = false
+    if err := provider.Refresh(); err != nil {
+        t.Fatalf("Refreshing should load the metadata once the IdP is back, got %v", err)
+    }
+    recorder = httptest.NewRecorder()
+    LoginHandler(recorder, httptest.NewRequest("GET", "/auth/login", nil))
+    location, _ := url.Parse(recorder.Header().Get("Location"))
+    if recorder.Code != http.StatusTemporaryRedirect || location.Host != "idp.example.com" || location.Query().Get("SAMLRequest") == "" {
+        t.Errorf("Logins should send an AuthnRequest to the IdP, got %d %s", recorder.Code, location)
+    }
+
+    // A local file, with the IdP among others in an EntitiesDescriptor
+    other := samlMetadata("https://other.example.com", dsig.RandomKeyStoreForTest())
+    entities := `<md:EntitiesDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata">` +
+                other + samlMetadata(testSAMLEntityId, idp.signer) + `</md:EntitiesDescriptor>`
+    file := filepath.Join(dir, "federation.xml")
+    ioutil.WriteFile(file, []byte(entities), 0644)
+    config := testSAMLConfig(file, "")
+    config.IdpIssuer = testSAMLEntityId
+    sp, err = NewSAMLProvider(config).ServiceProvider()
+    if err != nil || sp.IdentityProviderIssuer != testSAMLEntityId {
+        t.Errorf("idp_issuer should pick the IdP out of a federation's metadata, got %v", err)
+    }
+
+    bad := map[string]string{
+        "not XML": "<md:EntityDescriptor",
+        "no IdP": `<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="x"/>`,
+        "no certificate": samlMetadata(testSAMLEntityId),
+        "no single sign-on service": strings.Replace(samlMetadata(testSAMLEntityId, idp.signer), "SingleSignOnService", "ArtifactResolutionService", -1),
+    }
+    for name, metadata := range bad {
+        if _, err := parseSAMLMetadata([]byte(metadata), ""); err == nil {
+            t.Errorf("Metadata with %s should be refused!", name)
+        }
+    }
+}
+
+func TestSAMLLogin(t *testing.T) {
+    idp := newStubSAMLIdP()
+    defer idp.close()
+    oldProvider, oldSecret := SAMLProvider, secretKey
+    defer func() { SAMLProvider, secretKey = oldProvider, oldSecret }()
+    secretKey = NewTokenSecret()
+    SAMLProvider = NewSAMLProvider(testSAMLConfig(idp.server.URL, ""))
+
+    recorder := postAssertion(idp.samlResponse(t, testSAMLAudience, time.Now().Add(-time.Minute), "Everyone", "TestOrg"))
+    if recorder.Code != http.StatusSeeOther {
+        t.Fatalf("Logging in should succeed, got %d: %s", recorder.Code, recorder.Body.String())
+    }
+    var authCookie string
+    for _, cookie := range (&http.Response{Header: recorder.Header()}).Cookies() {
+        if cookie.Name == "auth" {
+            authCookie = cookie.Value
+        }
+    }
+    claims := secretKey.GetClaims(authCookie)
+    if claims["username"] != "first.last@example.com" || claims["rbac"] != "TestOrg" {
+        t.Errorf("Without a username attribute the NameID should be used, and the group matching saml.group_filter, got %+v", claims)
+    }
+
+    // The IdP's order decides between matching groups, not the names
+    recorder = postAssertion(idp.samlResponse(t, testSAMLAudience, time.Now().Add(-time.Minute), "TestZebra", "TestAardvark"))
+    for _, cookie := range (&http.Response{Header: recorder.Header()}).Cookies() {
+        if cookie.Name == "auth" {
+            authCookie = cookie.Value
+        }
+    }
+    if claims := secretKey.GetClaims(authCookie); claims["rbac"] != "TestZebra" {
+        t.Errorf("The first matching group in the assertion should be used, got %+v", claims)
+    }
+
+    if recorder := postAssertion(idp.samlResponse(t, "123", time.Now().Add(-time.Minute), "TestOrg")); recorder.Code != http.StatusUnauthorized {
+        t.Errorf("Assertions for another audience should be refused, got %d", recorder.Code)
+    }
+    if recorder := postAssertion(idp.samlResponse(t, testSAMLAudience, time.Now().Add(30 * time.Minute), "TestOrg")); recorder.Code != http.StatusUnauthorized {
+        t.Errorf("Assertions not valid yet should be refused, got %d", recorder.Code)
+    }
+    if recorder := postAssertion(idp.samlResponse(t, testSAMLAudience, time.Now().Add(-time.Minute), "Everyone")); recorder.Code != http.StatusForbidden {
+        t.Errorf("Users without a matching group should be refused, got %d", recorder.Code)
+    }
+
+    // The IdP rolls its signing certificate over: first it publishes both
+    rolled := dsig.RandomKeyStoreForTest()
+    idp.published = append(idp.published, rolled)
+    idp.signer = rolled
+    if recorder := postAssertion(idp.samlResponse(t, testSAMLAudience, time.Now().Add(-time.Minute), "TestOrg")); recorder.Code != http.StatusBadRequest {
+        t.Errorf("Assertions signed with an unpublished certificate should be refused, got %d", recorder.Code)
+    }
+    if err := SAMLProvider.Refresh(); err != nil {
+        t.Fatal(err)
+    }
+    if recorder := postAssertion(idp.samlResponse(t, testSAMLAudience, time.Now().Add(-time.Minute), "TestOrg")); recorder.Code != http.StatusSeeOther {
+        t.Errorf("Assertions signed with a rolled over certificate should be accepted after a refresh, got %d", recorder.Code)
+    }
+    // ...then drops the old one
+    old := idp.published[0]
+    idp.published = idp.published[1:]
+    SAMLProvider.Refresh()
+    idp.signer = old
+    if recorder := postAssertion(idp.samlResponse(t, testSAMLAudience, time.Now().Add(-time.Minute), "TestOrg")); recorder.Code != http.StatusBadRequest {
+        t.Errorf("Assertions signed with a retired certificate should be refused, got %d", recorder.Code)
+    }
+
+    // Failed refreshes keep the metadata already loaded
+    idp.signer = rolled
+    idp.broken = true
+    if err := SAMLProvider.Refresh(); err == nil {
+        t.Errorf("Refreshing should fail while the IdP is down!")
+    }
+    if recorder := postAssertion(idp.samlResponse(t, testSAMLAudience, time.Now().Add(-time.Minute), "TestOrg")); recorder.Code != http.StatusSeeOther {
+        t.Errorf("A failed refresh should keep the metadata in use, got %d", recorder.Code)
+    }
+}
+
+func TestSAMLConfig(t *testing.T) {
+    config := &InstanceConfig{}
+    if err := config.ValidateLogin(); err != nil {
+        t.Fatal(err)
+    }
+    if config.SAML.MetadataRefresh != "1h" || config.SAML.UsernameAttribute != "username" || config.SAML.GroupAttribute != "rbac" {
+        t.Errorf("SAML settings should default, got %+v", config.SAML)
+    }
+    config = &InstanceConfig{SAML: SAMLConfig{MetadataRefresh: "never"}}
+    if err := config.ValidateLogin(); err == nil {
+        t.Errorf("saml.metadata_refresh should be a duration!")
+    }
+    config = &InstanceConfig{SAML: SAMLConfig{GroupFilter: "("}}
+    if err := config.ValidateLogin(); err == nil {
+        t.Errorf("saml.group_filter should be a regular expression!")
+    }
+    config = &InstanceConfig{IdpMetadata: "http://idp.example.com/metadata"}
+    if err := config.ValidateLogin(); err == nil {
+        t.Errorf("idp_metadata should not be fetched over plain http!")
+    }
+    provider := &samlProvider{Config: config, client: samlMetadataClient}
+    if _, err := provider.fetch(); err != ErrSAMLMetadataInsecure {
+        t.Errorf("Fetching metadata over plain http should be refused, got %v", err)
+    }
+}
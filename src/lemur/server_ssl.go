@@ -2,6 +2,7 @@ package main
 
 import (
     "crypto/tls"
+    "fmt"
     "sync"
     "time"
     "io/ioutil"
@@ -41,15 +42,13 @@ func NewKeypairReloader(certPath, keyPath string, config *InstanceConfig) (*keyp
         for {
             // Check once per day to see if our certs are OK
             time.Sleep(24 * time.Hour)
-            cert, err := tls.LoadX509KeyPair(certPath, keyPath)
-            if err != nil {
-                Logs.Errorf("Unable to load certificates. It is likely that certificates will never be loaded!")
-                panic(err)
-            }
+            result.certMu.RLock()
+            leaf := result.cert.Leaf
+            result.certMu.RUnlock()
             // Give ourselves a 24 hour window to refresh
             refresh_soon := time.Now().Add(time.Duration(24) * time.Hour)
             // Cert is invalid or will be soon
-            if time.Now().Before(cert.Leaf.NotBefore) || refresh_soon.After(cert.Leaf.NotAfter) {
+            if time.Now().Before(leaf.NotBefore) || refresh_soon.After(leaf.NotAfter) {
                 Logs.Infof("Server certificate is or will soon be out-of-date. Refreshing.")
                 if err := result.maybeReload(); err != nil {
                     Logs.Errorf("Keeping old TLS certificate because the new one could not be loaded: %v", err)
@@ -61,7 +60,9 @@ func NewKeypairReloader(certPath, keyPath string, config *InstanceConfig) (*keyp
 }
 
 // maybeReload requests a new certificate from our builtin broker handler and
-// writes it to disk so the tls library can load it into the web server
+// writes it to disk so the tls library can load it into the web server.
+// ValidateCert has verified the material by then; anything that fails
+// verification leaves the current certificate in place.
 func (kpr *keypairReloader) maybeReload() error {
     // Start every cert at the beginning of the month
     // As of this writing, SSL certs are expected to be generated via Let's
@@ -70,26 +71,49 @@ func (kpr *keypairReloader) maybeReload() error {
     // so reduce requests to once per month.
     start := time.Date(time.Now().Year(), time.Now().Month(), 1, 1, 1, 1, 1, time.UTC)
     end := start.Add(time.Duration(24) * time.Hour * 730) // two years
-    man := NewCertManifest(kpr.config.CertAuthority,
+    profile, err := kpr.config.Profile(kpr.config.ServerProfile)
+    if err != nil {
+        return err
+    }
+    man := profile.NewCertManifest(kpr.config.CertAuthority,
                            kpr.config.CommonName,
                            kpr.config.EmailAddress,
                            start.Format("2006-01-02"),
                            end.Format("2006-01-02"),
                            kpr.config.CertOrg)
-    lemurReq := &LemurRequester{}
-    Logs.Infof("Requesting server certificate from broker.")
-    chainCertKey, err := lemurReq.ValidateCert(man)
+    // One certificate per common name per month, however often we restart.
+    // The idempotency store may only be in memory, so ask Lemur first.
+    monthStart := time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC)
+    chainCertKey, err := LemurClient.FindIssued(man, monthStart)
     if err != nil {
-        LemurCertsStatsd.Incr("errors", nil, 1)
-        Logs.Errorf("Requesting server certificate failed: %+v", err)
-        return err
+        Logs.Warningf("Unable to look up this month's server certificate in Lemur: %+v", err)
     }
-    writeFile(kpr.certPath, chainCertKey.PublicCertificate)
-    writeFile(kpr.keyPath, chainCertKey.PrivateKey)
-    newCert, err := tls.LoadX509KeyPair(kpr.certPath, kpr.keyPath)
+    if chainCertKey != nil {
+        Logs.Infof("Reusing this month's server certificate from Lemur.")
+    } else {
+        idempotencyKey := fmt.Sprintf("server/%s/%s", kpr.config.CommonName, start.Format("2006-01"))
+        Logs.Infof("Requesting server certificate from broker.")
+        chainCertKey, err = LemurClient.ValidateCert(man, idempotencyKey)
+        if err != nil {
+            LemurCertsStatsd.Incr("errors", nil, 1)
+            Logs.Errorf("Requesting server certificate failed: %+v", err)
+            return err
+        }
+    }
+    if chainCertKey.PrivateKey == "" {
+        Logs.Errorf("Server certificate authority %s is listed in lemur.disable_key_fetch", kpr.config.CertAuthority)
+        return ErrNoPrivateKey
+    }
+    if chainCertKey.leaf == nil {
+        return verificationFailed(CheckLeaf, "server certificate was not verified")
+    }
+    newCert, err := tls.X509KeyPair([]byte(chainCertKey.PublicCertificate), []byte(chainCertKey.PrivateKey))
     if err != nil {
         return err
     }
+    newCert.Leaf = chainCertKey.leaf
+    writeFile(kpr.certPath, chainCertKey.PublicCertificate)
+    writeFile(kpr.keyPath, chainCertKey.PrivateKey)
     kpr.certMu.Lock()
     defer kpr.certMu.Unlock()
     kpr.cert = &newCert
@@ -0,0 +1,222 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/pem"
+    "fmt"
+    "math/big"
+    "strings"
+    "time"
+)
+
+// App token signing algorithms. HS256 tokens can only be verified by
+// whoever holds the secret; RS256 and ES256 tokens can be verified by
+// anyone using the public keys published at /.well-known/jwks.json.
+const (
+    TokenAlgHS256 = "HS256"
+    TokenAlgRS256 = "RS256"
+    TokenAlgES256 = "ES256"
+)
+
+var TokenAlgorithms = []string{TokenAlgHS256, TokenAlgRS256, TokenAlgES256}
+
+// DefaultTokenAlgorithm is used for new keys unless tokens.algorithm says
+// otherwise
+const DefaultTokenAlgorithm = TokenAlgES256
+
+// minTokenKeyLength is the shortest HMAC secret accepted, in bytes
+const minTokenKeyLength = 32
+
+// minTokenRSABits is the smallest RSA key accepted
+const minTokenRSABits = 2048
+
+// signingKey is one token key and the id it is known by in token headers.
+// HS256 keys have a base64 Secret; RS256 and ES256 keys a PEM PrivateKey.
+// Keys written before algorithms could be chosen have no Algorithm and are
+// HS256.
+type signingKey struct {
+    Id         string    `json:"kid"`
+    Algorithm  string    `json:"alg,omitempty"`
+    Secret     string    `json:"secret,omitempty"`
+    PrivateKey string    `json:"private_key,omitempty"`
+    Created    time.Time `json:"created"`
+    hmac       []byte
+    private    interface{}
+}
+
+func knownTokenAlgorithm(algorithm string) bool {
+    for _, known := range TokenAlgorithms {
+        if algorithm == known {
+            return true
+        }
+    }
+    return false
+}
+
+// newSigningKey generates a key for algorithm
+func newSigningKey(algorithm string) (*signingKey, error) {
+    id := make([]byte, 8)
+    if _, err := rand.Read(id); err != nil {
+        return nil, err
+    }
+    key := &signingKey{Id: hex.EncodeToString(id), Algorithm: algorithm, Created: time.Now().UTC()}
+    switch algorithm {
+    case TokenAlgHS256:
+        secret := make([]byte, 64)
+        if _, err := rand.Read(secret); err != nil {
+            return nil, err
+        }
+        key.Secret = base64.StdEncoding.EncodeToString(secret)
+    case TokenAlgRS256:
+        private, err := rsa.GenerateKey(rand.Reader, minTokenRSABits)
+        if err != nil {
+            return nil, err
+        }
+        key.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY",
+                                                              Bytes: x509.MarshalPKCS1PrivateKey(private)}))
+    case TokenAlgES256:
+        private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+        if err != nil {
+            return nil, err
+        }
+        der, err := x509.MarshalECPrivateKey(private)
+        if err != nil {
+            return nil, err
+        }
+        key.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+    default:
+        return nil, fmt.Errorf("unknown token algorithm '%s'", algorithm)
+    }
+    return key, key.load()
+}
+
+// parseTokenKeys reads keys in the LEMUR_CLIENT_TOKEN_KEYS format. Each
+// value is base64: either an HMAC secret or a PEM private key.
+func parseTokenKeys(value string) ([]*signingKey, error) {
+    keys := []*signingKey{}
+    for _, pair := range strings.Split(value, ",") {
+        parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+        if len(parts) != 2 || parts[0] == "" {
+            return nil, fmt.Errorf("expected kid=secret, got '%s'", pair)
+        }
+        key := &signingKey{Id: parts[0], Secret: parts[1]}
+        if decoded, err := base64.StdEncoding.DecodeString(parts[1]); err == nil && strings.HasPrefix(string(decoded), "-----BEGIN") {
+            key.Secret, key.PrivateKey = "", string(decoded)
+        }
+        keys = append(keys, key)
+    }
+    return keys, loadTokenKeys(keys)
+}
+
+// loadTokenKeys parses every key, making sure ids are unique
+func loadTokenKeys(keys []*signingKey) error {
+    if len(keys) == 0 {
+        return fmt.Errorf("no keys")
+    }
+    seen := map[string]bool{}
+    for _, key := range keys {
+        if seen[key.Id] {
+            return fmt.Errorf("key id '%s' is used twice", key.Id)
+        }
+        seen[key.Id] = true
+        if err := key.load(); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// load parses the key material and works out the algorithm from it
+func (k *signingKey) load() error {
+    algorithm := TokenAlgHS256
+    if k.PrivateKey != "" {
+        der, err := pkcs8Key(k.PrivateKey)
+        if err != nil {
+            return fmt.Errorf("key '%s': %v", k.Id, err)
+        }
+        private, err := x509.ParsePKCS8PrivateKey(der)
+        if err != nil {
+            return fmt.Errorf("key '%s': %v", k.Id, err)
+        }
+        switch private := private.(type) {
+        case *rsa.PrivateKey:
+            if private.N.BitLen() < minTokenRSABits {
+                return fmt.Errorf("key '%s' must be at least %d bits", k.Id, minTokenRSABits)
+            }
+            algorithm = TokenAlgRS256
+        case *ecdsa.PrivateKey:
+            if private.Curve != elliptic.P256() {
+                return fmt.Errorf("key '%s' must be on curve P-256", k.Id)
+            }
+            algorithm = TokenAlgES256
+        default:
+            return fmt.Errorf("key '%s' is neither RSA nor ECDSA", k.Id)
+        }
+        k.private = private
+    } else {
+        secret, err := base64.StdEncoding.DecodeString(k.Secret)
+        if err != nil || len(secret) < minTokenKeyLength {
+            return fmt.Errorf("key '%s' must be at least %d bytes, base64 encoded", k.Id, minTokenKeyLength)
+        }
+        k.hmac = secret
+    }
+    if k.Algorithm != "" && k.Algorithm != algorithm {
+        return fmt.Errorf("key '%s' is marked %s but is a %s key", k.Id, k.Algorithm, algorithm)
+    }
+    k.Algorithm = algorithm
+    return nil
+}
+
+// signKey is what jwt-go signs with for this key
+func (k *signingKey) signKey() interface{} {
+    if k.private != nil {
+        return k.private
+    }
+    return k.hmac
+}
+
+// verifyKey is what jwt-go verifies with for this key
+func (k *signingKey) verifyKey() interface{} {
+    switch private := k.private.(type) {
+    case *rsa.PrivateKey:
+        return &private.PublicKey
+    case *ecdsa.PrivateKey:
+        return &private.PublicKey
+    }
+    return k.hmac
+}
+
+// JWK describes the public half of the key as a JSON Web Key, or returns
+// nil for HMAC keys, which have no public half
+func (k *signingKey) JWK() map[string]interface{} {
+    jwk := map[string]interface{}{"kid": k.Id, "alg": k.Algorithm, "use": "sig"}
+    switch private := k.private.(type) {
+    case *rsa.PrivateKey:
+        jwk["kty"] = "RSA"
+        jwk["n"] = base64.RawURLEncoding.EncodeToString(private.N.Bytes())
+        jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(private.E)).Bytes())
+    case *ecdsa.PrivateKey:
+        jwk["kty"] = "EC"
+        jwk["crv"] = "P-256"
+        jwk["x"] = base64.RawURLEncoding.EncodeToString(padCoordinate(private.X))
+        jwk["y"] = base64.RawURLEncoding.EncodeToString(padCoordinate(private.Y))
+    default:
+        return nil
+    }
+    return jwk
+}
+
+// padCoordinate writes a P-256 coordinate at its full 32 bytes, as JWKs
+// require
+func padCoordinate(n *big.Int) []byte {
+    bytes := n.Bytes()
+    padded := make([]byte, 32)
+    copy(padded[32 - len(bytes):], bytes)
+    return padded
+}
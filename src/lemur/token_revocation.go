@@ -0,0 +1,142 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// userRevocationTTL is how long revoking a user's tokens is remembered.
+// Tokens issued before the revocation have expired long before then.
+const userRevocationTTL = 24 * time.Hour
+
+// TokenRevocations lists app tokens that must no longer be accepted though
+// they have not expired: single tokens by jti, after a logout, and every
+// token issued to a user before a given time. With a path the list is kept
+// in a JSON file that replicas share and re-read when it changes; without
+// one it is only kept in memory.
+type TokenRevocations struct {
+    mu     sync.Mutex
+    file   *watchedFile
+    Tokens map[string]time.Time `json:"tokens"`
+    Users  map[string]time.Time `json:"users"`
+}
+
+// NewTokenRevocations opens the revocation list at path, which may be ""
+func NewTokenRevocations(path string) (*TokenRevocations, error) {
+    revocations := &TokenRevocations{Tokens: map[string]time.Time{}, Users: map[string]time.Time{}}
+    if path == "" {
+        return revocations, nil
+    }
+    revocations.file = &watchedFile{path: path}
+    if _, err := os.Stat(path); os.IsNotExist(err) {
+        return revocations, nil
+    }
+    if err := revocations.reload(); err != nil {
+        return nil, err
+    }
+    return revocations, nil
+}
+
+// reload re-reads the file if another replica changed it. The caller must
+// hold the lock.
+func (l *TokenRevocations) reload() error {
+    if l.file == nil {
+        return nil
+    }
+    if changed, err := l.file.Changed(); os.IsNotExist(err) || (err == nil && !changed) {
+        return nil
+    } else if err != nil {
+        return fmt.Errorf("Unable to read tokens.revocation_file: %v", err)
+    }
+    data, err := l.file.Read()
+    if err != nil {
+        return fmt.Errorf("Unable to read tokens.revocation_file: %v", err)
+    }
+    var file struct {
+        Tokens map[string]time.Time `json:"tokens"`
+        Users  map[string]time.Time `json:"users"`
+    }
+    if err := json.Unmarshal(data, &file); err != nil {
+        return fmt.Errorf("Unable to parse tokens.revocation_file: %v", err)
+    }
+    if file.Tokens == nil {
+        file.Tokens = map[string]time.Time{}
+    }
+    if file.Users == nil {
+        file.Users = map[string]time.Time{}
+    }
+    l.Tokens, l.Users = file.Tokens, file.Users
+    return nil
+}
+
+// update applies change to the latest list and writes it back, dropping
+// entries that no longer matter. Two replicas updating the file in the same
+// instant can still lose one of the updates.
+func (l *TokenRevocations) update(change func()) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if err := l.reload(); err != nil {
+        return err
+    }
+    change()
+    now := time.Now()
+    for jti, expiry := range l.Tokens {
+        if now.After(expiry) {
+            delete(l.Tokens, jti)
+        }
+    }
+    for user, revoked := range l.Users {
+        if now.Sub(revoked) > userRevocationTTL {
+            delete(l.Users, user)
+        }
+    }
+    if l.file == nil {
+        return nil
+    }
+    data, err := json.Marshal(l)
+    if err != nil {
+        return err
+    }
+    if err := l.file.Write(data, newTokenId()); err != nil {
+        return fmt.Errorf("Unable to write tokens.revocation_file: %v", err)
+    }
+    return nil
+}
+
+// RevokeToken stops the token with the given jti being accepted. It is
+// remembered until the token would have expired anyway.
+func (l *TokenRevocations) RevokeToken(jti string, expiry time.Time) error {
+    return l.update(func() { l.Tokens[jti] = expiry })
+}
+
+// RevokeUser stops every token issued to username so far being accepted
+// Returns the time from which tokens are accepted again and an error
+func (l *TokenRevocations) RevokeUser(username string) (time.Time, error) {
+    // Tokens carry whole seconds, so a token issued in this second is
+    // revoked too
+    revoked := time.Now().Truncate(time.Second).Add(time.Second)
+    return revoked, l.update(func() { l.Users[strings.ToLower(username)] = revoked })
+}
+
+// Revoked reports whether a token with the given jti, issued to username at
+// issued, has been revoked
+func (l *TokenRevocations) Revoked(jti, username string, issued time.Time) bool {
+    if l == nil {
+        return false
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if err := l.reload(); err != nil {
+        // Keep using the list we have rather than locking everyone out
+        Logs.Errorf("%+v", err)
+    }
+    if _, ok := l.Tokens[jti]; ok {
+        return true
+    }
+    revoked, ok := l.Users[strings.ToLower(username)]
+    return ok && issued.Before(revoked)
+}
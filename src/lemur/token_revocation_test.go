@@ -0,0 +1,123 @@
+package main
+
+import (
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestTokenRevocations(t *testing.T) {
+    dir, err := ioutil.TempDir("", "revocations")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "revoked.json")
+    revocations, err := NewTokenRevocations(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // A second replica sharing the file
+    replica, err := NewTokenRevocations(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    now := time.Now()
+    if err := revocations.RevokeToken("old", now.Add(-time.Minute)); err != nil {
+        t.Fatal(err)
+    }
+    if err := revocations.RevokeToken("current", now.Add(time.Hour)); err != nil {
+        t.Fatal(err)
+    }
+    if !replica.Revoked("current", "someone", now) {
+        t.Errorf("Replicas should see each other's revocations!")
+    }
+    if _, ok := replica.Tokens["old"]; ok {
+        t.Errorf("Revocations of expired tokens should be dropped!")
+    }
+    if _, err := replica.RevokeUser("First.Last@example.com"); err != nil {
+        t.Fatal(err)
+    }
+    if !revocations.Revoked("other", "first.last@example.com", now) {
+        t.Errorf("Tokens issued to a revoked user should be revoked, ignoring case!")
+    }
+    if revocations.Revoked("other", "first.last@example.com", now.Add(2 * time.Second)) {
+        t.Errorf("Tokens issued after a user was revoked should be accepted!")
+    }
+    reopened, err := NewTokenRevocations(path)
+    if err != nil || !reopened.Revoked("current", "", now) {
+        t.Errorf("Revocations should survive a restart: %v", err)
+    }
+}
+
+func TestLogout(t *testing.T) {
+    oldSecret := secretKey
+    defer func() { secretKey = oldSecret }()
+    secretKey = NewTokenSecret()
+    token, _ := secretKey.MakeToken("first.last@example.com", "TestOrg")
+    tokenString := token.(map[string]string)["token"]
+
+    request := httptest.NewRequest("POST", "/v1/auth/logout", nil)
+    request.AddCookie(&http.Cookie{Name: "auth", Value: tokenString})
+    recorder := httptest.NewRecorder()
+    LogoutHandler(recorder, request)
+    if recorder.Code != http.StatusNoContent {
+        t.Errorf("Logging out should succeed, got %d", recorder.Code)
+    }
+    if cookie := recorder.Header().Get("Set-Cookie"); !strings.HasPrefix(cookie, "auth=;") {
+        t.Errorf("Logging out should clear the auth cookie, got %q", cookie)
+    }
+    if _, err := secretKey.ValidateToken(tokenString); err == nil {
+        t.Errorf("Tokens should not validate after logging out!")
+    }
+    other, _ := secretKey.MakeToken("first.last@example.com", "TestOrg")
+    if _, err := secretKey.ValidateToken(other.(map[string]string)["token"]); err != nil {
+        t.Errorf("Logging out should only revoke the one token: %v", err)
+    }
+
+    oldFlags := Flags
+    defer func() { Flags = oldFlags }()
+    admin, _ := adminTokens()
+    body := "{\"username\": \"first.last@example.com\"}"
+    if recorder := adminRequest("POST", "/tokens/revoke", strings.NewReader(body), tokenString); recorder.Code != http.StatusUnauthorized {
+        t.Errorf("Revoking a user's tokens should need a valid token, got %d", recorder.Code)
+    }
+    if recorder := adminRequest("POST", "/tokens/revoke", strings.NewReader(body), other.(map[string]string)["token"]); recorder.Code != http.StatusForbidden {
+        t.Errorf("Revoking a user's tokens should be refused outside admin_groups, got %d", recorder.Code)
+    }
+    if _, err := secretKey.ValidateToken(other.(map[string]string)["token"]); err != nil {
+        t.Errorf("Refused revocations should not revoke anything: %v", err)
+    }
+    recorder = adminRequest("POST", "/tokens/revoke", strings.NewReader(body), admin)
+    if recorder.Code != http.StatusOK {
+        t.Errorf("Revoking a user's tokens should succeed, got %d", recorder.Code)
+    }
+    if _, err := secretKey.ValidateToken(other.(map[string]string)["token"]); err == nil {
+        t.Errorf("Tokens issued to a revoked user should not validate!")
+    }
+
+    // With only the refresh cookie left, logging out still ends the session
+    session, _ := secretKey.StartSession("someone.else@example.com", "TestOrg")
+    sid := secretKey.GetClaims(session["token"])["sid"].(string)
+    request = httptest.NewRequest("POST", "/v1/auth/logout", nil)
+    request.AddCookie(&http.Cookie{Name: refreshCookie, Value: sid + ".forged"})
+    LogoutHandler(httptest.NewRecorder(), request)
+    if _, err := secretKey.ValidateToken(session["token"]); err != nil {
+        t.Errorf("Logging out with a forged refresh token should not end the session: %v", err)
+    }
+    request = httptest.NewRequest("POST", "/v1/auth/logout", nil)
+    request.AddCookie(&http.Cookie{Name: refreshCookie, Value: session["refresh_token"]})
+    recorder = httptest.NewRecorder()
+    LogoutHandler(recorder, request)
+    if _, err := secretKey.RefreshSession(session["refresh_token"]); err == nil {
+        t.Errorf("Sessions should not refresh after logging out!")
+    }
+    if _, err := secretKey.ValidateToken(session["token"]); err == nil {
+        t.Errorf("Session tokens should not validate after logging out!")
+    }
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+var ErrRefreshTokenInvalid = errors.New("Invalid refresh token")
+var ErrRefreshTokenReused = errors.New("Refresh token was already used; the session has been ended")
+var ErrSessionExpired = errors.New("Session has expired")
+
+// refreshReuseGrace is how long after a refresh the refresh token it spent
+// may still be presented, by requests that raced to refresh the same
+// session, without being taken for a leaked token
+const refreshReuseGrace = 10 * time.Second
+
+// tokenSession is a login that app tokens can be refreshed under. Only
+// hashes of refresh tokens are kept: those that may be refreshed now, and
+// those the last refresh spent, which mean the token leaked if presented
+// again after the grace period.
+type tokenSession struct {
+    Username       string    `json:"username"`
+    Rbac           string    `json:"rbac"`
+    RefreshHashes  []string  `json:"refreshHashes"`
+    PreviousHashes []string  `json:"previousHashes,omitempty"`
+    Created        time.Time `json:"created"`
+    Refreshed      time.Time `json:"refreshed"`
+}
+
+// Ends is when the session expires unless it is refreshed first
+func (s *tokenSession) Ends(idle, absolute time.Duration) time.Time {
+    ends := s.Refreshed.Add(idle)
+    if limit := s.Created.Add(absolute); limit.Before(ends) {
+        return limit
+    }
+    return ends
+}
+
+// TokenSessions tracks the sessions refresh tokens belong to. A session
+// expires once it goes unrefreshed for the idle timeout, and regardless
+// after the absolute timeout. With a path the sessions are kept in a JSON
+// file that replicas share and re-read when it changes; without one they
+// are only kept in memory.
+type TokenSessions struct {
+    mu       sync.Mutex
+    file     *watchedFile
+    idle     time.Duration
+    absolute time.Duration
+    Sessions map[string]*tokenSession `json:"sessions"`
+}
+
+// NewTokenSessions opens the sessions at path, which may be ""
+func NewTokenSessions(path string, idle, absolute time.Duration) (*TokenSessions, error) {
+    sessions := &TokenSessions{idle: idle, absolute: absolute, Sessions: map[string]*tokenSession{}}
+    if path == "" {
+        return sessions, nil
+    }
+    sessions.file = &watchedFile{path: path}
+    if _, err := os.Stat(path); os.IsNotExist(err) {
+        return sessions, nil
+    }
+    if err := sessions.reload(); err != nil {
+        return nil, err
+    }
+    return sessions, nil
+}
+
+// reload re-reads the file if another replica changed it. The caller must
+// hold the lock.
+func (s *TokenSessions) reload() error {
+    if s.file == nil {
+        return nil
+    }
+    if changed, err := s.file.Changed(); os.IsNotExist(err) || (err == nil && !changed) {
+        return nil
+    } else if err != nil {
+        return fmt.Errorf("Unable to read tokens.session_file: %v", err)
+    }
+    data, err := s.file.Read()
+    if err != nil {
+        return fmt.Errorf("Unable to read tokens.session_file: %v", err)
+    }
+    var file struct {
+        Sessions map[string]*tokenSession `json:"sessions"`
+    }
+    if err := json.Unmarshal(data, &file); err != nil {
+        return fmt.Errorf("Unable to parse tokens.session_file: %v", err)
+    }
+    if file.Sessions == nil {
+        file.Sessions = map[string]*tokenSession{}
+    }
+    s.Sessions = file.Sessions
+    return nil
+}
+
+// update applies change to the latest sessions and writes them back,
+// dropping expired ones. An error from change is returned once the
+// sessions are written, since change may already have ended one. Two
+// replicas updating the file in the same instant can still lose one of the
+// updates.
+func (s *TokenSessions) update(change func(now time.Time) error) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if err := s.reload(); err != nil {
+        return err
+    }
+    now := time.Now()
+    changeErr := change(now)
+    for id, session := range s.Sessions {
+        if now.After(session.Ends(s.idle, s.absolute)) {
+            delete(s.Sessions, id)
+        }
+    }
+    if s.file == nil {
+        return changeErr
+    }
+    data, err := json.Marshal(s)
+    if err != nil {
+        return err
+    }
+    if err := s.file.Write(data, newTokenId()); err != nil {
+        return fmt.Errorf("Unable to write tokens.session_file: %v", err)
+    }
+    return changeErr
+}
+
+// hashRefreshSecret is what is stored in place of a refresh token's secret
+func hashRefreshSecret(secret string) string {
+    sum := sha256.Sum256([]byte(secret))
+    return hex.EncodeToString(sum[:])
+}
+
+// hasHash reports whether hash is one of hashes, in constant time
+func hasHash(hashes []string, hash string) bool {
+    found := 0
+    for _, candidate := range hashes {
+        found |= subtle.ConstantTimeCompare([]byte(candidate), []byte(hash))
+    }
+    return found == 1
+}
+
+// splitRefreshToken splits a refresh token into its session id and the
+// hash of its secret
+func splitRefreshToken(refreshToken string) (string, string, error) {
+    parts := strings.SplitN(refreshToken, ".", 2)
+    if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+        return "", "", ErrRefreshTokenInvalid
+    }
+    return parts[0], hashRefreshSecret(parts[1]), nil
+}
+
+// Start opens a session for username
+// Returns the session id, its first refresh token and an error
+func (s *TokenSessions) Start(username, rbac string) (string, string, error) {
+    id, secret := newTokenId(), newTokenId()
+    err := s.update(func(now time.Time) error {
+        s.Sessions[id] = &tokenSession{Username: username,
+                                       Rbac: rbac,
+                                       RefreshHashes: []string{hashRefreshSecret(secret)},
+                                       Created: now.UTC(),
+                                       Refreshed: now.UTC()}
+        return nil
+    })
+    return id, id + "." + secret, err
+}
+
+// Refresh exchanges a refresh token for the next one. Refresh tokens are
+// single use: presenting one that the last refresh already spent means it
+// has leaked, so the whole session is ended. Requests racing to refresh
+// with the same token within refreshReuseGrace each get a refresh token of
+// their own instead. Any other token, e.g. one guessed from the session id
+// in an app token's sid claim, is merely invalid.
+// Returns the session id, a copy of the session, the new refresh token and
+// an error
+func (s *TokenSessions) Refresh(refreshToken string) (string, tokenSession, string, error) {
+    id, hash, err := splitRefreshToken(refreshToken)
+    if err != nil {
+        return "", tokenSession{}, "", err
+    }
+    next := newTokenId()
+    var refreshed tokenSession
+    err = s.update(func(now time.Time) error {
+        session, ok := s.Sessions[id]
+        if !ok {
+            return ErrRefreshTokenInvalid
+        }
+        if now.After(session.Ends(s.idle, s.absolute)) {
+            return ErrSessionExpired
+        }
+        if hasHash(session.RefreshHashes, hash) {
+            session.PreviousHashes = session.RefreshHashes
+            session.RefreshHashes = []string{hashRefreshSecret(next)}
+            session.Refreshed = now.UTC()
+        } else if hasHash(session.PreviousHashes, hash) {
+            if now.Sub(session.Refreshed) > refreshReuseGrace {
+                delete(s.Sessions, id)
+                return ErrRefreshTokenReused
+            }
+            session.RefreshHashes = append(session.RefreshHashes, hashRefreshSecret(next))
+        } else {
+            return ErrRefreshTokenInvalid
+        }
+        refreshed = *session
+        return nil
+    })
+    if err != nil {
+        return "", tokenSession{}, "", err
+    }
+    return id, refreshed, id + "." + next, nil
+}
+
+// End closes a session, e.g. when a token carrying its id is revoked
+func (s *TokenSessions) End(id string) error {
+    return s.update(func(now time.Time) error {
+        delete(s.Sessions, id)
+        return nil
+    })
+}
+
+// Logout closes the session a refresh token belongs to. The token must be
+// one the session handed out, so knowing the session id is not enough.
+func (s *TokenSessions) Logout(refreshToken string) error {
+    id, hash, err := splitRefreshToken(refreshToken)
+    if err != nil {
+        return err
+    }
+    return s.update(func(now time.Time) error {
+        session, ok := s.Sessions[id]
+        if !ok || !(hasHash(session.RefreshHashes, hash) || hasHash(session.PreviousHashes, hash)) {
+            return ErrRefreshTokenInvalid
+        }
+        delete(s.Sessions, id)
+        return nil
+    })
+}
+
+// EndUser closes every session username has, ignoring case
+func (s *TokenSessions) EndUser(username string) error {
+    return s.update(func(now time.Time) error {
+        for id, session := range s.Sessions {
+            if strings.EqualFold(session.Username, username) {
+                delete(s.Sessions, id)
+            }
+        }
+        return nil
+    })
+}
+
+// Active reports whether the session with the given id is still open.
+// Tokens issued under a session that has ended are no longer accepted.
+func (s *TokenSessions) Active(id string) bool {
+    if s == nil {
+        return false
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if err := s.reload(); err != nil {
+        // Keep using the sessions we have rather than locking everyone out
+        Logs.Errorf("%+v", err)
+    }
+    session, ok := s.Sessions[id]
+    return ok && !time.Now().After(session.Ends(s.idle, s.absolute))
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestTokenSessions(t *testing.T) {
+    dir, err := ioutil.TempDir("", "sessions")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "sessions.json")
+    sessions, err := NewTokenSessions(path, time.Hour, 12 * time.Hour)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // A second replica sharing the file
+    replica, err := NewTokenSessions(path, time.Hour, 12 * time.Hour)
+    if err != nil {
+        t.Fatal(err)
+    }
+    id, first, err := sessions.Start("first.last@example.com", "TestOrg")
+    if err != nil {
+        t.Fatal(err)
+    }
+    refreshedId, session, second, err := replica.Refresh(first)
+    if err != nil {
+        t.Fatalf("Replicas should refresh each other's sessions: %v", err)
+    }
+    if refreshedId != id || session.Username != "first.last@example.com" || session.Rbac != "TestOrg" {
+        t.Errorf("Refreshing should keep the session, got %s %+v", refreshedId, session)
+    }
+    if second == first {
+        t.Errorf("Refreshing should rotate the refresh token!")
+    }
+    // A request racing the refresh with the same token gets its own
+    _, _, raced, err := sessions.Refresh(first)
+    if err != nil || raced == second {
+        t.Errorf("Refreshes racing with the same token should each get a refresh token, got %v", err)
+    }
+    // The session id is in every app token; it is not enough to end it
+    if _, _, _, err := sessions.Refresh(id + ".forged"); err != ErrRefreshTokenInvalid || !replica.Active(id) {
+        t.Errorf("Refresh tokens the session never handed out should only be invalid, got %v", err)
+    }
+    sessions.update(func(now time.Time) error {
+        sessions.Sessions[id].Refreshed = now.Add(-time.Minute)
+        return nil
+    })
+    if _, _, _, err := sessions.Refresh(first); err != ErrRefreshTokenReused {
+        t.Errorf("Refresh tokens should only work once, got %v", err)
+    }
+    if _, _, _, err := sessions.Refresh(second); err != ErrRefreshTokenInvalid {
+        t.Errorf("Reusing a refresh token should end its session, got %v", err)
+    }
+    if replica.Active(id) {
+        t.Errorf("Replicas should see sessions end!")
+    }
+
+    id, refresh, _ := sessions.Start("first.last@example.com", "TestOrg")
+    other, _, _ := sessions.Start("someone.else@example.com", "TestOrg")
+    if err := replica.EndUser("First.Last@example.com"); err != nil {
+        t.Fatal(err)
+    }
+    if sessions.Active(id) || !sessions.Active(other) {
+        t.Errorf("Ending a user's sessions should end only theirs, ignoring case!")
+    }
+    if _, _, _, err := sessions.Refresh(refresh); err != ErrRefreshTokenInvalid {
+        t.Errorf("Ended sessions should not refresh, got %v", err)
+    }
+    reopened, err := NewTokenSessions(path, time.Hour, 12 * time.Hour)
+    if err != nil || !reopened.Active(other) {
+        t.Errorf("Sessions should survive a restart: %v", err)
+    }
+}
+
+func TestTokenSessionTimeouts(t *testing.T) {
+    sessions, _ := NewTokenSessions("", time.Hour, 12 * time.Hour)
+    id, refresh, _ := sessions.Start("first.last@example.com", "TestOrg")
+    sessions.Sessions[id].Refreshed = time.Now().Add(-2 * time.Hour)
+    if sessions.Active(id) {
+        t.Errorf("Sessions should expire when idle!")
+    }
+    if _, _, _, err := sessions.Refresh(refresh); err != ErrSessionExpired {
+        t.Errorf("Idle sessions should not refresh, got %v", err)
+    }
+
+    id, refresh, _ = sessions.Start("first.last@example.com", "TestOrg")
+    sessions.Sessions[id].Created = time.Now().Add(-13 * time.Hour)
+    if _, _, _, err := sessions.Refresh(refresh); err != ErrSessionExpired {
+        t.Errorf("Sessions should expire after the absolute timeout however active, got %v", err)
+    }
+
+    id, _, _ = sessions.Start("first.last@example.com", "TestOrg")
+    ends := sessions.Sessions[id].Ends(time.Hour, 12 * time.Hour)
+    if ends.Sub(time.Now()) > time.Hour {
+        t.Errorf("Sessions should end after the idle timeout unless refreshed, got %v", ends)
+    }
+}
+
+func TestTokenSessionConfig(t *testing.T) {
+    lifetime, idle, absolute, err := (&TokenConfig{}).durations()
+    if err != nil || lifetime != 15 * time.Minute || idle != 2 * time.Hour || absolute != 12 * time.Hour {
+        t.Errorf("Token lifetimes should default, got %v %v %v %v", lifetime, idle, absolute, err)
+    }
+    bad := []TokenConfig{
+        {Lifetime: "soon"},
+        {IdleTimeout: "-1h"},
+        {Lifetime: "3h"},
+        {IdleTimeout: "24h"},
+    }
+    for _, config := range bad {
+        if _, _, _, err := config.durations(); err == nil {
+            t.Errorf("Token lifetimes %+v should be rejected!", config)
+        }
+    }
+}
+
+func TestRefresh(t *testing.T) {
+    oldSecret := secretKey
+    defer func() { secretKey = oldSecret }()
+    secretKey = NewTokenSecret()
+    tokens, err := secretKey.StartSession("first.last@example.com", "TestOrg")
+    if err != nil {
+        t.Fatal(err)
+    }
+    claims := secretKey.GetClaims(tokens["token"])
+    exp, _ := claims["exp"].(float64)
+    if lifetime := time.Unix(int64(exp), 0).Sub(time.Now()); lifetime > 15 * time.Minute {
+        t.Errorf("Session tokens should be short lived, got %v", lifetime)
+    }
+
+    // A client outside the browser sends its refresh token in the body
+    request := httptest.NewRequest("POST", "/v1/auth/refresh",
+                                   strings.NewReader("{\"refresh_token\": \"" + tokens["refresh_token"] + "\"}"))
+    recorder := httptest.NewRecorder()
+    RefreshHandler(recorder, request)
+    if recorder.Code != http.StatusOK {
+        t.Fatalf("Refreshing should succeed, got %d: %s", recorder.Code, recorder.Body.String())
+    }
+    var refreshed map[string]string
+    json.Unmarshal(recorder.Body.Bytes(), &refreshed)
+    if _, err := secretKey.ValidateToken(refreshed["token"]); err != nil {
+        t.Errorf("Refreshed tokens should validate: %v", err)
+    }
+    if refreshed["refresh_token"] == "" || refreshed["refresh_token"] == tokens["refresh_token"] {
+        t.Errorf("Refreshing should hand back the next refresh token, got %+v", refreshed)
+    }
+
+    // A browser sends it as a cookie and never sees it in the body
+    request = httptest.NewRequest("POST", "/v1/auth/refresh", nil)
+    request.AddCookie(&http.Cookie{Name: refreshCookie, Value: refreshed["refresh_token"]})
+    recorder = httptest.NewRecorder()
+    RefreshHandler(recorder, request)
+    if recorder.Code != http.StatusOK {
+        t.Fatalf("Refreshing from a cookie should succeed, got %d: %s", recorder.Code, recorder.Body.String())
+    }
+    if strings.Contains(recorder.Body.String(), "refresh_token") {
+        t.Errorf("Refresh tokens in cookies should not be handed to scripts!")
+    }
+    cookies := strings.Join(recorder.HeaderMap["Set-Cookie"], "\n")
+    if !strings.Contains(cookies, "auth=") || !strings.Contains(cookies, "HttpOnly") {
+        t.Errorf("Refreshing from a cookie should set new cookies, got %q", cookies)
+    }
+
+    // Replaying the refresh token the last refresh spent ends the session
+    sid := claims["sid"].(string)
+    secretKey.sessions.update(func(now time.Time) error {
+        secretKey.sessions.Sessions[sid].Refreshed = now.Add(-time.Minute)
+        return nil
+    })
+    request = httptest.NewRequest("POST", "/v1/auth/refresh",
+                                  strings.NewReader("{\"refresh_token\": \"" + refreshed["refresh_token"] + "\"}"))
+    recorder = httptest.NewRecorder()
+    RefreshHandler(recorder, request)
+    if recorder.Code != http.StatusUnauthorized {
+        t.Errorf("Spent refresh tokens should be refused, got %d", recorder.Code)
+    }
+    if _, err := secretKey.ValidateToken(refreshed["token"]); err == nil {
+        t.Errorf("Tokens should not validate once their session has ended!")
+    }
+}
+
+func TestRevokeUserEndsSessions(t *testing.T) {
+    oldSecret := secretKey
+    defer func() { secretKey = oldSecret }()
+    secretKey = NewTokenSecret()
+    tokens, _ := secretKey.StartSession("first.last@example.com", "TestOrg")
+    if _, err := secretKey.RevokeUser("first.last@example.com"); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := secretKey.RefreshSession(tokens["refresh_token"]); err == nil {
+        t.Errorf("Revoked users should not be able to refresh!")
+    }
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+)
+
+// validityLayouts are the date formats accepted for validityStart and
+// validityEnd. Times without a zone are taken to be UTC.
+var validityLayouts = []string{
+    time.RFC3339,
+    "2006-01-02T15:04:05",
+    "2006-01-02T15:04",
+    "2006-01-02",
+}
+
+// validitySkew is how far in the past a start time may be, to allow for a
+// request taking a moment to arrive or a slightly slow client clock
+const validitySkew = 5 * time.Minute
+
+// ValidityError maps each invalid request field to what is wrong with it
+type ValidityError struct {
+    Fields map[string]string
+}
+
+func (e *ValidityError) Error() string {
+    names := []string{}
+    for name := range e.Fields {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    problems := []string{}
+    for _, name := range names {
+        problems = append(problems, fmt.Sprintf("%s %s", name, e.Fields[name]))
+    }
+    return "Invalid validity window: " + strings.Join(problems, "; ")
+}
+
+// parseValidityTime parses a date or time in one of validityLayouts into UTC
+func parseValidityTime(value string) (time.Time, bool) {
+    for _, layout := range validityLayouts {
+        if t, err := time.Parse(layout, value); err == nil {
+            return t.UTC(), true
+        }
+    }
+    return time.Time{}, false
+}
+
+// ResolveValidity turns a requested validity window into UTC times. Either
+// may be a date, a time, or a duration such as 14d or 336h: a start
+// duration is counted from now and an end duration from the start. A
+// missing start is now, and a missing end is the start plus the profile's
+// default validity.
+// Takes the requested start and end, the profile and the current time
+// Returns the start and end times and an error, which is a *ValidityError
+// naming each bad field
+func ResolveValidity(start, end string, profile *CertProfile, now time.Time) (time.Time, time.Time, error) {
+    fields := map[string]string{}
+    now = now.UTC()
+    startTime := now
+    start, end = strings.TrimSpace(start), strings.TrimSpace(end)
+    if start != "" {
+        if t, ok := parseValidityTime(start); ok {
+            startTime = t
+            // A bare date means that day, so today is still allowed
+            if len(start) == len("2006-01-02") {
+                if startTime.Before(now.Truncate(24 * time.Hour)) {
+                    fields["validityStart"] = "is in the past"
+                } else if startTime.Before(now) {
+                    startTime = now
+                }
+            } else if startTime.Before(now.Add(-validitySkew)) {
+                fields["validityStart"] = "is in the past"
+            }
+        } else if d, err := ParseValidityDuration(start); err == nil {
+            startTime = now.Add(d)
+        } else {
+            fields["validityStart"] = "must be a date such as 2017-01-31, a time such as 2017-01-31T12:00:00Z, or a duration such as 2d"
+        }
+    }
+    var endTime time.Time
+    switch {
+    case end == "" && profile.DefaultValidity == "":
+        fields["validityEnd"] = fmt.Sprintf("is required, profile '%s' has no default validity", profile.Name)
+    case end == "":
+        d, _ := ParseValidityDuration(profile.DefaultValidity)
+        endTime = startTime.Add(d)
+    default:
+        if t, ok := parseValidityTime(end); ok {
+            endTime = t
+        } else if d, err := ParseValidityDuration(end); err == nil {
+            endTime = startTime.Add(d)
+        } else {
+            fields["validityEnd"] = "must be a date such as 2017-01-31, a time such as 2017-01-31T12:00:00Z, or a duration such as 14d"
+        }
+    }
+    if len(fields) > 0 {
+        return time.Time{}, time.Time{}, &ValidityError{Fields: fields}
+    }
+    if !endTime.After(startTime) {
+        fields["validityEnd"] = "must be after validityStart"
+    } else if profile.MaxValidity != "" {
+        maxValidity, _ := ParseValidityDuration(profile.MaxValidity)
+        if endTime.Sub(startTime) > maxValidity {
+            fields["validityEnd"] = fmt.Sprintf("is too far out, profile '%s' allows at most %s", profile.Name, profile.MaxValidity)
+        }
+    }
+    if len(fields) > 0 {
+        return time.Time{}, time.Time{}, &ValidityError{Fields: fields}
+    }
+    return startTime, endTime, nil
+}
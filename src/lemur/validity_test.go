@@ -0,0 +1,54 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestResolveValidity(t *testing.T) {
+    profile := &CertProfile{Name: "short", DefaultValidity: "14d", MaxValidity: "30d"}
+    now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+    valid := []struct {
+        start, end       string
+        expectStart, expectEnd string
+    }{
+        {"", "", "2017-03-01T12:00:00Z", "2017-03-15T12:00:00Z"},
+        {"2017-04-01", "", "2017-04-01T00:00:00Z", "2017-04-15T00:00:00Z"},
+        {"2d", "336h", "2017-03-03T12:00:00Z", "2017-03-17T12:00:00Z"},
+        {"2017-03-01", "2017-03-10", "2017-03-01T12:00:00Z", "2017-03-10T00:00:00Z"},
+        {"2017-03-02T09:00:00+09:00", "1w", "2017-03-02T00:00:00Z", "2017-03-09T00:00:00Z"},
+    }
+    for _, c := range valid {
+        start, end, err := profile.Window(c.start, c.end, now)
+        if err != nil || start != c.expectStart || end != c.expectEnd {
+            t.Errorf("'%s'-'%s' should resolve to %s-%s, got %s-%s: %v", c.start, c.end, c.expectStart, c.expectEnd, start, end, err)
+        }
+    }
+    invalid := []struct {
+        start, end string
+        fields     []string
+    }{
+        {"2017-02-28", "", []string{"validityStart"}},
+        {"2017-03-01T11:00:00Z", "", []string{"validityStart"}},
+        {"soon", "later", []string{"validityStart", "validityEnd"}},
+        {"2017-03-10", "2017-03-05", []string{"validityEnd"}},
+        {"", "45d", []string{"validityEnd"}},
+    }
+    for _, c := range invalid {
+        _, _, err := profile.Window(c.start, c.end, now)
+        verr, ok := err.(*ValidityError)
+        if !ok || len(verr.Fields) != len(c.fields) {
+            t.Errorf("'%s'-'%s' should fail on %v, got %v", c.start, c.end, c.fields, err)
+            continue
+        }
+        for _, field := range c.fields {
+            if verr.Fields[field] == "" {
+                t.Errorf("'%s'-'%s' should report %s, got %v", c.start, c.end, field, err)
+            }
+        }
+    }
+    noDefault := &CertProfile{Name: "manual"}
+    if _, _, err := noDefault.Window("", "", now); err == nil {
+        t.Errorf("Without a default validity an end should be required!")
+    }
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "strings"
+    "time"
+)
+
+// validityTolerance is how far Lemur may move a certificate's validity
+// window from the dates requested, e.g. to align it to midnight UTC
+const validityTolerance = 24 * time.Hour
+
+const (
+    CheckLeaf       = "leaf"
+    CheckChain      = "chain"
+    CheckKey        = "key"
+    CheckValidity   = "validity"
+    CheckSubject    = "subject"
+    CheckExtensions = "extensions"
+)
+
+// VerificationError is returned when certificate material from Lemur fails
+// one of our checks. Check is one of the Check* constants.
+type VerificationError struct {
+    Check  string
+    Reason string
+}
+
+func (e *VerificationError) Error() string {
+    return fmt.Sprintf("Lemur returned a certificate that failed the %s check: %s", e.Check, e.Reason)
+}
+
+// verificationFailed records a failed check and builds its error
+func verificationFailed(check, format string, args ...interface{}) error {
+    LemurCertsStatsd.Incr("verification.failed", []string{"check:" + check}, 1)
+    err := &VerificationError{Check: check, Reason: fmt.Sprintf(format, args...)}
+    Logs.Errorf("%v", err)
+    return err
+}
+
+// VerifyCertMaterial checks what Lemur handed back before we pass it on:
+// the leaf parses, the chain links it to its authority's certificate, the
+// private key (if any) matches the leaf, it has not expired, and, when a
+// manifest is given, its subject, validity window and extensions are the
+// ones requested
+// Called on a LemurRequester pointer
+// Takes the material, the Lemur certificate it came from and the manifest it
+// was requested with (may be nil)
+// Returns the parsed leaf, which is also kept on the material, and an
+// error, which is a *VerificationError if a check failed
+func (l *LemurRequester) VerifyCertMaterial(material *certChainPubKey, cert *Certificate, manifest *certManifest) (*x509.Certificate, error) {
+    leaves, err := parseCertificates(material.PublicCertificate)
+    if err != nil || len(leaves) != 1 {
+        return nil, verificationFailed(CheckLeaf, "expected exactly one PEM certificate (%v)", err)
+    }
+    leaf := leaves[0]
+
+    chain, err := parseCertificates(material.Chain)
+    if err != nil || len(chain) == 0 {
+        return nil, verificationFailed(CheckChain, "chain has no usable certificates (%v)", err)
+    }
+    anchor, err := l.authorityCertificate(cert, chain)
+    if err != nil {
+        return nil, verificationFailed(CheckChain, "%v", err)
+    }
+    roots := x509.NewCertPool()
+    roots.AddCert(anchor)
+    intermediates := x509.NewCertPool()
+    for _, c := range chain {
+        intermediates.AddCert(c)
+    }
+    // Verify as of the leaf's own start so that certificates requested for a
+    // future window still chain; the window itself is checked below
+    if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots,
+                                                Intermediates: intermediates,
+                                                CurrentTime: leaf.NotBefore.Add(time.Second),
+                                                KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+        return nil, verificationFailed(CheckChain, "does not chain to %s: %v", anchor.Subject.CommonName, err)
+    }
+
+    if material.PrivateKey != "" {
+        if _, err := tls.X509KeyPair([]byte(material.PublicCertificate), []byte(material.PrivateKey)); err != nil {
+            return nil, verificationFailed(CheckKey, "private key does not match the certificate: %v", err)
+        }
+    }
+
+    if !time.Now().Before(leaf.NotAfter) {
+        return nil, verificationFailed(CheckValidity, "certificate expired at %s", leaf.NotAfter)
+    }
+    if manifest == nil {
+        material.leaf = leaf
+        return leaf, nil
+    }
+    if err := checkValidityWindow(leaf, manifest); err != nil {
+        return nil, err
+    }
+    if manifest.CommonName != "" && !strings.EqualFold(leaf.Subject.CommonName, manifest.CommonName) {
+        return nil, verificationFailed(CheckSubject, "common name is '%s', requested '%s'", leaf.Subject.CommonName, manifest.CommonName)
+    }
+    if err := checkExtensions(leaf, manifest); err != nil {
+        return nil, err
+    }
+    material.leaf = leaf
+    return leaf, nil
+}
+
+// authorityCertificate finds the CA certificate the leaf must chain to: the
+// one Lemur embeds in the certificate's authority, or failing that the one
+// in our cached authority list. If Lemur tells us neither, the last
+// certificate in the chain is trusted as the anchor.
+func (l *LemurRequester) authorityCertificate(cert *Certificate, chain []*x509.Certificate) (*x509.Certificate, error) {
+    var body string
+    if cert != nil && cert.Authority != nil {
+        if cert.Authority.AuthorityCertificate != nil {
+            body = cert.Authority.AuthorityCertificate.Body
+        }
+        if body == "" {
+            if authorities, err := l.CachedAuthorities(); err == nil {
+                for _, authority := range authorities {
+                    if authority.Name == cert.Authority.Name && authority.AuthorityCertificate != nil {
+                        body = authority.AuthorityCertificate.Body
+                    }
+                }
+            }
+        }
+    }
+    if body == "" {
+        Logs.Warningf("No authority certificate available, trusting the end of the chain Lemur returned")
+        return chain[len(chain) - 1], nil
+    }
+    anchors, err := parseCertificates(body)
+    if err != nil || len(anchors) == 0 {
+        return nil, fmt.Errorf("authority certificate does not parse (%v)", err)
+    }
+    return anchors[0], nil
+}
+
+// checkValidityWindow makes sure the leaf is valid for the dates requested
+func checkValidityWindow(leaf *x509.Certificate, manifest *certManifest) error {
+    if manifest.StartDate != "" {
+        start, err := parseLemurTime(manifest.StartDate)
+        if err == nil && absDuration(leaf.NotBefore.Sub(start)) > validityTolerance {
+            return verificationFailed(CheckValidity, "starts %s, requested %s", leaf.NotBefore, manifest.StartDate)
+        }
+    }
+    if manifest.EndDate != "" {
+        end, err := parseLemurTime(manifest.EndDate)
+        if err == nil && absDuration(leaf.NotAfter.Sub(end)) > validityTolerance {
+            return verificationFailed(CheckValidity, "ends %s, requested %s", leaf.NotAfter, manifest.EndDate)
+        }
+    }
+    return nil
+}
+
+func absDuration(d time.Duration) time.Duration {
+    if d < 0 {
+        return -d
+    }
+    return d
+}
+
+// manifestKeyUsages and manifestExtKeyUsages map the Lemur extension flags
+// we request onto what they must produce in the certificate
+var manifestKeyUsages = map[string]x509.KeyUsage{
+    "useDigitalSignature": x509.KeyUsageDigitalSignature,
+    "useKeyEncipherment":  x509.KeyUsageKeyEncipherment,
+    "useDataEncipherment": x509.KeyUsageDataEncipherment,
+    "useKeyAgreement":     x509.KeyUsageKeyAgreement,
+}
+
+var manifestExtKeyUsages = map[string]x509.ExtKeyUsage{
+    "clientAuth":      x509.ExtKeyUsageClientAuth,
+    "serverAuth":      x509.ExtKeyUsageServerAuth,
+    "codeSigning":     x509.ExtKeyUsageCodeSigning,
+    "emailProtection": x509.ExtKeyUsageEmailProtection,
+    "timeStamping":    x509.ExtKeyUsageTimeStamping,
+}
+
+// checkExtensions makes sure every extension flag set in the manifest shows
+// up in the leaf
+func checkExtensions(leaf *x509.Certificate, manifest *certManifest) error {
+    extensions := manifest.Extensions["extensions"]
+    for flag, wanted := range extensions["keyUsage"] {
+        if usage, ok := manifestKeyUsages[flag]; ok && wanted && leaf.KeyUsage & usage == 0 {
+            return verificationFailed(CheckExtensions, "key usage is missing %s", flag)
+        }
+    }
+    for flag, wanted := range extensions["extendedKeyUsage"] {
+        usage, ok := manifestExtKeyUsages[flag]
+        if !ok || !wanted {
+            continue
+        }
+        found := false
+        for _, got := range leaf.ExtKeyUsage {
+            if got == usage {
+                found = true
+            }
+        }
+        if !found {
+            return verificationFailed(CheckExtensions, "extended key usage is missing %s", flag)
+        }
+    }
+    if extensions["subjectKeyIdentifier"]["includeSKI"] && len(leaf.SubjectKeyId) == 0 {
+        return verificationFailed(CheckExtensions, "subject key identifier is missing")
+    }
+    return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestVerifyCertMaterial(t *testing.T) {
+    fake, lemur := newTestLemur(t)
+    defer fake.Close()
+    if err := fake.AddAuthority("OtherCA"); err != nil {
+        t.Fatal(err)
+    }
+    manifest := NewCertManifest("TestCA", "first.last", "first.last@example.com", "", "", "TestOrg")
+    material, err := lemur.ValidateCert(manifest, "")
+    if err != nil {
+        t.Fatalf("Material from the fake should verify: %v", err)
+    }
+    cert := fake.Certificate(1)
+    other, err := lemur.ValidateCert(NewCertManifest("OtherCA", "first.last", "first.last@example.com", "", "", "TestOrg"), "")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    expectCheck := func(check string, material *certChainPubKey, manifest *certManifest) {
+        _, err := lemur.VerifyCertMaterial(material, cert, manifest)
+        if verr, ok := err.(*VerificationError); !ok || verr.Check != check {
+            t.Errorf("Expected the %s check to fail, got %v", check, err)
+        }
+    }
+    wrongKey := *material
+    wrongKey.PrivateKey = other.PrivateKey
+    expectCheck(CheckKey, &wrongKey, manifest)
+
+    wrongChain := *material
+    wrongChain.Chain = other.Chain
+    wrongChain.PublicCertificate = other.PublicCertificate
+    wrongChain.PrivateKey = other.PrivateKey
+    expectCheck(CheckChain, &wrongChain, manifest)
+
+    expectCheck(CheckLeaf, &certChainPubKey{Chain: material.Chain, PublicCertificate: "garbage"}, manifest)
+
+    expectCheck(CheckSubject, material, NewCertManifest("TestCA", "someone.else", "", "", "", "TestOrg"))
+
+    serverAuth := NewCertManifest("TestCA", "first.last", "", "", "", "TestOrg")
+    serverAuth.Extensions["extensions"]["extendedKeyUsage"]["serverAuth"] = true
+    expectCheck(CheckExtensions, material, serverAuth)
+
+    expectCheck(CheckValidity, material, NewCertManifest("TestCA", "first.last", "", "2001-01-01", "", "TestOrg"))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "time"
+)
+
+// watchedFile is a file shared between replicas, e.g. on a shared volume,
+// that each of them re-reads when another one changes it
+type watchedFile struct {
+    path     string
+    modified time.Time
+    read     time.Time
+}
+
+// Changed reports whether the file changed since it was last read. A file
+// modified just before it was read may have changed again within the same
+// timestamp, so it counts as changed until it has been stable for a second.
+func (f *watchedFile) Changed() (bool, error) {
+    info, err := os.Stat(f.path)
+    if err != nil {
+        return false, err
+    }
+    return !info.ModTime().Equal(f.modified) || f.read.Sub(f.modified) <= time.Second, nil
+}
+
+// Read returns the file's contents and remembers when it was read
+func (f *watchedFile) Read() ([]byte, error) {
+    info, err := os.Stat(f.path)
+    if err != nil {
+        return nil, err
+    }
+    data, err := ioutil.ReadFile(f.path)
+    if err != nil {
+        return nil, err
+    }
+    f.modified, f.read = info.ModTime(), time.Now()
+    return data, nil
+}
+
+// Write replaces the file's contents. The data is written aside and renamed
+// into place, so other replicas never read a truncated file; suffix keeps
+// concurrent writers from sharing the temporary file.
+func (f *watchedFile) Write(data []byte, suffix string) error {
+    tmp := f.path + "." + suffix + ".tmp"
+    if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp, f.path); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    if info, err := os.Stat(f.path); err == nil {
+        f.modified, f.read = info.ModTime(), time.Now()
+    }
+    return nil
+}